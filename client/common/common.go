@@ -19,11 +19,15 @@ import (
 
 const (
 	ConfigFile = "gocoin.conf"
-	Version    = uint32(70015)
-	Services   = uint64(0x00000009)
+	Version    = uint32(70016)
+
+	SERVICE_NETWORK         = 0x1
+	SERVICE_NETWORK_LIMITED = 0x400 // BIP159 - only the last 288 blocks are served
 )
 
 var (
+	Services = uint64(0x00000009) // NODE_NETWORK_LIMITED replaces NODE_NETWORK in pruning mode
+
 	LogBuffer             = new(bytes.Buffer)
 	Log       *log.Logger = log.New(LogBuffer, "", 0)
 
@@ -266,7 +270,7 @@ func LastTrustedBlockMatch(h *btc.Uint256) (res bool) {
 
 func AcceptTx() (res bool) {
 	mutex_cfg.Lock()
-	res = CFG.TXPool.Enabled && BlockChainSynchronized
+	res = CFG.TXPool.Enabled && !CFG.Net.BlocksOnly && BlockChainSynchronized
 	mutex_cfg.Unlock()
 	return
 }
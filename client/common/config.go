@@ -5,7 +5,9 @@ import (
 	"flag"
 	"fmt"
 	"github.com/piotrnar/gocoin"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/lib/utxo"
 	"io/ioutil"
 	"os"
@@ -38,6 +40,8 @@ var (
 		TextUI_Enabled bool
 		UserAgent      string
 		LastTrustedBlock string
+		TxIndex        bool // keep txid -> block index (for getrawtransaction)
+		HistIndex      bool // keep output script -> history index (for getaddresshistory)
 
 		WebUI          struct {
 			Interface   string
@@ -54,6 +58,14 @@ var (
 			Password string
 			TCPPort  uint32
 		}
+		Electrum struct {
+			Enabled    bool
+			Interface  string // IP address to listen on
+			TCPPort    uint16 // zero for the default one (50001 or 60001 for testnet)
+			SSLPort    uint16 // zero for the default one (50002 or 60002 for testnet) - needs ssl_cert/server.crt and server.key
+			TLSOnly    bool   // do not accept plain TCP connections
+			MaxClients uint
+		}
 		Net struct {
 			ListenTCP      bool
 			TCPPort        uint16
@@ -65,17 +77,31 @@ var (
 			MaxBlockAtOnce uint32
 			MinSegwitCons  uint32
 			ExternalIP     string
+			BlocksOnly     bool   // tell peers not to relay txs to us and drop the ones that still do
+			BlockRelayCons uint32 // extra outgoing connections used for blocks only (no txs, no addrs)
+			BlkRelayRotate uint32 // rotate one block-relay-only connection every N minutes (0 - never)
 		}
 		TXPool struct {
-			Enabled        bool // Global on/off swicth
-			AllowMemInputs bool
-			FeePerByte     float64
-			MaxTxSize      uint32
-			MaxSizeMB      uint
-			MaxRejectMB    uint
-			MaxRejectCnt   uint
-			SaveOnDisk     bool
-			Debug          bool
+			Enabled         bool    // Global on/off swicth
+			AllowMemInputs  bool
+			FeePerByte      float64
+			MaxTxSize       uint32
+			MaxSizeMB       uint
+			MaxRejectMB     uint
+			MaxRejectCnt    uint
+			SaveOnDisk      bool
+			Debug           bool
+			PackageRelay    bool    // experimental BIP331 (sendpackages/ancpkginfo/getpkgtxns)
+			MaxAncestors    uint    // max number of unconfirmed ancestors of a tx, including itself (0 for no limit)
+			MaxAncestorKB   uint    // max total vsize of the unconfirmed ancestors, in kB
+			MaxDescendants  uint    // max number of unconfirmed descendants of a tx, including itself
+			MaxDescendantKB uint    // max total vsize of the unconfirmed descendants, in kB
+			FullRBF         bool    // allow replacing txs that do not signal BIP125
+			TRUC            bool    // apply BIP431 rules to version 3 txs
+			MaxOrphans      uint    // max number of txs waiting for inputs (0 for no limit)
+			PeerOrphans     uint    // max number of txs waiting for inputs, from a single peer
+			PeerOrphansKB   uint    // max total size of txs waiting for inputs, from a single peer
+			OrphanExpireMin uint    // remove txs waiting for inputs after so many minutes
 		}
 		TXRoute struct {
 			Enabled    bool // Global on/off swicth
@@ -93,6 +119,7 @@ var (
 			DataFilesKeep uint32 // 0 for all
 			OldDataBackup bool // move old dat files to "oldat/" folder (instead of removing them)
 			PurgeUnspendableUTXO bool
+			SigCacheMB    uint // size of the script verification cache (0 to disable)
 		}
 		AllBalances struct {
 			MinValue   uint64 // Do not keep balance records for values lower than this
@@ -110,10 +137,23 @@ var (
 			BlckExpireHours uint // zero for never
 			PingPeriodSec   uint // zero to not ping
 		}
+		Prune struct {
+			TargetMB uint64 // zero to keep all the blocks (changing it requires a restart)
+		}
 		UTXOSave struct {
 			SecondsToTake uint  // zero for as fast as possible, 600 for do it in 10 minutes
 			BlocksToHold  uint32 // zero for immediatelly, one for every other block...
 		}
+		VerifyChain struct {
+			AtStartup bool
+			Level     uint // 0-4 (see chain.VerifyChain)
+			Depth     uint // zero for all the blocks
+		}
+		Mine struct {
+			PayTo   string // address for the coinbase of the blocks mined by the TextUI's "mine" command
+			Threads uint   // number of the mining goroutines (zero for one per CPU)
+		}
+		BIP9 []chain.BIP9Deployment // soft fork deployments to signal and report, besides the known ones
 	}
 
 	mutex_cfg sync.Mutex
@@ -125,6 +165,8 @@ type oneAllowedAddr struct {
 
 var WebUIAllowed []oneAllowedAddr
 
+var sig_cache_mb uint // size of the current chain.ScriptCache
+
 func InitConfig() {
 	var new_config_file bool
 
@@ -134,6 +176,8 @@ func InitConfig() {
 	CFG.Net.MaxInCons = 10
 	CFG.Net.MaxBlockAtOnce = 3
 	CFG.Net.MinSegwitCons = 4
+	CFG.Net.BlockRelayCons = 2
+	CFG.Net.BlkRelayRotate = 30
 	CFG.Net.BindToIF = "0.0.0.0"
 
 	CFG.TextUI_Enabled = true
@@ -148,6 +192,9 @@ func InitConfig() {
 	CFG.RPC.Username = "gocoinrpc"
 	CFG.RPC.Password = "gocoinpwd"
 
+	CFG.Electrum.Interface = "127.0.0.1"
+	CFG.Electrum.MaxClients = 20
+
 	CFG.TXPool.Enabled = true
 	CFG.TXPool.AllowMemInputs = true
 	CFG.TXPool.FeePerByte = 1.0
@@ -156,6 +203,14 @@ func InitConfig() {
 	CFG.TXPool.MaxRejectMB = 25
 	CFG.TXPool.MaxRejectCnt = 5000
 	CFG.TXPool.SaveOnDisk = true
+	CFG.TXPool.MaxAncestors = 25
+	CFG.TXPool.MaxAncestorKB = 101
+	CFG.TXPool.MaxDescendants = 25
+	CFG.TXPool.MaxDescendantKB = 101
+	CFG.TXPool.MaxOrphans = 1000
+	CFG.TXPool.PeerOrphans = 100
+	CFG.TXPool.PeerOrphansKB = 400
+	CFG.TXPool.OrphanExpireMin = 20
 
 	CFG.TXRoute.Enabled = true
 	CFG.TXRoute.FeePerByte = 0.0
@@ -164,6 +219,7 @@ func InitConfig() {
 
 	CFG.Memory.GCPercTrshold = 30 // 30% (To save mem)
 	CFG.Memory.MaxCachedBlks = 200
+	CFG.Memory.SigCacheMB = 32
 	CFG.Memory.CacheOnDisk = true
 	CFG.Memory.MaxDataFileMB = 1000 // max 1GB per single data file
 
@@ -183,6 +239,9 @@ func InitConfig() {
 	CFG.UTXOSave.SecondsToTake = 300
 	CFG.UTXOSave.BlocksToHold = 6
 
+	CFG.VerifyChain.Level = 3
+	CFG.VerifyChain.Depth = 6
+
 	cfgfilecontent, e := ioutil.ReadFile(ConfigFile)
 	if e == nil && len(cfgfilecontent) > 0 {
 		e = json.Unmarshal(cfgfilecontent, &CFG)
@@ -206,6 +265,8 @@ func InitConfig() {
 	flag.BoolVar(&CFG.TXRoute.Enabled, "txp", CFG.TXPool.Enabled, "Enable Memory Pool")
 	flag.BoolVar(&CFG.TXRoute.Enabled, "txr", CFG.TXRoute.Enabled, "Enable Transaction Routing")
 	flag.BoolVar(&CFG.TextUI_Enabled, "textui", CFG.TextUI_Enabled, "Enable processing TextUI commands (from stdin)")
+	flag.BoolVar(&CFG.TxIndex, "txindex", CFG.TxIndex, "Maintain the transaction index (for getrawtransaction)")
+	flag.BoolVar(&CFG.HistIndex, "histindex", CFG.HistIndex, "Maintain the address history index (for getaddresshistory)")
 	flag.UintVar(&FLAG.UndoBlocks, "undo", 0, "Undo UTXO with this many blocks and exit")
 	flag.BoolVar(&FLAG.TrustAll, "trust", FLAG.TrustAll, "Trust all scripts inside new blocks (for fast syncig)")
 	flag.BoolVar(&FLAG.UnbanAllPeers, "unban", FLAG.UnbanAllPeers, "Un-ban all peers in databse, before starting")
@@ -323,6 +384,18 @@ func Reset() {
 	utxo.UTXO_SKIP_SAVE_BLOCKS = CFG.UTXOSave.BlocksToHold
 	utxo.UTXO_PURGE_UNSPENDABLE = CFG.Memory.PurgeUnspendableUTXO
 
+	if chain.ScriptCache == nil || CFG.Memory.SigCacheMB != sig_cache_mb {
+		sig_cache_mb = CFG.Memory.SigCacheMB
+		if sig_cache_mb == 0 {
+			chain.ScriptCache = nil
+		} else {
+			// each record takes about 64 bytes (the map entry plus its slot in the ring)
+			sc := script.NewVerifyCache(int(sig_cache_mb << 20 / 64))
+			sc.Counter = CountSafe
+			chain.ScriptCache = sc
+		}
+	}
+
 	if CFG.UserAgent != "" {
 		UserAgent = CFG.UserAgent
 	} else {
@@ -333,6 +406,16 @@ func Reset() {
 		CFG.Memory.MaxDataFileMB = 8
 	}
 
+	if CFG.Prune.TargetMB != 0 {
+		if CFG.Prune.TargetMB < chain.PRUNE_MIN_MB {
+			CFG.Prune.TargetMB = chain.PRUNE_MIN_MB
+		}
+		// only the whole data files can be removed, so they must be much smaller than the target
+		if max := uint(CFG.Prune.TargetMB / 8); CFG.Memory.MaxDataFileMB == 0 || CFG.Memory.MaxDataFileMB > max {
+			CFG.Memory.MaxDataFileMB = max
+		}
+	}
+
 	if CFG.Net.BindToIF == "" {
 		CFG.Net.BindToIF = "0.0.0.0"
 	}
@@ -367,6 +450,27 @@ func RPCPort() (res uint32) {
 	return
 }
 
+// ElectrumPorts returns TCP ports for Electrum server's plain and TLS connections.
+func ElectrumPorts() (tcp, ssl uint16) {
+	mutex_cfg.Lock()
+	defer mutex_cfg.Unlock()
+
+	tcp, ssl = CFG.Electrum.TCPPort, CFG.Electrum.SSLPort
+	if tcp == 0 {
+		tcp = 50001
+		if CFG.Testnet {
+			tcp = 60001
+		}
+	}
+	if ssl == 0 {
+		ssl = 50002
+		if CFG.Testnet {
+			ssl = 60002
+		}
+	}
+	return
+}
+
 func DefaultTcpPort() (res uint16) {
 	mutex_cfg.Lock()
 	defer mutex_cfg.Unlock()
@@ -509,6 +613,30 @@ func RejectedTxsLimits() (size uint64, cnt int) {
 	return
 }
 
+func FullRBF() bool {
+	return GetBool(&CFG.TXPool.FullRBF)
+}
+
+func TRUCEnabled() bool {
+	return GetBool(&CFG.TXPool.TRUC)
+}
+
+func OrphanLimits() (peer_cnt int, peer_size uint64, max_cnt int, expire time.Duration) {
+	mutex_cfg.Lock()
+	peer_cnt, peer_size = int(CFG.TXPool.PeerOrphans), uint64(CFG.TXPool.PeerOrphansKB)*1000
+	max_cnt, expire = int(CFG.TXPool.MaxOrphans), time.Duration(CFG.TXPool.OrphanExpireMin)*time.Minute
+	mutex_cfg.Unlock()
+	return
+}
+
+func PackageLimits() (anc_cnt int, anc_size uint64, desc_cnt int, desc_size uint64) {
+	mutex_cfg.Lock()
+	anc_cnt, anc_size = int(CFG.TXPool.MaxAncestors), uint64(CFG.TXPool.MaxAncestorKB)*1000
+	desc_cnt, desc_size = int(CFG.TXPool.MaxDescendants), uint64(CFG.TXPool.MaxDescendantKB)*1000
+	mutex_cfg.Unlock()
+	return
+}
+
 func TempBlocksDir() string {
 	return GocoinHomeDir + "tmpblk" + string(os.PathSeparator)
 }
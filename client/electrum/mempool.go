@@ -0,0 +1,184 @@
+package electrum
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+const MEMPOOL_REINDEX_EVERY = 5 * time.Second
+
+// mpTx is a mempool transaction's relation to one scripthash
+type mpTx struct {
+	TxID   *btc.Uint256
+	Fee    uint64
+	Height int      // 0, or -1 if it spends unconfirmed inputs
+	Outs   []uint32 // outputs paying to the script
+	Values []uint64 // values of Outs
+	Spent  uint64   // value of the script's outputs spent by this tx
+}
+
+type mempoolFP struct {
+	cnt  int
+	size uint64
+}
+
+var mp struct {
+	sync.Mutex
+	fp      mempoolFP
+	last    time.Time
+	bysh    map[[32]byte][]*mpTx
+	bytx    map[[btc.Uint256IdxLen]byte][][32]byte // scripthashes of each tx
+	touched map[[32]byte]bool                      // scripthashes of the txs that came or went (see mempoolTouched)
+}
+
+func mempoolFingerprint() (fp mempoolFP) {
+	network.TxPool.Lock()
+	fp.cnt, fp.size = len(network.TxPool.TransactionsToSend), network.TxPool.TransactionsToSendSize
+	network.TxPool.Unlock()
+	return
+}
+
+// refreshMempool rebuilds the index when the memory pool has changed (but not too often)
+// and notes the scripthashes of the txs that came or went. Call it with mp locked.
+func refreshMempool() {
+	fp := mempoolFingerprint()
+	if mp.bysh != nil && (fp == mp.fp || time.Since(mp.last) < MEMPOOL_REINDEX_EVERY) {
+		return
+	}
+	bysh, bytx := indexMempool()
+	if mp.bysh != nil {
+		if mp.touched == nil {
+			mp.touched = make(map[[32]byte]bool)
+		}
+		for _, d := range [][2]map[[btc.Uint256IdxLen]byte][][32]byte{{bytx, mp.bytx}, {mp.bytx, bytx}} {
+			for k, shs := range d[0] {
+				if _, ok := d[1][k]; !ok {
+					for _, sh := range shs {
+						mp.touched[sh] = true
+					}
+				}
+			}
+		}
+	}
+	mp.fp, mp.bysh, mp.bytx, mp.last = fp, bysh, bytx, time.Now()
+}
+
+// mempoolFor returns the unconfirmed transactions involving the given scripthash.
+func mempoolFor(sh []byte) (res []*mpTx) {
+	var k [32]byte
+	copy(k[:], sh)
+	mp.Lock()
+	refreshMempool()
+	res = mp.bysh[k]
+	mp.Unlock()
+	return
+}
+
+// mempoolTouched returns the scripthashes whose unconfirmed transactions have changed since the last call.
+func mempoolTouched() (res map[[32]byte]bool) {
+	mp.Lock()
+	refreshMempool()
+	res, mp.touched = mp.touched, nil
+	mp.Unlock()
+	return
+}
+
+// mpSnap is what indexMempool needs to know about a mempool tx.
+type mpSnap struct {
+	t2s      *mempool.OneTxToSend
+	fee      uint64
+	mem_cnt  int
+	mem_prev []*btc.TxOut // spent outputs of unconfirmed parents (nil for the confirmed ones)
+}
+
+func indexMempool() (bysh map[[32]byte][]*mpTx, bytx map[[btc.Uint256IdxLen]byte][][32]byte) {
+	// only take what is needed from the memory pool, to not keep it locked for long
+	network.TxPool.Lock()
+	txs := make([]mpSnap, 0, len(network.TxPool.TransactionsToSend))
+	for _, t2s := range network.TxPool.TransactionsToSend {
+		s := mpSnap{t2s: t2s, fee: t2s.Fee, mem_cnt: t2s.MemInputCnt}
+		if t2s.MemInputs != nil {
+			s.mem_prev = make([]*btc.TxOut, len(t2s.TxIn))
+			for i, inp := range t2s.TxIn {
+				if !t2s.MemInputs[i] {
+					continue
+				}
+				if ptx, ok := network.TxPool.TransactionsToSend[btc.BIdx(inp.Input.Hash[:])]; ok && int(inp.Input.Vout) < len(ptx.TxOut) {
+					s.mem_prev[i] = ptx.TxOut[inp.Input.Vout]
+				}
+			}
+		}
+		txs = append(txs, s)
+	}
+	network.TxPool.Unlock()
+
+	bysh = make(map[[32]byte][]*mpTx)
+	bytx = make(map[[btc.Uint256IdxLen]byte][][32]byte, len(txs))
+	for _, s := range txs {
+		t2s := s.t2s
+		bidx := t2s.Hash.BIdx()
+		get := func(sh [32]byte) (rec *mpTx) {
+			lst := bysh[sh]
+			if len(lst) > 0 && lst[len(lst)-1].TxID == &t2s.Hash {
+				return lst[len(lst)-1]
+			}
+			rec = &mpTx{TxID: &t2s.Hash, Fee: s.fee}
+			if s.mem_cnt > 0 {
+				rec.Height = -1
+			}
+			bysh[sh] = append(lst, rec)
+			bytx[bidx] = append(bytx[bidx], sh)
+			return
+		}
+
+		for i, inp := range t2s.TxIn {
+			var prev *btc.TxOut
+			if s.mem_prev != nil && s.mem_prev[i] != nil {
+				prev = s.mem_prev[i]
+			} else {
+				prev = common.BlockChain.Unspent.UnspentGet(&inp.Input)
+			}
+			if prev != nil {
+				rec := get(sha256.Sum256(prev.Pk_script))
+				rec.Spent += prev.Value
+			}
+		}
+		for i, out := range t2s.TxOut {
+			rec := get(sha256.Sum256(out.Pk_script))
+			rec.Outs = append(rec.Outs, uint32(i))
+			rec.Values = append(rec.Values, out.Value)
+		}
+		if _, ok := bytx[bidx]; !ok {
+			bytx[bidx] = nil
+		}
+	}
+
+	// keep the order stable, as it matters for the status
+	for _, lst := range bysh {
+		if len(lst) > 1 {
+			sort.Slice(lst, func(i, j int) bool {
+				if lst[i].Height != lst[j].Height {
+					return lst[i].Height > lst[j].Height
+				}
+				return lst[i].TxID.String() < lst[j].TxID.String()
+			})
+		}
+	}
+	return
+}
+
+// spentInMempool returns true if the output is being spent by an unconfirmed transaction.
+func spentInMempool(txid *btc.Uint256, vout uint32) (yes bool) {
+	po := &btc.TxPrevOut{Hash: txid.Hash, Vout: vout}
+	network.TxPool.Lock()
+	_, yes = network.TxPool.SpentOutputs[po.UIdx()]
+	network.TxPool.Unlock()
+	return
+}
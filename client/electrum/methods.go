@@ -0,0 +1,341 @@
+package electrum
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"github.com/piotrnar/gocoin"
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+const MAX_HEADERS = 2016 // for blockchain.block.headers
+
+type handler func(c *client, params []json.RawMessage) (interface{}, error)
+
+var methods map[string]handler
+
+func init() {
+	methods = map[string]handler{
+		"server.version":          server_version,
+		"server.ping":             func(*client, []json.RawMessage) (interface{}, error) { return nil, nil },
+		"server.banner":           server_banner,
+		"server.donation_address": func(*client, []json.RawMessage) (interface{}, error) { return "", nil },
+		"server.peers.subscribe":  func(*client, []json.RawMessage) (interface{}, error) { return []interface{}{}, nil },
+		"mempool.get_fee_histogram": func(*client, []json.RawMessage) (interface{}, error) {
+			return []interface{}{}, nil
+		},
+
+		"blockchain.headers.subscribe": headers_subscribe,
+		"blockchain.block.header":      block_header,
+		"blockchain.block.headers":     block_headers,
+		"blockchain.estimatefee":       estimate_fee,
+		"blockchain.relayfee":          relay_fee,
+
+		"blockchain.scripthash.get_history": scripthash_get_history,
+		"blockchain.scripthash.get_mempool": scripthash_get_mempool,
+		"blockchain.scripthash.get_balance": scripthash_get_balance,
+		"blockchain.scripthash.listunspent": scripthash_listunspent,
+		"blockchain.scripthash.subscribe":   scripthash_subscribe,
+		"blockchain.scripthash.unsubscribe": scripthash_unsubscribe,
+		"blockchain.transaction.get":        transaction_get,
+		"blockchain.transaction.broadcast":  transaction_broadcast,
+	}
+}
+
+func param_string(params []json.RawMessage, i int) (s string, e error) {
+	if i >= len(params) || json.Unmarshal(params[i], &s) != nil {
+		e = errors.New("missing or invalid string parameter")
+	}
+	return
+}
+
+func param_int(params []json.RawMessage, i int, def int) (n int, e error) {
+	n = def
+	if i < len(params) && json.Unmarshal(params[i], &n) != nil {
+		e = errors.New("invalid integer parameter")
+	}
+	return
+}
+
+// Electrum's scripthash is SHA256 of the output script, in reversed byte order.
+func shFromString(s string) (sh []byte, e error) {
+	b, e := hex.DecodeString(s)
+	if e != nil || len(b) != 32 {
+		e = errors.New("invalid scripthash")
+		return
+	}
+	sh = make([]byte, 32)
+	for i := range b {
+		sh[31-i] = b[i]
+	}
+	return
+}
+
+func shToString(sh []byte) string {
+	return btc.NewUint256(sh).String()
+}
+
+func param_sh(params []json.RawMessage) (sh []byte, e error) {
+	s, e := param_string(params, 0)
+	if e == nil {
+		sh, e = shFromString(s)
+	}
+	if e == nil && common.BlockChain.HistIndex == nil {
+		e = errors.New("history index not enabled on this server")
+	}
+	return
+}
+
+func headerInfo(n *chain.BlockTreeNode) interface{} {
+	return map[string]interface{}{"hex": hex.EncodeToString(n.BlockHeader[:]), "height": n.Height}
+}
+
+// confirmedTxs returns the confirmed transactions of the scripthash (each one once, oldest first).
+func confirmedTxs(sh []byte) []*chain.HistRec {
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	recs := hi.Records(sh)
+	hi.Unlock()
+	return chain.HistTxs(recs)
+}
+
+// scriptStatus returns the status of the scripthash, as defined by the protocol.
+func scriptStatus(sh []byte) string {
+	conf := confirmedTxs(sh)
+	unconf := mempoolFor(sh)
+	txids := make([]*btc.Uint256, 0, len(conf)+len(unconf))
+	heights := make([]int, 0, len(conf)+len(unconf))
+	for _, r := range conf {
+		txids = append(txids, r.TxID)
+		heights = append(heights, int(r.Height))
+	}
+	for _, r := range unconf {
+		txids = append(txids, r.TxID)
+		heights = append(heights, r.Height)
+	}
+	return chain.HistStatus(txids, heights)
+}
+
+func server_version(c *client, params []json.RawMessage) (interface{}, error) {
+	return []string{"Gocoin " + gocoin.Version, PROTOCOL_VERSION}, nil
+}
+
+func server_banner(c *client, params []json.RawMessage) (interface{}, error) {
+	return "Welcome to Gocoin " + gocoin.Version + " Electrum server", nil
+}
+
+func headers_subscribe(c *client, params []json.RawMessage) (interface{}, error) {
+	c.Mutex.Lock()
+	c.headers = true
+	c.Mutex.Unlock()
+	common.Last.Mutex.Lock()
+	top := common.Last.Block
+	common.Last.Mutex.Unlock()
+	return headerInfo(top), nil
+}
+
+func block_header(c *client, params []json.RawMessage) (interface{}, error) {
+	height, e := param_int(params, 0, -1)
+	if e != nil || height < 0 {
+		return nil, errors.New("invalid height")
+	}
+	n := common.BlockChain.MainChainNode(uint32(height))
+	if n == nil {
+		return nil, errors.New("height out of range")
+	}
+	return hex.EncodeToString(n.BlockHeader[:]), nil
+}
+
+func block_headers(c *client, params []json.RawMessage) (interface{}, error) {
+	start, e := param_int(params, 0, -1)
+	if e != nil || start < 0 {
+		return nil, errors.New("invalid start height")
+	}
+	count, e := param_int(params, 1, 0)
+	if e != nil || count < 0 {
+		return nil, errors.New("invalid count")
+	}
+	if count > MAX_HEADERS {
+		count = MAX_HEADERS
+	}
+	nodes := common.BlockChain.MainChainNodes(uint32(start), count)
+	hdrs := make([]byte, 80*len(nodes))
+	for i, n := range nodes {
+		copy(hdrs[80*i:], n.BlockHeader[:])
+	}
+	return map[string]interface{}{"count": len(hdrs) / 80, "hex": hex.EncodeToString(hdrs), "max": MAX_HEADERS}, nil
+}
+
+func estimate_fee(c *client, params []json.RawMessage) (interface{}, error) {
+	blocks, e := param_int(params, 0, 6)
+	if e != nil || blocks < 1 {
+		return nil, errors.New("invalid number of blocks")
+	}
+	return usif.MempoolFeeRate(uint(blocks)) * 1000 / 1e8, nil // BTC per kB
+}
+
+func relay_fee(c *client, params []json.RawMessage) (interface{}, error) {
+	return float64(common.MinFeePerKB()) / 1e8, nil
+}
+
+func scripthash_get_history(c *client, params []json.RawMessage) (interface{}, error) {
+	sh, e := param_sh(params)
+	if e != nil {
+		return nil, e
+	}
+	res := []interface{}{}
+	for _, r := range confirmedTxs(sh) {
+		res = append(res, map[string]interface{}{"tx_hash": r.TxID.String(), "height": r.Height})
+	}
+	for _, r := range mempoolFor(sh) {
+		res = append(res, map[string]interface{}{"tx_hash": r.TxID.String(), "height": r.Height, "fee": r.Fee})
+	}
+	return res, nil
+}
+
+func scripthash_get_mempool(c *client, params []json.RawMessage) (interface{}, error) {
+	sh, e := param_sh(params)
+	if e != nil {
+		return nil, e
+	}
+	res := []interface{}{}
+	for _, r := range mempoolFor(sh) {
+		res = append(res, map[string]interface{}{"tx_hash": r.TxID.String(), "height": r.Height, "fee": r.Fee})
+	}
+	return res, nil
+}
+
+func scripthash_get_balance(c *client, params []json.RawMessage) (interface{}, error) {
+	sh, e := param_sh(params)
+	if e != nil {
+		return nil, e
+	}
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	_, confirmed := hi.Unspent(sh)
+	hi.Unlock()
+	var unconfirmed int64
+	for _, r := range mempoolFor(sh) {
+		for _, v := range r.Values {
+			unconfirmed += int64(v)
+		}
+		unconfirmed -= int64(r.Spent)
+	}
+	return map[string]interface{}{"confirmed": confirmed, "unconfirmed": unconfirmed}, nil
+}
+
+func scripthash_listunspent(c *client, params []json.RawMessage) (interface{}, error) {
+	sh, e := param_sh(params)
+	if e != nil {
+		return nil, e
+	}
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	unsp, _ := hi.Unspent(sh)
+	hi.Unlock()
+	res := []interface{}{}
+	for _, r := range unsp {
+		if !spentInMempool(r.TxID, r.Index) {
+			res = append(res, map[string]interface{}{"tx_hash": r.TxID.String(), "tx_pos": r.Index,
+				"height": r.Height, "value": r.Value})
+		}
+	}
+	for _, r := range mempoolFor(sh) {
+		for i, vout := range r.Outs {
+			if !spentInMempool(r.TxID, vout) {
+				res = append(res, map[string]interface{}{"tx_hash": r.TxID.String(), "tx_pos": vout,
+					"height": 0, "value": r.Values[i]})
+			}
+		}
+	}
+	return res, nil
+}
+
+func scripthash_subscribe(c *client, params []json.RawMessage) (interface{}, error) {
+	sh, e := param_sh(params)
+	if e != nil {
+		return nil, e
+	}
+	status := scriptStatus(sh)
+	var k [32]byte
+	copy(k[:], sh)
+	c.Mutex.Lock()
+	if len(c.subs) >= MAX_SUBSCRIPTIONS {
+		c.Mutex.Unlock()
+		return nil, errors.New("too many subscriptions")
+	}
+	c.subs[k] = status
+	c.Mutex.Unlock()
+	if status == "" {
+		return nil, nil
+	}
+	return status, nil
+}
+
+func scripthash_unsubscribe(c *client, params []json.RawMessage) (interface{}, error) {
+	s, e := param_string(params, 0)
+	if e != nil {
+		return nil, e
+	}
+	sh, e := shFromString(s)
+	if e != nil {
+		return nil, e
+	}
+	var k [32]byte
+	copy(k[:], sh)
+	c.Mutex.Lock()
+	_, ok := c.subs[k]
+	delete(c.subs, k)
+	c.Mutex.Unlock()
+	return ok, nil
+}
+
+func transaction_get(c *client, params []json.RawMessage) (interface{}, error) {
+	s, e := param_string(params, 0)
+	if e != nil {
+		return nil, e
+	}
+	var verbose bool
+	if len(params) > 1 {
+		json.Unmarshal(params[1], &verbose)
+	}
+	if verbose {
+		return nil, errors.New("verbose transactions not supported")
+	}
+	txid := btc.NewUint256FromString(s)
+	if txid == nil {
+		return nil, errors.New("invalid txid")
+	}
+	tx, _, e := usif.FindTx(txid)
+	if e != nil {
+		return nil, errors.New("transaction not found")
+	}
+	return hex.EncodeToString(tx.Raw), nil
+}
+
+func transaction_broadcast(c *client, params []json.RawMessage) (res interface{}, e error) {
+	s, e := param_string(params, 0)
+	if e != nil {
+		return
+	}
+	raw, e := hex.DecodeString(s)
+	if e != nil {
+		return nil, errors.New("invalid transaction hex")
+	}
+
+	req := &usif.OneUiReq{}
+	req.Done.Add(1)
+	req.Handler = func(string) {
+		var txid *btc.Uint256
+		if txid, e = usif.SubmitRawTx(raw); e == nil {
+			res = txid.String()
+		}
+	}
+	usif.UiChannel <- req
+	req.Done.Wait()
+	return
+}
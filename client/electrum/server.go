@@ -0,0 +1,315 @@
+package electrum
+
+// Electrum protocol (1.4) server - JSON-RPC over TCP or TLS, one request per line.
+// Test it with:
+// echo '{"id":1,"method":"server.version","params":["test","1.4"]}' | nc 127.0.0.1 50001
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+const (
+	PROTOCOL_VERSION  = "1.4"
+	MAX_REQUEST_SIZE  = 2e6   // a line with the request (i.e. hex of a broadcasted tx)
+	MAX_SUBSCRIPTIONS = 10000 // scripthashes per client
+)
+
+type Request struct {
+	Id     interface{}     `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	JsonRPC string      `json:"jsonrpc"`
+	Id      interface{} `json:"id"`
+	Result  interface{} `json:"result"`
+	Error   *Error      `json:"error,omitempty"`
+}
+
+type Notification struct {
+	JsonRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type client struct {
+	net.Conn
+	sync.Mutex            // protects the subscriptions and the pending notifications
+	wr         sync.Mutex // protects writing
+
+	headers bool                // subscribed to the headers
+	subs    map[[32]byte]string // subscribed scripthashes and their last statuses
+
+	// pending notifications, sent by the client's own goroutine (see notifications)
+	top     *chain.BlockTreeNode // a new block - check all the subscriptions
+	touched map[[32]byte]bool    // subscriptions to check
+	wake    chan bool
+	done    chan bool
+}
+
+var (
+	clients_mutex sync.Mutex
+	clients       = make(map[*client]bool)
+)
+
+// StartServer runs Electrum server's listeners. Call it once, in its own goroutine.
+func StartServer() {
+	iface := common.CFG.Electrum.Interface
+	tcp, ssl := common.ElectrumPorts()
+	if common.BlockChain.HistIndex == nil {
+		println("Electrum server needs the history index (-histindex) for its scripthash methods")
+	}
+
+	if cert, er := tls.LoadX509KeyPair("ssl_cert/server.crt", "ssl_cert/server.key"); er == nil {
+		ln, er := tls.Listen("tcp", fmt.Sprint(iface, ":", ssl), &tls.Config{Certificates: []tls.Certificate{cert}})
+		if er == nil {
+			fmt.Println("Starting Electrum server (TLS) at", ln.Addr().String())
+			go accept(ln)
+		} else {
+			println("Electrum TLS:", er.Error())
+		}
+	} else if common.CFG.Electrum.TLSOnly {
+		println("Electrum TLS:", er.Error())
+	}
+
+	if !common.CFG.Electrum.TLSOnly {
+		ln, er := net.Listen("tcp", fmt.Sprint(iface, ":", tcp))
+		if er != nil {
+			println("Electrum TCP:", er.Error())
+			return
+		}
+		fmt.Println("Starting Electrum server at", ln.Addr().String())
+		go accept(ln)
+	}
+
+	notifier()
+}
+
+func accept(ln net.Listener) {
+	for {
+		conn, er := ln.Accept()
+		if er != nil {
+			println("Electrum accept:", er.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		clients_mutex.Lock()
+		if uint(len(clients)) >= common.CFG.Electrum.MaxClients {
+			clients_mutex.Unlock()
+			common.CountSafe("ElectrumTooMany")
+			conn.Close()
+			continue
+		}
+		c := &client{Conn: conn, subs: make(map[[32]byte]string), wake: make(chan bool, 1), done: make(chan bool)}
+		clients[c] = true
+		clients_mutex.Unlock()
+		common.CountSafe("ElectrumConnect")
+		go c.serve()
+		go c.notifications()
+	}
+}
+
+func (c *client) serve() {
+	defer func() {
+		clients_mutex.Lock()
+		delete(clients, c)
+		clients_mutex.Unlock()
+		close(c.done)
+		c.Close()
+	}()
+
+	rd := bufio.NewScanner(c.Conn)
+	rd.Buffer(make([]byte, 0x10000), MAX_REQUEST_SIZE)
+	for rd.Scan() {
+		line := bytes.TrimSpace(rd.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var out interface{}
+		if line[0] == '[' {
+			var reqs []*Request
+			if er := json.Unmarshal(line, &reqs); er != nil {
+				out = &Response{JsonRPC: "2.0", Error: &Error{Code: -32700, Message: "Parse error"}}
+			} else {
+				resps := make([]*Response, len(reqs))
+				for i, req := range reqs {
+					resps[i] = c.handle(req)
+				}
+				out = resps
+			}
+		} else {
+			req := new(Request)
+			if er := json.Unmarshal(line, req); er != nil {
+				out = &Response{JsonRPC: "2.0", Error: &Error{Code: -32700, Message: "Parse error"}}
+			} else {
+				out = c.handle(req)
+			}
+		}
+		if c.send(out) != nil {
+			return
+		}
+	}
+}
+
+// send writes a JSON message to the client, followed by the new line.
+func (c *client) send(v interface{}) (er error) {
+	b, er := json.Marshal(v)
+	if er != nil {
+		println("Electrum json.Marshal:", er.Error())
+		return
+	}
+	c.wr.Lock()
+	c.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, er = c.Conn.Write(append(b, '\n'))
+	c.wr.Unlock()
+	return
+}
+
+func (c *client) handle(req *Request) (resp *Response) {
+	common.CountSafe("Electrum-" + req.Method)
+	resp = &Response{JsonRPC: "2.0", Id: req.Id}
+	var params []json.RawMessage
+	if len(req.Params) > 0 && json.Unmarshal(req.Params, &params) != nil {
+		resp.Error = &Error{Code: -32602, Message: "params must be an array"}
+		return
+	}
+	h, ok := methods[req.Method]
+	if !ok {
+		resp.Error = &Error{Code: -32601, Message: "unknown method " + req.Method}
+		return
+	}
+	var er error
+	if resp.Result, er = h(c, params); er != nil {
+		resp.Error = &Error{Code: 1, Message: er.Error()}
+	}
+	return
+}
+
+// notifier finds out about the new blocks and the scripthash status changes
+// and passes them to the clients.
+func notifier() {
+	var last_top [32]byte
+	for {
+		time.Sleep(time.Second)
+
+		common.Last.Mutex.Lock()
+		top := common.Last.Block
+		common.Last.Mutex.Unlock()
+		if top.BlockHash.Hash == last_top {
+			top = nil
+		} else {
+			last_top = top.BlockHash.Hash
+		}
+
+		touched := mempoolTouched()
+		if top == nil && len(touched) == 0 {
+			continue
+		}
+
+		clients_mutex.Lock()
+		for c := range clients {
+			c.notify(top, touched)
+		}
+		clients_mutex.Unlock()
+	}
+}
+
+// notify queues the notifications for the client's goroutine.
+// After a new block (top not nil) all the subscriptions get checked, otherwise only the touched ones.
+func (c *client) notify(top *chain.BlockTreeNode, touched map[[32]byte]bool) {
+	c.Mutex.Lock()
+	if top != nil {
+		c.top = top
+	}
+	for sh := range touched {
+		if _, ok := c.subs[sh]; ok {
+			if c.touched == nil {
+				c.touched = make(map[[32]byte]bool)
+			}
+			c.touched[sh] = true
+		}
+	}
+	c.Mutex.Unlock()
+	select {
+	case c.wake <- true:
+	default: // already pending
+	}
+}
+
+// notifications sends the pending notifications, so a slow client does not hold up the others.
+func (c *client) notifications() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+
+		c.Mutex.Lock()
+		top, headers := c.top, c.headers
+		shs := make([][32]byte, 0, len(c.touched))
+		if top != nil {
+			for sh := range c.subs {
+				shs = append(shs, sh)
+			}
+		} else {
+			for sh := range c.touched {
+				shs = append(shs, sh)
+			}
+		}
+		c.top, c.touched = nil, nil
+		c.Mutex.Unlock()
+
+		if top != nil && headers {
+			if c.send(&Notification{JsonRPC: "2.0", Method: "blockchain.headers.subscribe",
+				Params: []interface{}{headerInfo(top)}}) != nil {
+				c.Close()
+				return
+			}
+		}
+		for _, sh := range shs {
+			status := scriptStatus(sh[:])
+			c.Mutex.Lock()
+			prv, ok := c.subs[sh]
+			if ok {
+				c.subs[sh] = status
+			}
+			c.Mutex.Unlock()
+			if ok && prv != status {
+				var st interface{}
+				if status != "" {
+					st = status
+				}
+				if c.send(&Notification{JsonRPC: "2.0", Method: "blockchain.scripthash.subscribe",
+					Params: []interface{}{shToString(sh[:]), st}}) != nil {
+					c.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Clients returns the number of connected Electrum clients.
+func Clients() (cnt int) {
+	clients_mutex.Lock()
+	cnt = len(clients)
+	clients_mutex.Unlock()
+	return
+}
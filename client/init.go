@@ -69,10 +69,15 @@ func host_init() {
 		fmt.Println("Using native secp256k1 lib for EC_Verify (consider installing a speedup)")
 	}
 
+	if common.CFG.Prune.TargetMB != 0 {
+		common.Services = common.Services&^common.SERVICE_NETWORK | common.SERVICE_NETWORK_LIMITED
+	}
+
 	ext := &chain.NewChanOpts{
 		UTXOVolatileMode : common.FLAG.VolatileUTXO,
 		UndoBlocks : common.FLAG.UndoBlocks,
-		BlockMinedCB : blockMined, DoNotRescan : true}
+		BlockMinedCB : blockMined, DoNotRescan : true,
+		TxIndex : common.CFG.TxIndex, HistIndex : common.CFG.HistIndex}
 
 	sta := time.Now()
 	common.BlockChain = chain.NewChainExt(common.GocoinHomeDir, common.GenesisBlock, common.FLAG.Rescan, ext,
@@ -80,6 +85,7 @@ func host_init() {
 			MaxCachedBlocks : int(common.CFG.Memory.MaxCachedBlks),
 			MaxDataFileSize : uint64(common.CFG.Memory.MaxDataFileMB) << 20,
 			DataFilesKeep : common.CFG.Memory.DataFilesKeep,
+			PruneTarget : common.CFG.Prune.TargetMB << 20,
 			DataFilesBackup : common.CFG.Memory.OldDataBackup})
 	if chain.AbortNow {
 		fmt.Printf("Blockchain opening aborted after %s seconds\n", time.Now().Sub(sta).String())
@@ -88,6 +94,24 @@ func host_init() {
 		os.Exit(1)
 	}
 
+	for _, d := range common.CFG.BIP9 {
+		if er := common.BlockChain.AddBIP9Deployment(d); er != nil {
+			fmt.Println("Config:", er.Error())
+		}
+	}
+
+	if common.BlockChain.SnapshotCheck != nil || common.BlockChain.Blocks.PruneHeight() > 0 {
+		// the blocks below the UTXO snapshot are not kept
+		common.Services = common.Services&^common.SERVICE_NETWORK | common.SERVICE_NETWORK_LIMITED
+	}
+
+	if common.BlockChain.TxIndex != nil {
+		go common.BlockChain.BackfillTxIndex()
+	}
+	if common.BlockChain.HistIndex != nil {
+		go common.BlockChain.BackfillHistIndex()
+	}
+
 	if lb, _ := common.BlockChain.BlockTreeRoot.FindFarthestNode(); lb.Height > common.BlockChain.LastBlock().Height {
 		common.Last.ParseTill = lb
 	}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/piotrnar/gocoin"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/electrum"
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/rpcapi"
 	"github.com/piotrnar/gocoin/client/usif"
@@ -132,21 +133,7 @@ func retry_cached_blocks() bool {
 		if common.BlockChain.HasAllParents(newbl.BlockTreeNode) {
 			common.Busy()
 
-			if newbl.Block == nil {
-				tmpfn := common.TempBlocksDir() + newbl.BlockTreeNode.BlockHash.String()
-				dat, e := ioutil.ReadFile(tmpfn)
-				os.Remove(tmpfn)
-				if e != nil {
-					panic(e.Error())
-				}
-				if newbl.Block, e = btc.NewBlock(dat); e != nil {
-					panic(e.Error())
-				}
-				if e = newbl.Block.BuildTxList(); e != nil {
-					panic(e.Error())
-				}
-				newbl.Block.BlockExtraInfo = *newbl.BlockExtraInfo
-			}
+			loadTempBlock(newbl)
 
 			e := LocalAcceptBlock(newbl)
 			if e != nil {
@@ -179,6 +166,26 @@ func CheckParentDiscarded(n *chain.BlockTreeNode) bool {
 	return false
 }
 
+// loadTempBlock reads the block's data from the temporary file, if it is not in memory
+func loadTempBlock(newbl *network.BlockRcvd) {
+	if newbl.Block != nil {
+		return
+	}
+	tmpfn := common.TempBlocksDir() + newbl.BlockTreeNode.BlockHash.String()
+	dat, e := ioutil.ReadFile(tmpfn)
+	os.Remove(tmpfn)
+	if e != nil {
+		panic(e.Error())
+	}
+	if newbl.Block, e = btc.NewBlock(dat); e != nil {
+		panic(e.Error())
+	}
+	if e = newbl.Block.BuildTxList(); e != nil {
+		panic(e.Error())
+	}
+	newbl.Block.BlockExtraInfo = *newbl.BlockExtraInfo
+}
+
 // HandleNetBlock is called from the blockchain thread.
 func HandleNetBlock(newbl *network.BlockRcvd) {
 	if common.Last.ParseTill != nil {
@@ -201,6 +208,18 @@ func HandleNetBlock(newbl *network.BlockRcvd) {
 		return
 	}
 
+	if sc := common.BlockChain.SnapshotCheck; sc != nil && newbl.BlockTreeNode.Height <= sc.Base.Height {
+		// a block for the background validation of the UTXO snapshot
+		loadTempBlock(newbl)
+		newbl.Block.Trusted = newbl.Block.Trusted || common.FLAG.TrustAll || newbl.BlockTreeNode.Trusted
+		if sc.AddBlock(newbl.Block, newbl.BlockTreeNode) {
+			common.CountSafe("SnapshotBlock")
+		} else {
+			common.CountSafe("SnapshotBlockSkip")
+		}
+		return
+	}
+
 	if !common.BlockChain.HasAllParents(newbl.BlockTreeNode) {
 		// it's not linking - keep it for later
 		network.CachedBlocks = append(network.CachedBlocks, newbl)
@@ -209,21 +228,7 @@ func HandleNetBlock(newbl *network.BlockRcvd) {
 		return
 	}
 
-	if newbl.Block == nil {
-		tmpfn := common.TempBlocksDir() + newbl.BlockTreeNode.BlockHash.String()
-		dat, e := ioutil.ReadFile(tmpfn)
-		os.Remove(tmpfn)
-		if e != nil {
-			panic(e.Error())
-		}
-		if newbl.Block, e = btc.NewBlock(dat); e != nil {
-			panic(e.Error())
-		}
-		if e = newbl.Block.BuildTxList(); e != nil {
-			panic(e.Error())
-		}
-		newbl.Block.BlockExtraInfo = *newbl.BlockExtraInfo
-	}
+	loadTempBlock(newbl)
 
 	common.Busy()
 	if e := LocalAcceptBlock(newbl); e != nil {
@@ -275,38 +280,22 @@ func HandleRpcBlock(msg *rpcapi.BlockSubmited) {
 
 func do_the_blocks(end *chain.BlockTreeNode) {
 	sta := time.Now()
-	last := common.BlockChain.LastBlock()
-	for last != end {
-		nxt := last.FindPathTo(end)
-		if nxt == nil {
-			break
-		}
-
-		if nxt.BlockSize==0 {
-			println("BlockSize is zero - corrupt database")
-			break
-		}
-
+	// the blocks are read and decoded ahead, in parallel
+	rd := common.BlockChain.NewBlockReader(common.BlockChain.LastBlock(), end)
+	defer rd.Close()
+	for {
 		pre := time.Now()
-		crec, trusted, _ := common.BlockChain.Blocks.BlockGetInternal(nxt.BlockHash, true)
-
-		bl, er := btc.NewBlock(crec.Data)
-		if er != nil {
-			println("btc.NewBlock() error - corrupt database")
+		rd_bl := rd.Next()
+		if rd_bl == nil {
 			break
 		}
-		bl.Height = nxt.Height
+		nxt := rd_bl.Node
 
-		// Recover the flags to be used when verifying scripts for non-trusted blocks (stored orphaned blocks)
-		common.BlockChain.ApplyBlockFlags(bl)
-
-		er = bl.BuildTxList()
-		if er != nil {
-			println("bl.BuildTxList() error - corrupt database")
+		if rd_bl.Error != nil {
+			println("Block", nxt.Height, "-", rd_bl.Error.Error(), "- corrupt database")
 			break
 		}
-
-		bl.Trusted = trusted
+		bl := rd_bl.Block
 
 		tdl := time.Now()
 
@@ -322,9 +311,6 @@ func do_the_blocks(end *chain.BlockTreeNode) {
 		for NetBlocksSize.Get() > 64*1024*1024 {
 			time.Sleep(100*time.Millisecond)
 		}
-
-		last = nxt
-
 	}
 	//println("all blocks queued", len(network.NetBlocks))
 }
@@ -398,6 +384,7 @@ func main() {
 		peersdb.Services = common.Services
 		peersdb.InitPeers(common.GocoinHomeDir)
 		if common.FLAG.UnbanAllPeers {
+			peersdb.ClearBans()
 			var keys []qdb.KeyType
 			var vals [][]byte
 			peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
@@ -447,7 +434,24 @@ func main() {
 			go rpcapi.StartServer(common.RPCPort())
 		}
 
+		if common.CFG.Electrum.Enabled {
+			go electrum.StartServer()
+		}
+
+		if common.CFG.VerifyChain.AtStartup && common.Last.ParseTill == nil {
+			fmt.Println("Verifying last", common.CFG.VerifyChain.Depth, "blocks at level", common.CFG.VerifyChain.Level, "in the background...")
+			sta := time.Now()
+			usif.VerifyChain(uint32(common.CFG.VerifyChain.Level), uint32(common.CFG.VerifyChain.Depth), func(e error) {
+				if e != nil {
+					fmt.Println("WARNING: verifychain failed:", e.Error())
+				} else {
+					fmt.Println("Chain verified OK in", time.Now().Sub(sta).String())
+				}
+			})
+		}
+
 		usif.LoadBlockFees()
+		network.FeeEstLoad()
 
 		wallet.FetchingBalanceTick = func() bool {
 			select {
@@ -554,6 +558,7 @@ func main() {
 					break
 				}
 				network.NetworkTick()
+				network.FetchSnapshotBlocks()
 
 				if common.BlockChainSynchronized {
 					if common.WalletPendingTick() {
@@ -601,6 +606,7 @@ func main() {
 			}
 		}
 
+		usif.AbortVerifyChain()
 		common.BlockChain.Unspent.HurryUp()
 		wallet.UpdateMapSizes()
 		network.NetCloseAll()
@@ -614,6 +620,7 @@ func main() {
 	fmt.Println("Blockchain closed in", time.Now().Sub(sta).String())
 	peersdb.ClosePeerDB()
 	usif.SaveBlockFees()
+	network.FeeEstSave()
 	sys.UnlockDatabaseDir()
 	os.RemoveAll(common.TempBlocksDir())
 }
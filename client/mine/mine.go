@@ -0,0 +1,392 @@
+// Package mine is a simple solo CPU miner, meant for testing on testnet (or regtest-like chains).
+// It mines on top of the templates from rpcapi.GetNextBlockTemplate, with the coinbase paying
+// to Mine.PayTo config address, and submits the blocks it finds like the submitblock RPC does.
+package mine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/rpcapi"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	MAX_DIFFICULTY   = 1.0              // on testnet, wait for a template at the minimum difficulty, unless forced
+	TEMPLATE_REFRESH = 30 * time.Second // get a new template (with new txs) this often
+	TIP_CHECK        = 250 * time.Millisecond
+	NONCES_PER_CHECK = 1 << 16 // the workers check if their job is still valid after so many hashes
+	COINBASE_TAG     = "/gocoin/"
+)
+
+var (
+	mutex   sync.Mutex
+	running bool
+	exiting bool // set while waiting for the workers to finish
+	cur     *job // nil while there is nothing to mine
+	stop    chan bool
+	found   chan *foundBlock
+	wg      sync.WaitGroup
+
+	job_id uint32 // incremented each time the current job becomes invalid
+
+	Hashes          uint64
+	Found, Accepted uint32
+	Started         time.Time
+	Threads         int
+)
+
+type foundBlock struct {
+	id  uint32
+	raw []byte
+}
+
+// job is the block being mined - the same for all the workers, except for the coinbase.
+type job struct {
+	id         uint32
+	height     uint32
+	value      uint64
+	pk_script  []byte
+	commitment []byte // witness commitment (nil if SegWit is not active)
+	hdr        [80]byte
+	target     [32]byte // big-endian
+	txids      [][32]byte
+	raws       [][]byte // of the txs, following the coinbase
+	prev       *btc.Uint256
+	bits       uint32
+}
+
+// heightScript returns the serialized height for the coinbase (BIP34), the way chain.PostCheckBlock expects it.
+func heightScript(height uint32) []byte {
+	var exp [6]byte
+	var exp_len int
+	binary.LittleEndian.PutUint32(exp[1:5], height)
+	for exp_len = 5; exp_len > 1; exp_len-- {
+		if exp[exp_len] != 0 || exp[exp_len-1] >= 0x80 {
+			break
+		}
+	}
+	exp[0] = byte(exp_len)
+	return exp[:exp_len+1]
+}
+
+func newJob(r *rpcapi.GetBlockTemplateResp, pk_script []byte) (j *job, er error) {
+	var bits uint64
+	j = &job{height: uint32(r.Height), value: r.Coinbasevalue, pk_script: pk_script}
+
+	if bits, er = strconv.ParseUint(r.Bits, 16, 32); er != nil {
+		return
+	}
+	j.bits = uint32(bits)
+	target := btc.SetCompact(j.bits).Bytes()
+	if len(target) > 32 {
+		return nil, errors.New("target out of range")
+	}
+	copy(j.target[32-len(target):], target)
+
+	if j.prev = btc.NewUint256FromString(r.PreviousBlockHash); j.prev == nil {
+		return nil, errors.New("bad previous block hash")
+	}
+
+	txs := []*btc.Tx{nil} // the coinbase does not count for the witness merkle
+	j.txids = make([][32]byte, 1, len(r.Transactions)+1)
+	for i := range r.Transactions {
+		raw, er := hex.DecodeString(r.Transactions[i].Data)
+		if er != nil {
+			return nil, er
+		}
+		tx, le := btc.NewTx(raw)
+		if tx == nil || le != len(raw) {
+			return nil, errors.New("tx " + r.Transactions[i].Hash + " parse error")
+		}
+		tx.SetHash(raw)
+		txs = append(txs, tx)
+		j.txids = append(j.txids, tx.Hash.Hash)
+		j.raws = append(j.raws, raw)
+	}
+
+	for _, rule := range r.Rules {
+		if rule == "!segwit" {
+			merkle, _ := btc.GetWitnessMerkle(txs)
+			var nonce [32]byte
+			sum := btc.Sha2Sum(append(merkle, nonce[:]...))
+			j.commitment = sum[:]
+		}
+	}
+
+	binary.LittleEndian.PutUint32(j.hdr[0:4], r.Version)
+	copy(j.hdr[4:36], j.prev.Hash[:])
+	binary.LittleEndian.PutUint32(j.hdr[68:72], uint32(r.Curtime))
+	binary.LittleEndian.PutUint32(j.hdr[72:76], j.bits)
+	return
+}
+
+// coinbase returns the raw coinbase tx with the given extra nonce.
+func (j *job) coinbase(extranonce uint64) []byte {
+	var b [8]byte
+	cb := new(bytes.Buffer)
+	binary.Write(cb, binary.LittleEndian, uint32(1))
+	if j.commitment != nil {
+		cb.Write([]byte{0, 1}) // SegWit marker and flag
+	}
+
+	cb.WriteByte(1) // one input
+	cb.Write(make([]byte, 32))
+	cb.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	script := heightScript(j.height)
+	binary.LittleEndian.PutUint64(b[:], extranonce)
+	script = append(script, 8)
+	script = append(script, b[:]...)
+	script = append(script, byte(len(COINBASE_TAG)))
+	script = append(script, COINBASE_TAG...)
+	btc.WriteVlen(cb, uint64(len(script)))
+	cb.Write(script)
+	cb.Write([]byte{0xff, 0xff, 0xff, 0xff})
+
+	if j.commitment != nil {
+		cb.WriteByte(2)
+	} else {
+		cb.WriteByte(1)
+	}
+	binary.Write(cb, binary.LittleEndian, j.value)
+	btc.WriteVlen(cb, uint64(len(j.pk_script)))
+	cb.Write(j.pk_script)
+	if j.commitment != nil {
+		binary.Write(cb, binary.LittleEndian, uint64(0))
+		cb.Write([]byte{38, 0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed})
+		cb.Write(j.commitment)
+
+		cb.Write([]byte{1, 32}) // witness nonce
+		cb.Write(make([]byte, 32))
+	}
+
+	binary.Write(cb, binary.LittleEndian, uint32(0))
+	return cb.Bytes()
+}
+
+// isValid returns true if the hash meets the target.
+func (j *job) isValid(hash *[32]byte) bool {
+	for i := 0; i < 32; i++ {
+		if hash[31-i] != j.target[i] {
+			return hash[31-i] < j.target[i]
+		}
+	}
+	return true
+}
+
+// mine goes through all the nonces for the given extra nonce,
+// unless the job becomes invalid or a block is found.
+func (j *job) mine(extranonce uint64) {
+	cb := j.coinbase(extranonce)
+	tx, _ := btc.NewTx(cb)
+	tx.SetHash(cb)
+
+	txids := make([][32]byte, len(j.txids), 3*len(j.txids)) // CalcMerkle appends to it
+	copy(txids, j.txids)
+	txids[0] = tx.Hash.Hash
+	merkle, _ := btc.CalcMerkle(txids)
+
+	hdr := j.hdr
+	copy(hdr[36:68], merkle)
+	for nonce := uint64(0); nonce <= 0xffffffff; nonce++ {
+		if (nonce & (NONCES_PER_CHECK - 1)) == 0 {
+			if nonce != 0 {
+				atomic.AddUint64(&Hashes, NONCES_PER_CHECK)
+			}
+			if atomic.LoadUint32(&job_id) != j.id {
+				return
+			}
+		}
+		binary.LittleEndian.PutUint32(hdr[76:80], uint32(nonce))
+		if hash := btc.Sha2Sum(hdr[:]); j.isValid(&hash) {
+			bl := new(bytes.Buffer)
+			bl.Write(hdr[:])
+			btc.WriteVlen(bl, uint64(len(j.raws)+1))
+			bl.Write(cb)
+			for _, raw := range j.raws {
+				bl.Write(raw)
+			}
+			select {
+			case found <- &foundBlock{id: j.id, raw: bl.Bytes()}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+func worker(idx uint64) {
+	defer wg.Done()
+	var extra uint64
+	for {
+		mutex.Lock()
+		j, exit := cur, exiting
+		mutex.Unlock()
+		if exit {
+			return
+		}
+		if j == nil {
+			time.Sleep(TIP_CHECK)
+			continue
+		}
+		extra++
+		j.mine(idx<<32 | extra)
+	}
+}
+
+// setJob makes the workers switch to the given job (nil to make them wait).
+func setJob(j *job) {
+	id := atomic.AddUint32(&job_id, 1)
+	if j != nil {
+		j.id = id
+	}
+	mutex.Lock()
+	cur = j
+	mutex.Unlock()
+}
+
+func submit(raw []byte) {
+	atomic.AddUint32(&Found, 1)
+	bs, er := rpcapi.Submit(raw)
+	if er != nil {
+		fmt.Println("Mined block broken:", er.Error())
+	} else if bs.Error != "" {
+		fmt.Println("Mined block", bs.Block.Hash.String(), "rejected:", bs.Error)
+	} else {
+		atomic.AddUint32(&Accepted, 1)
+		fmt.Println("Mined block", bs.Block.Hash.String(), "accepted at height", bs.Block.Height)
+	}
+}
+
+func run(force bool, pk_script []byte) {
+	defer func() {
+		setJob(nil)
+		mutex.Lock()
+		exiting = true
+		mutex.Unlock()
+		wg.Wait()
+		mutex.Lock()
+		running, exiting = false, false
+		mutex.Unlock()
+		fmt.Println("Mining stopped")
+	}()
+
+	var waiting bool
+	for {
+		tmpl := new(rpcapi.GetBlockTemplateResp)
+		rpcapi.GetNextBlockTemplate(tmpl)
+		j, er := newJob(tmpl, pk_script)
+		if er != nil {
+			fmt.Println("Mining template error:", er.Error())
+			return
+		}
+		if diff := btc.GetDifficulty(j.bits); !force && diff > MAX_DIFFICULTY {
+			// testnet's difficulty drops to the minimum 20 minutes after the last block
+			if !waiting {
+				fmt.Println("Difficulty", diff, "is too high for CPU mining - waiting for the minimum one")
+				waiting = true
+			}
+			setJob(nil)
+		} else {
+			if waiting {
+				fmt.Println("Mining resumed at difficulty", diff)
+				waiting = false
+			}
+			setJob(j)
+		}
+
+		refresh := time.After(TEMPLATE_REFRESH)
+	wait:
+		for {
+			select {
+			case <-stop:
+				return
+			case f := <-found:
+				if f.id == j.id {
+					setJob(nil)
+					submit(f.raw)
+					break wait
+				}
+			case <-refresh:
+				break wait
+			case <-time.After(TIP_CHECK):
+				common.Last.Mutex.Lock()
+				new_tip := !common.Last.Block.BlockHash.Equal(j.prev)
+				common.Last.Mutex.Unlock()
+				if new_tip {
+					break wait
+				}
+			}
+		}
+	}
+}
+
+// Start runs the miner, paying to Mine.PayTo, with Mine.Threads workers (one per CPU if zero).
+// Unless forced, it does not start on mainnet and it only mines the blocks at MAX_DIFFICULTY.
+func Start(force bool) error {
+	common.LockCfg()
+	payto, threads, testnet := common.CFG.Mine.PayTo, int(common.CFG.Mine.Threads), common.CFG.Testnet
+	common.UnlockCfg()
+	if !testnet && !force {
+		return errors.New("CPU mining on mainnet makes no sense (use 'mine force' if you really mean it)")
+	}
+	if payto == "" {
+		return errors.New("set Mine.PayTo address in the config first")
+	}
+	addr, er := btc.NewAddrFromString(payto)
+	if er != nil {
+		return er
+	}
+	if threads == 0 {
+		threads = runtime.NumCPU()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if running {
+		return errors.New("already mining")
+	}
+	running = true
+	stop = make(chan bool, 1)
+	found = make(chan *foundBlock, threads)
+	atomic.StoreUint64(&Hashes, 0)
+	atomic.StoreUint32(&Found, 0)
+	atomic.StoreUint32(&Accepted, 0)
+	Started = time.Now()
+	Threads = threads
+	wg.Add(threads)
+	for i := 0; i < threads; i++ {
+		go worker(uint64(i))
+	}
+	go run(force, addr.OutScript())
+	return nil
+}
+
+// Stop makes the miner stop (it does not wait for it).
+func Stop() {
+	mutex.Lock()
+	if running {
+		select {
+		case stop <- true:
+		default:
+		}
+	}
+	mutex.Unlock()
+}
+
+// Running returns true if the miner is working.
+func Running() (res bool) {
+	mutex.Lock()
+	res = running
+	mutex.Unlock()
+	return
+}
@@ -0,0 +1,115 @@
+package mine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/piotrnar/gocoin/client/rpcapi"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+func TestHeightScript(t *testing.T) {
+	for _, v := range []struct {
+		height uint32
+		exp    string
+	}{
+		{1, "0101"},
+		{0x7f, "017f"},
+		{0x80, "028000"},
+		{300, "022c01"},
+		{0x8000, "03008000"},
+		{2500000, "03a02526"},
+		{0x80000000, "050000008000"},
+	} {
+		if res := hex.EncodeToString(heightScript(v.height)); res != v.exp {
+			t.Error("Height", v.height, "got", res, "expected", v.exp)
+		}
+	}
+}
+
+// Txs spending a made up output: a legacy one and a segwit one, with a single witness item.
+const (
+	testTx = "02000000" + "01" +
+		"1111111111111111111111111111111111111111111111111111111111111111" + "00000000" + "00" + "ffffffff" +
+		"01" + "e803000000000000" + "0151" + "00000000"
+	testSegwitTx = "02000000" + "0001" + "01" +
+		"2222222222222222222222222222222222222222222222222222222222222222" + "00000000" + "00" + "ffffffff" +
+		"01" + "e803000000000000" + "0151" + "01" + "03" + "aabbcc" + "00000000"
+)
+
+// mineTemplate mines a block on the given template and returns it after the chain's checks.
+func mineTemplate(t *testing.T, rules []string, txs ...string) *btc.Block {
+	tmpl := &rpcapi.GetBlockTemplateResp{
+		Version:           chain.BIP9_TOP_BITS,
+		Rules:             rules,
+		PreviousBlockHash: "000000000000000000000000000000000000000000000000000000000000abcd",
+		Coinbasevalue:     50e8,
+		Curtime:           1700000000,
+		Bits:              "207fffff",
+		Height:            2500000,
+	}
+	for _, tx := range txs {
+		tmpl.Transactions = append(tmpl.Transactions, rpcapi.OneTransaction{Data: tx})
+	}
+	pk_script := []byte{0x51}
+	j, er := newJob(tmpl, pk_script)
+	if er != nil {
+		t.Fatal(er)
+	}
+
+	found = make(chan *foundBlock, 1)
+	setJob(j)
+	j.mine(123)
+	setJob(nil)
+	var f *foundBlock
+	select {
+	case f = <-found:
+	default:
+		t.Fatal("Block not found")
+	}
+
+	bl, er := btc.NewBlock(f.raw)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if er = bl.BuildTxList(); er != nil {
+		t.Fatal(er)
+	}
+	if !btc.CheckProofOfWork(bl.Hash, bl.Bits()) || bl.Bits() != 0x207fffff {
+		t.Error("Bad proof of work")
+	}
+	if len(bl.Txs) != len(txs)+1 {
+		t.Fatal("Bad txs")
+	}
+	cb := bl.Txs[0]
+	if cb.TxOut[0].Value != 50e8 || !bytes.Equal(cb.TxOut[0].Pk_script, pk_script) {
+		t.Error("Bad coinbase output")
+	}
+
+	ch := new(chain.Chain)
+	ch.Consensus.BIP34Height = 1
+	if j.commitment != nil {
+		ch.Consensus.Enforce_SEGWIT = 1
+	}
+	bl.Height = uint32(tmpl.Height)
+	bl.MedianPastTime = uint32(tmpl.Curtime)
+	if er = ch.PostCheckBlock(bl); er != nil {
+		t.Fatal(er)
+	}
+	return bl
+}
+
+func TestMine(t *testing.T) {
+	bl := mineTemplate(t, []string{"csv", "!segwit"}, testTx, testSegwitTx)
+	cb := bl.Txs[0]
+	if len(cb.TxOut) != 2 || len(cb.SegWit) != 1 || !bytes.HasPrefix(cb.TxOut[1].Pk_script, []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}) {
+		t.Error("No witness commitment")
+	}
+
+	bl = mineTemplate(t, []string{"csv"}, testTx)
+	if cb = bl.Txs[0]; len(cb.TxOut) != 1 || cb.SegWit != nil {
+		t.Error("Witness commitment without segwit")
+	}
+}
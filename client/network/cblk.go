@@ -291,9 +291,9 @@ func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
 
 	var cnt_found int
 
-	TxMutex.Lock()
+	TxPool.Lock()
 
-	for _, v := range TransactionsToSend {
+	for _, v := range TxPool.TransactionsToSend {
 		var hash2take *btc.Uint256
 		if c.Node.SendCmpctVer == 2 {
 			hash2take = v.Tx.WTxID()
@@ -312,7 +312,7 @@ func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
 		}
 	}
 
-	for _, v := range TransactionsRejected {
+	for _, v := range TxPool.TransactionsRejected {
 		if v.Tx == nil {
 			continue
 		}
@@ -338,7 +338,7 @@ func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
 	var msg *bytes.Buffer
 
 	missing := len(shortids) - cnt_found
-	//fmt.Println(c.ConnID, c.Node.SendCmpctVer, "ShortIDs", cnt_found, "/", shortidscnt, "  Prefilled", prefilledcnt, "  Missing", missing, "  MemPool:", len(TransactionsToSend))
+	//fmt.Println(c.ConnID, c.Node.SendCmpctVer, "ShortIDs", cnt_found, "/", shortidscnt, "  Prefilled", prefilledcnt, "  Missing", missing, "  MemPool:", len(TxPool.TransactionsToSend))
 	col.Missing = missing
 	if missing > 0 {
 		msg = new(bytes.Buffer)
@@ -370,7 +370,7 @@ func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
 			shortidx_idx += 6
 		}
 	}
-	TxMutex.Unlock()
+	TxPool.Unlock()
 
 	if missing == 0 {
 		//sta := time.Now()
@@ -402,7 +402,7 @@ func (c *OneConnection) ProcessCmpctBlock(pl []byte) {
 		orb := &OneReceivedBlock{TmStart: b2g.Started, TmPreproc: time.Now(), FromConID: c.ConnID, DoInvs: b2g.SendInvs}
 		ReceivedBlocks[bidx] = orb
 		DelB2G(bidx) //remove it from BlocksToGet if no more pending downloads
-		if c.X.Authorized {
+		if c.Trusted(TRUST_BLOCKS) {
 			b2g.Block.Trusted = true
 		}
 		NetBlocks <- &BlockRcvd{Conn: c, Block: b2g.Block, BlockTreeNode: b2g.BlockTreeNode, OneReceivedBlock: orb}
@@ -541,7 +541,7 @@ func (c *OneConnection) ProcessBlockTxn(pl []byte) {
 	orb := &OneReceivedBlock{TmStart: b2g.Started, TmPreproc: b2g.TmPreproc,
 		TmDownload: c.LastMsgTime, TxMissing: col.Missing, FromConID: c.ConnID, DoInvs: b2g.SendInvs}
 	ReceivedBlocks[idx] = orb
-	if c.X.Authorized {
+	if c.Trusted(TRUST_BLOCKS) {
 		b2g.Block.Trusted = true
 	}
 	NetBlocks <- &BlockRcvd{Conn: c, Block: b2g.Block, BlockTreeNode: b2g.BlockTreeNode, OneReceivedBlock: orb}
@@ -5,14 +5,17 @@ import (
 	"net"
 	"time"
 	"sync"
+	"sort"
 	"bytes"
 	"errors"
 	"strings"
 	"sync/atomic"
 	"crypto/rand"
+	"crypto/cipher"
 	"encoding/hex"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 )
@@ -55,6 +58,13 @@ const (
 	InvsFlushPeriod = 10*time.Millisecond // send all the pending invs to the peer not more often than this
 
 	MAX_GETMP_TXS = 1e6
+
+	MAX_PACKAGE_COUNT = 25 // BIP331: max number of txs in ancestor package
+	MAX_PACKAGE_INFO_ASKED = 100 // max number of pending ancpkginfo requests per peer
+
+	ORPHAN_FLOOD_PERIOD = time.Minute // period of counting the txs with missing inputs above the peer's limit
+	ORPHAN_FLOOD_MAX = 100 // if the peer sends more of them within the period, it is clearly flooding us
+	ORPHAN_FLOOD_SCORE = 100 // misbehave score for each such period
 )
 
 
@@ -62,6 +72,7 @@ var (
 	Mutex_net sync.Mutex
 	OpenCons map[uint64]*OneConnection = make(map[uint64]*OneConnection)
 	InConsActive, OutConsActive uint32
+	BlockRelayConsActive uint32 // included in OutConsActive
 	LastConnId uint32
 	nonce [8]byte
 
@@ -90,6 +101,12 @@ type NetworkNodeStruct struct {
 	// BIP152:
 	SendCmpctVer uint64
 	HighBandwidth bool
+
+	// BIP339:
+	WTxIDRelay bool
+
+	// BIP331 (experimental):
+	SendPackages bool
 }
 
 type ConnectionStatus struct {
@@ -99,6 +116,8 @@ type ConnectionStatus struct {
 	LastBtsRcvd, LastBtsSent uint32
 	LastCmdRcvd, LastCmdSent string
 	LastDataGot time.Time // if we have no data for some time, we abort this conenction
+	VerackReceived bool
+	BlockRelayOnly bool // outgoing connection used only for blocks (no txs, no addrs)
 	OurGetAddrDone bool // Whether we shoudl issue another "getaddr"
 
 	AllHeadersReceived bool // keep sending getheaders until this is not set
@@ -132,6 +151,8 @@ type ConnectionStatus struct {
 	Authorized bool
 	AuthMsgGot uint
 	AuthAckGot bool
+	Trust byte // trust level of the auth key used by the peer
+	Encrypted bool // the peer has switched to the encrypted channel
 
 	LastMinFeePerKByte uint64
 
@@ -170,6 +191,7 @@ type OneConnection struct {
 	broken bool // flag that the conenction has been broken / shall be disconnected
 	why_disconnected string
 	banit bool // Ban this client after disconnecting
+	banreason string
 	misbehave int // When it reaches 1000, ban it
 
 	net.Conn
@@ -221,13 +243,33 @@ type OneConnection struct {
 	txsCha chan int
 	txsNxt time.Time
 
+	// txs with missing inputs above the peer's limit, received since orphansNxt-ORPHAN_FLOOD_PERIOD
+	orphansOver int
+	orphansNxt time.Time
+
 	writing_thread_done sync.WaitGroup
 	writing_thread_push chan bool
 
 	GetMP chan bool
+
+	// BIP331 package relay state (protected by TxPool's mutex):
+	pkg struct {
+		InfoAsked map[BIDX]time.Time // wtxids for which we have sent getdata(MSG_ANCPKGINFO)
+		Wtxids []*btc.Uint256 // ancestor package being downloaded (parents first, child last)
+		Asked map[BIDX]bool // which of the Wtxids have been requested with getpkgtxns
+	}
+
+	// Encrypted channel with a friend (see friends.go):
+	enc struct {
+		authkey []byte // the peer's auth key (from friends.txt)
+		ephemeral, eph_pub []byte // our ephemeral key pair
+		peer_eph []byte // the peer's ephemeral public key
+		send, recv cipher.AEAD
+		send_cnt, recv_cnt uint64
+	}
 }
 
-type BIDX [btc.Uint256IdxLen]byte
+type BIDX = mempool.BIDX
 
 type oneBlockDl struct {
 	hash *btc.Uint256
@@ -332,11 +374,16 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 	}*/
 
 	if !c.broken {
+		raw_cmd, raw_pl := cmd, pl
+		if c.enc.send != nil {
+			raw_cmd, raw_pl = "encmsg", c.seal(cmd, pl)
+		}
+
 		// we never allow the buffer to be totally full because then producer would be equal consumer
-		if bytes_left := SendBufSize - c.BytesToSent(); bytes_left <= len(pl) + 24 {
+		if bytes_left := SendBufSize - c.BytesToSent(); bytes_left <= len(raw_pl) + 24 {
 			c.Mutex.Unlock()
 			println(c.PeerAddr.Ip(), c.Node.Version, c.Node.Agent, "Peer Send Buffer Overflow @",
-				cmd, bytes_left, len(pl)+24, c.SendBufProd, c.SendBufCons, c.BytesToSent())
+				cmd, bytes_left, len(raw_pl)+24, c.SendBufProd, c.SendBufCons, c.BytesToSent())
 			c.Disconnect("SendBufferOverflow")
 			common.CountSafe("PeerSendOverflow")
 			return errors.New("Send buffer overflow")
@@ -354,14 +401,14 @@ func (c *OneConnection) SendRawMsg(cmd string, pl []byte) (e error) {
 
 		binary.LittleEndian.PutUint32(sbuf[0:4], common.Version)
 		copy(sbuf[0:4], common.Magic[:])
-		copy(sbuf[4:16], cmd)
-		binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(pl)))
+		copy(sbuf[4:16], raw_cmd)
+		binary.LittleEndian.PutUint32(sbuf[16:20], uint32(len(raw_pl)))
 
-		sh := btc.Sha2Sum(pl[:])
+		sh := btc.Sha2Sum(raw_pl[:])
 		copy(sbuf[20:24], sh[:4])
 
 		c.append_to_send_buffer(sbuf[:])
-		c.append_to_send_buffer(pl)
+		c.append_to_send_buffer(raw_pl)
 
 		if x:=c.BytesToSent(); x>c.X.MaxSentBufSize {
 			c.X.MaxSentBufSize = x
@@ -422,6 +469,7 @@ func (c *OneConnection) DoS(why string) {
 		print("BAN " + c.PeerAddr.Ip() + " (" + c.Node.Agent + ") because " + why + "\n> ")
 	}
 	c.banit = true
+	c.banreason = why
 	c.broken = true
 	c.Mutex.Unlock()
 }
@@ -435,10 +483,12 @@ func (c *OneConnection) Misbehave(why string, how_much int) (res bool) {
 	if !c.banit {
 		common.CountSafe("Bad"+why)
 		c.misbehave += how_much
+		c.PeerAddr.NoteMisbehave(how_much)
 		if c.misbehave >= 1000 {
 			common.CountSafe("BanMisbehave")
 			res = true
 			c.banit = true
+			c.banreason = "Misbehave:" + why
 			c.broken = true
 			//print("Ban " + c.PeerAddr.Ip() + " (" + c.Node.Agent + ") because " + why + "\n> ")
 		}
@@ -490,7 +540,7 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 			}
 			c.Mutex.Unlock()
 			common.CountSafe("NetBadMagic")
-			c.Ban()
+			c.Ban("BadMagic")
 			return
 		}
 		if c.broken {
@@ -570,6 +620,14 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 	c.recv.hdr_len = 0
 	c.recv.cmd = ""
 	c.recv.dat = nil
+	c.Mutex.Unlock()
+
+	if !c.openEncMsg(ret) {
+		ret = nil
+		return
+	}
+
+	c.Mutex.Lock()
 
 	c.counters["rcvd_"+ret.cmd]++
 	c.counters["rbts_"+ret.cmd] += uint64(len(ret.pl))
@@ -591,7 +649,7 @@ func (c *OneConnection) FetchMessage() (ret *BCmsg, timeout_or_data bool) {
 
 
 func (c *OneConnection) GetMPNow() {
-	if c.X.Authorized && common.GetBool(&common.CFG.TXPool.Enabled) {
+	if c.Trusted(TRUST_MEMPOOL) && common.GetBool(&common.CFG.TXPool.Enabled) {
 		select {
 			case c.GetMP <- true:
 			default:
@@ -650,6 +708,78 @@ func ConnectionActive(ad *peersdb.PeerAddr) (yes bool) {
 }
 
 
+// NoTxRelay returns true if we told the peer not to send us any transactions.
+func (c *OneConnection) NoTxRelay() bool {
+	return c.X.BlockRelayOnly || common.GetBool(&common.CFG.Net.BlocksOnly) ||
+		!common.GetBool(&common.CFG.TXPool.Enabled)
+}
+
+
+// txRelayViolated should be called when the peer sends us tx data after we asked it not to.
+// It returns true if the peer got disconnected.
+func (c *OneConnection) txRelayViolated(what string) bool {
+	if !c.X.BlockRelayOnly && !common.GetBool(&common.CFG.Net.BlocksOnly) || c.X.Authorized {
+		return false
+	}
+	common.CountSafe("TxRelayViolated" + what)
+	c.Disconnect("Unsolicited" + what)
+	return true
+}
+
+
+// OutboundGroups returns the network groups of all the outgoing connections.
+func OutboundGroups() (res map[uint16]bool) {
+	res = make(map[uint16]bool)
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if !v.X.Incomming {
+			res[peersdb.Group(v.PeerAddr.Ip4)] = true
+		}
+	}
+	Mutex_net.Unlock()
+	return
+}
+
+
+// SaveAnchors passes the longest living outgoing connections to peersdb,
+// so we could reconnect to them after restart.
+func SaveAnchors() {
+	var ads, brads []*peersdb.PeerAddr
+	var tms, brtms []time.Time
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		v.Mutex.Lock()
+		if !v.X.Incomming && v.X.VersionReceived && !v.X.IsSpecial && !v.PeerAddr.Friend {
+			if v.X.BlockRelayOnly {
+				brads = append(brads, v.PeerAddr)
+				brtms = append(brtms, v.X.ConnectedAt)
+			} else {
+				ads = append(ads, v.PeerAddr)
+				tms = append(tms, v.X.ConnectedAt)
+			}
+		}
+		v.Mutex.Unlock()
+	}
+	Mutex_net.Unlock()
+	// the block-relay-only connections go first
+	sort.Sort(byConnTime{brads, brtms})
+	sort.Sort(byConnTime{ads, tms})
+	peersdb.SetAnchors(append(brads, ads...))
+}
+
+type byConnTime struct {
+	ads []*peersdb.PeerAddr
+	tms []time.Time
+}
+
+func (b byConnTime) Len() int           { return len(b.ads) }
+func (b byConnTime) Less(i, j int) bool { return b.tms[i].Before(b.tms[j]) }
+func (b byConnTime) Swap(i, j int) {
+	b.ads[i], b.ads[j] = b.ads[j], b.ads[i]
+	b.tms[i], b.tms[j] = b.tms[j], b.tms[i]
+}
+
+
 // maxmsgsize returns maximum accepted payload size of a given type of message.
 // For wider compatibility, we assume that any var_len may be up to 9 bytes.
 func maxmsgsize(cmd string) uint32 {
@@ -667,6 +797,12 @@ func maxmsgsize(cmd string) uint32 {
 		case "blocktxn": return 4e6 // all txs that can fit withing max size block
 		case "notfound": return 9+50000*36 // same as maximum size of getdata
 		case "getmp": return 9+8*MAX_GETMP_TXS
+		case "sendpackages": return 8
+		case "ancpkginfo": return 9+MAX_PACKAGE_COUNT*32
+		case "getpkgtxns": return 9+MAX_PACKAGE_COUNT*32
+		case "pkgtxns": return 9+MAX_PACKAGE_COUNT*500e3 // up to 25 max size txs
+		case "pushmp": return 9+MAX_PUSHMP_SIZE+500e3 // the last tx may go over MAX_PUSHMP_SIZE
+		case "encmsg": return 12+16+9+MAX_PACKAGE_COUNT*500e3 // cmd and tag + the biggest message (pkgtxns)
 		default: return 1024 // Any other type of block: maximum 1KB payload limit
 	}
 }
@@ -677,6 +813,7 @@ func NetCloseAll() {
 	println("Closing network")
 	common.NetworkClosed.Set()
 	common.SetBool(&common.ListenTCP, false)
+	SaveAnchors()
 	Mutex_net.Lock()
 	if InConsActive > 0 || OutConsActive > 0 {
 		for _, v := range OpenCons {
@@ -724,6 +861,20 @@ func DropPeer(conid uint32) {
 }
 
 
+// DropSubnet disconnects all the peers from the given subnet.
+func DropSubnet(n *net.IPNet) (cnt int) {
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if n.Contains(net.IP(v.PeerAddr.Ip4[:])) {
+			v.Disconnect("Banned")
+			cnt++
+		}
+	}
+	Mutex_net.Unlock()
+	return
+}
+
+
 func GetMP(conid uint32) {
 	Mutex_net.Lock()
 	for _, v := range OpenCons {
@@ -6,10 +6,22 @@ import (
 	"io/ioutil"
 	"encoding/binary"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/client/common"
 )
 
 
+// blockTooDeep returns true if the block is not within the last MIN_BLOCKS_TO_KEEP of the chain.
+func blockTooDeep(hash *btc.Uint256) bool {
+	common.BlockChain.BlockIndexAccess.Lock()
+	node := common.BlockChain.BlockIndex[hash.BIdx()]
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if node == nil {
+		return true
+	}
+	return node.Height+chain.MIN_BLOCKS_TO_KEEP < common.Last.BlockHeight()
+}
+
 func (c *OneConnection) ProcessGetData(pl []byte) {
 	//var notfound []byte
 
@@ -58,6 +70,12 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 				common.CountSafe("GetdataBlockSw")
 			}
 			hash := btc.NewUint256(h[4:])
+			if common.BlockChain.Blocks.Pruning() && blockTooDeep(hash) {
+				// NODE_NETWORK_LIMITED - we do not serve the blocks below the last 288
+				common.CountSafe("GetdataPruned")
+				c.Disconnect("GetdataPruned")
+				return
+			}
 			crec, _, er := common.BlockChain.Blocks.BlockGetExt(hash)
 
 			if er == nil {
@@ -78,6 +96,9 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 				//fmt.Println("BlockGetExt-2 failed for", hash.String(), er.Error())
 				//notfound = append(notfound, h[:]...)
 			}
+		} else if (typ == MSG_TX || typ == MSG_WITNESS_TX || typ == MSG_WTX) && c.NoTxRelay() && !c.X.Authorized {
+			// block-relay-only connection or BlocksOnly mode - no txs in either direction
+			common.CountSafe("GetdataTxNoRelay")
 		} else if typ == MSG_TX || typ == MSG_WITNESS_TX {
 			if typ == MSG_TX {
 				common.CountSafe("GetdataTx")
@@ -85,20 +106,38 @@ func (c *OneConnection) ProcessGetData(pl []byte) {
 				common.CountSafe("GetdataTxSw")
 			}
 			// ransaction
-			TxMutex.Lock()
-			if tx, ok := TransactionsToSend[btc.NewUint256(h[4:]).BIdx()]; ok && tx.Blocked==0 {
+			TxPool.Lock()
+			if tx, ok := TxPool.TransactionsToSend[btc.NewUint256(h[4:]).BIdx()]; ok && tx.Blocked==0 {
 				tx.SentCnt++
 				tx.Lastsent = time.Now()
-				TxMutex.Unlock()
+				TxPool.Unlock()
 				if tx.SegWit==nil || typ==MSG_WITNESS_TX {
 					c.SendRawMsg("tx", tx.Raw)
 				} else {
 					c.SendRawMsg("tx", tx.Serialize())
 				}
 			} else {
-				TxMutex.Unlock()
+				TxPool.Unlock()
 				//notfound = append(notfound, h[:]...)
 			}
+		} else if typ == MSG_WTX {
+			common.CountSafe("GetdataWTx")
+			TxPool.Lock()
+			if tx := TxPool.TxByWTxID(btc.NewUint256(h[4:]).BIdx()); tx != nil && tx.Blocked == 0 {
+				tx.SentCnt++
+				tx.Lastsent = time.Now()
+				TxPool.Unlock()
+				c.SendRawMsg("tx", tx.Raw)
+			} else {
+				TxPool.Unlock()
+			}
+		} else if typ == MSG_ANCPKGINFO {
+			common.CountSafe("GetdataAncPkg")
+			if !c.Node.SendPackages {
+				c.DoS("GetdataAncPkgNS")
+				break
+			}
+			c.SendAncPkgInfo(btc.NewUint256(h[4:]))
 		} else if typ == MSG_CMPCT_BLOCK {
 			common.CountSafe("GetdataCmpctBlk")
 			if !c.SendCmpctBlk(btc.NewUint256(h[4:])) {
@@ -177,7 +216,7 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 
 	//println("block", b2g.BlockTreeNode.Height," len", len(b), " got from", conn.PeerAddr.Ip(), b2g.InProgress)
 	b2g.Block.Raw = b
-	if conn.X.Authorized {
+	if conn.Trusted(TRUST_BLOCKS) {
 		b2g.Block.Trusted = true
 	}
 
@@ -219,6 +258,7 @@ func netBlockReceived(conn *OneConnection, b []byte) {
 		orb.TxMissing = -1
 	}
 	conn.blocksreceived = append(conn.blocksreceived, time.Now())
+	conn.PeerAddr.NoteBlock()
 	conn.Mutex.Unlock()
 
 	ReceivedBlocks[idx] = orb
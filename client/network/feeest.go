@@ -0,0 +1,60 @@
+package network
+
+import (
+	"os"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+const (
+	FEEEST_FILE_NAME = "feeest.gob"
+)
+
+var (
+	// Tracks confirmation times of the mempool txs (see lib/mempool/estimator.go)
+	FeeEst = mempool.NewFeeEstimator()
+)
+
+// EstimateFee returns the fee (in SPB) needed to confirm within the target number of blocks,
+// and the target for which the estimate was actually found (zero if none).
+// The result is never lower than the current mempool minimum fee.
+func EstimateFee(target int, conservative bool) (spb float64, blocks int) {
+	if spb, blocks = FeeEst.EstimateSmartFee(target, conservative); blocks > 0 {
+		if min := float64(common.MinFeePerKB()) / 1000.0; spb < min {
+			spb = min
+		}
+	}
+	return
+}
+
+func FeeEstLoad() {
+	if er := FeeEst.Load(common.GocoinHomeDir + FEEEST_FILE_NAME); er != nil && !os.IsNotExist(er) {
+		println("FeeEstLoad:", er.Error())
+	}
+}
+
+func FeeEstSave() {
+	if er := FeeEst.Save(common.GocoinHomeDir + FEEEST_FILE_NAME); er != nil {
+		println("FeeEstSave:", er.Error())
+	}
+}
+
+func init() {
+	TxPool.OnAdded = func(t2s *mempool.OneTxToSend) {
+		// txs seen while catching up with the chain would give false confirmation times
+		if common.GetBool(&common.BlockChainSynchronized) {
+			FeeEst.TxAdded(t2s)
+		}
+	}
+	TxPool.OnMined = func(t2s *mempool.OneTxToSend, bl *btc.Block) {
+		FeeEst.TxMined(t2s, bl.Height)
+	}
+	TxPool.OnRemoved = func(t2s *mempool.OneTxToSend, reason byte) {
+		FeeEst.TxRemoved(t2s)
+	}
+	TxPool.OnReplaced = func(old, t2s *mempool.OneTxToSend) {
+		FeeEst.TxRemoved(old)
+	}
+}
@@ -0,0 +1,249 @@
+package network
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/secp256k1"
+)
+
+// Friends authenticate each other with "auth" / "authack" messages, signed with the keys from friends.txt.
+// Then both sides send "encinit" with an ephemeral public key and from there on every message
+// is sent inside "encmsg", encrypted with AES-256-GCM. The keys are derived (Noise KK style) from
+// the DH of the ephemeral and the static (auth) keys of both sides, so only the friend can read it.
+// Friend's privileges (trust levels) are only granted over the encrypted channel.
+
+// Trust levels of the auth keys, set in friends.txt as: @<base58 pubkey> [relay|mempool|blocks]
+// Each level includes the privileges of the lower ones.
+const (
+	TRUST_RELAY   = 1 // encrypted connection only, the txs and blocks are verified as usual
+	TRUST_MEMPOOL = 2 // share mempools (getmp / pushmp), accept its txs without verifying the scripts
+	TRUST_BLOCKS  = 3 // also accept its blocks without verifying the scripts (default)
+
+	MAX_PUSHMP_SIZE = 1e6 // when to stop adding more txs to a single "pushmp" message
+)
+
+var TrustNames = []string{"none", "relay", "mempool", "blocks"}
+
+type AuthKey struct {
+	Pubkey []byte
+	Trust  byte
+}
+
+// ParseTrust returns the trust level of the given name, or zero for an unknown name.
+func ParseTrust(s string) byte {
+	for i := TRUST_RELAY; i < len(TrustNames); i++ {
+		if strings.EqualFold(s, TrustNames[i]) {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+// Trusted returns true if the peer has authenticated itself with a key of at least
+// the given trust level and talks to us over the encrypted channel.
+func (c *OneConnection) Trusted(level byte) bool {
+	return c.X.Encrypted && c.X.Trust >= level
+}
+
+// StartEncryption sends "encinit" once both sides have accepted each other's auth.
+func (c *OneConnection) StartEncryption() {
+	if !c.X.Authorized || !c.X.AuthAckGot || c.enc.ephemeral != nil {
+		return
+	}
+	c.enc.ephemeral = make([]byte, 32)
+	rand.Read(c.enc.ephemeral)
+	c.enc.eph_pub = make([]byte, 33)
+	secp256k1.BaseMultiply(c.enc.ephemeral, c.enc.eph_pub)
+	c.SendRawMsg("encinit", c.enc.eph_pub)
+	c.deriveKeys()
+}
+
+// ProcessEncInit handles "encinit" message, carrying the peer's ephemeral public key.
+func (c *OneConnection) ProcessEncInit(pl []byte) {
+	if !c.X.Authorized || len(pl) != 33 || c.enc.peer_eph != nil {
+		c.DoS("EncInitBad")
+		return
+	}
+	c.enc.peer_eph = append([]byte{}, pl...)
+	c.StartEncryption()
+	c.deriveKeys()
+}
+
+// deriveKeys sets up the ciphers after "encinit" has been both sent and received.
+func (c *OneConnection) deriveKeys() {
+	if c.enc.ephemeral == nil || c.enc.peer_eph == nil || c.enc.recv != nil {
+		return
+	}
+	var ee, es, se, ss [33]byte
+	if !secp256k1.Multiply(c.enc.peer_eph, c.enc.ephemeral, ee[:]) ||
+		!secp256k1.Multiply(c.enc.authkey, c.enc.ephemeral, es[:]) ||
+		!secp256k1.Multiply(c.enc.peer_eph, common.SecretKey, se[:]) ||
+		!secp256k1.Multiply(c.enc.authkey, common.SecretKey, ss[:]) {
+		c.DoS("EncInitKey")
+		return
+	}
+	c.enc.ephemeral = nil
+
+	// Outgoing connection is the initiator
+	e_i, e_r := c.enc.eph_pub, c.enc.peer_eph
+	s_i, s_r := btc.PublicFromPrivate(common.SecretKey, true), c.enc.authkey
+	if c.X.Incomming {
+		e_i, e_r, s_i, s_r = e_r, e_i, s_r, s_i
+		es, se = se, es
+	}
+	h := sha256.New()
+	h.Write([]byte("gocoin-friend-v1"))
+	for _, d := range [][]byte{e_i, e_r, s_i, s_r, ee[1:], es[1:], se[1:], ss[1:]} {
+		h.Write(d)
+	}
+	key := h.Sum(nil)
+
+	i2r, r2i := new_aead(key, 'i'), new_aead(key, 'r')
+	c.Mutex.Lock()
+	if c.X.Incomming {
+		c.enc.send, c.enc.recv = r2i, i2r
+	} else {
+		c.enc.send, c.enc.recv = i2r, r2i
+	}
+	c.Mutex.Unlock()
+}
+
+func new_aead(key []byte, dir byte) cipher.AEAD {
+	k := sha256.Sum256(append(append([]byte{}, key...), dir))
+	bl, _ := aes.NewCipher(k[:])
+	aead, _ := cipher.NewGCM(bl)
+	return aead
+}
+
+func enc_nonce(cnt uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], cnt)
+	return nonce
+}
+
+// seal encrypts the message into the "encmsg" payload. Call it with c.Mutex locked.
+func (c *OneConnection) seal(cmd string, pl []byte) []byte {
+	msg := make([]byte, 12+len(pl), 12+len(pl)+c.enc.send.Overhead())
+	copy(msg[:12], cmd)
+	copy(msg[12:], pl)
+	c.enc.send_cnt++
+	return c.enc.send.Seal(msg[:0], enc_nonce(c.enc.send_cnt), msg, nil)
+}
+
+// openEncMsg decrypts "encmsg" in place. Once the peer has started encrypting,
+// any cleartext message is a protocol violation. Returns false on error.
+func (c *OneConnection) openEncMsg(msg *BCmsg) bool {
+	if msg.cmd != "encmsg" {
+		if c.X.Encrypted {
+			c.DoS("EncPlaintext")
+			return false
+		}
+		return true
+	}
+	if c.enc.recv == nil {
+		c.DoS("EncNotReady")
+		return false
+	}
+	c.enc.recv_cnt++
+	pl, er := c.enc.recv.Open(msg.pl[:0], enc_nonce(c.enc.recv_cnt), msg.pl, nil)
+	if er != nil || len(pl) < 12 {
+		c.DoS("EncBadMsg")
+		return false
+	}
+	msg.cmd = strings.TrimRight(string(pl[:12]), "\000")
+	msg.pl = pl[12:]
+	if uint32(len(msg.pl)) > maxmsgsize(msg.cmd) {
+		c.DoS("Big-" + msg.cmd)
+		return false
+	}
+	if !c.X.Encrypted {
+		c.Mutex.Lock()
+		c.X.Encrypted = true
+		c.Mutex.Unlock()
+		common.CountSafe("FriendEncrypted")
+		c.GetMPNow()
+	}
+	return true
+}
+
+// SendPushMP sends the txs from our mempool to a friend, inside "pushmp" messages.
+func (c *OneConnection) SendPushMP() (cnt int) {
+	if !c.Trusted(TRUST_MEMPOOL) {
+		return
+	}
+	var n int
+	b := new(bytes.Buffer)
+	flush := func() {
+		if n > 0 {
+			msg := new(bytes.Buffer)
+			btc.WriteVlen(msg, uint64(n))
+			msg.Write(b.Bytes())
+			c.SendRawMsg("pushmp", msg.Bytes())
+			b.Reset()
+			n = 0
+		}
+	}
+	TxPool.Lock()
+	for _, v := range TxPool.TransactionsToSend {
+		if c.BytesToSent() > SendBufSize/4 {
+			break
+		}
+		b.Write(v.Raw)
+		n++
+		cnt++
+		if b.Len() >= MAX_PUSHMP_SIZE {
+			flush()
+		}
+	}
+	flush()
+	TxPool.Unlock()
+	return
+}
+
+// ProcessPushMP handles "pushmp" message - a set of unconfirmed txs from a friend.
+func (c *OneConnection) ProcessPushMP(pl []byte) {
+	if !c.Trusted(TRUST_MEMPOOL) {
+		common.CountSafe("PushMPUntrusted")
+		return
+	}
+	br := bytes.NewReader(pl)
+	cnt, er := btc.ReadVLen(br)
+	if er != nil {
+		c.DoS("PushMPError1")
+		return
+	}
+	offs := len(pl) - br.Len()
+	for i := 0; i < int(cnt); i++ {
+		tx, le := btc.NewTx(pl[offs:])
+		if tx == nil {
+			c.DoS("PushMPError2")
+			return
+		}
+		if common.AcceptTx() {
+			c.ParseTxNet(append([]byte{}, pl[offs:offs+le]...))
+		}
+		offs += le
+	}
+	common.CountSafeAdd("PushMPTxs", cnt)
+}
+
+// PushMP sends our mempool to the friend with the given connection ID.
+func PushMP(conid uint32) (cnt int, ok bool) {
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if conid == v.ConnID {
+			Mutex_net.Unlock()
+			return v.SendPushMP(), v.Trusted(TRUST_MEMPOOL)
+		}
+	}
+	Mutex_net.Unlock()
+	return
+}
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+// testFriend is one end of a friend connection, with its own static (auth) key.
+// Both ends live in the same process, so common.SecretKey gets set for the end that acts.
+type testFriend struct {
+	*OneConnection
+	key []byte
+}
+
+func newTestFriend(t *testing.T, conn net.Conn, incomming bool, name string) *testFriend {
+	k := sha256.Sum256([]byte(name))
+	f := &testFriend{OneConnection: newTestConn(t, conn, incomming), key: k[:]}
+	f.Node.Nonce = nonce // the auth is signed with the peer's nonce
+	return f
+}
+
+func (f *testFriend) pubkey() []byte {
+	return btc.PublicFromPrivate(f.key, true)
+}
+
+// recv returns the next message received by f (nil if none or the connection got broken).
+func (f *testFriend) recv() *BCmsg {
+	return recvMsg(f.OneConnection)
+}
+
+// handle receives the next message and processes it like the connection's loop does.
+func (f *testFriend) handle(t *testing.T, exp string) {
+	common.SecretKey = f.key
+	msg := f.recv()
+	if msg == nil || msg.cmd != exp {
+		t.Fatal(f.ConnID, "expected", exp, "got", msg)
+	}
+	switch msg.cmd {
+	case "auth":
+		f.AuthRvcd(msg.pl)
+		f.StartEncryption()
+	case "authack":
+		f.X.AuthAckGot = true
+		f.StartEncryption()
+	case "encinit":
+		f.ProcessEncInit(msg.pl)
+	}
+}
+
+// frame returns the raw "encmsg" frame of the given message, sealed by f.
+func (f *testFriend) frame(cmd string, pl []byte) []byte {
+	f.Mutex.Lock()
+	epl := f.seal(cmd, pl)
+	f.Mutex.Unlock()
+	hdr := make([]byte, 24, 24+len(epl))
+	copy(hdr[0:4], common.Magic[:])
+	copy(hdr[4:16], "encmsg")
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(len(epl)))
+	sh := btc.Sha2Sum(epl)
+	copy(hdr[20:24], sh[:4])
+	return append(hdr, epl...)
+}
+
+// friendPair sets up the friends' keys and returns both ends of a connection, after the auth.
+// If known_b is false, a does not know b's key.
+func friendPair(t *testing.T, known_b bool) (a, b *testFriend) {
+	sec, last, keys := common.SecretKey, common.Last.Block, AuthPubkeys
+	t.Cleanup(func() {
+		common.SecretKey, common.Last.Block, AuthPubkeys = sec, last, keys
+	})
+	common.Last.Block = &chain.BlockTreeNode{BlockHash: btc.NewUint256(make([]byte, 32))} // for the auth
+
+	ca, cb := net.Pipe()
+	a = newTestFriend(t, ca, false, "a")
+	b = newTestFriend(t, cb, true, "b")
+	c := &testFriend{key: make([]byte, 32)}
+	c.key[31] = 1
+
+	AuthPubkeys = []*AuthKey{{Pubkey: a.pubkey(), Trust: TRUST_BLOCKS}, {Pubkey: c.pubkey(), Trust: TRUST_BLOCKS}}
+	if known_b {
+		AuthPubkeys = append(AuthPubkeys, &AuthKey{Pubkey: b.pubkey(), Trust: TRUST_RELAY})
+	}
+
+	common.SecretKey = a.key
+	a.SendAuth()
+	common.SecretKey = b.key
+	b.SendAuth()
+	b.handle(t, "auth")
+	a.handle(t, "auth")
+	return
+}
+
+func TestFriendChannel(t *testing.T) {
+	a, b := friendPair(t, true)
+	a.handle(t, "authack")
+	b.handle(t, "authack")
+	b.handle(t, "encinit")
+	a.handle(t, "encinit")
+	if a.enc.send == nil || b.enc.send == nil {
+		t.Fatal("Encryption not started")
+	}
+	if a.Trusted(TRUST_RELAY) || b.Trusted(TRUST_RELAY) {
+		t.Error("Trusted before the first encrypted message")
+	}
+
+	// the keys derived by both sides match and differ for each direction
+	msg := []byte("hello friend")
+	nc := enc_nonce(1000)
+	if pl, er := b.enc.recv.Open(nil, nc, a.enc.send.Seal(nil, nc, msg, nil), nil); er != nil || !bytes.Equal(pl, msg) {
+		t.Error("a -> b keys mismatch")
+	}
+	if pl, er := a.enc.recv.Open(nil, nc, b.enc.send.Seal(nil, nc, msg, nil), nil); er != nil || !bytes.Equal(pl, msg) {
+		t.Error("b -> a keys mismatch")
+	}
+	if _, er := a.enc.recv.Open(nil, nc, a.enc.send.Seal(nil, nc, msg, nil), nil); er == nil {
+		t.Error("Same keys for both directions")
+	}
+
+	// the traffic in both directions
+	a.SendRawMsg("ping", []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	if m := b.recv(); m == nil || m.cmd != "ping" || !bytes.Equal(m.pl, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatal("Bad message a -> b", m)
+	}
+	b.SendRawMsg("pong", []byte{8, 7, 6, 5, 4, 3, 2, 1})
+	if m := a.recv(); m == nil || m.cmd != "pong" || !bytes.Equal(m.pl, []byte{8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Fatal("Bad message b -> a", m)
+	}
+	if !a.X.Encrypted || !b.X.Encrypted {
+		t.Error("Not encrypted")
+	}
+
+	// the privileges follow the trust of the peer's key
+	if !b.Trusted(TRUST_BLOCKS) {
+		t.Error("a not trusted by b")
+	}
+	if !a.Trusted(TRUST_RELAY) || a.Trusted(TRUST_MEMPOOL) {
+		t.Error("Bad trust of b by a")
+	}
+
+	// a replayed frame is rejected
+	f1 := a.frame("ping", []byte{1})
+	go func() {
+		a.Conn.Write(f1)
+		a.Conn.Write(f1)
+	}()
+	if m := b.recv(); m == nil || m.cmd != "ping" {
+		t.Fatal("Frame not received", m)
+	}
+	if m := b.recv(); m != nil || !b.banit || b.banreason != "EncBadMsg" {
+		t.Error("Replayed frame accepted", m, b.banreason)
+	}
+}
+
+func TestFriendReorder(t *testing.T) {
+	a, b := friendPair(t, true)
+	a.handle(t, "authack")
+	b.handle(t, "authack")
+	b.handle(t, "encinit")
+	a.handle(t, "encinit")
+
+	f1, f2 := a.frame("ping", []byte{1}), a.frame("ping", []byte{2})
+	go func() {
+		a.Conn.Write(f2)
+		a.Conn.Write(f1)
+	}()
+	if m := b.recv(); m != nil || !b.banit || b.banreason != "EncBadMsg" {
+		t.Error("Reordered frame accepted", m, b.banreason)
+	}
+}
+
+func TestFriendWrongKey(t *testing.T) {
+	a, b := friendPair(t, false)
+	if a.X.Authorized || !b.X.Authorized {
+		t.Fatal("Bad auth", a.X.Authorized, b.X.Authorized)
+	}
+	// a does not accept b, so it never sends authack and neither side starts the encryption
+	a.handle(t, "authack")
+	if a.enc.ephemeral != nil || a.enc.send != nil || b.enc.ephemeral != nil {
+		t.Error("Encryption started with an unknown key")
+	}
+
+	// and b's attempt to start it anyway gets it banned
+	b.X.AuthAckGot = true
+	common.SecretKey = b.key
+	b.StartEncryption()
+	m := a.recv()
+	if m == nil || m.cmd != "encinit" {
+		t.Fatal("No encinit", m)
+	}
+	common.SecretKey = a.key
+	a.ProcessEncInit(m.pl)
+	if !a.banit || a.banreason != "EncInitBad" || a.enc.send != nil || a.Trusted(TRUST_RELAY) {
+		t.Error("Encryption with an unknown key", a.banreason)
+	}
+}
@@ -17,6 +17,8 @@ const (
 	MSG_TX = 1
 	MSG_BLOCK = 2
 	MSG_CMPCT_BLOCK = 4
+	MSG_WTX = 5 // BIP339
+	MSG_ANCPKGINFO = 6 // BIP331
 	MSG_WITNESS_TX = MSG_TX | MSG_WITNESS_FLAG
 	MSG_WITNESS_BLOCK = MSG_BLOCK | MSG_WITNESS_FLAG
 )
@@ -99,12 +101,28 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 					common.CountSafe("InvBlockOld")
 				}
 			}
+		} else if (typ==MSG_TX || typ==MSG_WTX) && c.NoTxRelay() {
+			if c.txRelayViolated("TxInv") {
+				return
+			}
+			common.CountSafe("InvTxIgnored")
 		} else if typ==MSG_TX {
-			if common.AcceptTx() {
+			if c.Node.WTxIDRelay {
+				// BIP339: after wtxidrelay, the peer shall only announce txs by wtxid
+				common.CountSafe("InvTxIdIgnored")
+			} else if common.AcceptTx() {
 				c.TxInvNotify(pl[of+4:of+36])
 			} else {
 				common.CountSafe("InvTxIgnored")
 			}
+		} else if typ==MSG_WTX {
+			if !c.Node.WTxIDRelay {
+				common.CountSafe("InvWTxIdIgnored")
+			} else if common.AcceptTx() {
+				c.WTxInvNotify(pl[of+4:of+36])
+			} else {
+				common.CountSafe("InvTxIgnored")
+			}
 		}
 		of+= 36
 	}
@@ -115,21 +133,24 @@ func (c *OneConnection) ProcessInv(pl []byte) {
 
 func NetRouteInv(typ uint32, h *btc.Uint256, fromConn *OneConnection) uint32 {
 	var fee_spkb uint64
+	var wtxid *btc.Uint256
 	if typ == MSG_TX {
-		TxMutex.Lock()
-		if tx, ok := TransactionsToSend[h.BIdx()]; ok {
+		TxPool.Lock()
+		if tx, ok := TxPool.TransactionsToSend[h.BIdx()]; ok {
 			fee_spkb = ( 1000 * tx.Fee ) / uint64(tx.VSize())
+			wtxid = tx.WTxID()
 		} else {
 			println("NetRouteInv: txid", h.String(), "not in mempool")
 		}
-		TxMutex.Unlock()
+		TxPool.Unlock()
 	}
-	return NetRouteInvExt(typ, h, fromConn, fee_spkb)
+	return NetRouteInvExt(typ, h, wtxid, fromConn, fee_spkb)
 }
 
 
 // NetRouteInvExt is called from the main thread (or from a UI).
-func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spkb uint64) (cnt uint32) {
+// For MSG_TX, wtxid is used to announce the tx to the peers that did wtxidrelay (BIP339).
+func NetRouteInvExt(typ uint32, h, wtxid *btc.Uint256, fromConn *OneConnection, fee_spkb uint64) (cnt uint32) {
 	common.CountSafe(fmt.Sprint("NetRouteInv", typ))
 
 	// Prepare the inv
@@ -137,6 +158,17 @@ func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spk
 	binary.LittleEndian.PutUint32(inv[0:4], typ)
 	copy(inv[4:36], h.Bytes())
 
+	var winv *[36]byte
+	if typ == MSG_TX {
+		winv = new([36]byte)
+		binary.LittleEndian.PutUint32(winv[0:4], MSG_WTX)
+		if wtxid != nil {
+			copy(winv[4:36], wtxid.Bytes())
+		} else {
+			copy(winv[4:36], h.Bytes())
+		}
+	}
+
 	// Append it to PendingInvs in each open connection
 	Mutex_net.Lock()
 	for _, v := range OpenCons {
@@ -147,6 +179,9 @@ func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spk
 				if v.Node.DoNotRelayTxs {
 					send_inv = false
 					common.CountSafe("SendInvNoTxNode")
+				} else if v.X.BlockRelayOnly {
+					send_inv = false
+					common.CountSafe("SendInvBlockRelay")
 				} else if v.X.MinFeeSPKB>0 && uint64(v.X.MinFeeSPKB)>fee_spkb {
 					send_inv = false
 					common.CountSafe("SendInvFeeTooLow")
@@ -160,11 +195,15 @@ func NetRouteInvExt(typ uint32, h *btc.Uint256, fromConn *OneConnection, fee_spk
 				*/
 			}
 			if send_inv {
+				the_inv := inv
+				if winv != nil && v.Node.WTxIDRelay {
+					the_inv = winv
+				}
 				if len(v.PendingInvs) < 500 {
-					if typ, ok := v.InvDone.Map[hash2invid(inv[4:36])]; ok {
+					if typ, ok := v.InvDone.Map[hash2invid(the_inv[4:36])]; ok {
 						common.CountSafe(fmt.Sprint("SendInvSame-", typ))
 					} else {
-						v.PendingInvs = append(v.PendingInvs, inv)
+						v.PendingInvs = append(v.PendingInvs, the_inv)
 						cnt++
 					}
 				} else {
@@ -34,6 +34,9 @@ func (c *OneConnection) HandlePong(pl []byte) {
 	}
 	c.Mutex.Lock()
 	c.X.PingHistory[c.X.PingHistoryIdx] = int(ms)
+	if pl != nil {
+		c.PeerAddr.NotePing(int(ms))
+	}
 	c.X.PingHistoryIdx = (c.X.PingHistoryIdx+1)%PingHistoryLength
 	c.PingInProgress = nil
 	c.Mutex.Unlock()
@@ -165,8 +168,8 @@ func drop_worst_peer() bool {
 		if v.MinutesOnline < OnlineImmunityMinutes {
 			continue
 		}
-		if v.Special {
-			continue
+		if v.Special || v.Conn.X.BlockRelayOnly {
+			continue // block-relay-only connections are rotated separately
 		}
 		if common.CFG.Net.MinSegwitCons > 0 && segwit_cnt <= int(common.CFG.Net.MinSegwitCons) &&
 			(v.Conn.Node.Services&SERVICE_SEGWIT) != 0 {
@@ -188,7 +191,7 @@ func drop_worst_peer() bool {
 				return true
 			}
 		} else {
-			if OutConsActive+2 > common.GetUint32(&common.CFG.Net.MaxOutCons) {
+			if OutConsActive-BlockRelayConsActive+2 > common.GetUint32(&common.CFG.Net.MaxOutCons) {
 				common.CountSafe("PeerOutDropped")
 				if common.FLAG.Log {
 					f, _ := os.OpenFile("drop_log.txt", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660);
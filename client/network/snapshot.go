@@ -0,0 +1,53 @@
+package network
+
+import (
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+// How many blocks for the background validation of a UTXO snapshot can be in BlocksToGet
+const MAX_SNAPSHOT_BLOCKS_TO_GET = 100
+
+// SnapshotLoaded removes from BlocksToGet the blocks that are below the base of a fresh UTXO snapshot.
+// They will be requested again, by FetchSnapshotBlocks, when the chain gets synchronized.
+func SnapshotLoaded(base *chain.BlockTreeNode) {
+	MutexRcv.Lock()
+	for idx, b2g := range BlocksToGet {
+		if b2g.BlockTreeNode.Height <= base.Height {
+			DelB2G(idx)
+		}
+	}
+	MutexRcv.Unlock()
+}
+
+// FetchSnapshotBlocks adds to BlocksToGet the blocks needed by the background validation of the UTXO snapshot.
+// It only does it once the chain is synchronized, so the tip has always priority.
+func FetchSnapshotBlocks() {
+	sc := common.BlockChain.SnapshotCheck
+	if sc == nil || sc.Done() || !common.GetBool(&common.BlockChainSynchronized) {
+		return
+	}
+	MutexRcv.Lock()
+	defer MutexRcv.Unlock()
+	if len(BlocksToGet) >= MAX_SNAPSHOT_BLOCKS_TO_GET {
+		return
+	}
+	for _, node := range sc.Needed(chain.SNAPSHOT_MAX_PENDING) {
+		if _, ok := BlocksToGet[node.BlockHash.BIdx()]; ok {
+			continue
+		}
+		bl, er := btc.NewBlock(node.BlockHeader[:])
+		if er != nil {
+			continue
+		}
+		bl.Height = node.Height
+		AddB2G(&OneBlockToGet{Started: time.Now(), Block: bl, BlockTreeNode: node})
+		common.CountSafe("SnapshotB2G")
+		if len(BlocksToGet) >= MAX_SNAPSHOT_BLOCKS_TO_GET {
+			break
+		}
+	}
+}
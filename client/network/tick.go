@@ -8,7 +8,6 @@ import (
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
-	"math/rand"
 	"net"
 	"os"
 	"runtime/debug"
@@ -21,8 +20,10 @@ var (
 	next_drop_peer     time.Time
 	next_clean_hammers time.Time
 
+	next_block_relay_rotate time.Time
+
 	NextConnectFriends time.Time = time.Now()
-	AuthPubkeys        [][]byte
+	AuthPubkeys        []*AuthKey
 
 	GetMPInProgressTicket = make(chan bool, 1)
 )
@@ -155,7 +156,7 @@ func (c *OneConnection) Tick(now time.Time) {
 
 	if mfpb := common.MinFeePerKB(); mfpb != c.X.LastMinFeePerKByte {
 		c.X.LastMinFeePerKByte = mfpb
-		if c.Node.Version >= 70013 {
+		if c.Node.Version >= 70013 && !c.NoTxRelay() {
 			c.SendFeeFilter()
 		}
 	}
@@ -166,7 +167,7 @@ func (c *OneConnection) Tick(now time.Time) {
 	}
 
 	// Ask node for new addresses...?
-	if !c.X.OurGetAddrDone && peersdb.PeerDB.Count() < common.MaxPeersNeeded {
+	if !c.X.OurGetAddrDone && !c.X.BlockRelayOnly && peersdb.PeerDB.Count() < common.MaxPeersNeeded {
 		common.CountSafe("AddrWanted")
 		c.SendRawMsg("getaddr", nil)
 		c.X.OurGetAddrDone = true
@@ -199,7 +200,17 @@ func (c *OneConnection) Tick(now time.Time) {
 }
 
 func DoNetwork(ad *peersdb.PeerAddr) {
+	doNetwork(ad, false)
+}
+
+// DoNetworkBlockRelay opens a block-relay-only connection (no txs, no addrs).
+func DoNetworkBlockRelay(ad *peersdb.PeerAddr) {
+	doNetwork(ad, true)
+}
+
+func doNetwork(ad *peersdb.PeerAddr, block_relay_only bool) {
 	conn := NewConnection(ad)
+	conn.X.BlockRelayOnly = block_relay_only
 	Mutex_net.Lock()
 	if _, ok := OpenCons[ad.UniqID()]; ok {
 		common.CountSafe("ConnectingAgain")
@@ -211,7 +222,11 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 	}
 	OpenCons[ad.UniqID()] = conn
 	OutConsActive++
+	if block_relay_only {
+		BlockRelayConsActive++
+	}
 	Mutex_net.Unlock()
+	ad.Attempt()
 	go func() {
 		var con net.Conn
 		var e error
@@ -244,6 +259,9 @@ func DoNetwork(ad *peersdb.PeerAddr) {
 		Mutex_net.Lock()
 		delete(OpenCons, ad.UniqID())
 		OutConsActive--
+		if block_relay_only {
+			BlockRelayConsActive--
+		}
 		Mutex_net.Unlock()
 		ad.Dead()
 	}()
@@ -279,6 +297,12 @@ func tcp_server() {
 			if e == nil && common.IsListenTCP() {
 				var terminate bool
 
+				if ta, ok := tc.RemoteAddr().(*net.TCPAddr); ok && peersdb.IsBanned(ta.IP) != nil {
+					common.CountSafe("InConnBanned")
+					tc.Close()
+					continue
+				}
+
 				// set port to default, for incmming connections
 				ad, e := peersdb.NewPeerFromString(tc.RemoteAddr().String(), true)
 				if e == nil {
@@ -292,7 +316,7 @@ func tcp_server() {
 
 					if terminate {
 						common.CountSafe("BanHammerIn")
-						ad.Ban()
+						ad.Ban("HammerIn")
 					} else {
 						// Incoming IP passed all the initial checks - talk to it
 						conn := NewConnection(ad)
@@ -383,7 +407,14 @@ func ConnectFriends() {
 				}
 				if len(pk) == 33 {
 					new_pubkey_cache[pks] = pk
-					AuthPubkeys = append(AuthPubkeys, pk)
+					ak := &AuthKey{Pubkey: pk, Trust: TRUST_BLOCKS}
+					if len(ls) > 1 {
+						// optional trust level may follow the key
+						if t := ParseTrust(strings.Fields(ls[1])[0]); t != 0 {
+							ak.Trust = t
+						}
+					}
+					AuthPubkeys = append(AuthPubkeys, ak)
 					//println("Using Auth Key:", hex.EncodeToString(pk))
 				} else {
 					println(pks, "is not a valid Auth Key. Check your friends.txt file")
@@ -458,7 +489,8 @@ func NetworkTick() {
 		}
 		v.Mutex.Unlock()
 	}
-	conn_cnt := OutConsActive
+	conn_cnt := OutConsActive - BlockRelayConsActive
+	brcon_cnt := BlockRelayConsActive
 	Mutex_net.Unlock()
 
 	if cnt_headers_in_progress == 0 {
@@ -528,24 +560,41 @@ func NetworkTick() {
 			Mutex_net.Unlock()
 		}
 
-		adrs := peersdb.GetBestPeers(128, func(ad *peersdb.PeerAddr) bool {
-			if segwit_conns < common.CFG.Net.MinSegwitCons && (ad.Services&SERVICE_SEGWIT) == 0 {
-				return true
-			}
-			return ConnectionActive(ad)
-		})
-		if len(adrs) == 0 && segwit_conns < common.CFG.Net.MinSegwitCons {
-			// we have only non-segwit peers in the database - take them
-			adrs = peersdb.GetBestPeers(128, func(ad *peersdb.PeerAddr) bool {
+		var ad *peersdb.PeerAddr
+		if common.GetUint32(&common.CFG.Net.BlockRelayCons) == 0 {
+			ad = nextAnchor()
+		}
+		if ad == nil {
+			used_groups := OutboundGroups()
+			ad = peersdb.SelectOutbound(func(ad *peersdb.PeerAddr) bool {
+				if segwit_conns < common.CFG.Net.MinSegwitCons && (ad.Services&SERVICE_SEGWIT) == 0 {
+					return true
+				}
 				return ConnectionActive(ad)
-			})
+			}, used_groups)
+			if ad == nil && segwit_conns < common.CFG.Net.MinSegwitCons {
+				// we have only non-segwit peers in the database - take them
+				ad = peersdb.SelectOutbound(func(ad *peersdb.PeerAddr) bool {
+					return ConnectionActive(ad)
+				}, used_groups)
+			}
 		}
-		if len(adrs) != 0 {
-			DoNetwork(adrs[rand.Int31n(int32(len(adrs)))])
+		if ad != nil {
+			DoNetwork(ad)
 			Mutex_net.Lock()
-			conn_cnt = OutConsActive
+			conn_cnt = OutConsActive - BlockRelayConsActive
 			Mutex_net.Unlock()
 		}
+	} else if brcon_cnt < common.GetUint32(&common.CFG.Net.BlockRelayCons) {
+		ad := nextAnchor()
+		if ad == nil {
+			ad = peersdb.SelectOutbound(ConnectionActive, OutboundGroups())
+		}
+		if ad != nil {
+			DoNetworkBlockRelay(ad)
+		}
+	} else if mins := common.GetUint32(&common.CFG.Net.BlkRelayRotate); mins != 0 {
+		rotateBlockRelay(now, time.Duration(mins)*time.Minute)
 	}
 
 	if expireTxsNow {
@@ -555,6 +604,38 @@ func NetworkTick() {
 	}
 }
 
+// nextAnchor returns the next anchor (from before restart) that we are not connected to.
+func nextAnchor() *peersdb.PeerAddr {
+	for {
+		ad := peersdb.NextAnchor()
+		if ad == nil || !ConnectionActive(ad) {
+			return ad
+		}
+	}
+}
+
+// rotateBlockRelay drops the oldest block-relay-only connection, if it is older than period.
+// A new one will be open in its place.
+func rotateBlockRelay(now time.Time, period time.Duration) {
+	if now.Before(next_block_relay_rotate) {
+		return
+	}
+	next_block_relay_rotate = now.Add(period)
+	var oldest *OneConnection
+	Mutex_net.Lock()
+	for _, v := range OpenCons {
+		if v.X.BlockRelayOnly && !v.X.ConnectedAt.IsZero() && now.Sub(v.X.ConnectedAt) >= period &&
+			(oldest == nil || v.X.ConnectedAt.Before(oldest.X.ConnectedAt)) {
+			oldest = v
+		}
+	}
+	Mutex_net.Unlock()
+	if oldest != nil {
+		common.CountSafe("BlockRelayRotate")
+		oldest.Disconnect("BlockRelayRotate")
+	}
+}
+
 func (c *OneConnection) SendFeeFilter() {
 	var pl [8]byte
 	binary.LittleEndian.PutUint64(pl[:], c.X.LastMinFeePerKByte)
@@ -677,6 +758,10 @@ func (c *OneConnection) Run() {
 			}
 			c.X.LastMinFeePerKByte = common.MinFeePerKB()
 
+			if !c.X.Incomming {
+				c.PeerAddr.Good()
+			}
+
 			if c.X.IsGocoin {
 				c.SendAuth()
 			}
@@ -684,7 +769,7 @@ func (c *OneConnection) Run() {
 			if c.Node.Version >= 70012 {
 				c.SendRawMsg("sendheaders", nil)
 				if c.Node.Version >= 70013 {
-					if c.X.LastMinFeePerKByte != 0 {
+					if c.X.LastMinFeePerKByte != 0 && !c.NoTxRelay() {
 						c.SendFeeFilter()
 					}
 					if c.Node.Version >= 70014 && common.GetBool(&common.CFG.TXPool.Enabled) {
@@ -704,7 +789,7 @@ func (c *OneConnection) Run() {
 			c.PeerAddr.Services = c.Node.Services
 			c.PeerAddr.Save()
 
-			if common.IsListenTCP() {
+			if common.IsListenTCP() && !c.X.BlockRelayOnly {
 				c.SendOwnAddr()
 			}
 			continue
@@ -716,11 +801,18 @@ func (c *OneConnection) Run() {
 			c.ProcessInv(cmd.pl)
 
 		case "tx":
+			if c.NoTxRelay() && c.txRelayViolated("Tx") {
+				break
+			}
 			if common.AcceptTx() {
 				c.ParseTxNet(cmd.pl)
 			}
 
 		case "addr":
+			if c.X.BlockRelayOnly {
+				common.CountSafe("AddrBlockRelayIgnored")
+				break
+			}
 			c.ParseAddr(cmd.pl)
 
 		case "block": //block received
@@ -735,7 +827,9 @@ func (c *OneConnection) Run() {
 			c.ProcessGetData(cmd.pl)
 
 		case "getaddr":
-			if !c.X.GetAddrDone {
+			if c.X.BlockRelayOnly {
+				common.CountSafe("GetAddrBlockRelayIgnored")
+			} else if !c.X.GetAddrDone {
 				c.SendAddr()
 				c.X.GetAddrDone = true
 			} else {
@@ -808,23 +902,45 @@ func (c *OneConnection) Run() {
 			//println(c.ConnID, c.PeerAddr.Ip(), c.Node.Agent, "blocktxn", hex.EncodeToString(cmd.pl))
 
 		case "getmp":
-			if c.X.Authorized {
+			if c.Trusted(TRUST_MEMPOOL) {
 				c.ProcessGetMP(cmd.pl)
 			}
 
+		case "pushmp":
+			c.ProcessPushMP(cmd.pl)
+
 		case "auth":
 			c.AuthRvcd(cmd.pl)
-			if c.X.AuthAckGot {
-				c.GetMPNow()
-			}
+			c.StartEncryption()
 
 		case "authack":
 			c.X.AuthAckGot = true
-			c.GetMPNow()
+			c.StartEncryption()
+
+		case "encinit":
+			c.ProcessEncInit(cmd.pl)
 
 		case "getmpdone":
 			c.GetMPDone(cmd.pl)
 
+		case "verack":
+			c.X.VerackReceived = true
+
+		case "wtxidrelay":
+			c.HandleWTxIDRelay()
+
+		case "sendpackages":
+			c.HandleSendPackages(cmd.pl)
+
+		case "ancpkginfo":
+			c.ProcessAncPkgInfo(cmd.pl)
+
+		case "getpkgtxns":
+			c.ProcessGetPkgTxns(cmd.pl)
+
+		case "pkgtxns":
+			c.ProcessPkgTxns(cmd.pl)
+
 		case "filterload", "filteradd", "filterclear", "merkleblock":
 			c.DoS("SPV")
 
@@ -849,14 +965,18 @@ func (c *OneConnection) Run() {
 	MutexRcv.Unlock()
 
 	ban := c.banit
+	banreason := c.banreason
 	c.Mutex.Unlock()
 
 	if c.PeerAddr.Friend || c.X.Authorized {
 		common.CountSafe(fmt.Sprint("FDisconnect-", ban))
 	} else {
 		if ban {
-			c.PeerAddr.Ban()
+			c.PeerAddr.Ban(banreason)
 			common.CountSafe("PeersBanned")
+			TxPool.Lock()
+			TxPool.DeletePeerOrphans(c.ConnID)
+			TxPool.Unlock()
 		} else if c.X.Incomming && !c.MutexGetBool(&c.X.IsSpecial) {
 			var rd *RecentlyDisconenctedType
 			HammeringMutex.Lock()
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+// rawTx returns the tx decoded from the given hex string.
+func rawTx(t *testing.T, s string) *btc.Tx {
+	raw, _ := hex.DecodeString(s)
+	tx, _ := btc.NewTx(raw)
+	if tx == nil {
+		t.Fatal("Bad tx", s)
+	}
+	tx.SetHash(raw)
+	return tx
+}
+
+func TestNeedThisWTx(t *testing.T) {
+	segwit := func(witness string) *btc.Tx {
+		return rawTx(t, "02000000"+"0001"+"01"+
+			"2222222222222222222222222222222222222222222222222222222222222222"+"00000000"+"00"+"ffffffff"+
+			"01"+"e803000000000000"+"0151"+"01"+witness+"00000000")
+	}
+	ltx := rawTx(t, "02000000"+"01"+
+		"1111111111111111111111111111111111111111111111111111111111111111"+"00000000"+"00"+"ffffffff"+
+		"01"+"e803000000000000"+"0151"+"00000000")
+	stx := segwit("03aabbcc")
+	other := segwit("03010203") // the same txid, with a different witness
+	if other.Hash != stx.Hash || *other.WTxID() == *stx.WTxID() {
+		t.Fatal("Bad test txs")
+	}
+
+	TxPool.Lock()
+	TxPool.RejectTx(ltx, mempool.TX_REJECTED_LOW_FEE)
+	TxPool.RejectTx(stx, mempool.TX_REJECTED_LOW_FEE)
+	TxPool.Unlock()
+	t.Cleanup(func() {
+		TxPool.Lock()
+		TxPool.DeleteRejected(ltx.Hash.BIdx())
+		TxPool.DeleteRejected(stx.Hash.BIdx())
+		TxPool.Unlock()
+	})
+
+	if NeedThisWTx(ltx.WTxID()) {
+		t.Error("Rejected legacy tx wanted")
+	}
+	if NeedThisWTx(stx.WTxID()) {
+		t.Error("Rejected wtxid wanted")
+	}
+	if !NeedThisWTx(other.WTxID()) {
+		t.Error("Other witness of a rejected tx not wanted")
+	}
+	if NeedThisTx(&other.Hash, nil) {
+		t.Error("Rejected txid wanted")
+	}
+}
@@ -2,51 +2,20 @@ package network
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"io"
 	"os"
-	"time"
-)
-
-var (
-	END_MARKER = []byte("END_OF_FILE")
 )
 
 const (
-	MEMPOOL_FILE_NAME2 = "mempool.dmp"
+	MEMPOOL_FILE_NAME2     = "mempool.dmp"
+	MEMPOOL_CORE_FILE_NAME = "mempool.dat" // Bitcoin Core's format (see MempoolSaveCore)
 )
 
-func bool2byte(v bool) byte {
-	if v {
-		return 1
-	} else {
-		return 0
-	}
-}
-
-func (t2s *OneTxToSend) WriteBytes(wr io.Writer) {
-	btc.WriteVlen(wr, uint64(len(t2s.Raw)))
-	wr.Write(t2s.Raw)
-
-	btc.WriteVlen(wr, uint64(len(t2s.Spent)))
-	binary.Write(wr, binary.LittleEndian, t2s.Spent[:])
-
-	binary.Write(wr, binary.LittleEndian, t2s.Invsentcnt)
-	binary.Write(wr, binary.LittleEndian, t2s.SentCnt)
-	binary.Write(wr, binary.LittleEndian, uint32(t2s.Firstseen.Unix()))
-	binary.Write(wr, binary.LittleEndian, uint32(t2s.Lastsent.Unix()))
-	binary.Write(wr, binary.LittleEndian, t2s.Volume)
-	binary.Write(wr, binary.LittleEndian, t2s.Fee)
-	binary.Write(wr, binary.LittleEndian, t2s.SigopsCost)
-	binary.Write(wr, binary.LittleEndian, t2s.VerifyTime)
-	wr.Write([]byte{bool2byte(t2s.Local), t2s.Blocked, bool2byte(t2s.MemInputs != nil), bool2byte(t2s.Final)})
-}
-
 func MempoolSave(force bool) {
 	if !force && !common.CFG.TXPool.SaveOnDisk {
 		os.Remove(common.GocoinHomeDir + MEMPOOL_FILE_NAME2)
@@ -61,35 +30,43 @@ func MempoolSave(force bool) {
 
 	fmt.Println("Saving", MEMPOOL_FILE_NAME2)
 	wr := bufio.NewWriter(f)
+	TxPool.WriteDump(wr, common.Last.Block.BlockHash)
+	wr.Flush()
+	f.Close()
+}
 
-	wr.Write(common.Last.Block.BlockHash.Hash[:])
+func MempoolLoad2() bool {
+	top, recs, deltas, er := mempool.ReadDump(common.GocoinHomeDir + MEMPOOL_FILE_NAME2)
+	if er == nil && !top.Equal(common.Last.Block.BlockHash) {
+		er = errors.New(MEMPOOL_FILE_NAME2 + " is for different last block hash (try to load it with 'mpl' command)")
+	}
+	if er != nil {
+		fmt.Println("Error loading", MEMPOOL_FILE_NAME2, ":", er.Error())
+		return false
+	}
 
-	btc.WriteVlen(wr, uint64(len(TransactionsToSend)))
-	for _, t2s := range TransactionsToSend {
-		t2s.WriteBytes(wr)
+	cnt1, cnt2 := TxPool.Load(recs)
+	for _, fd := range deltas {
+		TxPool.Prioritise(fd.Id, fd.Delta)
 	}
 
-	btc.WriteVlen(wr, uint64(len(SpentOutputs)))
-	for k, v := range SpentOutputs {
-		binary.Write(wr, binary.LittleEndian, k)
-		binary.Write(wr, binary.LittleEndian, v)
+	fmt.Println(len(TxPool.TransactionsToSend), "transactions taking", TxPool.TransactionsToSendSize, "Bytes loaded from", MEMPOOL_FILE_NAME2)
+	fmt.Println(cnt1, "transactions use", cnt2, "memory inputs")
+	if len(deltas) > 0 {
+		fmt.Println(len(deltas), "fee deltas loaded")
 	}
 
-	wr.Write(END_MARKER[:])
-	wr.Flush()
-	f.Close()
+	return true
 }
 
-func MempoolLoad2() bool {
-	var t2s *OneTxToSend
-	var totcnt, le uint64
+// MempoolLoadNew is only called from TextUI.
+func MempoolLoadNew(fname string, abort *bool) bool {
+	var t2s *mempool.OneTxToSend
+	var idx, totcnt, oneperc, cntdwn, perc uint64
 	var tmp [32]byte
-	var bi BIDX
-	var tina uint32
-	var i int
 	var cnt1, cnt2 uint
 
-	f, er := os.Open(common.GocoinHomeDir + MEMPOOL_FILE_NAME2)
+	f, er := os.Open(fname)
 	if er != nil {
 		fmt.Println("MempoolLoad:", er.Error())
 		return false
@@ -100,186 +77,102 @@ func MempoolLoad2() bool {
 	if _, er = io.ReadFull(rd, tmp[:32]); er != nil {
 		goto fatal_error
 	}
-	if !bytes.Equal(tmp[:32], common.Last.Block.BlockHash.Hash[:]) {
-		er = errors.New(MEMPOOL_FILE_NAME2 + " is for different last block hash (try to load it with 'mpl' command)")
-		goto fatal_error
-	}
 
 	if totcnt, er = btc.ReadVLen(rd); er != nil {
 		goto fatal_error
 	}
+	fmt.Println("Loading", totcnt, "transactions from", fname)
 
-	TransactionsToSend = make(map[BIDX]*OneTxToSend, int(totcnt))
-	for ; totcnt > 0; totcnt-- {
-		le, er = btc.ReadVLen(rd)
-		if er != nil {
-			goto fatal_error
-		}
-
-		t2s = new(OneTxToSend)
-		raw := make([]byte, int(le))
-
-		_, er = io.ReadFull(rd, raw)
-		if er != nil {
-			goto fatal_error
-		}
-
-		t2s.Tx, i = btc.NewTx(raw)
-		if t2s.Tx == nil || i != len(raw) {
-			er = errors.New(fmt.Sprint("Error parsing tx from ", MEMPOOL_FILE_NAME2, " at idx", len(TransactionsToSend)))
-			goto fatal_error
-		}
-		t2s.Tx.SetHash(raw)
-
-		le, er = btc.ReadVLen(rd)
-		if er != nil {
-			goto fatal_error
-		}
-		t2s.Spent = make([]uint64, int(le))
-		if er = binary.Read(rd, binary.LittleEndian, t2s.Spent[:]); er != nil {
-			goto fatal_error
-		}
-
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.Invsentcnt); er != nil {
-			goto fatal_error
-		}
-
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.SentCnt); er != nil {
-			goto fatal_error
-		}
-
-		if er = binary.Read(rd, binary.LittleEndian, &tina); er != nil {
-			goto fatal_error
-		}
-		t2s.Firstseen = time.Unix(int64(tina), 0)
-
-		if er = binary.Read(rd, binary.LittleEndian, &tina); er != nil {
-			goto fatal_error
-		}
-		t2s.Lastsent = time.Unix(int64(tina), 0)
-
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.Volume); er != nil {
-			goto fatal_error
-		}
+	oneperc = totcnt/100
 
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.Fee); er != nil {
-			goto fatal_error
+	for idx = 0; idx < totcnt; idx++ {
+		if cntdwn==0 {
+			fmt.Print("\r", perc, "% complete...")
+			perc++
+			cntdwn = oneperc
 		}
-
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.SigopsCost); er != nil {
-			goto fatal_error
+		cntdwn--
+		if abort != nil && *abort {
+			break
 		}
-
-		if er = binary.Read(rd, binary.LittleEndian, &t2s.VerifyTime); er != nil {
+		if t2s, er = mempool.ReadTxRecord(rd); er != nil {
+			er = errors.New(fmt.Sprint("Error parsing tx from ", fname, " at idx ", idx, ": ", er.Error()))
 			goto fatal_error
 		}
 
-		if _, er = io.ReadFull(rd, tmp[:4]); er != nil {
-			goto fatal_error
-		}
-		t2s.Local = tmp[0] != 0
-		t2s.Blocked = tmp[1]
-		if tmp[2] != 0 {
-			t2s.MemInputs = make([]bool, len(t2s.TxIn))
+		// submit tx if we dont have it yet (only the tx itself is taken from the record)...
+		if NeedThisTx(&t2s.Hash, nil) {
+			cnt2++
+			if HandleNetTx(&TxRcvd{Tx: t2s.Tx}, true) {
+				cnt1++
+			}
 		}
-		t2s.Final = tmp[3] != 0
-
-		t2s.Tx.Fee = t2s.Fee
-
-		TransactionsToSend[t2s.Hash.BIdx()] = t2s
-		TransactionsToSendSize += uint64(len(t2s.Raw))
-		TransactionsToSendWeight += uint64(t2s.Weight())
 	}
 
-	if totcnt, er = btc.ReadVLen(rd); er != nil {
-		goto fatal_error
-	}
+	fmt.Print("\r                                    \r")
+	fmt.Println(cnt1, "out of", cnt2, "new transactions accepted into memory pool")
 
-	SpentOutputs = make(map[uint64]BIDX, int(totcnt))
-	for ; totcnt > 0; totcnt-- {
-		if er = binary.Read(rd, binary.LittleEndian, &le); er != nil {
-			goto fatal_error
-		}
+	return true
 
-		if er = binary.Read(rd, binary.LittleEndian, &bi); er != nil {
-			goto fatal_error
-		}
+fatal_error:
+	fmt.Println("Error loading", fname, ":", er.Error())
+	return false
+}
 
-		SpentOutputs[le] = bi
+// MempoolSaveCore stores the memory pool in Bitcoin Core's mempool.dat format.
+func MempoolSaveCore(fname string) bool {
+	f, er := os.Create(fname)
+	if er != nil {
+		fmt.Println("MempoolSaveCore:", er.Error())
+		return false
 	}
 
-	if _, er = io.ReadFull(rd, tmp[:len(END_MARKER)]); er != nil {
-		goto fatal_error
-	}
-	if !bytes.Equal(tmp[:len(END_MARKER)], END_MARKER) {
-		er = errors.New(MEMPOOL_FILE_NAME2 + " has marker missing")
-		goto fatal_error
+	wr := bufio.NewWriter(f)
+	TxPool.Lock()
+	cnt := len(TxPool.TransactionsToSend)
+	TxPool.WriteCoreDump(wr)
+	TxPool.Unlock()
+	if er = wr.Flush(); er == nil {
+		er = f.Close()
+	} else {
+		f.Close()
 	}
-
-	// recover MemInputs
-	for _, t2s := range TransactionsToSend {
-		if t2s.MemInputs != nil {
-			cnt1++
-			for i := range t2s.TxIn {
-				if _, inmem := TransactionsToSend[btc.BIdx(t2s.TxIn[i].Input.Hash[:])]; inmem {
-					t2s.MemInputs[i] = true
-					t2s.MemInputCnt++
-					cnt2++
-				}
-			}
-			if t2s.MemInputCnt == 0 {
-				println("ERROR: MemInputs not nil but nothing found")
-				t2s.MemInputs = nil
-			}
-		}
+	if er != nil {
+		fmt.Println("MempoolSaveCore:", er.Error())
+		return false
 	}
-
-	fmt.Println(len(TransactionsToSend), "transactions taking", TransactionsToSendSize, "Bytes loaded from", MEMPOOL_FILE_NAME2)
-	fmt.Println(cnt1, "transactions use", cnt2, "memory inputs")
-
+	fmt.Println(cnt, "transactions saved to", fname)
 	return true
-
-fatal_error:
-	fmt.Println("Error loading", MEMPOOL_FILE_NAME2, ":", er.Error())
-	TransactionsToSend = make(map[BIDX]*OneTxToSend)
-	TransactionsToSendSize = 0
-	TransactionsToSendWeight = 0
-	SpentOutputs = make(map[uint64]BIDX)
-	return false
 }
 
-
-// MempoolLoadNew is only called from TextUI.
-func MempoolLoadNew(fname string, abort *bool) bool {
-	var ntx *TxRcvd
-	var idx, totcnt, le, tmp64, oneperc, cntdwn, perc uint64
-	var tmp [32]byte
-	var tina uint32
-	var i int
+// MempoolLoadCore submits the transactions from Bitcoin Core's mempool.dat file,
+// as if they came from the network (with the scripts verified).
+// It is only called from TextUI.
+func MempoolLoadCore(fname string, abort *bool) bool {
 	var cnt1, cnt2 uint
-	var t2s OneTxToSend
+	var oneperc, cntdwn, perc int
 
-	f, er := os.Open(fname)
+	recs, deltas, er := mempool.ReadCoreDump(fname)
 	if er != nil {
-		fmt.Println("MempoolLoad:", er.Error())
+		fmt.Println("Error loading", fname, ":", er.Error())
 		return false
 	}
-	defer f.Close()
+	fmt.Println("Loading", len(recs), "transactions from", fname)
 
-	rd := bufio.NewReader(f)
-	if _, er = io.ReadFull(rd, tmp[:32]); er != nil {
-		goto fatal_error
+	TxPool.Lock()
+	for _, fd := range deltas {
+		TxPool.Prioritise(fd.Id, fd.Delta)
 	}
-
-	if totcnt, er = btc.ReadVLen(rd); er != nil {
-		goto fatal_error
+	for _, rec := range recs {
+		if rec.FeeDelta != 0 {
+			TxPool.Prioritise(&rec.Hash, rec.FeeDelta)
+		}
 	}
-	fmt.Println("Loading", totcnt, "transactions from", fname)
-
-	oneperc = totcnt/100
+	TxPool.Unlock()
 
-	for idx = 0; idx < totcnt; idx++ {
-		if cntdwn==0 {
+	oneperc = len(recs) / 100
+	for _, rec := range recs {
+		if cntdwn == 0 {
 			fmt.Print("\r", perc, "% complete...")
 			perc++
 			cntdwn = oneperc
@@ -288,66 +181,23 @@ func MempoolLoadNew(fname string, abort *bool) bool {
 		if abort != nil && *abort {
 			break
 		}
-		le, er = btc.ReadVLen(rd)
-		if er != nil {
-			goto fatal_error
-		}
-
-		ntx = new(TxRcvd)
-		raw := make([]byte, int(le))
-
-		_, er = io.ReadFull(rd, raw)
-		if er != nil {
-			goto fatal_error
-		}
-
-		ntx.Tx, i = btc.NewTx(raw)
-		if ntx.Tx == nil || i != len(raw) {
-			er = errors.New(fmt.Sprint("Error parsing tx from ", fname, " at idx", idx))
-			goto fatal_error
-		}
-		ntx.SetHash(raw)
-
-		le, er = btc.ReadVLen(rd)
-		if er != nil {
-			goto fatal_error
-		}
-
-		for le > 0 {
-			if er = binary.Read(rd, binary.LittleEndian, &tmp64); er != nil {
-				goto fatal_error
-			}
-			le--
-		}
-
-		// discard all the rest...
-		binary.Read(rd, binary.LittleEndian, &t2s.Invsentcnt)
-		binary.Read(rd, binary.LittleEndian, &t2s.SentCnt)
-		binary.Read(rd, binary.LittleEndian, &tina)
-		binary.Read(rd, binary.LittleEndian, &tina)
-		binary.Read(rd, binary.LittleEndian, &t2s.Volume)
-		binary.Read(rd, binary.LittleEndian, &t2s.Fee)
-		binary.Read(rd, binary.LittleEndian, &t2s.SigopsCost)
-		binary.Read(rd, binary.LittleEndian, &t2s.VerifyTime)
-		if _, er = io.ReadFull(rd, tmp[:4]); er != nil {
-			goto fatal_error
-		}
-
-		// submit tx if we dont have it yet...
-		if NeedThisTx(&ntx.Hash, nil) {
+		if NeedThisTx(&rec.Hash, nil) {
 			cnt2++
-			if HandleNetTx(ntx, true) {
+			if HandleNetTx(&TxRcvd{Tx: rec.Tx}, true) {
 				cnt1++
+				TxPool.Lock()
+				if t2s := TxPool.TransactionsToSend[rec.Hash.BIdx()]; t2s != nil && rec.Time.Before(t2s.Firstseen) {
+					t2s.Firstseen = rec.Time
+				}
+				TxPool.Unlock()
 			}
 		}
 	}
 
 	fmt.Print("\r                                    \r")
 	fmt.Println(cnt1, "out of", cnt2, "new transactions accepted into memory pool")
-
+	if len(deltas) > 0 {
+		fmt.Println(len(deltas), "fee deltas of other transactions loaded")
+	}
 	return true
-
-fatal_error:
-	fmt.Println("Error loading", fname, ":", er.Error())
-	return false
 }
@@ -0,0 +1,356 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+// Experimental package relay (BIP331), as in ancestor packages.
+// When a tx from a peer gets rejected because of a low fee or missing inputs,
+// we ask the peer (getdata MSG_ANCPKGINFO) for the list of the tx's unconfirmed ancestors.
+// The peer responds with "ancpkginfo" and we request the txs we don't have with "getpkgtxns".
+// Once "pkgtxns" arrives, the whole package goes via NetTxs to HandleNetTx.
+
+const (
+	PKG_RELAY_ANCPKG = 1 << 0 // versions bit in "sendpackages"
+
+	PackageInfoExpire = time.Minute
+)
+
+func PackageRelayEnabled() bool {
+	return common.GetBool(&common.CFG.TXPool.PackageRelay)
+}
+
+// SendPackages sends "sendpackages" message. Must be done after "wtxidrelay" and before "verack".
+func (c *OneConnection) SendPackages() {
+	var pl [8]byte
+	binary.LittleEndian.PutUint64(pl[:], PKG_RELAY_ANCPKG)
+	c.SendRawMsg("sendpackages", pl[:])
+}
+
+// HandleSendPackages processes "sendpackages" message.
+func (c *OneConnection) HandleSendPackages(pl []byte) {
+	if len(pl) != 8 {
+		c.DoS("SendPackagesErr")
+		return
+	}
+	if c.X.VerackReceived {
+		c.Misbehave("SendPackagesLate", 100)
+		return
+	}
+	if PackageRelayEnabled() && (binary.LittleEndian.Uint64(pl)&PKG_RELAY_ANCPKG) != 0 {
+		c.Mutex.Lock()
+		c.Node.SendPackages = true
+		c.Mutex.Unlock()
+	}
+}
+
+// AskForPackage sends getdata(MSG_ANCPKGINFO) for the given tx, if the peer supports packages.
+// It returns false if the peer does not support them.
+// Call it with TxPool unlocked.
+func (c *OneConnection) AskForPackage(tx *btc.Tx) bool {
+	if !c.Node.SendPackages || !c.Node.WTxIDRelay || c.IsBroken() {
+		return false
+	}
+
+	wtxid := tx.WTxID()
+	bidx := wtxid.BIdx()
+	now := time.Now()
+
+	TxPool.Lock()
+	if c.pkg.InfoAsked == nil {
+		c.pkg.InfoAsked = make(map[BIDX]time.Time)
+	}
+	for k, v := range c.pkg.InfoAsked {
+		if now.Sub(v) > PackageInfoExpire {
+			delete(c.pkg.InfoAsked, k)
+		}
+	}
+	if _, ok := c.pkg.InfoAsked[bidx]; ok || len(c.pkg.InfoAsked) >= MAX_PACKAGE_INFO_ASKED {
+		TxPool.Unlock()
+		common.CountSafe("PkgInfoNotAsked")
+		return true
+	}
+	c.pkg.InfoAsked[bidx] = now
+	TxPool.Unlock()
+
+	var b [1 + 4 + 32]byte
+	b[0] = 1 // One inv
+	binary.LittleEndian.PutUint32(b[1:5], MSG_ANCPKGINFO)
+	copy(b[5:37], wtxid.Hash[:])
+	c.SendRawMsg("getdata", b[:])
+	common.CountSafe("PkgInfoAsked")
+	return true
+}
+
+// SendAncPkgInfo responds to getdata(MSG_ANCPKGINFO) with a list of wtxids.
+func (c *OneConnection) SendAncPkgInfo(wtxid *btc.Uint256) {
+	var pkg []*mempool.OneTxToSend
+	TxPool.Lock()
+	if t2s := TxPool.TxByWTxID(wtxid.BIdx()); t2s != nil && t2s.Blocked == 0 {
+		pkg = append(TxPool.GetAllParents(t2s), t2s)
+	}
+	TxPool.Unlock()
+
+	if pkg == nil || len(pkg) > MAX_PACKAGE_COUNT {
+		common.CountSafe("PkgInfoNotFound")
+		b := new(bytes.Buffer)
+		btc.WriteVlen(b, 1)
+		binary.Write(b, binary.LittleEndian, uint32(MSG_ANCPKGINFO))
+		b.Write(wtxid.Hash[:])
+		c.SendRawMsg("notfound", b.Bytes())
+		return
+	}
+
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(pkg)))
+	for _, t2s := range pkg {
+		b.Write(t2s.WTxID().Hash[:])
+	}
+	c.SendRawMsg("ancpkginfo", b.Bytes())
+	common.CountSafe("PkgInfoSent")
+}
+
+func parseWTxIDs(pl []byte) (res []*btc.Uint256) {
+	cnt, of := btc.VLen(pl)
+	if of == 0 || cnt < 1 || cnt > MAX_PACKAGE_COUNT || len(pl) != of+32*cnt {
+		return
+	}
+	res = make([]*btc.Uint256, cnt)
+	for i := range res {
+		res[i] = btc.NewUint256(pl[of : of+32])
+		of += 32
+	}
+	return
+}
+
+// ProcessAncPkgInfo handles "ancpkginfo" message.
+func (c *OneConnection) ProcessAncPkgInfo(pl []byte) {
+	wtxids := parseWTxIDs(pl)
+	if wtxids == nil {
+		c.DoS("PkgInfoErr")
+		return
+	}
+
+	child := wtxids[len(wtxids)-1].BIdx()
+
+	TxPool.Lock()
+	if _, ok := c.pkg.InfoAsked[child]; !ok {
+		TxPool.Unlock()
+		c.Misbehave("PkgInfoUnsolicited", 100)
+		return
+	}
+	delete(c.pkg.InfoAsked, child)
+
+	if c.pkg.Wtxids != nil {
+		// we only download one package at a time from each peer
+		TxPool.Unlock()
+		common.CountSafe("PkgInfoBusy")
+		return
+	}
+
+	var toget []*btc.Uint256
+	asked := make(map[BIDX]bool)
+	for _, wtxid := range wtxids {
+		bidx := wtxid.BIdx()
+		if TxPool.TxByWTxID(bidx) != nil || TxPool.RejectedByWTxID(bidx) != nil {
+			continue
+		}
+		toget = append(toget, wtxid)
+		asked[bidx] = true
+	}
+
+	if len(toget) == 0 {
+		TxPool.Unlock()
+		// we have all the txs already - just try the package
+		c.submitPackage(wtxids, nil)
+		return
+	}
+
+	c.pkg.Wtxids = wtxids
+	c.pkg.Asked = asked
+	TxPool.Unlock()
+
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(toget)))
+	for _, wtxid := range toget {
+		b.Write(wtxid.Hash[:])
+	}
+	c.SendRawMsg("getpkgtxns", b.Bytes())
+	common.CountSafe("PkgTxnsAsked")
+}
+
+// ProcessGetPkgTxns handles "getpkgtxns" message.
+func (c *OneConnection) ProcessGetPkgTxns(pl []byte) {
+	wtxids := parseWTxIDs(pl)
+	if wtxids == nil {
+		c.DoS("GetPkgTxnsErr")
+		return
+	}
+
+	raws := make([][]byte, 0, len(wtxids))
+	TxPool.Lock()
+	for _, wtxid := range wtxids {
+		t2s := TxPool.TxByWTxID(wtxid.BIdx())
+		if t2s == nil || t2s.Blocked != 0 {
+			break
+		}
+		raws = append(raws, t2s.Raw)
+	}
+	TxPool.Unlock()
+
+	if len(raws) != len(wtxids) {
+		common.CountSafe("PkgTxnsNotFound")
+		b := new(bytes.Buffer)
+		btc.WriteVlen(b, uint64(len(wtxids)))
+		for _, wtxid := range wtxids {
+			binary.Write(b, binary.LittleEndian, uint32(MSG_WTX))
+			b.Write(wtxid.Hash[:])
+		}
+		c.SendRawMsg("notfound", b.Bytes())
+		return
+	}
+
+	b := new(bytes.Buffer)
+	btc.WriteVlen(b, uint64(len(raws)))
+	for _, raw := range raws {
+		b.Write(raw)
+	}
+	c.SendRawMsg("pkgtxns", b.Bytes())
+	common.CountSafe("PkgTxnsSent")
+}
+
+// ProcessPkgTxns handles "pkgtxns" message.
+func (c *OneConnection) ProcessPkgTxns(pl []byte) {
+	cnt, of := btc.VLen(pl)
+	if of == 0 || cnt < 1 || cnt > MAX_PACKAGE_COUNT {
+		c.DoS("PkgTxnsErr")
+		return
+	}
+
+	got := make(map[BIDX]*btc.Tx, cnt)
+	for i := 0; i < cnt; i++ {
+		tx, le := btc.NewTx(pl[of:])
+		if tx == nil {
+			c.DoS("PkgTxnsBroken")
+			return
+		}
+		tx.SetHash(pl[of : of+le])
+		of += le
+		got[tx.WTxID().BIdx()] = tx
+	}
+	if of != len(pl) {
+		c.DoS("PkgTxnsLenMismatch")
+		return
+	}
+
+	TxPool.Lock()
+	wtxids := c.pkg.Wtxids
+	asked := c.pkg.Asked
+	c.pkg.Wtxids = nil
+	c.pkg.Asked = nil
+	TxPool.Unlock()
+
+	if wtxids == nil || len(got) != len(asked) {
+		c.Misbehave("PkgTxnsUnsolicited", 100)
+		return
+	}
+	for k := range got {
+		if !asked[k] {
+			c.Misbehave("PkgTxnsUnsolicited", 100)
+			return
+		}
+	}
+
+	c.submitPackage(wtxids, got)
+}
+
+// submitPackage puts the package into NetTxs queue.
+// The txs are taken from got, or from the mempool / rejected list (if they are there).
+func (c *OneConnection) submitPackage(wtxids []*btc.Uint256, got map[BIDX]*btc.Tx) {
+	pkg := make([]*btc.Tx, 0, len(wtxids))
+	TxPool.Lock()
+	for _, wtxid := range wtxids {
+		bidx := wtxid.BIdx()
+		if tx := got[bidx]; tx != nil {
+			pkg = append(pkg, tx)
+		} else if t2s := TxPool.TxByWTxID(bidx); t2s != nil {
+			pkg = append(pkg, t2s.Tx)
+		} else if rej := TxPool.RejectedByWTxID(bidx); rej != nil {
+			pkg = append(pkg, rej.Tx)
+		} else {
+			TxPool.Unlock()
+			common.CountSafe("PkgTxMissing")
+			return
+		}
+	}
+	TxPool.Unlock()
+
+	select {
+	case NetTxs <- &TxRcvd{conn: c, Tx: pkg[len(pkg)-1], pkg: pkg}:
+		common.CountSafe("PkgQueued")
+	default:
+		common.CountSafe("PkgRejectedFullQ")
+	}
+}
+
+// handleNetPackage is called from HandleNetTx, to process an ancestor package.
+// The package gets accepted only if its total fee rate is above the minimum (see mempool.AcceptPackage).
+func handleNetPackage(ntx *TxRcvd) (accepted bool) {
+	common.CountSafe("HandleNetPkg")
+
+	var from uint32
+	if ntx.conn != nil {
+		from = ntx.conn.ConnID
+	}
+	res := TxPool.AcceptPackage(ntx.pkg, mempool.AcceptOpts{Retry: true, From: from})
+	if res.Reason != 0 {
+		ntx.reason = res.Reason
+		if ntx.conn != nil && res.Failed != nil {
+			switch res.Reason {
+			case mempool.TX_REJECTED_OVERSPEND:
+				ntx.conn.DoS("TxOverspend")
+			case mempool.TX_REJECTED_SCRIPT_FAIL:
+				ntx.conn.DoS("TxScriptFail")
+			case mempool.TX_REJECTED_ORPHAN_MAX:
+				ntx.conn.OrphanOverLimit()
+			}
+		}
+		common.CountSafe("PkgRejected")
+		return
+	}
+
+	if maxpoolsize := common.MaxMempoolSize(); maxpoolsize != 0 {
+		TxPool.Lock()
+		if TxPool.TransactionsToSendSize >= maxpoolsize {
+			expireTxsNow = true
+		}
+		TxPool.Unlock()
+	}
+
+	for _, t2s := range res.Added {
+		if t2s.MemInputs != nil && !common.GetBool(&common.CFG.TXRoute.MemInputs) {
+			t2s.Blocked = mempool.TX_REJECTED_NOT_MINED
+			common.CountSafe("TxRouteNotMined")
+		} else if isRoutable(t2s) {
+			t2s.Invsentcnt += NetRouteInvExt(MSG_TX, &t2s.Hash, t2s.WTxID(), ntx.conn, 1000*res.Fee/res.VSize)
+			common.CountSafe("TxRouteOK")
+		}
+	}
+	if ntx.conn != nil {
+		ntx.conn.Mutex.Lock()
+		ntx.conn.txsCur += len(res.Added)
+		ntx.conn.X.TxsReceived += len(res.Added)
+		ntx.conn.PeerAddr.NoteTx()
+		ntx.conn.Mutex.Unlock()
+	}
+
+	common.CountSafe("PkgAccepted")
+	accepted = true
+	return
+}
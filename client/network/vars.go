@@ -33,6 +33,8 @@ type TxRcvd struct {
 	conn *OneConnection
 	*btc.Tx
 	trusted, local bool
+	pkg []*btc.Tx // if not nil, this is an ancestor package (parents first) and Tx is the child
+	reason byte // set by HandleNetTx, if the tx (or the package) got rejected
 }
 
 type OneBlockToGet struct {
@@ -38,7 +38,7 @@ func (c *OneConnection) SendVersion() {
 	common.UnlockCfg()
 
 	binary.Write(b, binary.LittleEndian, uint32(common.Last.BlockHeight()))
-	if !common.GetBool(&common.CFG.TXPool.Enabled) {
+	if c.NoTxRelay() {
 		b.WriteByte(0) // don't notify me about txs
 	}
 
@@ -172,10 +172,27 @@ func (c *OneConnection) HandleVersion(pl []byte) error {
 	} else {
 		return errors.New("version message too short")
 	}
+	if c.Node.Version >= 70016 {
+		c.SendRawMsg("wtxidrelay", nil) // BIP339
+		if PackageRelayEnabled() && !c.NoTxRelay() {
+			c.SendPackages()
+		}
+	}
 	c.SendRawMsg("verack", []byte{})
 	return nil
 }
 
+// HandleWTxIDRelay processes "wtxidrelay" message (BIP339), which must come before "verack".
+func (c *OneConnection) HandleWTxIDRelay() {
+	if c.X.VerackReceived {
+		c.Misbehave("WTxIDRelayLate", 100)
+		return
+	}
+	c.Mutex.Lock()
+	c.Node.WTxIDRelay = true
+	c.Mutex.Unlock()
+}
+
 // SendAuth sends auth messages (only used by other gocoin nodes).
 func (c *OneConnection) SendAuth() {
 	rnd := make([]byte, 32)
@@ -221,9 +238,11 @@ func (c *OneConnection) AuthRvcd(pl []byte) {
 	copy(b32[:8], nonce[:]) // the remaining bytes shall be zero'ed
 	m.SetBytes(b32[:])
 
-	for _, pub := range AuthPubkeys {
-		if pkey.ParsePubkey(pub) && sig.Verify(&pkey, &m) {
+	for _, ak := range AuthPubkeys {
+		if pkey.ParsePubkey(ak.Pubkey) && sig.Verify(&pkey, &m) {
 			c.X.Authorized = true
+			c.X.Trust = ak.Trust
+			c.enc.authkey = ak.Pubkey
 			break
 		}
 	}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+// newTestConn returns a connection over the given pipe end, with its writing thread running.
+func newTestConn(t *testing.T, conn net.Conn, incomming bool) *OneConnection {
+	c := NewConnection(peersdb.NewEmptyPeer())
+	c.Conn = conn
+	c.X.Incomming = incomming
+	c.writing_thread_push = make(chan bool, 1)
+	c.writing_thread_done.Add(1)
+	go c.writing_thread()
+	t.Cleanup(func() {
+		c.Disconnect("TestDone")
+		conn.Close()
+		c.writing_thread_done.Wait()
+	})
+	return c
+}
+
+// recvMsg returns the next message received by c (nil if none or the connection got broken).
+func recvMsg(c *OneConnection) *BCmsg {
+	for i := 0; i < 300 && !c.IsBroken(); i++ {
+		if msg, _ := c.FetchMessage(); msg != nil {
+			return msg
+		}
+	}
+	return nil
+}
+
+// versionPayload returns a "version" message's payload of the given protocol version.
+func versionPayload(ver uint32) []byte {
+	pl := make([]byte, 86)
+	binary.LittleEndian.PutUint32(pl[0:4], ver)
+	copy(pl[72:80], "peernonc")
+	return pl
+}
+
+func TestWTxIDRelay(t *testing.T) {
+	for _, ver := range []uint32{70015, 70016} {
+		ca, cb := net.Pipe()
+		a := newTestConn(t, ca, true)
+		b := newTestConn(t, cb, false)
+
+		go a.HandleVersion(versionPayload(ver))
+		var cmds []string
+		for m := recvMsg(b); m != nil; m = recvMsg(b) {
+			cmds = append(cmds, m.cmd)
+			if m.cmd == "wtxidrelay" {
+				b.HandleWTxIDRelay()
+			}
+			if m.cmd == "verack" {
+				break
+			}
+		}
+		if len(cmds) == 0 || cmds[len(cmds)-1] != "verack" {
+			t.Fatal("No verack for version", ver, cmds)
+		}
+		if (cmds[0] == "wtxidrelay") != (ver >= 70016) {
+			t.Error("Bad messages for version", ver, cmds)
+		}
+		if b.Node.WTxIDRelay != (ver >= 70016) {
+			t.Error("Bad WTxIDRelay for version", ver)
+		}
+	}
+
+	// not allowed after verack
+	ca, _ := net.Pipe()
+	c := newTestConn(t, ca, true)
+	c.X.VerackReceived = true
+	c.HandleWTxIDRelay()
+	if c.Node.WTxIDRelay || c.misbehave != 100 {
+		t.Error("wtxidrelay after verack accepted", c.misbehave)
+	}
+}
@@ -56,30 +56,14 @@ func SubmitBlock(cmd *RpcCommand, resp *RpcResponse, b []byte) {
 			return
 	}
 
-	bs := new(BlockSubmited)
-
-	bs.Block, er = btc.NewBlock(bd)
+	bs, er := Submit(bd)
 	if er != nil {
 		resp.Error = RpcError{Code: -4, Message: er.Error()}
 		return
 	}
-
-	network.MutexRcv.Lock()
-	network.ReceivedBlocks[bs.Block.Hash.BIdx()] = &network.OneReceivedBlock{TmStart: time.Now()}
-	network.MutexRcv.Unlock()
-
-	println("new block", bs.Block.Hash.String(), "len", len(bd), "- submitting...")
-	bs.Done.Add(1)
-	RpcBlocks <- bs
-	bs.Done.Wait()
 	if bs.Error != "" {
 		//resp.Error = RpcError{Code: -10, Message: bs.Error}
-		idx := strings.Index(bs.Error, "- RPC_Result:")
-		if idx == -1 {
-			resp.Result = "inconclusive"
-		} else {
-			resp.Result = bs.Error[idx+13:]
-		}
+		resp.Result = rpcResult(bs.Error)
 		println("submiting block error:", bs.Error)
 		println("submiting block result:", resp.Result.(string))
 
@@ -109,4 +93,31 @@ func SubmitBlock(cmd *RpcCommand, resp *RpcResponse, b []byte) {
 	}
 }
 
+// Submit passes the new block to the chain's thread (see HandleRpcBlock in client/main.go)
+// and waits until it has been processed. The result is in bs.Error.
+func Submit(bd []byte) (bs *BlockSubmited, er error) {
+	bs = new(BlockSubmited)
+	if bs.Block, er = btc.NewBlock(bd); er != nil {
+		return
+	}
+
+	network.MutexRcv.Lock()
+	network.ReceivedBlocks[bs.Block.Hash.BIdx()] = &network.OneReceivedBlock{TmStart: time.Now()}
+	network.MutexRcv.Unlock()
+
+	println("new block", bs.Block.Hash.String(), "len", len(bd), "- submitting...")
+	bs.Done.Add(1)
+	RpcBlocks <- bs
+	bs.Done.Wait()
+	return
+}
+
 var last_given_time, last_given_mintime uint32
+
+// rpcResult returns the reason given after "- RPC_Result:" in the chain's error message.
+func rpcResult(er string) string {
+	if idx := strings.Index(er, "- RPC_Result:"); idx != -1 {
+		return er[idx+13:]
+	}
+	return "inconclusive"
+}
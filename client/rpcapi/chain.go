@@ -0,0 +1,69 @@
+package rpcapi
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// ChainCommand implements: invalidateblock "blockhash", reconsiderblock "blockhash" and preciousblock "blockhash"
+func ChainCommand(cmd *RpcCommand, resp *RpcResponse, what string) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		resp.Error = RpcError{Code: -1, Message: cmd.Method + " \"blockhash\""}
+		return
+	}
+	str, _ := uu[0].(string)
+	hash := btc.NewUint256FromString(str)
+	if hash == nil {
+		resp.Error = RpcError{Code: -8, Message: "blockhash must be of length 64"}
+		return
+	}
+
+	var e error
+	req := &usif.OneUiReq{Handler: func(string) {
+		e = usif.ChainCommand(what, hash)
+	}}
+	req.Done.Add(1)
+	usif.UiChannel <- req
+	req.Done.Wait()
+
+	if e != nil {
+		resp.Error = RpcError{Code: -5, Message: e.Error()}
+	}
+}
+
+// VerifyChain implements: verifychain ( checklevel nblocks )
+func VerifyChain(cmd *RpcCommand, resp *RpcResponse) {
+	level, depth := uint32(3), uint32(6)
+	if uu, ok := cmd.Params.([]interface{}); ok {
+		if len(uu) > 0 {
+			if n, ok := uu[0].(json.Number); ok {
+				if v, e := n.Int64(); e == nil && v >= 0 {
+					level = uint32(v)
+				}
+			}
+		}
+		if len(uu) > 1 {
+			if n, ok := uu[1].(json.Number); ok {
+				if v, e := n.Int64(); e == nil && v >= 0 {
+					depth = uint32(v)
+				}
+			}
+		}
+	}
+
+	res := make(chan error, 1)
+	e := usif.VerifyChain(level, depth, func(e error) {
+		res <- e
+	})
+	if e == nil {
+		e = <-res
+	}
+	if e != nil {
+		fmt.Println("verifychain:", e.Error())
+	}
+	resp.Result = e == nil
+}
@@ -0,0 +1,54 @@
+package rpcapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+type RpcEstimateSmartFee struct {
+	FeeRate float64  `json:"feerate,omitempty"` // BTC/kvB
+	Errors  []string `json:"errors,omitempty"`
+	Blocks  int      `json:"blocks"`
+}
+
+// EstimateSmartFee implements: estimatesmartfee conf_target ( "estimate_mode" )
+func EstimateSmartFee(cmd *RpcCommand, resp *RpcResponse) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		resp.Error = RpcError{Code: -1, Message: "estimatesmartfee conf_target ( \"estimate_mode\" )"}
+		return
+	}
+	n, _ := uu[0].(json.Number)
+	target, e := n.Int64()
+	if e != nil || target < 1 || target > mempool.FEE_EST_MAX_TARGET {
+		// we do not track longer confirmation times, so unlike Core we cannot accept up to 1008
+		resp.Error = RpcError{Code: -8, Message: fmt.Sprint("Invalid conf_target, must be between 1 and ", mempool.FEE_EST_MAX_TARGET)}
+		return
+	}
+	var conservative bool
+	if len(uu) > 1 {
+		mode, _ := uu[1].(string)
+		switch strings.ToLower(mode) {
+		case "unset", "economical":
+		case "conservative":
+			conservative = true
+		default:
+			resp.Error = RpcError{Code: -8, Message: "Invalid estimate_mode parameter, must be one of: \"unset\", \"economical\", \"conservative\""}
+			return
+		}
+	}
+
+	var res RpcEstimateSmartFee
+	spb, blocks := network.EstimateFee(int(target), conservative)
+	if blocks == 0 {
+		res.Errors = []string{"Insufficient data or no feerate found"}
+	} else {
+		res.FeeRate = spb * 1000 / 1e8
+		res.Blocks = blocks
+	}
+	resp.Result = &res
+}
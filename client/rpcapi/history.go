@@ -0,0 +1,129 @@
+package rpcapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+const MAX_HISTORY_PAGE = 1000
+
+type AddrHistEntry struct {
+	Txid        string `json:"txid"`
+	Height      uint32 `json:"height"`
+	Type        string `json:"type"`  // "funding" or "spending"
+	Index       uint32 `json:"index"` // vout or vin
+	Value       uint64 `json:"value"`
+	SpentHeight uint32 `json:"spent_height,omitempty"`
+}
+
+type AddrHistResponse struct {
+	Address    string           `json:"address"`
+	ScriptHash string           `json:"scripthash"` // Electrum style (reversed)
+	Status     string           `json:"status"`
+	Height     uint32           `json:"height"` // the index is up to date with this block
+	Total      int              `json:"total"`
+	History    []*AddrHistEntry `json:"history"`
+}
+
+type AddrBalanceResponse struct {
+	Address    string `json:"address"`
+	Confirmed  uint64 `json:"confirmed"`
+	UnspentCnt int    `json:"unspent_count"`
+	Height     uint32 `json:"height"`
+}
+
+func addr_hist_params(cmd *RpcCommand, usage string, resp *RpcResponse) (addr string, sh []byte, nums []int) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		resp.Error = RpcError{Code: -1, Message: usage}
+		return
+	}
+	addr, _ = uu[0].(string)
+	var e error
+	if sh, e = usif.AddrScriptHash(addr); e != nil {
+		resp.Error = RpcError{Code: -5, Message: e.Error()}
+		return
+	}
+	for _, v := range uu[1:] {
+		n, _ := v.(json.Number)
+		i, _ := n.Int64()
+		nums = append(nums, int(i))
+	}
+	return
+}
+
+func reversed_hex(b []byte) string {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return hex.EncodeToString(r)
+}
+
+// GetAddressHistory implements: getaddresshistory "address" (skip) (count)
+func GetAddressHistory(cmd *RpcCommand, resp *RpcResponse) {
+	addr, sh, nums := addr_hist_params(cmd, "getaddresshistory \"address\" (skip) (count)", resp)
+	if sh == nil {
+		return
+	}
+	skip, count := 0, 100
+	if len(nums) > 0 && nums[0] > 0 {
+		skip = nums[0]
+	}
+	if len(nums) > 1 && nums[1] > 0 {
+		count = nums[1]
+	}
+	if count > MAX_HISTORY_PAGE {
+		count = MAX_HISTORY_PAGE
+	}
+
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	recs := hi.Records(sh)
+	height := hi.Height
+	hi.Unlock()
+
+	txs := chain.HistTxs(recs)
+	txids := make([]*btc.Uint256, len(txs))
+	heights := make([]int, len(txs))
+	for i, r := range txs {
+		txids[i], heights[i] = r.TxID, int(r.Height)
+	}
+
+	res := &AddrHistResponse{Address: addr, ScriptHash: reversed_hex(sh), Status: chain.HistStatus(txids, heights),
+		Height: height, Total: len(recs), History: []*AddrHistEntry{}}
+	if skip < len(recs) {
+		recs = recs[skip:]
+		if len(recs) > count {
+			recs = recs[:count]
+		}
+		for _, r := range recs {
+			e := &AddrHistEntry{Txid: r.TxID.String(), Height: r.Height, Type: "funding", Index: r.Index,
+				Value: r.Value, SpentHeight: r.SpentHeight}
+			if r.Spending {
+				e.Type = "spending"
+			}
+			res.History = append(res.History, e)
+		}
+	}
+	resp.Result = res
+}
+
+// GetAddressBalance implements: getaddressbalance "address"
+func GetAddressBalance(cmd *RpcCommand, resp *RpcResponse) {
+	addr, sh, _ := addr_hist_params(cmd, "getaddressbalance \"address\"", resp)
+	if sh == nil {
+		return
+	}
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	unsp, bal := hi.Unspent(sh)
+	height := hi.Height
+	hi.Unlock()
+	resp.Result = &AddrBalanceResponse{Address: addr, Confirmed: bal, UnspentCnt: len(unsp), Height: height}
+}
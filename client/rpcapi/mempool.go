@@ -0,0 +1,121 @@
+package rpcapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+)
+
+const (
+	DEFAULT_MAX_FEE_RATE = 0.10 // BTC/kvB
+)
+
+type RpcTestAcceptFees struct {
+	Base             float64 `json:"base"`              // BTC
+	EffectiveFeeRate float64 `json:"effective-feerate"` // BTC/kvB
+}
+
+type RpcTestAcceptResult struct {
+	Txid         string             `json:"txid"`
+	Wtxid        string             `json:"wtxid"`
+	Allowed      bool               `json:"allowed"`
+	Vsize        int                `json:"vsize,omitempty"`
+	Fees         *RpcTestAcceptFees `json:"fees,omitempty"`
+	RejectReason string             `json:"reject-reason,omitempty"`
+}
+
+// TestMempoolAccept implements: testmempoolaccept ["rawtx",...] ( maxfeerate )
+// The reject reasons are the ones shown in the WebUI (see mempool.ReasonToString).
+func TestMempoolAccept(cmd *RpcCommand, resp *RpcResponse) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		resp.Error = RpcError{Code: -1, Message: "testmempoolaccept [\"rawtx\",...] ( maxfeerate )"}
+		return
+	}
+	raws, ok := uu[0].([]interface{})
+	if !ok || len(raws) < 1 || len(raws) > network.MAX_PACKAGE_COUNT {
+		resp.Error = RpcError{Code: -8, Message: "Array must contain between 1 and 25 transactions."}
+		return
+	}
+	max_rate := DEFAULT_MAX_FEE_RATE
+	if len(uu) > 1 {
+		n, _ := uu[1].(json.Number)
+		v, e := n.Float64()
+		if e != nil || v < 0 {
+			resp.Error = RpcError{Code: -3, Message: "Invalid maxfeerate"}
+			return
+		}
+		max_rate = v
+	}
+
+	txs := make([]*btc.Tx, len(raws))
+	for i := range raws {
+		var le int
+		s, _ := raws[i].(string)
+		raw, e := hex.DecodeString(s)
+		if e == nil {
+			txs[i], le = btc.NewTx(raw)
+		}
+		if txs[i] == nil || le != len(raw) || len(txs[i].TxIn) < 1 {
+			resp.Error = RpcError{Code: -22, Message: "TX decode failed: " + s}
+			return
+		}
+		txs[i].SetHash(raw)
+	}
+
+	res := make([]RpcTestAcceptResult, len(txs))
+	for i, r := range network.TestNetTxs(txs) {
+		res[i].Txid = txs[i].Hash.String()
+		res[i].Wtxid = txs[i].WTxID().String()
+		if r.Reason != 0 {
+			res[i].RejectReason = mempool.ReasonToString(r.Reason)
+			continue
+		}
+		rate := r.SPB * 1000 / 1e8
+		if max_rate != 0 && rate > max_rate {
+			res[i].RejectReason = "MAX_FEE_EXCEEDED"
+			continue
+		}
+		res[i].Allowed = true
+		res[i].Vsize = r.VSize
+		res[i].Fees = &RpcTestAcceptFees{Base: float64(r.Fee) / 1e8, EffectiveFeeRate: rate}
+	}
+	resp.Result = res
+}
+
+// PrioritiseTransaction implements: prioritisetransaction "txid" ( dummy ) fee_delta
+// The fee delta (in satoshis) affects the block templates and eviction.
+// It is saved along with the memory pool.
+func PrioritiseTransaction(cmd *RpcCommand, resp *RpcResponse) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 3 {
+		resp.Error = RpcError{Code: -1, Message: "prioritisetransaction \"txid\" ( dummy ) fee_delta"}
+		return
+	}
+	str, _ := uu[0].(string)
+	txid := btc.NewUint256FromString(str)
+	if txid == nil {
+		resp.Error = RpcError{Code: -8, Message: "txid must be of length 64"}
+		return
+	}
+	if uu[1] != nil {
+		if n, _ := uu[1].(json.Number); n != "0" {
+			resp.Error = RpcError{Code: -8, Message: "Priority is no longer supported, dummy argument to prioritisetransaction must be 0."}
+			return
+		}
+	}
+	n, _ := uu[2].(json.Number)
+	delta, e := n.Int64()
+	if e != nil {
+		resp.Error = RpcError{Code: -3, Message: "fee_delta must be an integer (satoshis)"}
+		return
+	}
+
+	network.TxPool.Lock()
+	network.TxPool.Prioritise(txid, delta)
+	network.TxPool.Unlock()
+	resp.Result = true
+}
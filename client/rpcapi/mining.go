@@ -1,17 +1,26 @@
 package rpcapi
 
 import (
-	"sort"
 	"time"
+	"strconv"
 	"encoding/hex"
 	"fmt"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
 )
 
 const MAX_TXS_LEN = 999e3 // 999KB, with 1KB margin to not exceed 1MB with conibase
 
+const (
+	LONGPOLL_TIP_CHECK = 250*time.Millisecond // how often the long polling checks for a new top block
+	LONGPOLL_FEE_CHECK = 10*time.Second // ... and for the fees, if the mempool has changed
+	LONGPOLL_FEE_GAIN = 100 // a new template is given once its fees grow by 1/100th
+	LONGPOLL_TIMEOUT = 5*time.Minute // ... or after this time anyway
+)
+
 type OneTransaction struct {
 	Data string `json:"data"`
 	Hash string `json:"hash"`
@@ -23,6 +32,9 @@ type OneTransaction struct {
 type GetBlockTemplateResp struct {
 	Capabilities []string `json:"capabilities"`
 	Version uint32 `json:"version"`
+	Rules []string `json:"rules"`
+	Vbavailable map[string]uint `json:"vbavailable"`
+	Vbrequired uint32 `json:"vbrequired"`
 	PreviousBlockHash string `json:"previousblockhash"`
 	Transactions []OneTransaction `json:"transactions"`
 	Coinbaseaux struct {
@@ -61,13 +73,13 @@ func GetNextBlockTemplate(r *GetBlockTemplateResp) {
 	bits := common.BlockChain.GetNextWorkRequired(common.Last.Block, uint32(r.Curtime))
 	target := btc.SetCompact(bits).Bytes()
 
-	r.Capabilities = []string{"proposal"}
-	r.Version = 4
+	r.Capabilities = []string{"proposal", "longpoll"}
+	r.Version, r.Rules, r.Vbavailable = versionBits(common.Last.Block)
 	r.PreviousBlockHash = common.Last.Block.BlockHash.String()
 	r.Transactions, r.Coinbasevalue = GetTransactions(height, uint32(r.Mintime))
+	r.Longpollid = longPollId(r.PreviousBlockHash, r.Coinbasevalue)
 	r.Coinbasevalue += btc.GetBlockReward(height)
 	r.Coinbaseaux.Flags = ""
-	r.Longpollid = r.PreviousBlockHash
 	r.Target = hex.EncodeToString(append(zer[:32-len(target)], target...))
 	r.Mutable = []string{"time","transactions","prevblock"}
 	r.Noncerange = "00000000ffffffff"
@@ -83,116 +95,209 @@ func GetNextBlockTemplate(r *GetBlockTemplateResp) {
 }
 
 
+// GetBlockTemplate handles the request parameters of BIP22 and BIP23.
+// It returns false if resp has been set (a proposal's result or an error),
+// otherwise r gets filled with a new template - once it is there, for the long polling,
+// which is abandoned when done gets closed (the client has disconnected).
+func GetBlockTemplate(cmd *RpcCommand, resp *RpcResponse, r *GetBlockTemplateResp, done <-chan struct{}) bool {
+	var req map[string]interface{}
+	if uu, ok := cmd.Params.([]interface{}); ok && len(uu) > 0 {
+		req, _ = uu[0].(map[string]interface{})
+	}
+
+	mode, _ := req["mode"].(string)
+	switch mode {
+	case "", "template":
+	case "proposal":
+		data, _ := req["data"].(string)
+		resp.Result = CheckProposal(data, resp)
+		return false
+	default:
+		resp.Error = RpcError{Code: -8, Message: "Invalid mode"}
+		return false
+	}
+
+	if rules, ok := req["rules"].([]interface{}); ok {
+		var segwit bool
+		for _, v := range rules {
+			if s, _ := v.(string); s == "segwit" {
+				segwit = true
+			}
+		}
+		common.Last.Mutex.Lock()
+		height := common.Last.Block.Height + 1
+		common.Last.Mutex.Unlock()
+		if sw := common.BlockChain.Consensus.Enforce_SEGWIT; !segwit && sw != 0 && height >= sw {
+			resp.Error = RpcError{Code: -8, Message: "getblocktemplate must be called with the segwit rule set"}
+			return false
+		}
+	}
 
-/* memory pool transaction sorting stuff */
-type one_mining_tx struct {
-	*network.OneTxToSend
-	depends []uint
-	startat int
+	if lpid, ok := req["longpollid"].(string); ok && !longPollWait(lpid, done) {
+		resp.Error = RpcError{Code: -1, Message: "Client disconnected"}
+		return false
+	}
+	GetNextBlockTemplate(r)
+	return true
 }
 
-type sortedTxList []*one_mining_tx
-func (tl sortedTxList) Len() int {return len(tl)}
-func (tl sortedTxList) Swap(i, j int)      { tl[i], tl[j] = tl[j], tl[i] }
-func (tl sortedTxList) Less(i, j int) bool { return tl[j].Fee < tl[i].Fee }
+// CheckProposal checks the block given as hex (BIP23) like any new block (see chain.CheckBlock),
+// except for the proof of work, and without storing it.
+// It returns nil if the block passes the checks, or the reason why not.
+func CheckProposal(data string, resp *RpcResponse) interface{} {
+	raw, er := hex.DecodeString(data)
+	if er != nil {
+		resp.Error = RpcError{Code: -22, Message: "Block decode failed"}
+		return nil
+	}
+	bl, er := btc.NewBlock(raw)
+	if er != nil {
+		resp.Error = RpcError{Code: -22, Message: "Block decode failed"}
+		return nil
+	}
 
+	common.Last.Mutex.Lock()
+	is_top := common.Last.Block.BlockHash.Equal(btc.NewUint256(bl.ParentHash()))
+	common.Last.Mutex.Unlock()
+	if !is_top {
+		return "inconclusive-not-best-prevblk"
+	}
 
-var txs_so_far map[[32]byte] uint
-var totlen int
-var sigops uint64
+	bl.Proposal = true
+	common.BlockChain.BlockIndexAccess.Lock()
+	er, _, _ = common.BlockChain.CheckBlock(bl)
+	common.BlockChain.BlockIndexAccess.Unlock()
+	if er != nil {
+		common.CountSafe("RPCProposalRejected")
+		return rpcResult(er.Error())
+	}
+	common.CountSafe("RPCProposalOK")
+	return nil
+}
 
-func get_next_tranche_of_txs(height, timestamp uint32) (res sortedTxList) {
-	var unsp *btc.TxOut
-	var all_inputs_found bool
-	for _, v := range network.TransactionsToSend {
-		tx := v.Tx
+// versionBits returns the version, the rules and the available BIP9 deployments for the block
+// following the given one. Only the deployments known to the chain are signalled and reported
+// (see chain.BIP9Deployment and the BIP9 section of the config).
+func versionBits(last *chain.BlockTreeNode) (version uint32, rules []string, available map[string]uint) {
+	height := last.Height + 1
+	rules = []string{}
+	if csv := common.BlockChain.Consensus.Enforce_CSV; csv != 0 && height >= csv {
+		rules = append(rules, "csv")
+	}
+	if sw := common.BlockChain.Consensus.Enforce_SEGWIT; sw != 0 && height >= sw {
+		rules = append(rules, "!segwit")
+	}
 
-		if _, ok := txs_so_far[tx.Hash.Hash]; ok {
-			continue
+	version = common.BlockChain.BIP9Version(last)
+	available = make(map[string]uint)
+	for i, state := range common.BlockChain.BIP9States(last) {
+		d := common.BlockChain.Consensus.BIP9[i]
+		switch state {
+		case chain.BIP9_STARTED, chain.BIP9_LOCKED_IN:
+			available[d.Name] = uint(d.Bit)
+		case chain.BIP9_ACTIVE:
+			rules = append(rules, d.Name)
 		}
+	}
+	return
+}
 
-		if !tx.IsFinal(height, timestamp) {
-			continue
-		}
+// longPollId identifies the template by its parent and the fees.
+func longPollId(prev string, fees uint64) string {
+	return fmt.Sprint(prev, fees)
+}
 
-		if totlen+len(v.Raw) > 1e6 {
-			//println("Too many txs - limit to 999000 bytes")
-			return
-		}
-		totlen += len(v.Raw)
+// longPollWait blocks until there is a new top block, until the fees of a new template
+// would be noticeably higher than in the one identified by lpid, or for LONGPOLL_TIMEOUT.
+// It returns false if the client has gone (done closed) in the meantime.
+func longPollWait(lpid string, done <-chan struct{}) bool {
+	if len(lpid) <= 64 {
+		return true
+	}
+	prev := lpid[:64]
+	fees, er := strconv.ParseUint(lpid[64:], 10, 64)
+	if er != nil {
+		return true
+	}
+	min_fees := fees + fees/LONGPOLL_FEE_GAIN
+	if min_fees == fees {
+		min_fees++
+	}
 
-		if sigops + v.SigopsCost > btc.MAX_BLOCK_SIGOPS_COST {
-			//println("Too many sigops - limit to 999000 bytes")
-			return
+	var pool_size uint64
+	next_fee_check := time.Now().Add(LONGPOLL_FEE_CHECK)
+	timeout := time.After(LONGPOLL_TIMEOUT)
+	tick := time.NewTicker(LONGPOLL_TIP_CHECK)
+	defer tick.Stop()
+	for {
+		common.Last.Mutex.Lock()
+		same_tip := common.Last.Block.BlockHash.String() == prev
+		height := common.Last.Block.Height + 1
+		mintime := common.Last.Block.GetMedianTimePast() + 1
+		common.Last.Mutex.Unlock()
+		if !same_tip {
+			common.CountSafe("RPCLongPollTip")
+			return true
 		}
-		sigops += v.SigopsCost
-
-		all_inputs_found = true
-		var depends []uint
-		for i := range tx.TxIn {
-			unsp = common.BlockChain.Unspent.UnspentGet(&tx.TxIn[i].Input)
-			if unsp==nil {
-				// not found in the confirmed blocks
-				// check if txid is in txs_so_far
-				if idx, ok := txs_so_far[tx.TxIn[i].Input.Hash]; !ok {
-					// also not in txs_so_far
-					all_inputs_found = false
-					break
-				} else {
-					depends = append(depends, idx)
+
+		if time.Now().After(next_fee_check) {
+			next_fee_check = time.Now().Add(LONGPOLL_FEE_CHECK)
+			network.TxPool.Lock()
+			if network.TxPool.TransactionsToSendSize != pool_size {
+				pool_size = network.TxPool.TransactionsToSendSize
+				fees = 0
+				for _, t2s := range blockTxs(height, mintime) {
+					fees += t2s.Fee
 				}
 			}
+			network.TxPool.Unlock()
+			if fees >= min_fees {
+				common.CountSafe("RPCLongPollFees")
+				return true
+			}
 		}
 
-		if all_inputs_found {
-			res = append(res, &one_mining_tx{OneTxToSend:v, depends:depends, startat:1+len(txs_so_far)})
+		select {
+		case <-tick.C:
+		case <-timeout:
+			common.CountSafe("RPCLongPollTimeout")
+			return true
+		case <-done:
+			common.CountSafe("RPCLongPollGone")
+			return false
 		}
 	}
-	return
 }
 
-func GetTransactions(height, timestamp uint32) (res []OneTransaction, totfees uint64) {
-
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
-
-	var cnt int
-	var sorted sortedTxList
-	txs_so_far = make(map[[32]byte]uint)
-	totlen = 0
-	sigops = 0
-	//println("\ngetting txs from the pool of", len(network.TransactionsToSend), "...")
-	for {
-		new_piece := get_next_tranche_of_txs(height, timestamp)
-		if new_piece.Len()==0 {
-			break
-		}
-		//println("adding another", len(new_piece))
-		sort.Sort(new_piece)
+// blockTxs returns the mempool txs for a new block, selected by chunks of the mempool clusters
+// (see lib/mempool/cluster.go), leaving some weight for the coinbase.
+// Make sure to call it with TxPool locked.
+func blockTxs(height, timestamp uint32) []*mempool.OneTxToSend {
+	return network.TxPool.GetBlockTxs(btc.MAX_BLOCK_WEIGHT-4000, btc.MAX_BLOCK_SIGOPS_COST,
+		func(t2s *mempool.OneTxToSend) bool { return t2s.IsFinal(height, timestamp) })
+}
 
-		for i:=0; i<len(new_piece); i++ {
-			txs_so_far[new_piece[i].Tx.Hash.Hash] = uint(1+len(sorted)+i)
-		}
+// GetTransactions returns the txs for a new block (see blockTxs), in the getblocktemplate format.
+func GetTransactions(height, timestamp uint32) (res []OneTransaction, totfees uint64) {
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
-		sorted = append(sorted, new_piece...)
-	}
-	/*if len(txs_so_far)!=len(network.TransactionsToSend) {
-		println("ERROR: txs_so_far len", len(txs_so_far), " - please report!")
-	}*/
-	txs_so_far = nil // leave it for the garbage collector
+	txs := blockTxs(height, timestamp)
 
-	res = make([]OneTransaction, len(sorted))
-	for cnt=0; cnt<len(sorted); cnt++ {
-		v := sorted[cnt]
+	idx := make(map[[32]byte]uint, len(txs))
+	res = make([]OneTransaction, len(txs))
+	for cnt, v := range txs {
+		idx[v.Hash.Hash] = uint(cnt + 1)
 		res[cnt].Data = hex.EncodeToString(v.Raw)
 		res[cnt].Hash = v.Tx.Hash.String()
 		res[cnt].Fee = v.Fee
 		res[cnt].Sigops = v.SigopsCost
-		res[cnt].Depends = v.depends
+		for i := range v.TxIn {
+			if d, ok := idx[v.TxIn[i].Input.Hash]; ok {
+				res[cnt].Depends = append(res[cnt].Depends, d)
+			}
+		}
 		totfees += v.Fee
-		//println("", cnt+1, v.Tx.Hash.String(), "  turn:", v.startat, "  spb:", int(v.Fee)/len(v.Data), "  depend:", fmt.Sprint(v.depends))
 	}
-
-	//println("returning transacitons:", totlen, len(res))
 	return
 }
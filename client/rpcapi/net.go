@@ -0,0 +1,82 @@
+package rpcapi
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/others/peersdb"
+)
+
+type BannedResponse struct {
+	Address       string `json:"address"`
+	BanCreated    int64  `json:"ban_created"`
+	BannedUntil   int64  `json:"banned_until"`
+	BanDuration   int64  `json:"ban_duration"`
+	TimeRemaining int64  `json:"time_remaining"`
+	BanReason     string `json:"ban_reason"`
+}
+
+// SetBan implements: setban "subnet" "add|remove" (bantime) (absolute)
+func SetBan(cmd *RpcCommand, resp *RpcResponse) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 2 {
+		resp.Error = RpcError{Code: -1, Message: "setban \"subnet\" \"add|remove\" (bantime) (absolute)"}
+		return
+	}
+	str, _ := uu[0].(string)
+	subnet, er := peersdb.ParseSubnet(str)
+	if er != nil {
+		resp.Error = RpcError{Code: -30, Message: "Error: Invalid IP/Subnet"}
+		return
+	}
+
+	switch uu[1] {
+	case "add":
+		if peersdb.IsSubnetBanned(subnet) != nil { // a narrower ban inside a wider one is fine
+			resp.Error = RpcError{Code: -23, Message: "Error: IP/Subnet already banned"}
+			return
+		}
+		var bantime int64
+		var absolute bool
+		if len(uu) > 2 {
+			if n, ok := uu[2].(json.Number); ok {
+				bantime, _ = n.Int64()
+			}
+		}
+		if len(uu) > 3 {
+			absolute, _ = uu[3].(bool)
+		}
+		if absolute && bantime > 0 {
+			peersdb.BanSubnetUntil(subnet, time.Unix(bantime, 0), "rpc")
+		} else {
+			peersdb.BanSubnet(subnet, time.Duration(bantime)*time.Second, "rpc")
+		}
+		network.DropSubnet(subnet)
+
+	case "remove":
+		if !peersdb.Unban(subnet) {
+			resp.Error = RpcError{Code: -30, Message: "Error: Unban failed. Requested address/subnet was not previously manually banned."}
+			return
+		}
+
+	default:
+		resp.Error = RpcError{Code: -1, Message: "setban: the command must be \"add\" or \"remove\""}
+	}
+}
+
+// ListBanned implements: listbanned
+func ListBanned(resp *RpcResponse) {
+	now := time.Now().Unix()
+	res := []BannedResponse{}
+	for _, b := range peersdb.ListBans() {
+		res = append(res, BannedResponse{Address: b.Address, BanCreated: b.Created, BannedUntil: b.Until,
+			BanDuration: b.Until - b.Created, TimeRemaining: b.Until - now, BanReason: b.Reason})
+	}
+	resp.Result = res
+}
+
+// ClearBanned implements: clearbanned
+func ClearBanned(resp *RpcResponse) {
+	peersdb.ClearBans()
+}
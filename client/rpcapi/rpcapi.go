@@ -73,7 +73,10 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 		case "getblocktemplate":
 			var resp_my RpcGetBlockTemplateResp
 
-			GetNextBlockTemplate(&resp_my.Result)
+			if !GetBlockTemplate(&RpcCmd, &resp, &resp_my.Result, r.Context().Done()) {
+				break // a proposal or an error
+			}
+			resp_my.Id = RpcCmd.Id
 
 			if false {
 				var resp_ok RpcGetBlockTemplateResp
@@ -123,6 +126,41 @@ func my_handler(w http.ResponseWriter, r *http.Request) {
 			//ioutil.WriteFile("submitblock.json", b, 0777)
 			SubmitBlock(&RpcCmd, &resp, b)
 
+		case "setban":
+			SetBan(&RpcCmd, &resp)
+
+		case "listbanned":
+			ListBanned(&resp)
+
+		case "clearbanned":
+			ClearBanned(&resp)
+		case "getrawtransaction":
+			GetRawTransaction(&RpcCmd, &resp)
+		case "getaddresshistory":
+			GetAddressHistory(&RpcCmd, &resp)
+		case "getaddressbalance":
+			GetAddressBalance(&RpcCmd, &resp)
+		case "invalidateblock":
+			ChainCommand(&RpcCmd, &resp, "invalidate")
+		case "reconsiderblock":
+			ChainCommand(&RpcCmd, &resp, "reconsider")
+		case "preciousblock":
+			ChainCommand(&RpcCmd, &resp, "precious")
+		case "verifychain":
+			VerifyChain(&RpcCmd, &resp)
+		case "gettxoutsetinfo":
+			GetTxOutSetInfo(&RpcCmd, &resp)
+		case "dumptxoutset":
+			DumpTxOutSet(&RpcCmd, &resp)
+		case "loadtxoutset":
+			LoadTxOutSet(&RpcCmd, &resp)
+		case "estimatesmartfee":
+			EstimateSmartFee(&RpcCmd, &resp)
+		case "testmempoolaccept":
+			TestMempoolAccept(&RpcCmd, &resp)
+		case "prioritisetransaction":
+			PrioritiseTransaction(&RpcCmd, &resp)
+
 		default:
 			fmt.Println("Method:", RpcCmd.Method, len(b))
 			//w.Write(bitcoind_result)
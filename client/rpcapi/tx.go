@@ -0,0 +1,76 @@
+package rpcapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+type RawTxResponse struct {
+	Hex           string `json:"hex"`
+	Txid          string `json:"txid"`
+	Hash          string `json:"hash"`
+	Size          int    `json:"size"`
+	Vsize         int    `json:"vsize"`
+	Weight        int    `json:"weight"`
+	Version       uint32 `json:"version"`
+	Locktime      uint32 `json:"locktime"`
+	Blockhash     string `json:"blockhash,omitempty"`
+	Confirmations uint32 `json:"confirmations,omitempty"`
+	Time          uint32 `json:"time,omitempty"`
+	Blocktime     uint32 `json:"blocktime,omitempty"`
+}
+
+// GetRawTransaction implements: getrawtransaction "txid" (verbose)
+// The transaction is looked for in the memory pool and then in the txindex.
+func GetRawTransaction(cmd *RpcCommand, resp *RpcResponse) {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		resp.Error = RpcError{Code: -1, Message: "getrawtransaction \"txid\" (verbose)"}
+		return
+	}
+	str, _ := uu[0].(string)
+	txid := btc.NewUint256FromString(str)
+	if txid == nil {
+		resp.Error = RpcError{Code: -8, Message: "txid must be of length 64"}
+		return
+	}
+	var verbose bool
+	if len(uu) > 1 {
+		switch v := uu[1].(type) {
+		case bool:
+			verbose = v
+		case json.Number:
+			n, _ := v.Int64()
+			verbose = n != 0
+		}
+	}
+
+	tx, bn, er := usif.FindTx(txid)
+	if er != nil {
+		msg := "No such mempool transaction. Use -txindex or provide a block hash to enable blockchain transaction queries."
+		if common.BlockChain.TxIndex != nil {
+			msg = "No such mempool or blockchain transaction."
+		}
+		resp.Error = RpcError{Code: -5, Message: msg}
+		return
+	}
+
+	if !verbose {
+		resp.Result = hex.EncodeToString(tx.Raw)
+		return
+	}
+
+	res := &RawTxResponse{Hex: hex.EncodeToString(tx.Raw), Txid: tx.Hash.String(), Hash: tx.WTxID().String(),
+		Size: len(tx.Raw), Vsize: tx.VSize(), Weight: tx.Weight(), Version: tx.Version, Locktime: tx.Lock_time}
+	if bn != nil {
+		res.Blockhash = bn.BlockHash.String()
+		res.Confirmations = common.Last.BlockHeight() - bn.Height + 1
+		res.Time = bn.Timestamp()
+		res.Blocktime = bn.Timestamp()
+	}
+	resp.Result = res
+}
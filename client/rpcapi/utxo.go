@@ -0,0 +1,127 @@
+package rpcapi
+
+import (
+	"path/filepath"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/usif"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+type DumpTxOutSetResponse struct {
+	CoinsWritten uint64 `json:"coins_written"`
+	BaseHash     string `json:"base_hash"`
+	BaseHeight   uint32 `json:"base_height"`
+	Path         string `json:"path"`
+	TxOutSetHash string `json:"txoutset_hash"`
+}
+
+type LoadTxOutSetResponse struct {
+	CoinsLoaded uint64 `json:"coins_loaded"`
+	TipHash     string `json:"tip_hash"`
+	BaseHeight  uint32 `json:"base_height"`
+	Path        string `json:"path"`
+}
+
+type TxOutSetInfoResponse struct {
+	Height          uint32  `json:"height"`
+	BestBlock       string  `json:"bestblock"`
+	TxOuts          uint64  `json:"txouts"`
+	BogoSize        uint64  `json:"bogosize"`
+	HashSerialized3 string  `json:"hash_serialized_3,omitempty"`
+	MuHash          string  `json:"muhash,omitempty"`
+	TotalAmount     float64 `json:"total_amount"`
+	Transactions    uint64  `json:"transactions"`
+}
+
+// GetTxOutSetInfo implements: gettxoutsetinfo ("hash_type")
+func GetTxOutSetInfo(cmd *RpcCommand, resp *RpcResponse) {
+	hash_type := "hash_serialized_3"
+	if uu, ok := cmd.Params.([]interface{}); ok && len(uu) > 0 {
+		hash_type, _ = uu[0].(string)
+	}
+	if hash_type != "hash_serialized_3" && hash_type != "muhash" && hash_type != "none" {
+		resp.Error = RpcError{Code: -8, Message: "hash_type '" + hash_type + "' is not a valid hash_type"}
+		return
+	}
+
+	info := common.BlockChain.Unspent.GetTxOutSetInfo(hash_type == "hash_serialized_3", hash_type == "muhash")
+	res := &TxOutSetInfoResponse{Height: info.Height, BestBlock: btc.NewUint256(info.BlockHash).String(),
+		TxOuts: info.TxOuts, BogoSize: info.BogoSize, TotalAmount: float64(info.TotalAmount) / 1e8,
+		Transactions: info.Transactions}
+	if info.HashSerialized != nil {
+		res.HashSerialized3 = btc.NewUint256(info.HashSerialized[:]).String()
+	}
+	if info.MuHash != nil {
+		res.MuHash = btc.NewUint256(info.MuHash[:]).String()
+	}
+	resp.Result = res
+}
+
+// snapshot_path returns the path from the first parameter; relative paths are in the data directory.
+func snapshot_path(cmd *RpcCommand) string {
+	uu, ok := cmd.Params.([]interface{})
+	if !ok || len(uu) < 1 {
+		return ""
+	}
+	str, _ := uu[0].(string)
+	if str == "" || filepath.IsAbs(str) {
+		return str
+	}
+	return filepath.Join(common.GocoinHomeDir, str)
+}
+
+// DumpTxOutSet implements: dumptxoutset "path"
+func DumpTxOutSet(cmd *RpcCommand, resp *RpcResponse) {
+	fname := snapshot_path(cmd)
+	if fname == "" {
+		resp.Error = RpcError{Code: -1, Message: "dumptxoutset \"path\""}
+		return
+	}
+
+	var hash *btc.Uint256
+	var cnt uint64
+	var last *chain.BlockTreeNode
+	var e error
+	req := &usif.OneUiReq{Handler: func(string) {
+		last = common.BlockChain.LastBlock()
+		hash, cnt, e = usif.DumpUTXO(fname)
+	}}
+	req.Done.Add(1)
+	usif.UiChannel <- req
+	req.Done.Wait()
+
+	if e != nil {
+		resp.Error = RpcError{Code: -1, Message: e.Error()}
+		return
+	}
+	resp.Result = &DumpTxOutSetResponse{CoinsWritten: cnt, BaseHash: last.BlockHash.String(),
+		BaseHeight: last.Height, Path: fname, TxOutSetHash: hash.String()}
+}
+
+// LoadTxOutSet implements: loadtxoutset "path"
+func LoadTxOutSet(cmd *RpcCommand, resp *RpcResponse) {
+	fname := snapshot_path(cmd)
+	if fname == "" {
+		resp.Error = RpcError{Code: -1, Message: "loadtxoutset \"path\""}
+		return
+	}
+
+	var base *chain.BlockTreeNode
+	var cnt uint64
+	var e error
+	req := &usif.OneUiReq{Handler: func(string) {
+		base, cnt, e = usif.LoadUTXO(fname, nil)
+	}}
+	req.Done.Add(1)
+	usif.UiChannel <- req
+	req.Done.Wait()
+
+	if e != nil {
+		resp.Error = RpcError{Code: -32603, Message: "Unable to load UTXO snapshot: " + e.Error()}
+		return
+	}
+	resp.Result = &LoadTxOutSetResponse{CoinsLoaded: cnt,
+		TipHash: base.BlockHash.String(), BaseHeight: base.Height, Path: fname}
+}
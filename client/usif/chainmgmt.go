@@ -0,0 +1,181 @@
+package usif
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+var (
+	verify_chain_mutex   sync.Mutex
+	verify_chain_status  string
+	verify_chain_running bool
+	verify_chain_abort   bool
+	verify_chain_done    sync.WaitGroup
+)
+
+// VerifyChainStatus returns the progress of the chain verification, or an empty string if none is running.
+func VerifyChainStatus() (s string) {
+	verify_chain_mutex.Lock()
+	s = verify_chain_status
+	verify_chain_mutex.Unlock()
+	return
+}
+
+func setVerifyChainStatus(s string) {
+	verify_chain_mutex.Lock()
+	verify_chain_status = s
+	verify_chain_mutex.Unlock()
+}
+
+// VerifyChain starts checking the last depth blocks of the chain at the given level (see chain.VerifyChain)
+// in the background. Its progress is reported by VerifyChainStatus and it can be stopped by AbortVerifyChain.
+// For the levels 3 and up, the main thread gets stopped while the blocks are disconnected and connected back.
+// When finished, done (if not nil) is called with the result, from the verifying goroutine.
+func VerifyChain(level, depth uint32, done func(error)) (e error) {
+	common.Last.Mutex.Lock()
+	parsing := common.Last.ParseTill != nil
+	common.Last.Mutex.Unlock()
+	if parsing {
+		return errors.New("the initial blocks parsing is in progress")
+	}
+
+	verify_chain_mutex.Lock()
+	defer verify_chain_mutex.Unlock()
+	if verify_chain_running {
+		return errors.New("the chain verification is already in progress")
+	}
+	verify_chain_running, verify_chain_abort = true, false
+	verify_chain_status = "Starting"
+	verify_chain_done.Add(1)
+
+	go func() {
+		var lck *OneLock
+		e := common.BlockChain.VerifyChain(level, depth, &chain.VerifyChainOpts{
+			Progress: func(s string) {
+				setVerifyChainStatus(fmt.Sprint("Level ", level, ": ", s))
+			},
+			Abort: func() (res bool) {
+				verify_chain_mutex.Lock()
+				res = verify_chain_abort
+				verify_chain_mutex.Unlock()
+				return
+			},
+			Lock: func() {
+				lck = new(OneLock)
+				lck.In.Add(1)
+				lck.Out.Add(1)
+				LocksChan <- lck
+				lck.In.Wait()
+			},
+			Unlock: func() {
+				// if a block could not be connected back, the chain is not where it was
+				common.Last.Mutex.Lock()
+				common.Last.Block = common.BlockChain.LastBlock()
+				common.Last.Mutex.Unlock()
+				lck.Out.Done()
+			},
+		})
+
+		if e != nil {
+			common.CountSafe("VerifyChainFailed")
+		} else {
+			common.CountSafe("VerifyChainOK")
+		}
+		verify_chain_mutex.Lock()
+		verify_chain_running = false
+		verify_chain_status = ""
+		verify_chain_mutex.Unlock()
+		if done != nil {
+			done(e)
+		}
+		verify_chain_done.Done()
+	}()
+	return
+}
+
+// AbortVerifyChain stops the chain verification started by VerifyChain, if it is running.
+// Call it from the main thread (it serves LocksChan while waiting), i.e. before closing the chain.
+func AbortVerifyChain() {
+	verify_chain_mutex.Lock()
+	verify_chain_abort = true
+	verify_chain_mutex.Unlock()
+
+	finished := make(chan bool)
+	go func() {
+		verify_chain_done.Wait()
+		close(finished)
+	}()
+	for {
+		select {
+		case rec := <-LocksChan: // the verification might be waiting for the main thread
+			rec.In.Done()
+			rec.Out.Wait()
+		case <-finished:
+			return
+		}
+	}
+}
+
+// ChainCommand executes one of the chain management commands: "invalidate", "reconsider" or "precious"
+// on the given block and brings the node's state in line with the new chain's head.
+// Call it from the main thread (e.g. via UiChannel).
+func ChainCommand(cmd string, hash *btc.Uint256) (e error) {
+	common.Last.Mutex.Lock()
+	parsing := common.Last.ParseTill != nil
+	common.Last.Mutex.Unlock()
+	if parsing {
+		return errors.New("the initial blocks parsing is in progress")
+	}
+
+	switch cmd {
+	case "invalidate":
+		e = common.BlockChain.InvalidateBlock(hash)
+	case "reconsider":
+		e = common.BlockChain.ReconsiderBlock(hash)
+	case "precious":
+		e = common.BlockChain.PreciousBlock(hash)
+	default:
+		return errors.New("unknown command " + cmd)
+	}
+
+	common.Last.Mutex.Lock()
+	common.Last.Block = common.BlockChain.LastBlock()
+	common.Last.Time = time.Now()
+	common.Last.Mutex.Unlock()
+
+	// forget the blocks that are not in the tree anymore
+	inTree := func(n *btc.Uint256) bool {
+		common.BlockChain.BlockIndexAccess.Lock()
+		_, ok := common.BlockChain.BlockIndex[n.BIdx()]
+		common.BlockChain.BlockIndexAccess.Unlock()
+		return ok
+	}
+	network.MutexRcv.Lock()
+	for idx, b2g := range network.BlocksToGet {
+		if !inTree(b2g.BlockTreeNode.BlockHash) {
+			network.DelB2G(idx)
+		}
+	}
+	network.LastCommitedHeader, _ = common.BlockChain.BlockTreeRoot.FindFarthestNode()
+	network.MutexRcv.Unlock()
+
+	var cached []*network.BlockRcvd
+	for _, newbl := range network.CachedBlocks {
+		if inTree(newbl.BlockTreeNode.BlockHash) {
+			cached = append(cached, newbl)
+		} else if newbl.Block == nil {
+			os.Remove(common.TempBlocksDir() + newbl.BlockTreeNode.BlockHash.String())
+		}
+	}
+	network.CachedBlocks = cached
+	network.CachedBlocksLen.Store(len(network.CachedBlocks))
+	return
+}
@@ -0,0 +1,59 @@
+package usif
+
+import (
+	"errors"
+	"os"
+
+	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+)
+
+// DumpUTXO writes the current UTXO set to the given file (in the format of Bitcoin Core's dumptxoutset).
+// Call it from the main thread (e.g. via UiChannel).
+func DumpUTXO(fname string) (hash *btc.Uint256, cnt uint64, e error) {
+	return common.BlockChain.DumpSnapshot(fname, common.Magic)
+}
+
+// LoadUTXO replaces the UTXO set with the one from the given snapshot file.
+// utxohash can be nil for the snapshots that are known to the node.
+// Call it from the main thread (e.g. via UiChannel).
+func LoadUTXO(fname string, utxohash *btc.Uint256) (base *chain.BlockTreeNode, cnt uint64, e error) {
+	if common.GetBool(&common.BlockChainSynchronized) {
+		e = errors.New("the chain is already synchronized")
+		return
+	}
+	common.Last.Mutex.Lock()
+	parsing := common.Last.ParseTill != nil
+	common.Last.Mutex.Unlock()
+	if parsing {
+		e = errors.New("the initial blocks parsing is in progress")
+		return
+	}
+
+	if base, cnt, e = common.BlockChain.LoadSnapshot(fname, common.Magic, utxohash); e != nil {
+		return
+	}
+
+	common.Last.Mutex.Lock()
+	common.Last.Block = common.BlockChain.LastBlock()
+	common.Last.Mutex.Unlock()
+
+	// the blocks below the snapshot will be fetched again for the background validation
+	network.SnapshotLoaded(base)
+	var cached []*network.BlockRcvd
+	for _, newbl := range network.CachedBlocks {
+		if newbl.BlockTreeNode.Height > base.Height {
+			cached = append(cached, newbl)
+		} else if newbl.Block == nil {
+			os.Remove(common.TempBlocksDir() + newbl.BlockTreeNode.BlockHash.String())
+		}
+	}
+	network.CachedBlocks = cached
+	network.CachedBlocksLen.Store(len(network.CachedBlocks))
+
+	// we will not be able to serve the old blocks
+	common.Services = common.Services&^common.SERVICE_NETWORK | common.SERVICE_NETWORK_LIMITED
+	return
+}
@@ -5,10 +5,11 @@ import (
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"time"
 )
 
-func get_total_block_fees(txs []*network.OneTxToSend) (totfees uint64, totwgh, tcnt int) {
+func get_total_block_fees(txs []*mempool.OneTxToSend) (totfees uint64, totwgh, tcnt int) {
 	var quiet bool
 	already_in := make(map[[32]byte]bool)
 	for _, tx := range txs {
@@ -46,13 +47,17 @@ func get_total_block_fees(txs []*network.OneTxToSend) (totfees uint64, totwgh, t
 
 func new_block(par string) {
 	sta := time.Now()
-	txs := network.GetSortedMempool()
+	txs := network.TxPool.GetSortedMempool()
 	println(len(txs), "OLD tx_sort got in", time.Now().Sub(sta).String())
 
 	sta = time.Now()
-	cpfp := network.GetSortedMempoolNew()
+	cpfp := network.TxPool.GetSortedMempoolNew()
 	println(len(cpfp), "NEW tx_sort got in", time.Now().Sub(sta).String())
 
+	sta = time.Now()
+	clst := network.TxPool.GetBlockTxs(4e6, btc.MAX_BLOCK_SIGOPS_COST, nil)
+	println(len(clst), "CLUSTER tx_sort got in", time.Now().Sub(sta).String())
+
 	var totwgh, tcnt int
 	var totfees, totfees2 uint64
 	totfees, totwgh, tcnt = get_total_block_fees(txs)
@@ -66,6 +71,14 @@ func new_block(par string) {
 	} else {
 		fmt.Printf("New method -LOSE-: %.3f%%\n", 100.0*float64(totfees-totfees2)/float64(totfees))
 	}
+
+	totfees2, totwgh, tcnt = get_total_block_fees(clst)
+	fmt.Println("Fees from CLUSTER sorting:", btc.UintToBtc(totfees2), totwgh, tcnt)
+	if totfees2 > totfees {
+		fmt.Printf("Cluster method profit: %.3f%%\n", 100.0*float64(totfees2-totfees)/float64(totfees))
+	} else {
+		fmt.Printf("Cluster method -LOSE-: %.3f%%\n", 100.0*float64(totfees-totfees2)/float64(totfees))
+	}
 }
 
 func gettxchildren(par string) {
@@ -75,16 +88,16 @@ func gettxchildren(par string) {
 		return
 	}
 	bidx := txid.BIdx()
-	t2s := network.TransactionsToSend[bidx]
+	t2s := network.TxPool.TransactionsToSend[bidx]
 	if t2s == nil {
 		println(txid.String(), "not im mempool")
 		return
 	}
-	chlds := t2s.GetAllChildren()
+	chlds := network.TxPool.GetAllChildren(t2s)
 	println("has", len(chlds), "all children")
 	var tot_wg, tot_fee uint64
 	for _, tx := range chlds {
-		println(" -", tx.Hash.String(), len(tx.GetChildren()), tx.SPB(), "@", tx.Weight())
+		println(" -", tx.Hash.String(), len(network.TxPool.GetChildren(tx)), tx.SPB(), "@", tx.Weight())
 		tot_wg += uint64(tx.Weight())
 		tot_fee += tx.Fee
 		//gettxchildren(tx.Hash.String())
@@ -9,6 +9,7 @@ import (
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/lib/others/qdb"
 	"github.com/piotrnar/gocoin/lib/others/sys"
@@ -161,23 +162,23 @@ func show_info(par string) {
 		atomic.LoadUint32(&common.BlockChain.Unspent.CurrentHeightOnDisk))
 	network.Mutex_net.Unlock()
 
-	network.TxMutex.Lock()
+	network.TxPool.Lock()
 	var sw_cnt, sw_bts uint64
-	for _, v := range network.TransactionsToSend {
+	for _, v := range network.TxPool.TransactionsToSend {
 		if v.SegWit != nil {
 			sw_cnt++
 			sw_bts += uint64(v.Size)
 		}
 	}
 	fmt.Printf("Txs in mempool: %d (%sB),  Using SegWit: %d (%sB),  Rejected: %d (%sB)\n",
-		len(network.TransactionsToSend), common.UintToString(network.TransactionsToSendSize),
+		len(network.TxPool.TransactionsToSend), common.UintToString(network.TxPool.TransactionsToSendSize),
 		sw_cnt, common.UintToString(sw_bts),
-		len(network.TransactionsRejected), common.UintToString(network.TransactionsRejectedSize))
+		len(network.TxPool.TransactionsRejected), common.UintToString(network.TxPool.TransactionsRejectedSize))
 	fmt.Printf(" Wait4Input: %d (%sB),  SpentOuts: %d,  AvgFee: %.1f SpB,  Pending:%d/%d\n",
-		len(network.WaitingForInputs), common.UintToString(network.WaitingForInputsSize),
-		len(network.SpentOutputs), common.GetAverageFee(),
+		len(network.TxPool.WaitingForInputs), common.UintToString(network.TxPool.WaitingForInputsSize),
+		len(network.TxPool.SpentOutputs), common.GetAverageFee(),
 		len(network.TransactionsPending), len(network.NetTxs))
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 
 	var gs debug.GCStats
 	debug.ReadGCStats(&gs)
@@ -319,6 +320,133 @@ func blchain_utxodb(par string) {
 	fmt.Println(common.BlockChain.Unspent.UTXOStats())
 }
 
+func dump_utxo(par string) {
+	fname := strings.TrimSpace(par)
+	if fname == "" {
+		fname = fmt.Sprintf("utxo-%d.dat", common.BlockChain.LastBlock().Height)
+	}
+	sta := time.Now()
+	hash, cnt, e := usif.DumpUTXO(fname)
+	if e != nil {
+		fmt.Println("Error:", e.Error())
+		return
+	}
+	fmt.Println(cnt, "coins written to", fname, "in", time.Now().Sub(sta).String())
+	fmt.Println("UTXO hash:", hash.String())
+}
+
+func load_utxo(par string) {
+	ps := strings.Fields(par)
+	if len(ps) == 0 {
+		if sc := common.BlockChain.SnapshotCheck; sc != nil {
+			fmt.Println(sc.Status())
+		} else {
+			fmt.Println("No UTXO snapshot is being validated")
+			fmt.Println("Specify the snapshot file (and optionally its UTXO hash) to load it")
+		}
+		return
+	}
+	var utxohash *btc.Uint256
+	if len(ps) > 1 {
+		if utxohash = btc.NewUint256FromString(ps[1]); utxohash == nil {
+			fmt.Println("Bad UTXO hash")
+			return
+		}
+	}
+	sta := time.Now()
+	base, cnt, e := usif.LoadUTXO(ps[0], utxohash)
+	if e != nil {
+		fmt.Println("Error:", e.Error())
+		return
+	}
+	fmt.Println(cnt, "coins loaded in", time.Now().Sub(sta).String(), "- the chain is now at block", base.Height)
+	fmt.Println("The blocks below it will be validated in background, once the chain is synchronized")
+}
+
+func chain_command(cmd, par string) {
+	hash := btc.NewUint256FromString(strings.TrimSpace(par))
+	if hash == nil {
+		fmt.Println("Specify hash of the block")
+		return
+	}
+	if e := usif.ChainCommand(cmd, hash); e != nil {
+		fmt.Println("Error:", e.Error())
+	}
+	last := common.BlockChain.LastBlock()
+	fmt.Println("Last block is now", last.Height, last.BlockHash.String())
+}
+
+func invalidate_block(par string) {
+	if par == "" {
+		inv := common.BlockChain.InvalidBlocks()
+		for _, n := range inv {
+			fmt.Println(" ", n.Height, n.BlockHash.String())
+		}
+		fmt.Println(len(inv), "block(s) marked invalid")
+		return
+	}
+	chain_command("invalidate", par)
+}
+
+func reconsider_block(par string) {
+	chain_command("reconsider", par)
+}
+
+func precious_block(par string) {
+	chain_command("precious", par)
+}
+
+func verify_chain(par string) {
+	level, depth := uint64(3), uint64(6)
+	ps := strings.Fields(par)
+	if len(ps) > 0 && ps[0] == "abort" {
+		usif.AbortVerifyChain()
+		return
+	}
+	if len(ps) > 0 {
+		level, _ = strconv.ParseUint(ps[0], 10, 32)
+	}
+	if len(ps) > 1 {
+		depth, _ = strconv.ParseUint(ps[1], 10, 32)
+	}
+	sta := time.Now()
+	e := usif.VerifyChain(uint32(level), uint32(depth), func(e error) {
+		if e != nil {
+			fmt.Println("verifychain:", e.Error())
+		} else {
+			fmt.Println("Chain verified OK in", time.Now().Sub(sta).String())
+		}
+	})
+	if e != nil {
+		fmt.Println("Error:", e.Error())
+		return
+	}
+	fmt.Println("Verification started in the background - see the status in the WebUI or use 'verifychain abort'")
+}
+
+func txoutset_info(par string) {
+	hash_type := strings.TrimSpace(par)
+	if hash_type == "" {
+		hash_type = "hash_serialized_3"
+	}
+	if hash_type != "hash_serialized_3" && hash_type != "muhash" && hash_type != "none" {
+		fmt.Println("Specify hash type: hash_serialized_3, muhash or none")
+		return
+	}
+	sta := time.Now()
+	info := common.BlockChain.Unspent.GetTxOutSetInfo(hash_type == "hash_serialized_3", hash_type == "muhash")
+	fmt.Println("Height:", info.Height, "  Block:", btc.NewUint256(info.BlockHash).String())
+	fmt.Println("Transactions:", info.Transactions, "  TxOuts:", info.TxOuts, "  BogoSize:", info.BogoSize)
+	fmt.Printf("Total amount: %.8f BTC\n", float64(info.TotalAmount)/1e8)
+	if info.HashSerialized != nil {
+		fmt.Println("hash_serialized_3:", btc.NewUint256(info.HashSerialized[:]).String())
+	}
+	if info.MuHash != nil {
+		fmt.Println("muhash:", btc.NewUint256(info.MuHash[:]).String())
+	}
+	fmt.Println("Calculated in", time.Now().Sub(sta).String())
+}
+
 func set_ulmax(par string) {
 	v, e := strconv.ParseUint(par, 10, 64)
 	if e == nil {
@@ -388,6 +516,8 @@ func save_config(s string) {
 
 func show_addresses(par string) {
 	fmt.Println(peersdb.PeerDB.Count(), "peers in the database")
+	new_cnt, tried_cnt := peersdb.AddrManStats()
+	fmt.Println(new_cnt, "addresses in the new table and", tried_cnt, "in the tried one")
 	if par == "list" {
 		cnt := 0
 		peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
@@ -425,7 +555,7 @@ func show_addresses(par string) {
 	} else {
 		fmt.Println("Use 'peers list' to list them")
 		fmt.Println("Use 'peers ban' to list the benned ones")
-		fmt.Println("Use 'peers <number>' to show the most recent ones")
+		fmt.Println("Use 'peers <number>' to show the best scored ones")
 	}
 }
 
@@ -433,6 +563,20 @@ func unban_peer(par string) {
 	fmt.Print(usif.UnbanPeer(par))
 }
 
+func ban_peer(par string) {
+	fmt.Print(usif.BanPeer(par))
+}
+
+func list_bans(par string) {
+	bans := peersdb.ListBans()
+	for i, b := range bans {
+		fmt.Printf("%4d) %-18s  until %s  (%s)  %s\n", i+1, b.Address,
+			time.Unix(b.Until, 0).Format("2006-01-02 15:04:05"),
+			time.Unix(b.Until, 0).Sub(time.Now()).Round(time.Second).String(), b.Reason)
+	}
+	fmt.Println(len(bans), "ban(s) on the list")
+}
+
 func add_peer(par string) {
 	ad, er := peersdb.NewAddrFromString(par, false)
 	if er != nil {
@@ -488,10 +632,9 @@ func analyze_bip9(par string) {
 		start_time := n.Timestamp()
 		bits := make(map[byte]uint32)
 		for i = 0; i < 2016 && n != nil; i++ {
-			ver := n.BlockVersion()
-			if (ver & 0x20000000) != 0 {
+			if sig := chain.BIP9Signals(n.BlockVersion()); sig != 0 {
 				for bit := byte(0); bit <= 28; bit++ {
-					if (ver & (1 << bit)) != 0 {
+					if (sig & (1 << bit)) != 0 {
 						bits[bit]++
 					}
 				}
@@ -514,6 +657,12 @@ func analyze_bip9(par string) {
 			}
 		}
 	}
+
+	// the states of the known deployments, as reported by getblocktemplate
+	for i, state := range common.BlockChain.BIP9States(common.BlockChain.LastBlock()) {
+		d := common.BlockChain.Consensus.BIP9[i]
+		fmt.Println("Next block:", d.Name, "( bit", d.Bit, ") is", chain.BIP9StateNames[state])
+	}
 }
 
 func switch_trust(par string) {
@@ -546,20 +695,29 @@ func init() {
 	newUi("configsave cs", false, save_config, "Save current settings to a common file")
 	newUi("configset cfg", false, set_config, "Set a specific common value - use JSON, omit top {}")
 	newUi("counters c", false, show_counters, "Show all kind of debug counters")
+	newUi("dumputxo", true, dump_utxo, "Save UTXO snapshot to a file, compatible with dumptxoutset (specify file name)")
 	newUi("dlimit dl", false, set_dlmax, "Set maximum download speed. The value is in KB/second - 0 for unlimited")
 	newUi("help h ?", false, show_help, "Shows this help")
 	newUi("info i", false, show_info, "Shows general info about the node")
+	newUi("invalidate", true, invalidate_block, "Mark block with the given hash (and its descendants) invalid, or list the invalid blocks")
 	newUi("inv", false, send_inv, "Send inv message to all the peers - specify type & hash")
+	newUi("loadutxo", true, load_utxo, "Load UTXO snapshot from a file: <file> [utxo_hash], or show the background validation status")
 	newUi("mem", false, show_mem, "Show detailed memory stats (optionally free, gc or a numeric param)")
 	newUi("peers", false, show_addresses, "Dump pers database (specify number)")
 	newUi("peeradd", false, add_peer, "Add a peer to the database, mark it as alive")
 	newUi("pend", false, show_pending, "Show pending blocks, to be fetched")
+	newUi("precious", true, precious_block, "Switch to the block with the given hash, if it has as much work as the current top")
 	newUi("purge", true, purge_utxo, "Purge all unspendable outputs from UTXO database")
 	newUi("quit q", false, ui_quit, "Quit the node")
 	newUi("savebl", false, dump_block, "Saves a block with a given hash to a binary file")
+	newUi("reconsider", true, reconsider_block, "Remove the invalid mark from the block with the given hash")
 	newUi("saveutxo s", true, save_utxo, "Save UTXO database now")
 	newUi("trust t", true, switch_trust, "Assume all donwloaded blocks trusted (1) or un-trusted (0)")
 	newUi("ulimit ul", false, set_ulmax, "Set maximum upload speed. The value is in KB/second - 0 for unlimited")
-	newUi("unban", false, unban_peer, "Unban a peer specified by IP[:port] (or 'unban all')")
+	newUi("unban", false, unban_peer, "Unban a peer specified by IP[:port] or subnet (or 'unban all')")
+	newUi("ban", false, ban_peer, "Ban IP or subnet: <ip|cidr> [duration] [reason]")
+	newUi("bans", false, list_bans, "Show the ban list")
+	newUi("verifychain", true, verify_chain, "Check consistency of the last blocks with the databases (specify level 0-4 and number of blocks, or abort)")
+	newUi("txoutset", true, txoutset_info, "Show UTXO set info and hash, like gettxoutsetinfo (hash_serialized_3, muhash or none)")
 	newUi("utxo u", true, blchain_utxodb, "Display UTXO-db statistics")
 }
@@ -5,8 +5,10 @@ import (
 	"time"
 	"regexp"
 	"strconv"
+	"sync/atomic"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/mine"
 )
 
 
@@ -94,7 +96,32 @@ func do_mining(s string) {
 	}
 }
 
+func do_mine(s string) {
+	switch s {
+	case "on", "force":
+		if er := mine.Start(s == "force"); er != nil {
+			fmt.Println("Cannot start mining:", er.Error())
+		} else {
+			fmt.Println("Mining started")
+		}
+	case "off":
+		mine.Stop()
+	case "":
+		if !mine.Running() {
+			fmt.Println("Not mining. Use 'mine on' to start.")
+			return
+		}
+		secs := time.Now().Sub(mine.Started).Seconds()
+		fmt.Println("Mining with", mine.Threads, "threads for", time.Duration(secs)*time.Second)
+		fmt.Println("Hashrate:", common.HashrateToString(float64(atomic.LoadUint64(&mine.Hashes))/secs))
+		fmt.Println("Blocks found:", atomic.LoadUint32(&mine.Found), "  accepted:", atomic.LoadUint32(&mine.Accepted))
+	default:
+		fmt.Println("Specify: on, off or force")
+	}
+}
+
 
 func init() {
+	newUi("mine", false, do_mine, "Solo CPU mining for testing: on, off, force (to mine at any difficulty, also on mainnet) or show the status")
 	newUi("minerstat m", false, do_mining, "Look for the miner ID in recent blocks (optionally specify number of hours)")
 }
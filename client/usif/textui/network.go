@@ -136,6 +136,8 @@ func net_stats(par string) {
 
 		if v.X.Incomming {
 			fmt.Print("<- ")
+		} else if v.X.BlockRelayOnly {
+			fmt.Print(" =>")
 		} else {
 			fmt.Print(" ->")
 		}
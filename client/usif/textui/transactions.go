@@ -6,9 +6,11 @@ import (
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -37,15 +39,15 @@ func send_tx(par string) {
 		list_txs("")
 		return
 	}
-	network.TxMutex.Lock()
-	if ptx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
-		network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	if ptx, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
+		network.TxPool.Unlock()
 		cnt := network.NetRouteInv(1, txid, nil)
 		ptx.Invsentcnt += cnt
 		fmt.Println("INV for TxID", txid.String(), "sent to", cnt, "node(s)")
 		fmt.Println("If it does not appear in the chain, you may want to redo it.")
 	} else {
-		network.TxMutex.Unlock()
+		network.TxPool.Unlock()
 		fmt.Println("No such transaction ID in the memory pool.")
 		list_txs("")
 	}
@@ -58,15 +60,15 @@ func send1_tx(par string) {
 		list_txs("")
 		return
 	}
-	network.TxMutex.Lock()
-	if ptx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
-		network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	if ptx, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
+		network.TxPool.Unlock()
 		usif.SendInvToRandomPeer(1, txid)
 		ptx.Invsentcnt++
 		fmt.Println("INV for TxID", txid.String(), "sent to a random node")
 		fmt.Println("If it does not appear in the chain, you may want to redo it.")
 	} else {
-		network.TxMutex.Unlock()
+		network.TxPool.Unlock()
 		fmt.Println("No such transaction ID in the memory pool.")
 		list_txs("")
 	}
@@ -79,16 +81,16 @@ func del_tx(par string) {
 		list_txs("")
 		return
 	}
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
-	tx, ok := network.TransactionsToSend[txid.BIdx()]
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
+	tx, ok := network.TxPool.TransactionsToSend[txid.BIdx()]
 	if !ok {
-		network.TxMutex.Unlock()
+		network.TxPool.Unlock()
 		fmt.Println("No such transaction ID in the memory pool.")
 		list_txs("")
 		return
 	}
-	tx.Delete(true, 0)
+	network.TxPool.DeleteTx(tx, true, 0)
 	fmt.Println("Transaction", txid.String(), "and all its children removed from the memory pool")
 }
 
@@ -99,7 +101,7 @@ func dec_tx(par string) {
 		list_txs("")
 		return
 	}
-	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+	if tx, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
 		s, _, _, _, _ := usif.DecodeTx(tx.Tx)
 		fmt.Println(s)
 	} else {
@@ -114,7 +116,7 @@ func save_tx(par string) {
 		list_txs("")
 		return
 	}
-	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+	if tx, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
 		fn := tx.Hash.String() + ".tx"
 		ioutil.WriteFile(fn, tx.Raw, 0600)
 		fmt.Println("Saved to", fn)
@@ -127,14 +129,38 @@ func mempool_stats(par string) {
 	fmt.Print(usif.MemoryPoolFees())
 }
 
+func estimate_fee(par string) {
+	targets := []int{1, 2, 3, 6, 12, 24, 48, 144}
+	if par != "" {
+		n, er := strconv.ParseUint(par, 10, 32)
+		if er != nil || n == 0 || n > mempool.FEE_EST_MAX_TARGET {
+			fmt.Printf("Specify the confirmation target in blocks (1 to %d)\n", mempool.FEE_EST_MAX_TARGET)
+			return
+		}
+		targets = []int{int(n)}
+	}
+	fmt.Println("Fee estimates based on", network.FeeEst.Tracked(), "tracked mempool txs:")
+	for _, target := range targets {
+		spb, blocks := network.EstimateFee(target, false)
+		cspb, cblocks := network.EstimateFee(target, true)
+		if blocks == 0 {
+			fmt.Printf("%5d blocks: insufficient data\n", target)
+		} else if cblocks == 0 {
+			fmt.Printf("%5d blocks: %9.3f SPB (%d)\n", target, spb, blocks)
+		} else {
+			fmt.Printf("%5d blocks: %9.3f SPB (%d),  conservative: %9.3f SPB (%d)\n", target, spb, blocks, cspb, cblocks)
+		}
+	}
+}
+
 func list_txs(par string) {
 	limitbytes, _ := strconv.ParseUint(par, 10, 64)
 	fmt.Println("Transactions in the memory pool:", limitbytes)
 	cnt := 0
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
-	sorted := network.GetSortedMempool()
+	sorted := network.TxPool.GetSortedMempool()
 
 	var totlen uint64
 	for cnt = 0; cnt < len(sorted); cnt++ {
@@ -171,41 +197,62 @@ func list_txs(par string) {
 func baned_txs(par string) {
 	fmt.Println("Rejected transactions:")
 	cnt := 0
-	network.TxMutex.Lock()
-	for k, v := range network.TransactionsRejected {
+	network.TxPool.Lock()
+	for k, v := range network.TxPool.TransactionsRejected {
 		cnt++
 		fmt.Println("", cnt, btc.NewUint256(k[:]).String(), "-", v.Size, "bytes",
 			"-", v.Reason, "-", time.Now().Sub(v.Time).String(), "ago")
 	}
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 }
 
 func send_all_tx(par string) {
-	network.TxMutex.Lock()
-	for k, v := range network.TransactionsToSend {
+	network.TxPool.Lock()
+	for k, v := range network.TxPool.TransactionsToSend {
 		if v.Local {
 			cnt := network.NetRouteInv(1, btc.NewUint256(k[:]), nil)
 			v.Invsentcnt += cnt
 			fmt.Println("INV for TxID", v.Hash.String(), "sent to", cnt, "node(s)")
 		}
 	}
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
+}
+
+// mempool_file_args parses "[-core] [filename]" parameters of txmpsave and txmpload.
+func mempool_file_args(par string) (core bool, fname string) {
+	fname = strings.TrimSpace(par)
+	if fname == "-core" || strings.HasPrefix(fname, "-core ") {
+		core = true
+		fname = strings.TrimSpace(fname[5:])
+	}
+	if fname == "" {
+		if core {
+			fname = common.GocoinHomeDir + network.MEMPOOL_CORE_FILE_NAME
+		} else {
+			fname = common.GocoinHomeDir + network.MEMPOOL_FILE_NAME2
+		}
+	}
+	return
 }
 
 func save_mempool(par string) {
-	network.MempoolSave(true)
+	if core, fname := mempool_file_args(par); core {
+		network.MempoolSaveCore(fname)
+	} else if par == "" {
+		network.MempoolSave(true)
+	} else {
+		fmt.Println("Only the mempool.dmp in the data folder can be saved in the native format")
+	}
 }
 
 func check_txs(par string) {
-	network.TxMutex.Lock()
-	network.MempoolCheck()
-	network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	network.TxPool.Check()
+	network.TxPool.Unlock()
 }
 
 func load_mempool(par string) {
-	if par == "" {
-		par = common.GocoinHomeDir + "mempool.dmp"
-	}
+	core, fname := mempool_file_args(par)
 	var abort bool
 	__exit := make(chan bool)
 	__done := make(chan bool)
@@ -222,7 +269,11 @@ func load_mempool(par string) {
 		}
 	}()
 	fmt.Println("Press Ctrl+C to abort...")
-	network.MempoolLoadNew(par, &abort)
+	if core {
+		network.MempoolLoadCore(fname, &abort)
+	} else {
+		network.MempoolLoadNew(fname, &abort)
+	}
 	__exit <- true
 	_ = <-__done
 	if abort {
@@ -241,6 +292,44 @@ func get_mempool(par string) {
 	network.GetMP(uint32(conid))
 }
 
+func find_tx(par string) {
+	txid := btc.NewUint256FromString(par)
+	if txid == nil {
+		fmt.Println("You must specify a valid transaction ID for this command.")
+		return
+	}
+	tx, bn, er := usif.FindTx(txid)
+	if er != nil {
+		fmt.Println(er.Error())
+		if common.BlockChain.TxIndex != nil {
+			fmt.Println(common.BlockChain.TxIndex.Stats())
+		}
+		return
+	}
+	if bn != nil {
+		fmt.Println("Mined in block", bn.Height, bn.BlockHash.String())
+	} else {
+		fmt.Println("Found in the memory pool")
+	}
+	s, _, _, _, _ := usif.DecodeTx(tx)
+	fmt.Println(s)
+}
+
+func push_mempool(par string) {
+	conid, e := strconv.ParseUint(par, 10, 32)
+	if e != nil {
+		fmt.Println("Specify ID of the peer")
+		return
+	}
+
+	cnt, ok := network.PushMP(uint32(conid))
+	if !ok {
+		fmt.Println("Connection", conid, "is not an encrypted friend with mempool trust level")
+		return
+	}
+	fmt.Println(cnt, "transactions pushed to connection ID", conid)
+}
+
 
 func init() {
 	newUi("txload tx", true, load_tx, "Load transaction data from the given file, decode it and store in memory")
@@ -248,13 +337,16 @@ func init() {
 	newUi("tx1send stx1", true, send1_tx, "Broadcast transaction to a single random peer (identified by a given <txid>)")
 	newUi("txsendall stxa", true, send_all_tx, "Broadcast all the transactions (what you see after ltx)")
 	newUi("txdel dtx", true, del_tx, "Remove a transaction from memory pool (identified by a given <txid>)")
+	newUi("txfind tf", true, find_tx, "Find a transaction in memory pool or txindex and decode it (identified by a given <txid>)")
 	newUi("txdecode td", true, dec_tx, "Decode a transaction from memory pool (identified by a given <txid>)")
 	newUi("txlist ltx", true, list_txs, "List all the transaction loaded into memory pool up to 1MB space <max_size>")
 	newUi("txlistban ltxb", true, baned_txs, "List the transaction that we have rejected")
 	newUi("mempool mp", true, mempool_stats, "Show the mempool statistics")
+	newUi("estimatefee ef", false, estimate_fee, "Show fee needed to confirm within the given number of blocks <target>")
 	newUi("txsave", true, save_tx, "Save raw transaction from memory pool to disk")
-	newUi("txmpsave mps", true, save_mempool, "Save memory pool to disk")
+	newUi("txmpsave mps", true, save_mempool, "Save memory pool to disk (add -core [<filename>] for Bitcoin Core's mempool.dat format)")
 	newUi("txcheck txc", true, check_txs, "Verify consistency of mempool")
-	newUi("txmpload mpl", true, load_mempool, "Load transaction from the given file (must be in mempool.dmp format)")
+	newUi("txmpload mpl", true, load_mempool, "Load transactions from the given file, verifying them (mempool.dmp, or mempool.dat format with -core)")
 	newUi("getmp mpg", true, get_mempool, "Get getmp message to the peer with teh given ID")
+	newUi("pushmp mpp", true, push_mempool, "Push our mempool to the friend with the given connection ID")
 }
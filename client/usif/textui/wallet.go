@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
+	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/wallet"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type OneWalletAddrs struct {
@@ -197,21 +200,21 @@ func list_unspent(addr string) {
 		fmt.Println(ad.String(), "has", btc.UintToBtc(tot), "BTC in", len(unsp), "records:")
 		for i := range unsp {
 			fmt.Println(unsp[i].String())
-			network.TxMutex.Lock()
-			bidx, spending := network.SpentOutputs[unsp[i].TxPrevOut.UIdx()]
-			var t2s *network.OneTxToSend
+			network.TxPool.Lock()
+			bidx, spending := network.TxPool.SpentOutputs[unsp[i].TxPrevOut.UIdx()]
+			var t2s *mempool.OneTxToSend
 			if spending {
-				t2s, spending = network.TransactionsToSend[bidx]
+				t2s, spending = network.TxPool.TransactionsToSend[bidx]
 			}
-			network.TxMutex.Unlock()
+			network.TxPool.Unlock()
 			if spending {
 				fmt.Println("\t- being spent by TxID", t2s.Hash.String())
 			}
 		}
 	}
 
-	network.TxMutex.Lock()
-	for _, t2s := range network.TransactionsToSend {
+	network.TxPool.Lock()
+	for _, t2s := range network.TxPool.TransactionsToSend {
 		for vo, to := range t2s.TxOut {
 			if bytes.Equal(to.Pk_script, outscr) {
 				fmt.Println(fmt.Sprintf("Mempool Tx: %15s BTC comming with %s-%03d",
@@ -219,7 +222,7 @@ func list_unspent(addr string) {
 			}
 		}
 	}
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 }
 
 func all_val_stats(s string) {
@@ -263,10 +266,53 @@ func wallet_on_off(s string) {
 	}
 }
 
+func addr_history(par string) {
+	const page = 50
+	ss := strings.Fields(par)
+	if len(ss) < 1 {
+		fmt.Println("Specify the address and optionally the page number")
+		return
+	}
+	sh, e := usif.AddrScriptHash(ss[0])
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+	var pg int
+	if len(ss) > 1 {
+		pg, _ = strconv.Atoi(ss[1])
+	}
+
+	hi := common.BlockChain.HistIndex
+	hi.Lock()
+	recs, total := hi.History(sh, pg*page, page)
+	_, bal := hi.Unspent(sh)
+	height := hi.Height
+	hi.Unlock()
+
+	fmt.Println("Address", ss[0], "has", total, "events in the history index (up to block", height, ")")
+	for i, r := range recs {
+		if r.Spending {
+			fmt.Printf("%5d) %7d  %s-%03d  spent  %15s BTC\n", pg*page+i+1, r.Height, r.TxID.String(), r.Index, btc.UintToBtc(r.Value))
+		} else {
+			fmt.Printf("%5d) %7d  %s-%03d  recv   %15s BTC", pg*page+i+1, r.Height, r.TxID.String(), r.Index, btc.UintToBtc(r.Value))
+			if r.SpentHeight != 0 {
+				fmt.Print("  (spent in ", r.SpentHeight, ")")
+			}
+			fmt.Println()
+		}
+	}
+	if total > (pg+1)*page {
+		fmt.Println("Use 'ah", ss[0], pg+1, "' to see the next page")
+	}
+	fmt.Println("Confirmed balance:", btc.UintToBtc(bal), "BTC")
+}
+
 func init() {
 	newUi("richest r", true, best_val, "Show addresses with most coins [0,1,2,3 or count]")
 	newUi("maxouts o", true, max_outs, "Show addresses with highest number of outputs [0,1,2,3 or count]")
 	newUi("balance a", true, list_unspent, "List balance of given bitcoin address")
 	newUi("allbal ab", true, all_val_stats, "Show Allbalance statistics")
+	newUi("addrhist ah", true, addr_history, "Show confirmed history of given bitcoin address from the history index [page]")
 	newUi("wallet w", false, wallet_on_off, "Enable (on) or disable (off) wallet functionality")
 }
@@ -8,11 +8,16 @@ import (
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
+	"github.com/piotrnar/gocoin/lib/chain"
 	"github.com/piotrnar/gocoin/lib/others/peersdb"
 	"github.com/piotrnar/gocoin/lib/others/qdb"
 	"github.com/piotrnar/gocoin/lib/others/sys"
 	"github.com/piotrnar/gocoin/lib/script"
 	"math/rand"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -48,7 +53,7 @@ func DecodeTxSops(tx *btc.Tx) (s string, missinginp bool, totinp, totout uint64,
 		var po *btc.TxOut
 
 		inpid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
-		if txinmem, ok := network.TransactionsToSend[inpid.BIdx()]; ok {
+		if txinmem, ok := network.TxPool.TransactionsToSend[inpid.BIdx()]; ok {
 			s += fmt.Sprint(" mempool")
 			if int(tx.TxIn[i].Input.Vout) >= len(txinmem.TxOut) {
 				s += fmt.Sprintf(" - Vout TOO BIG (%d/%d)!", int(tx.TxIn[i].Input.Vout), len(txinmem.TxOut))
@@ -141,18 +146,18 @@ func LoadRawTx(buf []byte) (s string) {
 
 	if why := network.NeedThisTxExt(&tx.Hash, nil); why != 0 {
 		s += fmt.Sprintln("Transaction not needed or not wanted", why)
-		network.TxMutex.Lock()
-		if t2s := network.TransactionsToSend[tx.Hash.BIdx()]; t2s != nil {
+		network.TxPool.Lock()
+		if t2s := network.TxPool.TransactionsToSend[tx.Hash.BIdx()]; t2s != nil {
 			t2s.Local = true // make as own (if not needed)
 		}
-		network.TxMutex.Unlock()
+		network.TxPool.Unlock()
 		return
 	}
 
 	if !network.SubmitLocalTx(tx, txd) {
-		network.TxMutex.Lock()
-		rr := network.TransactionsRejected[tx.Hash.BIdx()]
-		network.TxMutex.Unlock()
+		network.TxPool.Lock()
+		rr := network.TxPool.TransactionsRejected[tx.Hash.BIdx()]
+		network.TxPool.Unlock()
 		if rr != nil {
 			s += fmt.Sprintln("Transaction rejected", rr.Reason)
 		} else {
@@ -161,9 +166,9 @@ func LoadRawTx(buf []byte) (s string) {
 		return
 	}
 
-	network.TxMutex.Lock()
-	_, ok := network.TransactionsToSend[tx.Hash.BIdx()]
-	network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	_, ok := network.TxPool.TransactionsToSend[tx.Hash.BIdx()]
+	network.TxPool.Unlock()
 	if ok {
 		s += fmt.Sprintln("Transaction added to the memory pool. You can broadcast it now.")
 	} else {
@@ -173,6 +178,27 @@ func LoadRawTx(buf []byte) (s string) {
 	return
 }
 
+// FindTx looks for the transaction in the memory pool and then in the txindex.
+// For a confirmed transaction, it also returns the block containing it.
+func FindTx(txid *btc.Uint256) (tx *btc.Tx, bn *chain.BlockTreeNode, e error) {
+	network.TxPool.Lock()
+	if t2s, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
+		tx = t2s.Tx
+	}
+	network.TxPool.Unlock()
+	if tx != nil {
+		return
+	}
+
+	var raw []byte
+	if raw, bn, e = common.BlockChain.GetTx(txid); e != nil {
+		return
+	}
+	tx, _ = btc.NewTx(raw)
+	tx.SetHash(raw)
+	return
+}
+
 func SendInvToRandomPeer(typ uint32, h *btc.Uint256) {
 	common.CountSafe(fmt.Sprint("NetSendOneInv", typ))
 
@@ -236,10 +262,10 @@ func ExecUiReq(req *OneUiReq) {
 
 func MemoryPoolFees() (res string) {
 	res = fmt.Sprintln("Content of mempool sorted by fee's SPB:")
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
-	sorted := network.GetSortedMempoolNew()
+	sorted := network.TxPool.GetSortedMempoolClusters()
 
 	var totlen, rawlen uint64
 	for cnt := 0; cnt < len(sorted); cnt++ {
@@ -264,23 +290,31 @@ func MemoryPoolFees() (res string) {
 	return
 }
 
-// UnbanPeer unbans peer of a given IP or "all" banned peers
+// UnbanPeer unbans a given IP or subnet (CIDR), or "all" banned peers
 func UnbanPeer(par string) (s string) {
-	var ad *peersdb.PeerAddr
+	var subnet *net.IPNet
 
 	if par != "all" {
 		var er error
-		ad, er = peersdb.NewAddrFromString(par, false)
+		subnet, er = peersdb.ParseSubnet(par)
 		if er != nil {
 			s = fmt.Sprintln(par, er.Error())
 			return
 		}
-		s += fmt.Sprintln("Unban", ad.Ip(), "...")
+		s += fmt.Sprintln("Unban", subnet.String(), "...")
+		if !peersdb.Unban(subnet) {
+			s += fmt.Sprintln(subnet.String(), "was not on the ban list")
+		}
 		network.HammeringMutex.Lock()
-		delete(network.RecentlyDisconencted, ad.Ip4)
+		for ip := range network.RecentlyDisconencted {
+			if subnet.Contains(net.IP(ip[:])) {
+				delete(network.RecentlyDisconencted, ip)
+			}
+		}
 		network.HammeringMutex.Unlock()
 	} else {
 		s += fmt.Sprintln("Unban all peers ...")
+		peersdb.ClearBans()
 		network.HammeringMutex.Lock()
 		network.RecentlyDisconencted = make(map[[4]byte]*network.RecentlyDisconenctedType)
 		network.HammeringMutex.Unlock()
@@ -291,7 +325,7 @@ func UnbanPeer(par string) (s string) {
 	peersdb.PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		peer := peersdb.NewPeer(v)
 		if peer.Banned != 0 {
-			if ad == nil || peer.Ip() == ad.Ip() {
+			if subnet == nil || subnet.Contains(net.IP(peer.Ip4[:])) {
 				s += fmt.Sprintln(" -", peer.NetAddr.String())
 				peer.Banned = 0
 				keys = append(keys, k)
@@ -308,6 +342,111 @@ func UnbanPeer(par string) (s string) {
 	return
 }
 
+// BanPeer bans a given IP or subnet (CIDR): "<ip|subnet> [duration] [reason]"
+// The duration can be given in seconds or as a Go duration string (e.g. 48h).
+func BanPeer(par string) (s string) {
+	ss := strings.SplitN(strings.TrimSpace(par), " ", 3)
+	if ss[0] == "" {
+		s = fmt.Sprintln("Specify IP or subnet to ban")
+		return
+	}
+	subnet, er := peersdb.ParseSubnet(ss[0])
+	if er != nil {
+		s = fmt.Sprintln(ss[0], er.Error())
+		return
+	}
+	var dur time.Duration
+	if len(ss) > 1 {
+		if dur, er = ParseBanTime(ss[1]); er != nil {
+			s = fmt.Sprintln(ss[1], er.Error())
+			return
+		}
+	}
+	reason := "manual"
+	if len(ss) > 2 {
+		reason = ss[2]
+	}
+	peersdb.BanSubnet(subnet, dur, reason)
+	s = fmt.Sprintln(subnet.String(), "banned.", network.DropSubnet(subnet), "connection(s) dropped")
+	return
+}
+
+// ParseBanTime parses the ban duration, given in seconds or as a Go duration string.
+func ParseBanTime(s string) (time.Duration, error) {
+	if v, er := strconv.ParseUint(s, 10, 32); er == nil {
+		return time.Duration(v) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
 func init() {
 	rand.Seed(int64(time.Now().Nanosecond()))
 }
+
+// AddrScriptHash returns the key of the address' output script in the history index.
+func AddrScriptHash(addr string) (sh []byte, e error) {
+	if common.BlockChain.HistIndex == nil {
+		e = errors.New("History index not enabled (use -histindex)")
+		return
+	}
+	var a *btc.BtcAddr
+	if a, e = btc.NewAddrFromString(addr); e != nil {
+		return
+	}
+	h := chain.HistScriptHash(a.OutScript())
+	sh = h[:]
+	return
+}
+
+// SubmitRawTx puts the transaction into the memory pool and broadcasts it.
+// Call it from the main thread (e.g. via UiChannel).
+func SubmitRawTx(raw []byte) (txid *btc.Uint256, e error) {
+	tx, le := btc.NewTx(raw)
+	if tx == nil || le != len(raw) {
+		e = errors.New("TX decode failed")
+		return
+	}
+	tx.SetHash(raw)
+	txid = &tx.Hash
+
+	network.RemoveFromRejected(txid) // in case we rejected it eariler, to try it again as trusted
+	if why := network.NeedThisTxExt(txid, nil); why == 0 {
+		if !network.SubmitLocalTx(tx, raw) {
+			network.TxPool.Lock()
+			rr := network.TxPool.TransactionsRejected[txid.BIdx()]
+			network.TxPool.Unlock()
+			if rr != nil {
+				e = errors.New("Transaction rejected: " + mempool.ReasonToString(rr.Reason))
+			} else {
+				e = errors.New("Transaction rejected")
+			}
+			return
+		}
+	}
+
+	network.TxPool.Lock()
+	t2s := network.TxPool.TransactionsToSend[txid.BIdx()]
+	network.TxPool.Unlock()
+	if t2s == nil {
+		e = errors.New("Transaction not accepted to the memory pool")
+		return
+	}
+	t2s.Local = true
+	t2s.Invsentcnt += network.NetRouteInv(1, txid, nil)
+	return
+}
+
+// MempoolFeeRate returns the fee (in SPB) needed to get into one of the next blocks,
+// judging by the current content of the memory pool.
+func MempoolFeeRate(blocks uint) float64 {
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
+
+	var weight uint64
+	for _, ch := range network.TxPool.GetChunks() {
+		if weight += uint64(ch.Weight); weight > uint64(blocks)*4e6 {
+			return 4 * float64(ch.Fee) / float64(ch.Weight)
+		}
+	}
+	return float64(common.MinFeePerKB()) / 1000 // the mempool is not that big
+}
@@ -126,6 +126,18 @@ func p_cfg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(r.Form["fullrbfonoff"]) > 0 {
+		common.SetBool(&common.CFG.TXPool.FullRBF, !common.CFG.TXPool.FullRBF)
+		http.Redirect(w, r, "txs", http.StatusFound)
+		return
+	}
+
+	if len(r.Form["truconoff"]) > 0 {
+		common.SetBool(&common.CFG.TXPool.TRUC, !common.CFG.TXPool.TRUC)
+		http.Redirect(w, r, "txs", http.StatusFound)
+		return
+	}
+
 	if len(r.Form["txronoff"]) > 0 {
 		common.CFG.TXRoute.Enabled = !common.CFG.TXRoute.Enabled
 		http.Redirect(w, r, "txs", http.StatusFound)
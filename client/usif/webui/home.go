@@ -119,6 +119,9 @@ func json_system(w http.ResponseWriter, r *http.Request) {
 		LastHeaderHeight uint32
 		NetworkHashRate float64
 		SavingUTXO bool
+		Pruning bool
+		PruneHeight uint32
+		VerifyChain string
 	}
 
 	out.Blocks_cached = network.CachedBlocksLen.Get()
@@ -142,6 +145,9 @@ func json_system(w http.ResponseWriter, r *http.Request) {
 	network.MutexRcv.Lock()
 	out.LastHeaderHeight = network.LastCommitedHeader.Height
 	network.MutexRcv.Unlock()
+	out.Pruning = common.BlockChain.Blocks.Pruning()
+	out.PruneHeight = common.BlockChain.Blocks.PruneHeight()
+	out.VerifyChain = usif.VerifyChainStatus()
 
 	mutexHrate.Lock()
 	if nextHrate.IsZero() || time.Now().After(nextHrate) {
@@ -12,6 +12,7 @@ import (
 	"github.com/piotrnar/gocoin/lib/utxo"
 	"github.com/piotrnar/gocoin/client/usif"
 	"github.com/piotrnar/gocoin/client/common"
+	"github.com/piotrnar/gocoin/client/network"
 )
 
 
@@ -237,6 +238,17 @@ func p_snd(w http.ResponseWriter, r *http.Request) {
 
 	s := load_template("send.html")
 
+	var est string
+	for _, target := range []int{1, 2, 3, 6, 12, 24, 48, 144} {
+		if spb, blocks := network.EstimateFee(target, false); blocks == target {
+			if est != "" {
+				est += ","
+			}
+			est += fmt.Sprintf("%d:%.3f", target, spb)
+		}
+	}
+	s = strings.Replace(s, "/*_FEE_ESTIMATES_*/", "var fee_estimates = {"+est+"}", 1)
+
 	write_html_head(w, r)
 	w.Write([]byte(s))
 	write_html_tail(w)
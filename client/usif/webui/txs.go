@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/mempool"
 	"github.com/piotrnar/gocoin/lib/script"
 	"github.com/piotrnar/gocoin/client/common"
 	"github.com/piotrnar/gocoin/client/network"
@@ -62,6 +63,18 @@ func p_txs(w http.ResponseWriter, r *http.Request) {
 		s = strings.Replace(s, "<!--MEM_POOL_ENABLED-->", "Disabled", 1)
 	}
 
+	if common.CFG.TXPool.FullRBF {
+		s = strings.Replace(s, "<!--FULL_RBF_ENABLED-->", "Enabled", 1)
+	} else {
+		s = strings.Replace(s, "<!--FULL_RBF_ENABLED-->", "Disabled", 1)
+	}
+
+	if common.CFG.TXPool.TRUC {
+		s = strings.Replace(s, "<!--TRUC_ENABLED-->", "Enabled", 1)
+	} else {
+		s = strings.Replace(s, "<!--TRUC_ENABLED-->", "Disabled", 1)
+	}
+
 	if common.CFG.TXRoute.Enabled {
 		s = strings.Replace(s, "<!--TX_ROUTE_ENABLED-->", "Enabled", 1)
 	} else {
@@ -84,7 +97,7 @@ func output_tx_xml(w http.ResponseWriter, tx *btc.Tx) {
 		fmt.Fprint(w, "<txid-vout>", tx.TxIn[i].Input.String(), "</txid-vout>")
 		var po *btc.TxOut
 		inpid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
-		if txinmem, ok := network.TransactionsToSend[inpid.BIdx()]; ok {
+		if txinmem, ok := network.TxPool.TransactionsToSend[inpid.BIdx()]; ok {
 			if int(tx.TxIn[i].Input.Vout) < len(txinmem.TxOut) {
 				po = txinmem.TxOut[tx.TxIn[i].Input.Vout]
 			}
@@ -143,7 +156,7 @@ func output_tx_xml(w http.ResponseWriter, tx *btc.Tx) {
 }
 
 
-func tx_xml(w http.ResponseWriter, v *network.OneTxToSend, verbose bool) {
+func tx_xml(w http.ResponseWriter, v *mempool.OneTxToSend, verbose bool) {
 	w.Write([]byte("<tx><status>OK</status>"))
 	fmt.Fprint(w, "<id>", v.Tx.Hash.String(), "</id>")
 	fmt.Fprint(w, "<version>", v.Tx.Version, "</version>")
@@ -171,7 +184,7 @@ func tx_xml(w http.ResponseWriter, v *network.OneTxToSend, verbose bool) {
 	fmt.Fprint(w, "<sentlast>", v.Lastsent.Unix(), "</sentlast>")
 	fmt.Fprint(w, "<volume>", v.Volume, "</volume>")
 	fmt.Fprint(w, "<fee>", v.Fee, "</fee>")
-	fmt.Fprint(w, "<blocked>", network.ReasonToString(v.Blocked), "</blocked>")
+	fmt.Fprint(w, "<blocked>", mempool.ReasonToString(v.Blocked), "</blocked>")
 	fmt.Fprint(w, "<final>", v.Final, "</final>")
 	fmt.Fprint(w, "<verify_us>", uint(v.VerifyTime/time.Microsecond), "</verify_us>")
 	w.Write([]byte("</tx>"))
@@ -213,7 +226,7 @@ func output_utxo_tx_xml(w http.ResponseWriter, minedid, minedat string) {
 
 
 /* memory pool transaction sorting stuff */
-type sortedTxList []*network.OneTxToSend
+type sortedTxList []*mempool.OneTxToSend
 
 func (tl sortedTxList) Len() int {return len(tl)}
 func (tl sortedTxList) Swap(i, j int)      { tl[i], tl[j] = tl[j], tl[i] }
@@ -280,9 +293,9 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 		if txid==nil {
 			return
 		}
-		network.TxMutex.Lock()
-		defer network.TxMutex.Unlock()
-		if t2s, ok := network.TransactionsToSend[txid.BIdx()]; ok {
+		network.TxPool.Lock()
+		defer network.TxPool.Unlock()
+		if t2s, ok := network.TxPool.TransactionsToSend[txid.BIdx()]; ok {
 			tx_xml(w, t2s, true)
 		} else {
 			w.Write([]byte("<tx>"))
@@ -297,20 +310,20 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 		if len(r.Form["del"])>0 {
 			tid := btc.NewUint256FromString(r.Form["del"][0])
 			if tid!=nil {
-				network.TxMutex.Lock()
-				if tts, ok := network.TransactionsToSend[tid.BIdx()]; ok {
-					tts.Delete(true, 0)
+				network.TxPool.Lock()
+				if tts, ok := network.TxPool.TransactionsToSend[tid.BIdx()]; ok {
+					network.TxPool.DeleteTx(tts, true, 0)
 				}
-				network.TxMutex.Unlock()
+				network.TxPool.Unlock()
 			}
 		}
 
 		if len(r.Form["send"])>0 {
 			tid := btc.NewUint256FromString(r.Form["send"][0])
 			if tid!=nil {
-				network.TxMutex.Lock()
-				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
-					network.TxMutex.Unlock()
+				network.TxPool.Lock()
+				if ptx, ok := network.TxPool.TransactionsToSend[tid.BIdx()]; ok {
+					network.TxPool.Unlock()
 					cnt := network.NetRouteInv(1, tid, nil)
 					if cnt==0 {
 						usif.SendInvToRandomPeer(1, tid)
@@ -318,7 +331,7 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 						ptx.Invsentcnt += cnt
 					}
 				} else {
-					network.TxMutex.Unlock()
+					network.TxPool.Unlock()
 				}
 			}
 		}
@@ -326,13 +339,13 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 		if len(r.Form["sendone"])>0 {
 			tid := btc.NewUint256FromString(r.Form["sendone"][0])
 			if tid!=nil {
-				network.TxMutex.Lock()
-				if ptx, ok := network.TransactionsToSend[tid.BIdx()]; ok {
-					network.TxMutex.Unlock()
+				network.TxPool.Lock()
+				if ptx, ok := network.TxPool.TransactionsToSend[tid.BIdx()]; ok {
+					network.TxPool.Unlock()
 					usif.SendInvToRandomPeer(1, tid)
 					ptx.Invsentcnt++
 				} else {
-					network.TxMutex.Unlock()
+					network.TxPool.Unlock()
 				}
 			}
 		}
@@ -355,12 +368,12 @@ func xml_txs2s(w http.ResponseWriter, r *http.Request) {
 		txs2s_sort_desc = len(r.Form["descending"])>0
 	}
 
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
-	sorted := make(sortedTxList, len(network.TransactionsToSend))
+	sorted := make(sortedTxList, len(network.TxPool.TransactionsToSend))
 	var cnt int
-	for _, v := range network.TransactionsToSend {
+	for _, v := range network.TxPool.TransactionsToSend {
 		if len(r.Form["ownonly"])>0 && !v.Local {
 			continue
 		}
@@ -386,16 +399,16 @@ func xml_txsre(w http.ResponseWriter, r *http.Request) {
 
 	w.Header()["Content-Type"] = []string{"text/xml"}
 	w.Write([]byte("<txbanned>"))
-	network.TxMutex.Lock()
-	for _, v := range network.TransactionsRejected {
+	network.TxPool.Lock()
+	for _, v := range network.TxPool.TransactionsRejected {
 		w.Write([]byte("<tx>"))
 		fmt.Fprint(w, "<id>", v.Id.String(), "</id>")
 		fmt.Fprint(w, "<time>", v.Time.Unix(), "</time>")
 		fmt.Fprint(w, "<size>", v.Size, "</size>")
-		fmt.Fprint(w, "<reason>", network.ReasonToString(v.Reason), "</reason>")
+		fmt.Fprint(w, "<reason>", mempool.ReasonToString(v.Reason), "</reason>")
 		w.Write([]byte("</tx>"))
 	}
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 	w.Write([]byte("</txbanned>"))
 }
 
@@ -407,13 +420,13 @@ func xml_txw4i(w http.ResponseWriter, r *http.Request) {
 
 	w.Header()["Content-Type"] = []string{"text/xml"}
 	w.Write([]byte("<pending>"))
-	network.TxMutex.Lock()
-	for _, v := range network.WaitingForInputs {
+	network.TxPool.Lock()
+	for _, v := range network.TxPool.WaitingForInputs {
 		w.Write([]byte("<wait4>"))
 		fmt.Fprint(w, "<id>", v.TxID.String(), "</id>")
 		for x, t := range v.Ids {
 			w.Write([]byte("<tx>"))
-			if v, ok := network.TransactionsRejected[x]; ok {
+			if v, ok := network.TxPool.TransactionsRejected[x]; ok {
 				fmt.Fprint(w, "<id>", v.Id.String(), "</id>")
 				fmt.Fprint(w, "<time>", t.Unix(), "</time>")
 			} else {
@@ -424,7 +437,7 @@ func xml_txw4i(w http.ResponseWriter, r *http.Request) {
 		}
 		w.Write([]byte("</wait4>"))
 	}
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 	w.Write([]byte("</pending>"))
 }
 
@@ -450,11 +463,14 @@ func raw_tx(w http.ResponseWriter, r *http.Request) {
 
 	txid := btc.NewUint256FromString(r.Form["id"][0])
 	fmt.Fprintln(w, "TxID:", txid.String())
-	if tx, ok := network.TransactionsToSend[txid.BIdx()]; ok {
-		s, _, _, _, _ := usif.DecodeTx(tx.Tx)
+	if tx, bn, er := usif.FindTx(txid); er == nil {
+		if bn != nil {
+			fmt.Fprintln(w, "Block:", bn.Height, bn.BlockHash.String())
+		}
+		s, _, _, _, _ := usif.DecodeTx(tx)
 		w.Write([]byte(s))
 	} else {
-		fmt.Fprintln(w, "Not found")
+		fmt.Fprintln(w, "Not found:", er.Error())
 	}
 }
 
@@ -466,20 +482,23 @@ func json_txstat(w http.ResponseWriter, r *http.Request) {
 	w.Header()["Content-Type"] = []string{"application/json"}
 	w.Write([]byte("{"))
 
-	network.TxMutex.Lock()
+	network.TxPool.Lock()
 
-	w.Write([]byte(fmt.Sprint("\"t2s_cnt\":", len(network.TransactionsToSend), ",")))
-	w.Write([]byte(fmt.Sprint("\"t2s_size\":", network.TransactionsToSendSize, ",")))
-	w.Write([]byte(fmt.Sprint("\"tre_cnt\":", len(network.TransactionsRejected), ",")))
-	w.Write([]byte(fmt.Sprint("\"tre_size\":", network.TransactionsRejectedSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"t2s_cnt\":", len(network.TxPool.TransactionsToSend), ",")))
+	w.Write([]byte(fmt.Sprint("\"t2s_size\":", network.TxPool.TransactionsToSendSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"tre_cnt\":", len(network.TxPool.TransactionsRejected), ",")))
+	w.Write([]byte(fmt.Sprint("\"tre_size\":", network.TxPool.TransactionsRejectedSize, ",")))
 	w.Write([]byte(fmt.Sprint("\"ptr1_cnt\":", len(network.TransactionsPending), ",")))
 	w.Write([]byte(fmt.Sprint("\"ptr2_cnt\":", len(network.NetTxs), ",")))
-	w.Write([]byte(fmt.Sprint("\"spent_outs_cnt\":", len(network.SpentOutputs), ",")))
-	w.Write([]byte(fmt.Sprint("\"awaiting_inputs\":", len(network.WaitingForInputs), ",")))
-	w.Write([]byte(fmt.Sprint("\"awaiting_inputs_size\":", network.WaitingForInputsSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"spent_outs_cnt\":", len(network.TxPool.SpentOutputs), ",")))
+	w.Write([]byte(fmt.Sprint("\"awaiting_inputs\":", len(network.TxPool.WaitingForInputs), ",")))
+	w.Write([]byte(fmt.Sprint("\"awaiting_inputs_size\":", network.TxPool.WaitingForInputsSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"orphans_cnt\":", network.TxPool.OrphansCnt, ",")))
+	w.Write([]byte(fmt.Sprint("\"orphans_size\":", network.TxPool.OrphansSize, ",")))
+	w.Write([]byte(fmt.Sprint("\"orphans_peers\":", len(network.TxPool.OrphansPerPeer), ",")))
 	w.Write([]byte(fmt.Sprint("\"min_fee_per_kb\":", common.MinFeePerKB(), "")))
 
-	network.TxMutex.Unlock()
+	network.TxPool.Unlock()
 
 	w.Write([]byte("}\n"))
 }
@@ -502,20 +521,20 @@ func json_mempool_stats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
 	if len(r.Form["max"])>0 {
 		maxweight, e = strconv.ParseUint(r.Form["max"][0], 10, 64)
 		if e!=nil {
-			maxweight = network.TransactionsToSendWeight
+			maxweight = network.TxPool.TransactionsToSendWeight
 		}
 	} else {
-		maxweight = network.TransactionsToSendWeight
+		maxweight = network.TxPool.TransactionsToSendWeight
 	}
 
-	if maxweight > network.TransactionsToSendWeight {
-		maxweight = network.TransactionsToSendWeight
+	if maxweight > network.TxPool.TransactionsToSendWeight {
+		maxweight = network.TxPool.TransactionsToSendWeight
 	}
 
 	if len(r.Form["div"])>0 {
@@ -531,11 +550,11 @@ func json_mempool_stats(w http.ResponseWriter, r *http.Request) {
 		division = 100
 	}
 
-	var sorted []*network.OneTxToSend
+	var sorted []*mempool.OneTxToSend
 	if len(r.Form["new"])>0 {
-		sorted = network.GetSortedMempoolNew()
+		sorted = network.TxPool.GetSortedMempoolClusters()
 	} else {
-		sorted = network.GetSortedMempool()
+		sorted = network.TxPool.GetSortedMempool()
 	}
 
 	type one_stat_row struct {
@@ -592,20 +611,20 @@ func json_mempool_fees(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	network.TxMutex.Lock()
-	defer network.TxMutex.Unlock()
+	network.TxPool.Lock()
+	defer network.TxPool.Unlock()
 
 	if len(r.Form["max"])>0 {
 		maxweight, e = strconv.ParseUint(r.Form["max"][0], 10, 64)
 		if e!=nil {
-			maxweight = network.TransactionsToSendWeight
+			maxweight = network.TxPool.TransactionsToSendWeight
 		}
 	} else {
-		maxweight = network.TransactionsToSendWeight
+		maxweight = network.TxPool.TransactionsToSendWeight
 	}
 
-	if maxweight > network.TransactionsToSendWeight {
-		maxweight = network.TransactionsToSendWeight
+	if maxweight > network.TxPool.TransactionsToSendWeight {
+		maxweight = network.TxPool.TransactionsToSendWeight
 	}
 
 	if len(r.Form["div"])>0 {
@@ -621,7 +640,7 @@ func json_mempool_fees(w http.ResponseWriter, r *http.Request) {
 		division = 1
 	}
 
-	sorted := network.GetMempoolFees(maxweight)
+	sorted := network.TxPool.GetMempoolFees(maxweight)
 
 	var mempool_stats [][3]uint64
 	var totweight uint64
@@ -646,3 +665,60 @@ func json_mempool_fees(w http.ResponseWriter, r *http.Request) {
 		println(er.Error())
 	}
 }
+
+
+func json_addrhist(w http.ResponseWriter, r *http.Request) {
+	if !ipchecker(r) {
+		return
+	}
+
+	type one_hist_rec struct {
+		TxID string
+		Height uint32
+		Spending bool
+		Index uint32
+		Value uint64
+		SpentHeight uint32
+	}
+
+	var out struct {
+		Error string `json:",omitempty"`
+		Total int
+		Height uint32
+		Balance uint64
+		History []one_hist_rec
+	}
+
+	const page = 100
+	var pg int
+	if len(r.Form["page"]) > 0 {
+		pg, _ = strconv.Atoi(r.Form["page"][0])
+	}
+
+	if len(r.Form["addr"]) == 0 {
+		out.Error = "No address given"
+	} else if sh, e := usif.AddrScriptHash(r.Form["addr"][0]); e != nil {
+		out.Error = e.Error()
+	} else {
+		hi := common.BlockChain.HistIndex
+		hi.Lock()
+		recs, total := hi.History(sh, pg*page, page)
+		_, out.Balance = hi.Unspent(sh)
+		out.Height = hi.Height
+		hi.Unlock()
+		out.Total = total
+		out.History = make([]one_hist_rec, len(recs))
+		for i, rec := range recs {
+			out.History[i] = one_hist_rec{TxID: rec.TxID.String(), Height: rec.Height, Spending: rec.Spending,
+				Index: rec.Index, Value: rec.Value, SpentHeight: rec.SpentHeight}
+		}
+	}
+
+	bx, er := json.Marshal(out)
+	if er == nil {
+		w.Header()["Content-Type"] = []string{"application/json"}
+		w.Write(bx)
+	} else {
+		println(er.Error())
+	}
+}
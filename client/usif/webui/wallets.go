@@ -143,9 +143,9 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 			newrec.OutCnt = len(unsp)
 			for _, u := range unsp {
 				newrec.Value += u.Value
-				network.TxMutex.Lock()
-				_, spending := network.SpentOutputs[u.TxPrevOut.UIdx()]
-				network.TxMutex.Unlock()
+				network.TxPool.Lock()
+				_, spending := network.TxPool.SpentOutputs[u.TxPrevOut.UIdx()]
+				network.TxPool.Unlock()
 				if spending {
 					newrec.SpendingValue += u.Value
 					newrec.SpendingCnt++
@@ -189,9 +189,9 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 				as := aa.String()
 				for _, u := range unsp {
 					newrec.Value += u.Value
-					network.TxMutex.Lock()
-					_, spending := network.SpentOutputs[u.TxPrevOut.UIdx()]
-					network.TxMutex.Unlock()
+					network.TxPool.Lock()
+					_, spending := network.TxPool.SpentOutputs[u.TxPrevOut.UIdx()]
+					network.TxPool.Unlock()
 					if spending {
 						newrec.SpendingValue += u.Value
 						newrec.SpendingCnt++
@@ -227,9 +227,9 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 				as := aa.String()
 				for _, u := range unsp {
 					newrec.Value += u.Value
-					network.TxMutex.Lock()
-					_, spending := network.SpentOutputs[u.TxPrevOut.UIdx()]
-					network.TxMutex.Unlock()
+					network.TxPool.Lock()
+					_, spending := network.TxPool.SpentOutputs[u.TxPrevOut.UIdx()]
+					network.TxPool.Unlock()
 					if spending {
 						newrec.SpendingValue += u.Value
 						newrec.SpendingCnt++
@@ -260,8 +260,8 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 
 	// check memory pool
 	if mempool {
-		network.TxMutex.Lock()
-		for _, t2s := range network.TransactionsToSend {
+		network.TxPool.Lock()
+		for _, t2s := range network.TxPool.TransactionsToSend {
 			for vo, to := range t2s.TxOut {
 				if a, ok := addr_map[string(to.Pk_script)]; ok {
 					newrec := out[a]
@@ -269,7 +269,7 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 					newrec.PendingCnt++
 					if !summary {
 						po := &btc.TxPrevOut{Hash:t2s.Hash.Hash, Vout:uint32(vo)}
-						_, spending := network.SpentOutputs[po.UIdx()]
+						_, spending := network.TxPool.SpentOutputs[po.UIdx()]
 						newrec.PendingOuts = append(newrec.PendingOuts, OneOut{
 							TxId : t2s.Hash.String(), Vout : uint32(vo),
 							Value : to.Value, Spending : spending})
@@ -277,7 +277,7 @@ func json_balance(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-		network.TxMutex.Unlock()
+		network.TxPool.Unlock()
 	}
 
 	lck.Out.Done()
@@ -196,6 +196,7 @@ func ServerThread(iface string) {
 	http.HandleFunc("/txsre.xml", xml_txsre)
 	http.HandleFunc("/txw4i.xml", xml_txw4i)
 	http.HandleFunc("/raw_tx", raw_tx)
+	http.HandleFunc("/addrhist.json", json_addrhist)
 
 	http.HandleFunc("/", p_home)
 	http.HandleFunc("/status.json", json_status)
@@ -50,6 +50,7 @@ func LoadBalance() {
 
 	InitMaps(false)
 
+	common.BlockChain.Unspent.Flush()
 	common.BlockChain.Unspent.RWMutex.RLock()
 	defer common.BlockChain.Unspent.RWMutex.RUnlock()
 
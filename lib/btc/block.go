@@ -13,6 +13,7 @@ type Block struct {
 	Txs               []*Tx
 	TxCount, TxOffset int  // Number of transactions and byte offset to the first one
 	Trusted           bool // if the block is trusted, we do not check signatures and some other things...
+	Proposal          bool // a block proposal (BIP23) - its proof of work does not get checked
 	LastKnownHeight   uint32
 
 	BlockExtraInfo // If we cache block on disk (between downloading and comitting), this data has to be preserved
@@ -0,0 +1,190 @@
+package chain
+
+import (
+	"errors"
+	"sync"
+)
+
+// BIP9 deployments are soft forks activated by the blocks signalling their version bit.
+// Only the deployments known to the chain (Consensus.BIP9) have states - the signals
+// of any other bits are ignored. The states change only at the period boundaries.
+
+const (
+	BIP9_PERIOD  = 2016
+	BIP9_MAX_BIT = 28 // the top three bits are BIP9_TOP_BITS
+
+	BIP9_TOP_MASK = 0xe0000000
+	BIP9_TOP_BITS = 0x20000000
+
+	BIP9_ALWAYS_ACTIVE = -1 // special StartTime of a deployment that is always active
+	BIP9_NEVER_ACTIVE  = -2 // special StartTime of a deployment that is never started
+)
+
+const (
+	BIP9_DEFINED = iota
+	BIP9_STARTED
+	BIP9_LOCKED_IN
+	BIP9_ACTIVE
+	BIP9_FAILED
+)
+
+var BIP9StateNames = [...]string{"DEFINED", "STARTED", "LOCKED_IN", "ACTIVE", "FAILED"}
+
+// BIP9Deployment describes a soft fork deployment (see BIP9 and, for MinActivationHeight, BIP341).
+type BIP9Deployment struct {
+	Name                string // as reported in the rules and vbavailable of getblocktemplate
+	Bit                 uint8  // 0 to BIP9_MAX_BIT
+	StartTime           int64  // median time past from which the signals are counted (or BIP9_ALWAYS_ACTIVE / BIP9_NEVER_ACTIVE)
+	Timeout             int64  // median time past from which the deployment fails, if not locked in before
+	Threshold           uint32 // signalling blocks in a period needed to lock in (zero for Consensus.BIP9_Treshold)
+	MinActivationHeight uint32 // a locked in deployment does not get active below this height
+}
+
+type bip9Cache struct {
+	sync.Mutex
+	states map[*BIP9Deployment]map[*BlockTreeNode]byte // by the last node of a period
+}
+
+// BIP9Signals returns the bits signalled by a block of the given version
+// (zero if the version does not use BIP9).
+func BIP9Signals(ver uint32) uint32 {
+	if (ver & BIP9_TOP_MASK) != BIP9_TOP_BITS {
+		return 0
+	}
+	return ver &^ BIP9_TOP_MASK
+}
+
+// AddBIP9Deployment makes the chain track the state of the given deployment.
+func (ch *Chain) AddBIP9Deployment(d BIP9Deployment) error {
+	if d.Name == "" {
+		return errors.New("BIP9 deployment without a name")
+	}
+	if d.Bit > BIP9_MAX_BIT {
+		return errors.New("BIP9 deployment " + d.Name + ": bit out of range")
+	}
+	if d.StartTime >= 0 && d.Timeout <= d.StartTime {
+		return errors.New("BIP9 deployment " + d.Name + ": timeout not after the start time")
+	}
+	if d.Threshold > BIP9_PERIOD {
+		return errors.New("BIP9 deployment " + d.Name + ": threshold above the period")
+	}
+	for _, o := range ch.Consensus.BIP9 {
+		if o.Name == d.Name {
+			return errors.New("BIP9 deployment " + d.Name + " already known")
+		}
+	}
+	ch.Consensus.BIP9 = append(ch.Consensus.BIP9, &d)
+	return nil
+}
+
+// BIP9States returns the states of the known deployments (Consensus.BIP9)
+// for the block following the given one.
+func (ch *Chain) BIP9States(last *BlockTreeNode) (res []byte) {
+	res = make([]byte, len(ch.Consensus.BIP9))
+	for i, d := range ch.Consensus.BIP9 {
+		res[i] = ch.BIP9State(d, last)
+	}
+	return
+}
+
+// BIP9Version returns the version of a new block following the given one,
+// signalling the known deployments that are STARTED or LOCKED_IN.
+func (ch *Chain) BIP9Version(last *BlockTreeNode) uint32 {
+	ver := uint32(BIP9_TOP_BITS)
+	for i, state := range ch.BIP9States(last) {
+		if state == BIP9_STARTED || state == BIP9_LOCKED_IN {
+			ver |= 1 << ch.Consensus.BIP9[i].Bit
+		}
+	}
+	return ver
+}
+
+// BIP9State returns the state of the deployment for the block following the given one.
+func (ch *Chain) BIP9State(d *BIP9Deployment, last *BlockTreeNode) (state byte) {
+	switch d.StartTime {
+	case BIP9_ALWAYS_ACTIVE:
+		return BIP9_ACTIVE
+	case BIP9_NEVER_ACTIVE:
+		return BIP9_FAILED
+	}
+	threshold := d.Threshold
+	if threshold == 0 {
+		threshold = ch.Consensus.BIP9_Treshold
+	}
+
+	ch.bip9.Lock()
+	defer ch.bip9.Unlock()
+	if ch.bip9.states == nil {
+		ch.bip9.states = make(map[*BIP9Deployment]map[*BlockTreeNode]byte)
+	}
+	cache := ch.bip9.states[d]
+	if cache == nil {
+		cache = make(map[*BlockTreeNode]byte)
+		ch.bip9.states[d] = cache
+	}
+
+	// the state is the same for the whole period, so go to the last block of the previous one
+	n := bip9Ancestor(last, int64(last.Height)-int64((last.Height+1)%BIP9_PERIOD))
+
+	// walk back to a period with a known state
+	var todo []*BlockTreeNode
+	for n != nil {
+		var ok bool
+		if state, ok = cache[n]; ok {
+			break
+		}
+		if int64(n.GetMedianTimePast()) < d.StartTime {
+			state = BIP9_DEFINED
+			cache[n] = state
+			break
+		}
+		todo = append(todo, n)
+		n = bip9Ancestor(n, int64(n.Height)-BIP9_PERIOD)
+	}
+	if n == nil {
+		state = BIP9_DEFINED
+	}
+
+	// and compute the states of the following periods
+	for i := len(todo) - 1; i >= 0; i-- {
+		n = todo[i]
+		mtp := int64(n.GetMedianTimePast())
+		switch state {
+		case BIP9_DEFINED:
+			if mtp >= d.StartTime {
+				state = BIP9_STARTED
+			}
+		case BIP9_STARTED:
+			var cnt uint32
+			p := n
+			for j := 0; j < BIP9_PERIOD && p != nil; j++ {
+				if (BIP9Signals(p.BlockVersion()) & (1 << d.Bit)) != 0 {
+					cnt++
+				}
+				p = p.Parent
+			}
+			if cnt >= threshold {
+				state = BIP9_LOCKED_IN
+			} else if mtp >= d.Timeout {
+				state = BIP9_FAILED
+			}
+		case BIP9_LOCKED_IN:
+			if n.Height+1 >= d.MinActivationHeight {
+				state = BIP9_ACTIVE
+			}
+		}
+		cache[n] = state
+	}
+	return
+}
+
+// bip9Ancestor returns the node's ancestor at the given height (nil if below zero).
+func bip9Ancestor(n *BlockTreeNode, height int64) *BlockTreeNode {
+	if height < 0 {
+		return nil
+	}
+	for n != nil && int64(n.Height) > height {
+		n = n.Parent
+	}
+	return n
+}
@@ -0,0 +1,87 @@
+package chain
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestBIP9States(t *testing.T) {
+	ch := new(Chain)
+	ch.Consensus.BIP9_Treshold = 1512
+
+	ts := func(h int) int64 { return 1500000000 + 600*int64(h) }
+
+	var n *BlockTreeNode
+	nodes := make([]*BlockTreeNode, 30*BIP9_PERIOD)
+	for h := range nodes {
+		ver := uint32(BIP9_TOP_BITS | 1<<20) // version rolling - not a known deployment
+		switch {
+		case h >= BIP9_PERIOD && h < BIP9_PERIOD+1600:
+			ver |= 1 << 1
+		case h > 3*BIP9_PERIOD && h <= 4*BIP9_PERIOD:
+			ver |= 1 << 3
+		}
+		if h == 10 {
+			ver = 1 << 1 // not a BIP9 version
+		}
+		n = &BlockTreeNode{Height: uint32(h), Parent: n}
+		binary.LittleEndian.PutUint32(n.BlockHeader[0:4], ver)
+		binary.LittleEndian.PutUint32(n.BlockHeader[68:72], uint32(ts(h)))
+		nodes[h] = n
+	}
+	last := nodes[len(nodes)-1]
+
+	for _, d := range []BIP9Deployment{
+		{Name: "one", Bit: 1, StartTime: ts(100), Timeout: ts(100 * BIP9_PERIOD)},
+		{Name: "two", Bit: 2, StartTime: ts(100), Timeout: ts(3 * BIP9_PERIOD)},
+		{Name: "three", Bit: 3, StartTime: ts(100), Timeout: ts(4*BIP9_PERIOD - 10), MinActivationHeight: 6 * BIP9_PERIOD},
+		{Name: "four", Bit: 4, StartTime: ts(100 * BIP9_PERIOD), Timeout: ts(200 * BIP9_PERIOD)},
+		{Name: "five", Bit: 5, StartTime: BIP9_ALWAYS_ACTIVE},
+	} {
+		if er := ch.AddBIP9Deployment(d); er != nil {
+			t.Fatal(er)
+		}
+	}
+	if ch.AddBIP9Deployment(BIP9Deployment{Name: "one", Bit: 6, StartTime: 1, Timeout: 2}) == nil {
+		t.Error("Duplicate deployment accepted")
+	}
+	if ch.AddBIP9Deployment(BIP9Deployment{Name: "six", Bit: 29, StartTime: 1, Timeout: 2}) == nil {
+		t.Error("Deployment with the bit 29 accepted")
+	}
+
+	// the furthest block first, as it fills the cache of the states
+	exp := func(last *BlockTreeNode, idx int, state byte) {
+		if res := ch.BIP9States(last); res[idx] != state {
+			t.Error("Next to", last.Height, ch.Consensus.BIP9[idx].Name, "expected",
+				BIP9StateNames[state], "got", BIP9StateNames[res[idx]])
+		}
+	}
+	exp(last, 0, BIP9_ACTIVE) // not forgotten after many periods
+	exp(last, 1, BIP9_FAILED)
+	exp(last, 2, BIP9_ACTIVE)
+	exp(last, 3, BIP9_DEFINED)
+	exp(last, 4, BIP9_ACTIVE)
+
+	exp(nodes[50], 0, BIP9_DEFINED)
+	exp(nodes[BIP9_PERIOD-2], 0, BIP9_DEFINED)
+	exp(nodes[BIP9_PERIOD-1], 0, BIP9_STARTED) // the next block starts a new period
+	exp(nodes[BIP9_PERIOD+1700], 0, BIP9_STARTED)
+	exp(nodes[2*BIP9_PERIOD-1], 0, BIP9_LOCKED_IN)
+	exp(nodes[2*BIP9_PERIOD+10], 0, BIP9_LOCKED_IN)
+	exp(nodes[3*BIP9_PERIOD+5], 0, BIP9_ACTIVE)
+
+	exp(nodes[3*BIP9_PERIOD+5], 1, BIP9_STARTED)
+	exp(nodes[4*BIP9_PERIOD], 1, BIP9_FAILED)
+
+	exp(nodes[3*BIP9_PERIOD+5], 2, BIP9_STARTED)
+	exp(nodes[4*BIP9_PERIOD], 2, BIP9_LOCKED_IN) // despite the timeout
+	exp(nodes[5*BIP9_PERIOD], 2, BIP9_LOCKED_IN) // below MinActivationHeight
+	exp(nodes[6*BIP9_PERIOD], 2, BIP9_ACTIVE)
+
+	if ver := ch.BIP9Version(nodes[2*BIP9_PERIOD+10]); ver != BIP9_TOP_BITS|1<<1|1<<2|1<<3 {
+		t.Errorf("Version %08x", ver)
+	}
+	if ver := ch.BIP9Version(last); ver != BIP9_TOP_BITS {
+		t.Errorf("Version %08x at the end", ver)
+	}
+}
@@ -27,7 +27,7 @@ func (ch *Chain) PreCheckBlock(bl *btc.Block) (er error, dos bool, maybelater bo
 	}
 
 	// Check proof-of-work
-	if !btc.CheckProofOfWork(bl.Hash, bl.Bits()) {
+	if !bl.Proposal && !btc.CheckProofOfWork(bl.Hash, bl.Bits()) {
 		er = errors.New("CheckBlock() : proof of work failed - RPC_Result:high-hash")
 		dos = true
 		return
@@ -51,6 +51,15 @@ func (ch *Chain) PreCheckBlock(bl *btc.Block) (er error, dos bool, maybelater bo
 		}
 	}
 
+	if _, inv := ch.invalidBlocks[bl.Hash.BIdx()]; inv {
+		er = errors.New("CheckBlock: "+bl.Hash.String()+" marked invalid - RPC_Result:invalid")
+		return
+	}
+	if _, inv := ch.invalidBlocks[btc.NewUint256(bl.ParentHash()).BIdx()]; inv {
+		er = errors.New("CheckBlock: "+bl.Hash.String()+" parent marked invalid - RPC_Result:bad-prevblk")
+		return
+	}
+
 	prevblk, ok := ch.BlockIndex[btc.NewUint256(bl.ParentHash()).BIdx()]
 	if !ok {
 		er = errors.New("CheckBlock: "+bl.Hash.String()+" parent not found - RPC_Result:bad-prevblk")
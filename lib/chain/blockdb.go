@@ -83,6 +83,8 @@ type BlockDBOpts struct {
 	MaxDataFileSize uint64
 	DataFilesKeep uint32
 	DataFilesBackup bool
+	PruneTarget uint64 // if not zero, remove the oldest data files to keep the total size below it (see prune.go)
+	ReadOnly bool // open the files for reading only and never change them (the flags are only set in memory)
 }
 
 type oneB2W struct {
@@ -112,6 +114,12 @@ type BlockDB struct {
 	data_files_keep uint32
 	data_files_backup bool
 	data_files_done sync.WaitGroup
+
+	prune_target uint64
+	prune_height uint32
+	datfiles map[uint32]*datFileInfo // size and max block height of each data file
+
+	read_only bool
 }
 
 
@@ -123,9 +131,14 @@ func NewBlockDBExt(dir string, opts *BlockDBOpts) (db *BlockDB) {
 		db.dirname += "/"
 	}
 	db.blockIndex = make(map[[btc.Uint256IdxLen]byte] *oneBl)
-	os.MkdirAll(db.dirname, 0770)
+	db.read_only = opts != nil && opts.ReadOnly
 
-	db.blockindx, _ = os.OpenFile(db.dirname+"blockchain.new", os.O_RDWR|os.O_CREATE, 0660)
+	if db.read_only {
+		db.blockindx, _ = os.Open(db.dirname+"blockchain.new")
+	} else {
+		os.MkdirAll(db.dirname, 0770)
+		db.blockindx, _ = os.OpenFile(db.dirname+"blockchain.new", os.O_RDWR|os.O_CREATE, 0660)
+	}
 	if db.blockindx == nil {
 		panic("Cannot open blockchain.new")
 	}
@@ -137,7 +150,9 @@ func NewBlockDBExt(dir string, opts *BlockDBOpts) (db *BlockDB) {
 		db.max_data_file_size = opts.MaxDataFileSize
 		db.data_files_keep = opts.DataFilesKeep
 		db.data_files_backup = opts.DataFilesBackup
+		db.prune_target = opts.PruneTarget
 	}
+	db.datfiles = make(map[uint32]*datFileInfo)
 
 	if db.max_cached_blocks == 0 {
 		db.max_cached_blocks = 100 // default
@@ -211,6 +226,11 @@ func (db *BlockDB) BlockAdd(height uint32, bl *btc.Block) (e error) {
 	var trust_it bool
 	var flush bool
 
+	if db.read_only {
+		e = errors.New("BlockAdd: the database is read-only")
+		return
+	}
+
 	db.mutex.Lock()
 	idx := bl.Hash.BIdx()
 	if rec, ok := db.blockIndex[idx]; !ok {
@@ -264,6 +284,9 @@ func (db *BlockDB) writeAll() (sync bool) {
 
 func (db *BlockDB) removeDatFile(idx uint32) {
 	var remove bool
+	db.mutex.Lock()
+	delete(db.datfiles, idx)
+	db.mutex.Unlock()
 	dat_file := db.dat_fname(idx, false)
 	if db.data_files_backup {
 		os.Mkdir(db.dirname + "oldat", 0770)
@@ -385,6 +408,10 @@ func (db *BlockDB) writeOne() (written bool) {
 
 	db.disk_access.Unlock()
 
+	db.mutex.Lock()
+	db.addToDatFile(rec.datfileidx, rec.blen, b2w.height)
+	db.mutex.Unlock()
+
 	written = true
 
 	return
@@ -418,6 +445,33 @@ func (db *BlockDB) BlockInvalid(hash []byte) {
 }
 
 
+// BlockSetInvalid sets or clears the "invalid" flag of the block (for InvalidateBlock and ReconsiderBlock).
+// Unlike BlockInvalid, it leaves the block in the database.
+func (db *BlockDB) BlockSetInvalid(hash []byte, invalid bool) {
+	var b [1]byte
+	db.writeAll() // the record must be in the index file
+	idx := btc.NewUint256(hash).BIdx()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	cur, ok := db.blockIndex[idx]
+	if !ok || cur.ipos == -1 {
+		return // we don't have this block's data
+	}
+	if db.read_only {
+		return
+	}
+	db.disk_access.Lock()
+	db.blockindx.ReadAt(b[:], cur.ipos)
+	if invalid {
+		b[0] |= BLOCK_INVALID
+	} else {
+		b[0] &^= BLOCK_INVALID
+	}
+	db.blockindx.WriteAt(b[:], cur.ipos)
+	db.disk_access.Unlock()
+}
+
+
 func (db *BlockDB) BlockTrusted(hash []byte) {
 	idx := btc.NewUint256(hash).BIdx()
 	db.mutex.Lock()
@@ -437,6 +491,9 @@ func (db *BlockDB) BlockTrusted(hash []byte) {
 func (db *BlockDB) setBlockFlag(cur *oneBl, fl byte) {
 	var b [1]byte
 	cur.trusted = true
+	if db.read_only {
+		return
+	}
 	db.disk_access.Lock()
 	cpos, _ := db.blockindx.Seek(0, os.SEEK_CUR) // remember our position
 	db.blockindx.ReadAt(b[:], cur.ipos)
@@ -608,6 +665,7 @@ func (db *BlockDB) dat_fname(idx uint32, archive bool) string {
 func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []byte, height, blen, txs uint32)) (e error) {
 	var b [136]byte
 	var bh, txs uint32
+	var invalid bool
 	db.blockindx.Seek(0, os.SEEK_SET)
 	db.maxidxfilepos = 0
 	rd := bufio.NewReader(db.blockindx)
@@ -619,10 +677,13 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 		bh = binary.LittleEndian.Uint32(b[36:40])
 		BlockHash := btc.NewSha2Hash(b[56:136])
 
-		if (b[0]&BLOCK_INVALID) != 0 {
-			// just ignore it
+		if invalid = (b[0]&BLOCK_INVALID) != 0; invalid {
 			fmt.Println("BlockDB: Block", binary.LittleEndian.Uint32(b[36:40]), BlockHash.String(), "is invalid")
-			continue
+			if ch == nil {
+				// just ignore it
+				db.maxidxfilepos += 136
+				continue
+			}
 		}
 
 		ob := new(oneBl)
@@ -648,17 +709,35 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 
 		db.blockIndex[BlockHash.BIdx()] = ob
 
+		if ob.blen == 0 {
+			if bh > db.prune_height {
+				db.prune_height = bh
+			}
+		} else if ob.datfileidx != 0xffffffff {
+			db.addToDatFile(ob.datfileidx, ob.blen, bh)
+		}
+
 		if int64(ob.fpos)+int64(ob.blen) > db.maxdatfilepos {
 			db.maxdatfilepos = int64(ob.fpos)+int64(ob.blen)
 		}
 
 		walk(ch, BlockHash.Hash[:], b[56:136], bh, blen, txs)
+		if invalid {
+			// keep it for ReconsiderBlock
+			if n := ch.BlockIndex[BlockHash.BIdx()]; n != nil {
+				n.Invalid = true
+			}
+		}
 		db.maxidxfilepos += 136
 	}
 	// In case if there was some trash at the end of data or index file, this should truncate it:
 	db.blockindx.Seek(db.maxidxfilepos, os.SEEK_SET)
 
-	db.blockdata, _ = os.OpenFile(db.dat_fname(db.maxdatfileidx, false), os.O_RDWR|os.O_CREATE, 0660)
+	if db.read_only {
+		db.blockdata, _ = os.Open(db.dat_fname(db.maxdatfileidx, false))
+	} else {
+		db.blockdata, _ = os.OpenFile(db.dat_fname(db.maxdatfileidx, false), os.O_RDWR|os.O_CREATE, 0660)
+	}
 	if db.blockdata == nil {
 		panic("Cannot open blockchain.dat")
 	}
@@ -666,7 +745,7 @@ func (db *BlockDB) LoadBlockIndex(ch *Chain, walk func(ch *Chain, hash, hdr []by
 	db.blockdata.Seek(db.maxdatfilepos, os.SEEK_SET)
 
 	// remove (or backup) the old .dat files before continuing
-	if db.data_files_keep != 0 && db.maxdatfileidx > db.data_files_keep  {
+	if !db.read_only && db.data_files_keep != 0 && db.maxdatfileidx > db.data_files_keep  {
 		idx := db.maxdatfileidx - db.data_files_keep
 		for limit := 0; limit < 3; limit++ {
 			idx--
@@ -2,6 +2,7 @@ package chain
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"math/big"
 	"encoding/binary"
@@ -19,14 +20,22 @@ type Chain struct {
 
 	BlockTreeRoot *BlockTreeNode
 	blockTreeEnd *BlockTreeNode
+	mainChain []*BlockTreeNode // the main chain's nodes, by height (protected by blockTreeAccess)
 	blockTreeAccess sync.Mutex
 	Genesis *btc.Uint256
 
 	BlockIndexAccess sync.Mutex
 	BlockIndex map[[btc.Uint256IdxLen]byte] *BlockTreeNode
+	invalidBlocks map[[btc.Uint256IdxLen]byte] *BlockTreeNode // detached from the tree by InvalidateBlock
 
 	CB NewChanOpts // callbacks used by Unspent database
 
+	TxIndex *TxIndex // optional txid -> block index (nil if disabled)
+	HistIndex *HistIndex // optional output script -> history index (nil if disabled)
+	SnapshotCheck *SnapshotCheck // background validation of a loaded UTXO snapshot (see snapshot.go)
+
+	bip9 bip9Cache // states of the BIP9 deployments, at the period boundaries
+
 	Consensus struct {
 		Window, EnforceUpgrade, RejectBlock uint
 		MaxPOWBits uint32
@@ -34,7 +43,8 @@ type Chain struct {
 		GensisTimestamp uint32
 		Enforce_CSV uint32 // if non zero CVS verifications will be enforced from this block onwards
 		Enforce_SEGWIT uint32 // if non zero CVS verifications will be enforced from this block onwards
-		BIP9_Treshold uint32 // It is not really used at this moment, but maybe one day...
+		BIP9_Treshold uint32 // default threshold of the BIP9 deployments
+		BIP9 []*BIP9Deployment // the known BIP9 deployments (see bip9.go)
 		BIP34Height uint32
 		BIP65Height uint32
 		BIP66Height uint32
@@ -48,6 +58,10 @@ type NewChanOpts struct {
 	UTXOCallbacks utxo.CallbackFunctions
 	BlockMinedCB func(*btc.Block) // used to remove mined txs from memory pool
 	DoNotRescan bool // when set UTXO will not be automatically updated with new block found on disk
+	TxIndex bool // maintain the transaction index (see txindex.go)
+	HistIndex bool // maintain the history index of output scripts (see history.go)
+	UTXODir string // if not empty, keep the UTXO database in this folder, instead of dbrootdir
+	UTXOPrealloc int // initial size of an empty UTXO map (see utxo.NewUnspentOpts)
 }
 
 
@@ -83,9 +97,13 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 
 	ch.Blocks = NewBlockDBExt(dbrootdir, bdbopts)
 
+	utxo_dir := dbrootdir
+	if opts.UTXODir != "" {
+		utxo_dir = opts.UTXODir
+	}
 	ch.Unspent = utxo.NewUnspentDb(&utxo.NewUnspentOpts{
-		Dir:dbrootdir, Rescan:rescan, VolatimeMode:opts.UTXOVolatileMode,
-		CB:opts.UTXOCallbacks, AbortNow:&AbortNow})
+		Dir:utxo_dir, Rescan:rescan, VolatimeMode:opts.UTXOVolatileMode,
+		CB:opts.UTXOCallbacks, AbortNow:&AbortNow, Prealloc:opts.UTXOPrealloc})
 
 	if AbortNow {
 		return
@@ -96,8 +114,30 @@ func NewChainExt(dbrootdir string, genesis *btc.Uint256, rescan bool, opts *NewC
 		return
 	}
 
+	if opts.TxIndex {
+		var e error
+		if ch.TxIndex, e = NewTxIndex(dbrootdir + "txindex"); e != nil {
+			println("NewTxIndex:", e.Error())
+			ch.TxIndex = nil
+		}
+	}
+
+	if opts.HistIndex {
+		var e error
+		if ch.HistIndex, e = NewHistIndex(dbrootdir+"history", genesis, ch.Unspent.UnwindBufLen); e != nil {
+			println("NewHistIndex:", e.Error())
+			ch.HistIndex = nil
+		} else {
+			ch.Unspent.CB.NotifyBlock = ch.HistIndex.NotifyBlock
+		}
+	}
+
 	if rescan {
 		ch.SetLast(ch.BlockTreeRoot)
+		os.Remove(dbrootdir + SNAPSHOT_STATE_FILE)
+		os.RemoveAll(dbrootdir + "snapshot")
+	} else {
+		ch.loadSnapshotCheck()
 	}
 
 	if AbortNow {
@@ -155,6 +195,15 @@ func (ch *Chain) Stats() (s string) {
 	ch.BlockIndexAccess.Unlock()
 	s += ch.Blocks.GetStats()
 	s += ch.Unspent.GetStats()
+	if ch.TxIndex != nil {
+		s += ch.TxIndex.Stats() + "\n"
+	}
+	if ch.HistIndex != nil {
+		s += ch.HistIndex.Stats() + "\n"
+	}
+	if ch.SnapshotCheck != nil {
+		s += ch.SnapshotCheck.Status() + "\n"
+	}
 	return
 }
 
@@ -163,6 +212,15 @@ func (ch *Chain) Stats() (s string) {
 func (ch *Chain) Close() {
 	ch.Blocks.Close()
 	ch.Unspent.Close()
+	if ch.TxIndex != nil {
+		ch.TxIndex.Close()
+	}
+	if ch.HistIndex != nil {
+		ch.HistIndex.Close()
+	}
+	if ch.SnapshotCheck != nil {
+		ch.SnapshotCheck.close()
+	}
 }
 
 
@@ -201,6 +259,14 @@ func (ch *Chain) LastBlock() (res *BlockTreeNode) {
 func (ch *Chain) SetLast(val *BlockTreeNode) {
 	ch.blockTreeAccess.Lock()
 	ch.blockTreeEnd = val
+	if int(val.Height) < len(ch.mainChain) {
+		ch.mainChain = ch.mainChain[:val.Height+1]
+	} else {
+		ch.mainChain = append(ch.mainChain, make([]*BlockTreeNode, int(val.Height)+1-len(ch.mainChain))...)
+	}
+	for n := val; n != nil && ch.mainChain[n.Height] != n; n = n.Parent {
+		ch.mainChain[n.Height] = n
+	}
 	ch.blockTreeAccess.Unlock()
 	return
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"sync"
 	"errors"
-	"sync/atomic"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/utxo"
 	"github.com/piotrnar/gocoin/lib/script"
@@ -14,11 +13,16 @@ import (
 // been verified already by the client while being taken to its memory pool
 var TrustedTxChecker func(*btc.Tx) bool
 
+// ScriptCache, if set, holds inputs that have already passed the scripts verification
+// (i.e. when the transaction was accepted to the memory pool) so they can be skipped here
+var ScriptCache *script.VerifyCache
+
 
 func (ch *Chain) ProcessBlockTransactions(bl *btc.Block, height, lknown uint32) (changes *utxo.BlockChanges, sigopscost uint32, e error) {
 	changes = new(utxo.BlockChanges)
 	changes.Height = height
 	changes.LastKnownHeight = lknown
+	changes.Block = bl
 	changes.DeledTxs = make(map[[32]byte] []bool, bl.TotalInputs)
 	sigopscost, e = ch.commitTxs(bl, changes)
 	return
@@ -83,6 +87,12 @@ func (ch *Chain)CommitBlock(bl *btc.Block, cur *BlockTreeNode) (e error) {
 			// Apply the block's trabnsactions to the unspent database:
 			ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
 			ch.SetLast(cur) // Advance the head
+			if ch.TxIndex != nil {
+				ch.TxIndex.BlockCommitted(bl, cur.Height)
+			}
+			if ch.Blocks.Pruning() {
+				ch.pruneBlocks(cur.Height)
+			}
 			if ch.CB.BlockMinedCB != nil {
 				ch.CB.BlockMinedCB(bl)
 			}
@@ -119,8 +129,8 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 
 	blUnsp := make(map[[32]byte] []*btc.TxOut, len(bl.Txs))
 
-	var wg sync.WaitGroup
-	var ver_err_cnt uint32
+	var scripts scriptBatch
+	prefetched := ch.prefetchInputs(bl)
 
 	for i := range bl.Txs {
 		txoutsum, txinsum = 0, 0
@@ -150,7 +160,12 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 						return
 					}
 				}
-				tout := ch.Unspent.UnspentGet(inp)
+				var tout *btc.TxOut
+				if prefetched != nil {
+					tout = prefetched[i][j]
+				} else {
+					tout = ch.Unspent.UnspentGet(inp)
+				}
 				if tout==nil {
 					t, ok := blUnsp[inp.Hash]
 					if !ok {
@@ -208,14 +223,9 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 					}
 				}
 
-				if !tx_trusted { // run VerifyTxScript() in a parallel task
-					wg.Add(1)
-					go func (prv []byte, amount uint64, i int, tx *btc.Tx) {
-						if !script.VerifyTxScript(prv, amount, i, tx, bl.VerifyFlags) {
-							atomic.AddUint32(&ver_err_cnt, 1)
-						}
-						wg.Done()
-					}(tout.Pk_script, tout.Value, j, bl.Txs[i])
+				if !tx_trusted && !ScriptCache.Check(bl.Txs[i].WTxID(), j, bl.VerifyFlags, true) {
+					// queue VerifyTxScript() for the workers
+					scripts.add(tout.Pk_script, tout.Value, j, bl.Txs[i], bl.VerifyFlags)
 				}
 
 				if btc.IsP2SH(tout.Pk_script) {
@@ -260,8 +270,7 @@ func (ch *Chain)commitTxs(bl *btc.Block, changes *utxo.BlockChanges) (sigopscost
 	}
 
 	if !bl.Trusted {
-		wg.Wait()
-		if ver_err_cnt > 0 {
+		if ver_err_cnt := scripts.wait(); ver_err_cnt > 0 {
 			println("VerifyScript failed", ver_err_cnt, "time (s)")
 			e = errors.New(fmt.Sprint("VerifyScripts failed ", ver_err_cnt, "time (s)"))
 			return
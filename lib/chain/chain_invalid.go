@@ -0,0 +1,241 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+/*
+	Manual chain management, like Core's invalidateblock, reconsiderblock and preciousblock.
+	A block marked invalid is taken out of the tree, together with all its descendants,
+	and kept in ch.invalidBlocks, so ReconsiderBlock can put it back later.
+	The "invalid" flag is also stored in blockchain.new, so it survives restarts.
+*/
+
+// detachBranch moves the node and all its descendants from BlockIndex to invalidBlocks.
+// Make sure ch.BlockIndexAccess is locked before calling it.
+func (ch *Chain) detachBranch(n *BlockTreeNode) {
+	idx := n.BlockHash.BIdx()
+	delete(ch.BlockIndex, idx)
+	ch.invalidBlocks[idx] = n
+	for _, c := range n.Childs {
+		ch.detachBranch(c)
+	}
+}
+
+// attachBranch moves the node and its descendants, which are not marked invalid, back to BlockIndex.
+// Make sure ch.BlockIndexAccess is locked before calling it.
+func (ch *Chain) attachBranch(n *BlockTreeNode) {
+	idx := n.BlockHash.BIdx()
+	delete(ch.invalidBlocks, idx)
+	ch.BlockIndex[idx] = n
+	for _, c := range append([]*BlockTreeNode{}, n.Childs...) {
+		if c.Invalid {
+			n.delChild(c)
+		} else {
+			ch.attachBranch(c)
+		}
+	}
+}
+
+// findNode looks for the block in the tree as well as among the invalid blocks.
+func (ch *Chain) findNode(hash *btc.Uint256) (n *BlockTreeNode, invalid bool) {
+	ch.BlockIndexAccess.Lock()
+	if n = ch.BlockIndex[hash.BIdx()]; n == nil {
+		n, invalid = ch.invalidBlocks[hash.BIdx()]
+	}
+	ch.BlockIndexAccess.Unlock()
+	return
+}
+
+// bestTip returns the block with the most POW that we can switch to (i.e. we have data of all the blocks leading to it).
+// In case of a tie, the current head stays.
+func (ch *Chain) bestTip() (best *BlockTreeNode) {
+	best = ch.LastBlock()
+	start := best
+	for i := uint32(0); i < ch.Unspent.UnwindBufLen && start.Parent != nil; i++ {
+		start = start.Parent // we cannot undo deeper than this
+	}
+	var walk func(n *BlockTreeNode)
+	walk = func(n *BlockTreeNode) {
+		var leaf = true
+		for _, c := range n.Childs {
+			if c.TxCount > 0 {
+				leaf = false
+				walk(c)
+			}
+		}
+		if leaf && n.MorePOW(best) {
+			best = n
+		}
+	}
+	ch.BlockIndexAccess.Lock()
+	walk(start)
+	ch.BlockIndexAccess.Unlock()
+	return
+}
+
+// moveToBest switches the chain to the best block available.
+func (ch *Chain) moveToBest() (e error) {
+	if best := ch.bestTip(); best != ch.LastBlock() {
+		ch.MoveToBlock(best)
+		if ch.LastBlock() != best {
+			e = errors.New("failed to move to block " + best.BlockHash.String())
+		}
+	}
+	return
+}
+
+// InvalidateBlock marks the block (with all its descendants) as invalid and moves the chain's head
+// to the best block that remains valid. Call it from the main thread.
+func (ch *Chain) InvalidateBlock(hash *btc.Uint256) (e error) {
+	n, invalid := ch.findNode(hash)
+	if n == nil {
+		e = errors.New("block not found")
+		return
+	}
+	if n.Parent == nil {
+		e = errors.New("genesis block cannot be invalidated")
+		return
+	}
+	if n.Invalid {
+		e = errors.New("block already marked invalid")
+		return
+	}
+	if n.Height <= ch.Blocks.PruneHeight() {
+		e = errors.New("block data has been pruned")
+		return
+	}
+
+	if !invalid && ch.OnActiveBranch(n) {
+		if last := ch.LastBlock(); last.Height-n.Height >= ch.Unspent.UnwindBufLen {
+			e = fmt.Errorf("block %d too deep to be undone (current height is %d)", n.Height, last.Height)
+			return
+		}
+		for ch.LastBlock() != n.Parent {
+			if AbortNow {
+				e = errors.New("aborted")
+				return
+			}
+			ch.UndoLastBlock()
+		}
+	}
+
+	n.Invalid = true
+	ch.Blocks.BlockSetInvalid(n.BlockHash.Hash[:], true)
+	if !invalid {
+		ch.BlockIndexAccess.Lock()
+		n.Parent.delChild(n)
+		ch.detachBranch(n)
+		ch.BlockIndexAccess.Unlock()
+	}
+
+	e = ch.moveToBest()
+	return
+}
+
+// ReconsiderBlock removes the invalid mark from the block, its ancestors and descendants,
+// puts them back to the tree and moves the chain's head to the best block. Call it from the main thread.
+func (ch *Chain) ReconsiderBlock(hash *btc.Uint256) (e error) {
+	n, invalid := ch.findNode(hash)
+	if n == nil {
+		e = errors.New("block not found")
+		return
+	}
+	if !invalid {
+		e = errors.New("block is not marked invalid")
+		return
+	}
+
+	var clear func(n *BlockTreeNode)
+	clear = func(n *BlockTreeNode) {
+		if n.Invalid {
+			n.Invalid = false
+			ch.Blocks.BlockSetInvalid(n.BlockHash.Hash[:], false)
+		}
+		for _, c := range n.Childs {
+			clear(c)
+		}
+	}
+
+	ch.BlockIndexAccess.Lock()
+	clear(n)
+	for p := n.Parent; p != nil && ch.invalidBlocks[p.BlockHash.BIdx()] == p; p = p.Parent {
+		if p.Invalid {
+			p.Invalid = false
+			ch.Blocks.BlockSetInvalid(p.BlockHash.Hash[:], false)
+		}
+	}
+	// put back all the branches that hook to the tree and are not marked invalid anymore
+	for again := true; again; {
+		again = false
+		for _, v := range ch.invalidBlocks {
+			if !v.Invalid && ch.BlockIndex[v.Parent.BlockHash.BIdx()] == v.Parent {
+				var linked bool
+				for _, c := range v.Parent.Childs {
+					linked = linked || c == v
+				}
+				if !linked {
+					v.Parent.addChild(v)
+				}
+				ch.attachBranch(v)
+				again = true
+			}
+		}
+	}
+	ch.BlockIndexAccess.Unlock()
+
+	e = ch.moveToBest()
+	return
+}
+
+// PreciousBlock switches the chain's head to the block if it has at least as much POW as the current head.
+// Call it from the main thread.
+func (ch *Chain) PreciousBlock(hash *btc.Uint256) (e error) {
+	n, invalid := ch.findNode(hash)
+	if n == nil {
+		e = errors.New("block not found")
+		return
+	}
+	if invalid {
+		e = errors.New("block is marked invalid")
+		return
+	}
+	if ch.OnActiveBranch(n) {
+		return // nothing to do
+	}
+	last := ch.LastBlock()
+	if last.MorePOW(n) {
+		return // it has less work - ignore it, as Core does
+	}
+	p := n
+	for ; !ch.OnActiveBranch(p); p = p.Parent {
+		if p.TxCount == 0 {
+			e = errors.New("block data not available")
+			return
+		}
+	}
+	if last.Height-p.Height >= ch.Unspent.UnwindBufLen {
+		e = errors.New("block forks too deep to switch to it")
+		return
+	}
+	ch.MoveToBlock(n)
+	if ch.LastBlock() != n {
+		e = errors.New("failed to move to the block")
+	}
+	return
+}
+
+// InvalidBlocks returns the blocks marked invalid.
+func (ch *Chain) InvalidBlocks() (res []*BlockTreeNode) {
+	ch.BlockIndexAccess.Lock()
+	for _, v := range ch.invalidBlocks {
+		if v.Invalid {
+			res = append(res, v)
+		}
+	}
+	ch.BlockIndexAccess.Unlock()
+	return
+}
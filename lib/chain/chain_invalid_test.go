@@ -0,0 +1,121 @@
+package chain
+
+import (
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func testChain(t *testing.T, dir string, rescan bool) *Chain {
+	ch := NewChainExt(dir, testGenesis, rescan, &NewChanOpts{UTXOPrealloc: 1000}, &BlockDBOpts{MaxCachedBlocks: 100})
+	ch.Consensus.MaxPOWBits = regtestBits
+	return ch
+}
+
+func testAccept(t *testing.T, ch *Chain, bl *btc.Block) {
+	if e := ch.AcceptBlock(bl); e != nil {
+		t.Fatal("AcceptBlock", bl.Height, e.Error())
+	}
+}
+
+// testMainChain checks MainChainNode(s) against the main chain's blocks.
+func testMainChain(t *testing.T, ch *Chain, blocks ...*btc.Block) {
+	nodes := ch.MainChainNodes(1, 10)
+	if len(nodes) != len(blocks) || ch.MainChainNode(uint32(len(blocks)+1)) != nil {
+		t.Fatal("MainChainNodes", len(nodes), "expected", len(blocks))
+	}
+	for i, bl := range blocks {
+		if !nodes[i].BlockHash.Equal(bl.Hash) || ch.MainChainNode(uint32(i+1)) != nodes[i] {
+			t.Fatal("MainChainNode", i+1, "mismatch")
+		}
+	}
+}
+
+func TestInvalidateBlock(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "gocoin_chain_test")
+	defer os.RemoveAll(dir)
+	ch := testChain(t, dir+"/", true)
+
+	// main chain: a1 - a2 - a3, competing branch with equal work: a1 - b2 - b3
+	a1 := testBlock(testGenesis, 1, 'a')
+	a2 := testBlock(a1.Hash, 2, 'a')
+	a3 := testBlock(a2.Hash, 3, 'a')
+	b2 := testBlock(a1.Hash, 2, 'b')
+	b3 := testBlock(b2.Hash, 3, 'b')
+	for _, bl := range []*btc.Block{a1, a2, a3, b2, b3} {
+		testAccept(t, ch, bl)
+	}
+	if !ch.LastBlock().BlockHash.Equal(a3.Hash) {
+		t.Fatal("a3 should stay on top after the tie")
+	}
+
+	// preciousblock breaks the tie both ways
+	if e := ch.PreciousBlock(b3.Hash); e != nil || !ch.LastBlock().BlockHash.Equal(b3.Hash) {
+		t.Fatal("PreciousBlock b3", e)
+	}
+	if e := ch.PreciousBlock(a3.Hash); e != nil || !ch.LastBlock().BlockHash.Equal(a3.Hash) {
+		t.Fatal("PreciousBlock a3", e)
+	}
+
+	// invalidate a2 - we should go to b3
+	if e := ch.InvalidateBlock(a2.Hash); e != nil {
+		t.Fatal("InvalidateBlock", e.Error())
+	}
+	if !ch.LastBlock().BlockHash.Equal(b3.Hash) {
+		t.Fatal("not at b3 after invalidating a2")
+	}
+	testMainChain(t, ch, a1, b2, b3)
+	if ch.Unspent.TxPresent(&a2.Txs[0].Hash) || !ch.Unspent.TxPresent(&b2.Txs[0].Hash) {
+		t.Error("bad UTXO after invalidating a2")
+	}
+	if _, ok := ch.BlockIndex[a3.Hash.BIdx()]; ok {
+		t.Error("a3 still in the block index")
+	}
+	if e := ch.PreciousBlock(a3.Hash); e == nil {
+		t.Error("PreciousBlock on invalid block should fail")
+	}
+
+	// a block building on the invalid branch is rejected
+	a4 := testBlock(a3.Hash, 4, 'a')
+	ch.BlockIndexAccess.Lock()
+	er, _, _ := ch.PreCheckBlock(a4)
+	ch.BlockIndexAccess.Unlock()
+	if er == nil {
+		t.Error("block on top of invalid branch not rejected")
+	}
+
+	// reconsider a3 (and so a2) - b3 stays on top (equal work), until a4 comes
+	if e := ch.ReconsiderBlock(a3.Hash); e != nil {
+		t.Fatal("ReconsiderBlock", e.Error())
+	}
+	if !ch.LastBlock().BlockHash.Equal(b3.Hash) || len(ch.InvalidBlocks()) != 0 {
+		t.Fatal("bad state after ReconsiderBlock")
+	}
+	testAccept(t, ch, a4)
+	if !ch.LastBlock().BlockHash.Equal(a4.Hash) {
+		t.Fatal("not at a4")
+	}
+	testMainChain(t, ch, a1, a2, a3, a4)
+
+	// the invalid mark survives a restart
+	if e := ch.InvalidateBlock(b2.Hash); e != nil {
+		t.Fatal("InvalidateBlock b2", e.Error())
+	}
+	ch.Close()
+	ch = testChain(t, dir+"/", false)
+	defer ch.Close()
+	if inv := ch.InvalidBlocks(); len(inv) != 1 || !inv[0].BlockHash.Equal(b2.Hash) {
+		t.Fatal("invalid blocks not restored", len(inv))
+	}
+	if _, ok := ch.BlockIndex[b3.Hash.BIdx()]; ok {
+		t.Error("b3 in the block index after restart")
+	}
+	if !ch.LastBlock().BlockHash.Equal(a4.Hash) {
+		t.Error("not at a4 after restart")
+	}
+	testMainChain(t, ch, a1, a2, a3, a4)
+	if e := ch.ReconsiderBlock(b3.Hash); e != nil || ch.BlockIndex[b3.Hash.BIdx()] == nil {
+		t.Error("ReconsiderBlock b3 after restart", e)
+	}
+}
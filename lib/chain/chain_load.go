@@ -25,6 +25,7 @@ func nextBlock(ch *Chain, hash, header []byte, height, blen, txs uint32) {
 // loadBlockIndex loads the block index from the disk.
 func (ch *Chain)loadBlockIndex() {
 	ch.BlockIndex = make(map[[btc.Uint256IdxLen]byte]*BlockTreeNode, BlockMapInitLen)
+	ch.invalidBlocks = make(map[[btc.Uint256IdxLen]byte]*BlockTreeNode)
 	ch.BlockTreeRoot = new(BlockTreeNode)
 	ch.BlockTreeRoot.BlockHash = ch.Genesis
 	ch.RebuildGenesisHeader()
@@ -53,6 +54,13 @@ func (ch *Chain)loadBlockIndex() {
 		v.Parent = par
 		v.Parent.addChild(v)
 	}
+	// the blocks marked invalid (with their descendants) go out of the tree
+	for _, v := range ch.BlockIndex {
+		if v.Invalid && v.Parent != nil {
+			v.Parent.delChild(v)
+			ch.detachBranch(v)
+		}
+	}
 	if tlb == nil {
 		//println("No last block - full rescan will be needed")
 		ch.SetLast(ch.BlockTreeRoot)
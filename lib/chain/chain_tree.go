@@ -22,12 +22,10 @@ type BlockTreeNode struct {
 	BlockHeader [80]byte
 
 	Trusted bool
+	Invalid bool // marked invalid by InvalidateBlock (see chain_invalid.go)
 }
 
 func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
-	var crec *BlckCachRec
-	var er error
-	var trusted bool
 	var tot_bytes uint64
 
 	last := ch.LastBlock()
@@ -40,6 +38,8 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 	fmt.Println("\rApplying", total_size_to_process>>20, "MB of transactions data from", end.Height-last.Height, "blocks to UTXO.db")
 	sta := time.Now()
 	prv := sta
+	rd := ch.NewBlockReader(last, end)
+	defer rd.Close()
 	for !AbortNow && last != end {
 		cur := time.Now()
 		if cur.Sub(prv) >= 10 * time.Second {
@@ -50,44 +50,32 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 			prv = cur
 		}
 
-		nxt := last.FindPathTo(end)
-		if nxt == nil {
-			break
-		}
-
-		if nxt.BlockSize==0 {
-			println("ParseTillBlock: ", nxt.Height, nxt.BlockHash.String(), "- not yet commited")
+		// The blocks come already decoded, with their verify flags recovered (see BlockReader).
+		// Do not recover MedianPastTime as it is only checked in PostCheckBlock()
+		// that had to be done before the block was stored on disk.
+		rb := rd.Next()
+		if rb == nil {
 			break
 		}
+		nxt := rb.Node
 
-		crec, trusted, er = ch.Blocks.BlockGetInternal(nxt.BlockHash, true)
-		if er != nil {
-			panic("Db.BlockGet(): "+er.Error())
+		if rb.Error != nil {
+			if rb.Corrupt {
+				ch.DeleteBranch(nxt, nil)
+				break
+			}
+			if nxt.BlockSize==0 {
+				println("ParseTillBlock: ", nxt.Height, nxt.BlockHash.String(), "- not yet commited")
+				break
+			}
+			panic("Db.BlockGet(): "+rb.Error.Error())
 		}
-		tot_bytes += uint64(len(crec.Data))
+		tot_bytes += uint64(rb.Size)
 		l, _ := ch.Blocks.BlockLength(nxt.BlockHash, false)
 		total_size_to_process -= uint64(l)
 
-		bl, er := btc.NewBlock(crec.Data)
-		if er != nil {
-			ch.DeleteBranch(nxt, nil)
-			break
-		}
-		bl.Height = nxt.Height
-
-		// Recover the flags to be used when verifying scripts for non-trusted blocks (stored orphaned blocks)
-		ch.ApplyBlockFlags(bl)
-
-		// Do not recover MedianPastTime as it is only checked in PostCheckBlock()
-		// that had to be done before the block was stored on disk.
-
-		er = bl.BuildTxList()
-		if er != nil {
-			ch.DeleteBranch(nxt, nil)
-			break
-		}
-
-		bl.Trusted = trusted
+		bl := rb.Block
+		trusted := bl.Trusted
 
 		changes, sigopscost, er := ch.ProcessBlockTransactions(bl, nxt.Height, end.Height)
 		if er != nil {
@@ -104,6 +92,12 @@ func (ch *Chain) ParseTillBlock(end *BlockTreeNode) {
 
 		ch.SetLast(nxt)
 		last = nxt
+		if ch.TxIndex != nil {
+			ch.TxIndex.BlockCommitted(bl, nxt.Height)
+		}
+		if ch.Blocks.Pruning() {
+			ch.pruneBlocks(nxt.Height)
+		}
 
 		if ch.CB.BlockMinedCB != nil {
 			bl.Height = nxt.Height
@@ -252,6 +246,13 @@ func (ch *Chain) MoveToBlock(dst *BlockTreeNode) {
 	}
 
 	// At this point "cur" is at the highest common block
+	if cur.Height < ch.Blocks.PruneHeight() ||
+		ch.Blocks.Pruning() && ch.LastBlock().Height-cur.Height > ch.Unspent.UnwindBufLen {
+		fmt.Println("MoveToBlock cannot continue C - the blocks to undo have been pruned")
+		fmt.Println("Trying to go:", dst.BlockHash.String())
+		fmt.Println("Common block:", cur.Height, cur.BlockHash.String())
+		return
+	}
 	for ch.LastBlock() != cur {
 		if AbortNow {
 			return
@@ -276,6 +277,9 @@ func (ch *Chain) UndoLastBlock() {
 
 	ch.Unspent.UndoBlockTxs(bl, last.Parent.BlockHash.Hash[:])
 	ch.SetLast(last.Parent)
+	if ch.TxIndex != nil {
+		ch.TxIndex.BlockUndone(bl, last.Height)
+	}
 }
 
 
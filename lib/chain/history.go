@@ -0,0 +1,598 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+	"github.com/piotrnar/gocoin/lib/script"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+/*
+	Optional history index of the output scripts, kept in "history" folder (qdb database).
+	It is maintained through utxo.CallbackFunctions.NotifyBlock and has four kinds of records:
+
+	1) Script key (8 bytes of SHA256 of pk_script) - the number of the script's events (4 bytes),
+	followed by the first HistPageRecs of them. The events are 57 bytes each:
+		[0]     - 0 for funding (tx output) or 1 for spending (tx input)
+		[1:33]  - txid
+		[33:37] - block height
+		[37:41] - vout (funding) or vin (spending)
+		[41:49] - value
+		[49:53] - height of the block that has spent the output (funding only, zero if unspent)
+		[53:57] - bytes [8:12] of the script's SHA256 (to tell apart scripts with the same key)
+
+	2) Page key (see histPageKey) - the following pages of the script's events, HistPageRecs each.
+	New events are only appended to the last page, so a block does not rewrite the entire history.
+
+	3) Outpoint key (8 bytes of SHA256 of txid+vout) - for each unspent output:
+		[0:8]   - script key
+		[8:16]  - value
+		[16:20] - bytes [8:12] of the script's SHA256
+		[20:24] - the page with the funding event
+
+	4) Block key (histBlockKey + height) - what is needed to undo the block, kept for the last UnwindBufLen blocks:
+		[0:32]  - parent block hash
+		then: varint + script keys touched, varint + outpoint keys created, varint + spent outpoints (key + record)
+
+	The state (height and hash of the last indexed block and the version) is kept under histState key.
+*/
+
+const (
+	HistRecLen   = 57
+	HistPageRecs = 64
+	histOutLen   = 24
+	histVersion  = 2
+
+	histKeyMask  = qdb.KeyType(1<<63 - 1) // script, page and outpoint keys have the top bit cleared
+	histBlockKey = qdb.KeyType(1 << 63)
+	histState    = qdb.KeyType(1<<63 | 1<<62)
+)
+
+type HistRec struct {
+	Spending    bool
+	TxID        *btc.Uint256
+	Height      uint32
+	Index       uint32 // vout for funding, vin for spending
+	Value       uint64
+	SpentHeight uint32 // for funding: height of the block that has spent it (zero if unspent)
+}
+
+type HistIndex struct {
+	db  *qdb.DB
+	dir string
+	sync.Mutex
+	Height uint32
+	Hash   [32]byte
+
+	genesis  [32]byte
+	undo_len uint32
+	undone   map[[32]byte]bool // blocks undone while backfilling
+}
+
+// HistScriptHash returns SHA256 of the output script.
+// Reverse it, to get Electrum's scripthash.
+func HistScriptHash(pk_script []byte) [32]byte {
+	return sha256.Sum256(pk_script)
+}
+
+func histKey(sh []byte) qdb.KeyType {
+	return qdb.KeyType(binary.LittleEndian.Uint64(sh[:8])) & histKeyMask
+}
+
+func histOutKey(txid []byte, vout uint32) qdb.KeyType {
+	var b [36]byte
+	copy(b[:32], txid)
+	binary.LittleEndian.PutUint32(b[32:], vout)
+	h := sha256.Sum256(b[:])
+	return histKey(h[:])
+}
+
+// histPageKey returns the key of the given page of the script's events.
+// The first page is stored under the script key itself.
+func histPageKey(k qdb.KeyType, page uint32) qdb.KeyType {
+	if page == 0 {
+		return k
+	}
+	var b [12]byte
+	binary.LittleEndian.PutUint64(b[:8], uint64(k))
+	binary.LittleEndian.PutUint32(b[8:], page)
+	h := sha256.Sum256(b[:])
+	return histKey(h[:])
+}
+
+// NewHistIndex opens the history index database.
+func NewHistIndex(dir string, genesis *btc.Uint256, undo_len uint32) (hi *HistIndex, e error) {
+	hi = &HistIndex{dir: dir, genesis: genesis.Hash, undo_len: undo_len}
+	if e = qdb.NewDBExt(&hi.db, &qdb.NewDBOpts{Dir: dir, LoadData: false}); e != nil {
+		return
+	}
+	if v := hi.db.Get(histState); len(v) == 37 && v[36] == histVersion {
+		hi.Height = binary.LittleEndian.Uint32(v[:4])
+		copy(hi.Hash[:], v[4:36])
+	} else if hi.db.Count() > 0 {
+		println("HistIndex: old format - rebuilding from scratch")
+		hi.reset()
+	} else {
+		hi.Hash = hi.genesis
+	}
+	return
+}
+
+func (hi *HistIndex) saveState() {
+	var v [37]byte
+	binary.LittleEndian.PutUint32(v[:4], hi.Height)
+	copy(v[4:36], hi.Hash[:])
+	v[36] = histVersion
+	hi.db.Put(histState, v[:])
+}
+
+// reset removes all the data, so the index can be rebuilt from scratch.
+func (hi *HistIndex) reset() {
+	hi.db.Close()
+	os.RemoveAll(hi.dir)
+	qdb.NewDBExt(&hi.db, &qdb.NewDBOpts{Dir: hi.dir, LoadData: false})
+	hi.Height = 0
+	hi.Hash = hi.genesis
+}
+
+// histPages keeps the pages of the scripts' events, modified by a block being applied or undone.
+type histPages struct {
+	db    *qdb.DB
+	cnt   map[qdb.KeyType]uint32 // number of events, by the script key
+	pages map[qdb.KeyType][]byte // by the page key (without the number of events for the first page)
+}
+
+func (hi *HistIndex) newPages() *histPages {
+	return &histPages{db: hi.db, cnt: make(map[qdb.KeyType]uint32), pages: make(map[qdb.KeyType][]byte)}
+}
+
+func (hp *histPages) count(k qdb.KeyType) uint32 {
+	c, ok := hp.cnt[k]
+	if !ok {
+		if v := hp.db.Get(k); len(v) >= 4 {
+			c = binary.LittleEndian.Uint32(v[:4])
+			hp.pages[k] = append([]byte{}, v[4:]...)
+		}
+		hp.cnt[k] = c
+	}
+	return c
+}
+
+func (hp *histPages) page(k qdb.KeyType, page uint32) []byte {
+	if page == 0 {
+		hp.count(k)
+		return hp.pages[k]
+	}
+	pk := histPageKey(k, page)
+	v, ok := hp.pages[pk]
+	if !ok {
+		v = append([]byte{}, hp.db.Get(pk)...)
+		hp.pages[pk] = v
+	}
+	return v
+}
+
+// add appends the event to the script's list and returns the page it went to.
+func (hp *histPages) add(k qdb.KeyType, rec []byte) (page uint32) {
+	c := hp.count(k)
+	page = c / HistPageRecs
+	hp.pages[histPageKey(k, page)] = append(hp.page(k, page), rec...)
+	hp.cnt[k] = c + 1
+	return
+}
+
+// pop removes the script's events from the given height (they are always the last ones).
+func (hp *histPages) pop(k qdb.KeyType, height uint32) {
+	c := hp.count(k)
+	for ; c > 0; c-- {
+		page := (c - 1) / HistPageRecs
+		v := hp.page(k, page)
+		if len(v) < HistRecLen || binary.LittleEndian.Uint32(v[len(v)-HistRecLen+33:]) != height {
+			break
+		}
+		hp.pages[histPageKey(k, page)] = v[:len(v)-HistRecLen]
+	}
+	hp.cnt[k] = c
+}
+
+// flush stores the modified pages in the database.
+func (hp *histPages) flush() {
+	for pk, v := range hp.pages {
+		if c, ok := hp.cnt[pk]; ok {
+			if c == 0 {
+				hp.db.Del(pk)
+				continue
+			}
+			nv := make([]byte, 4+len(v))
+			binary.LittleEndian.PutUint32(nv[:4], c)
+			copy(nv[4:], v)
+			v = nv
+		} else if len(v) == 0 {
+			hp.db.Del(pk)
+			continue
+		}
+		hp.db.PutExt(pk, v, qdb.NO_CACHE)
+	}
+}
+
+// applyBlock adds the block's events to the index. Call it with the mutex locked.
+func (hi *HistIndex) applyBlock(bl *btc.Block, height uint32) {
+	hp := hi.newPages()
+	var touched []qdb.KeyType
+	add := func(k qdb.KeyType, rec []byte) uint32 {
+		if _, ok := hp.cnt[k]; !ok {
+			touched = append(touched, k)
+		}
+		return hp.add(k, rec)
+	}
+	newouts := make(map[qdb.KeyType][]byte)
+	spent := new(bytes.Buffer)
+	var spent_cnt int
+
+	var rec [HistRecLen]byte
+	binary.LittleEndian.PutUint32(rec[33:37], height)
+	for i, tx := range bl.Txs {
+		copy(rec[1:33], tx.Hash.Hash[:])
+		if i > 0 {
+			rec[0] = 1
+			for vin, inp := range tx.TxIn {
+				ok := histOutKey(inp.Input.Hash[:], inp.Input.Vout)
+				out, in_block := newouts[ok]
+				if in_block {
+					delete(newouts, ok)
+				} else {
+					if out = hi.db.Get(ok); len(out) != histOutLen {
+						continue // unspendable output (not indexed)
+					}
+					out = append([]byte{}, out...)
+					hi.db.Del(ok)
+					binary.Write(spent, binary.LittleEndian, uint64(ok))
+					spent.Write(out)
+					spent_cnt++
+				}
+				k := qdb.KeyType(binary.LittleEndian.Uint64(out[0:8]))
+				pg := hp.page(k, binary.LittleEndian.Uint32(out[20:24]))
+				for j := 0; j+HistRecLen <= len(pg); j += HistRecLen {
+					r := pg[j : j+HistRecLen]
+					if r[0] == 0 && binary.LittleEndian.Uint32(r[37:41]) == inp.Input.Vout &&
+						bytes.Equal(r[1:33], inp.Input.Hash[:]) && bytes.Equal(r[53:57], out[16:20]) {
+						binary.LittleEndian.PutUint32(r[49:53], height)
+						break
+					}
+				}
+				binary.LittleEndian.PutUint32(rec[37:41], uint32(vin))
+				copy(rec[41:49], out[8:16])
+				binary.LittleEndian.PutUint32(rec[49:53], 0)
+				copy(rec[53:57], out[16:20])
+				add(k, rec[:])
+			}
+		}
+
+		rec[0] = 0
+		for vout, txo := range tx.TxOut {
+			if script.IsUnspendable(txo.Pk_script) {
+				continue
+			}
+			sh := HistScriptHash(txo.Pk_script)
+			k := histKey(sh[:])
+			binary.LittleEndian.PutUint32(rec[37:41], uint32(vout))
+			binary.LittleEndian.PutUint64(rec[41:49], txo.Value)
+			binary.LittleEndian.PutUint32(rec[49:53], 0)
+			copy(rec[53:57], sh[8:12])
+			page := add(k, rec[:])
+
+			out := make([]byte, histOutLen)
+			binary.LittleEndian.PutUint64(out[0:8], uint64(k))
+			binary.LittleEndian.PutUint64(out[8:16], txo.Value)
+			copy(out[16:20], sh[8:12])
+			binary.LittleEndian.PutUint32(out[20:24], page)
+			newouts[histOutKey(tx.Hash.Hash[:], uint32(vout))] = out
+		}
+	}
+	hp.flush()
+
+	undo := new(bytes.Buffer)
+	undo.Write(bl.ParentHash())
+	btc.WriteVlen(undo, uint64(len(touched)))
+	for _, k := range touched {
+		binary.Write(undo, binary.LittleEndian, uint64(k))
+	}
+	btc.WriteVlen(undo, uint64(len(newouts)))
+	for k, v := range newouts {
+		binary.Write(undo, binary.LittleEndian, uint64(k))
+		hi.db.PutExt(k, v, qdb.NO_CACHE)
+	}
+	btc.WriteVlen(undo, uint64(spent_cnt))
+	undo.Write(spent.Bytes())
+	hi.db.PutExt(histBlockKey+qdb.KeyType(height), undo.Bytes(), qdb.NO_CACHE)
+	if height > hi.undo_len {
+		hi.db.Del(histBlockKey + qdb.KeyType(height-hi.undo_len))
+	}
+
+	hi.Height = height
+	copy(hi.Hash[:], bl.Hash.Hash[:])
+	hi.saveState()
+}
+
+// undoBlock removes the last block's events from the index. Call it with the mutex locked.
+func (hi *HistIndex) undoBlock() bool {
+	height := hi.Height
+	d := hi.db.Get(histBlockKey + qdb.KeyType(height))
+	if len(d) < 32 {
+		return false
+	}
+	d = append([]byte{}, d...)
+	rd := bytes.NewReader(d[32:])
+	hp := hi.newPages()
+	var k uint64
+
+	cnt, _ := btc.ReadVLen(rd)
+	for ; cnt > 0; cnt-- {
+		binary.Read(rd, binary.LittleEndian, &k)
+		hp.pop(qdb.KeyType(k), height)
+	}
+
+	cnt, _ = btc.ReadVLen(rd)
+	for ; cnt > 0; cnt-- {
+		binary.Read(rd, binary.LittleEndian, &k)
+		hi.db.Del(qdb.KeyType(k))
+	}
+
+	cnt, _ = btc.ReadVLen(rd)
+	for ; cnt > 0; cnt-- {
+		out := make([]byte, histOutLen)
+		binary.Read(rd, binary.LittleEndian, &k)
+		rd.Read(out)
+		hi.db.PutExt(qdb.KeyType(k), out, qdb.NO_CACHE)
+		// all the outputs marked as spent at this height have been spent by this block
+		pg := hp.page(qdb.KeyType(binary.LittleEndian.Uint64(out[0:8])), binary.LittleEndian.Uint32(out[20:24]))
+		for j := 0; j+HistRecLen <= len(pg); j += HistRecLen {
+			if r := pg[j : j+HistRecLen]; r[0] == 0 && binary.LittleEndian.Uint32(r[49:53]) == height {
+				binary.LittleEndian.PutUint32(r[49:53], 0)
+			}
+		}
+	}
+	hp.flush()
+
+	hi.db.Del(histBlockKey + qdb.KeyType(height))
+	hi.Height = height - 1
+	copy(hi.Hash[:], d[:32])
+	hi.saveState()
+	return true
+}
+
+// NotifyBlock is meant to be used as utxo.CallbackFunctions.NotifyBlock.
+func (hi *HistIndex) NotifyBlock(changes *utxo.BlockChanges, undo bool) {
+	bl := changes.Block
+	hi.Lock()
+	defer hi.Unlock()
+	if undo {
+		if changes.Height == hi.Height && bl.Hash.Hash == hi.Hash {
+			if !hi.undoBlock() {
+				println("HistIndex: no undo data for block", changes.Height, "- rebuild needed")
+				hi.reset()
+			}
+		} else if hi.undone != nil {
+			hi.undone[bl.Hash.Hash] = true
+		}
+		return
+	}
+	if hi.undone != nil {
+		delete(hi.undone, bl.Hash.Hash) // back in the chain
+	}
+	if changes.Height == hi.Height+1 && bytes.Equal(bl.ParentHash(), hi.Hash[:]) {
+		hi.applyBlock(bl, changes.Height)
+	}
+}
+
+// Records returns all the events of the given script (its SHA256), oldest first.
+// Lock the index, to have them consistent with its Height.
+func (hi *HistIndex) Records(sh []byte) (res []*HistRec) {
+	k := histKey(sh)
+	v := hi.db.Get(k)
+	if len(v) < 4 {
+		return
+	}
+	cnt := binary.LittleEndian.Uint32(v[:4])
+	v = append([]byte{}, v[4:]...)
+	for page := uint32(1); page*HistPageRecs < cnt; page++ {
+		v = append(v, hi.db.Get(histPageKey(k, page))...)
+	}
+	return histRecs(res, v, sh)
+}
+
+// histRecs appends the script's events from the raw records to res,
+// skipping the ones of other scripts with the same key.
+func histRecs(res []*HistRec, v []byte, sh []byte) []*HistRec {
+	for j := 0; j+HistRecLen <= len(v); j += HistRecLen {
+		r := v[j : j+HistRecLen]
+		if !bytes.Equal(r[53:57], sh[8:12]) {
+			continue
+		}
+		res = append(res, &HistRec{Spending: r[0] != 0, TxID: btc.NewUint256(r[1:33]),
+			Height: binary.LittleEndian.Uint32(r[33:37]), Index: binary.LittleEndian.Uint32(r[37:41]),
+			Value: binary.LittleEndian.Uint64(r[41:49]), SpentHeight: binary.LittleEndian.Uint32(r[49:53])})
+	}
+	return res
+}
+
+// History returns a page of the script's events (oldest first) and the total number of them.
+// Only the pages of the database that cover the requested range are read. The (very unlikely)
+// events of other scripts with the same key count in the total and are only left out of the result.
+func (hi *HistIndex) History(sh []byte, skip, limit int) (res []*HistRec, total int) {
+	k := histKey(sh)
+	v := hi.db.Get(k)
+	if len(v) < 4 {
+		return
+	}
+	total = int(binary.LittleEndian.Uint32(v[:4]))
+	end := total
+	if limit > 0 && skip+limit < end {
+		end = skip + limit
+	}
+	for page := skip / HistPageRecs; page*HistPageRecs < end; page++ {
+		pv := v[4:]
+		if page > 0 {
+			pv = hi.db.Get(histPageKey(k, uint32(page)))
+		}
+		base := page * HistPageRecs
+		from, to := 0, len(pv)/HistRecLen
+		if skip > base {
+			from = skip - base
+		}
+		if end-base < to {
+			to = end - base
+		}
+		if from < to {
+			res = histRecs(res, pv[from*HistRecLen:to*HistRecLen], sh)
+		}
+	}
+	return
+}
+
+// Unspent returns the script's unspent outputs and their total value.
+func (hi *HistIndex) Unspent(sh []byte) (res []*HistRec, balance uint64) {
+	for _, r := range hi.Records(sh) {
+		if !r.Spending && r.SpentHeight == 0 {
+			res = append(res, r)
+			balance += r.Value
+		}
+	}
+	return
+}
+
+// HistTxs returns the list of transactions from the events (each one listed once).
+func HistTxs(recs []*HistRec) (res []*HistRec) {
+	for _, r := range recs {
+		if len(res) > 0 && res[len(res)-1].Height == r.Height && res[len(res)-1].TxID.Equal(r.TxID) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return
+}
+
+// HistStatus returns Electrum's status of the script's history (empty string for no history).
+// Unconfirmed transactions should have the height of 0 (or -1 if they have unconfirmed inputs).
+func HistStatus(txids []*btc.Uint256, heights []int) string {
+	if len(txids) == 0 {
+		return ""
+	}
+	s := new(bytes.Buffer)
+	for i := range txids {
+		fmt.Fprint(s, txids[i].String(), ":", heights[i], ":")
+	}
+	h := sha256.Sum256(s.Bytes())
+	return hex.EncodeToString(h[:])
+}
+
+// Stats returns a short status of the index.
+func (hi *HistIndex) Stats() string {
+	hi.Lock()
+	defer hi.Unlock()
+	return fmt.Sprint("HistIndex: height ", hi.Height, ", ", hi.db.Count(), " records")
+}
+
+func (hi *HistIndex) Close() {
+	hi.db.Close()
+}
+
+// BackfillHistIndex brings the history index up to the current chain's head,
+// using the blocks from the database. It can run in its own goroutine.
+func (ch *Chain) BackfillHistIndex() {
+	hi := ch.HistIndex
+	if hi == nil {
+		return
+	}
+
+	hi.db.NoSync()
+	stop := func() {
+		hi.Lock()
+		hi.undone = nil
+		hi.Unlock()
+		hi.db.Sync()
+	}
+
+	sta := time.Now()
+	prv := sta
+	var done int
+	for !AbortNow {
+		hi.Lock()
+		hi.undone = make(map[[32]byte]bool) // only the blocks undone since now matter
+		// make sure that the index is on the main chain
+		if n := ch.MainChainNode(hi.Height); n == nil || n.BlockHash.Hash != hi.Hash {
+			if !hi.undoBlock() {
+				println("HistIndex: cannot undo block", hi.Height, "- rebuilding from scratch")
+				hi.reset()
+			}
+			hi.Unlock()
+			continue
+		}
+		start := hi.Height + 1
+		hi.Unlock()
+
+		end := ch.LastBlock()
+		if end.Height < start {
+			break
+		}
+		nodes := make([]*BlockTreeNode, end.Height-start+1)
+		ch.BlockIndexAccess.Lock()
+		for n := end; n != nil && n.Height >= start; n = n.Parent {
+			nodes[n.Height-start] = n
+		}
+		ch.BlockIndexAccess.Unlock()
+		if done == 0 {
+			fmt.Println("Building history index for", len(nodes), "blocks, starting from", start)
+		}
+
+		for _, n := range nodes {
+			if AbortNow {
+				break
+			}
+			if cur := time.Now(); cur.Sub(prv) >= 10*time.Second {
+				fmt.Printf("BackfillHistIndex %d / %d ... %d blocks/s\n", n.Height, end.Height,
+					int64(done)*int64(time.Second)/int64(cur.Sub(sta)))
+				prv = cur
+			}
+
+			crec, _, er := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+			if er != nil {
+				fmt.Println("BackfillHistIndex: block", n.Height, "not in the database - stopped")
+				stop()
+				return
+			}
+			bl, er := btc.NewBlock(crec.Data)
+			if er == nil {
+				er = bl.BuildTxList()
+			}
+			if er != nil {
+				fmt.Println("BackfillHistIndex: block", n.Height, "corrupt:", er.Error(), "- stopped")
+				stop()
+				return
+			}
+
+			hi.Lock()
+			if hi.undone[bl.Hash.Hash] || n.Height != hi.Height+1 || !bytes.Equal(bl.ParentHash(), hi.Hash[:]) {
+				hi.Unlock()
+				break // the chain has changed - start over
+			}
+			hi.applyBlock(bl, n.Height)
+			hi.Unlock()
+			done++
+		}
+	}
+
+	stop()
+	if done > 0 {
+		fmt.Println("BackfillHistIndex done at", hi.Height, "in", time.Now().Sub(sta).String())
+	}
+}
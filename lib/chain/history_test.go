@@ -0,0 +1,146 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+const regtestBits = 0x207fffff
+
+var testGenesis = btc.NewUint256FromString("0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206")
+
+// testBlock makes a block with a coinbase tx (made unique by the tag) followed by the given txs,
+// mined at the regtest difficulty.
+func testBlock(parent *btc.Uint256, height uint32, tag byte, txs ...[]byte) (bl *btc.Block) {
+	var b [8]byte
+	tx := new(bytes.Buffer)
+	tx.Write([]byte{1, 0, 0, 0, 1})
+	tx.Write(make([]byte, 32))
+	tx.Write([]byte{0xff, 0xff, 0xff, 0xff, 4, 3, byte(height), byte(height >> 8), tag, 0xff, 0xff, 0xff, 0xff, 1})
+	binary.LittleEndian.PutUint64(b[:], 50e8)
+	tx.Write(b[:])
+	tx.Write([]byte{1, 0x51, 0, 0, 0, 0})
+
+	hdr := make([]byte, 80)
+	binary.LittleEndian.PutUint32(hdr[0:4], 4)
+	copy(hdr[4:36], parent.Hash[:])
+	mtr := [][32]byte{btc.NewSha2Hash(tx.Bytes()).Hash}
+	for _, t := range txs {
+		mtr = append(mtr, btc.NewSha2Hash(t).Hash)
+	}
+	merkle, _ := btc.CalcMerkle(mtr)
+	copy(hdr[36:68], merkle)
+	binary.LittleEndian.PutUint32(hdr[68:72], 1296688602+600*height)
+	binary.LittleEndian.PutUint32(hdr[72:76], regtestBits)
+	for nonce := uint32(0); ; nonce++ {
+		binary.LittleEndian.PutUint32(hdr[76:80], nonce)
+		if btc.CheckProofOfWork(btc.NewSha2Hash(hdr), regtestBits) {
+			break
+		}
+	}
+	raw := bytes.NewBuffer(hdr)
+	btc.WriteVlen(raw, uint64(1+len(txs)))
+	raw.Write(tx.Bytes())
+	for _, t := range txs {
+		raw.Write(t)
+	}
+	bl, _ = btc.NewBlock(raw.Bytes())
+	bl.BuildTxList()
+	bl.Height = height
+	return
+}
+
+// testSpend makes a tx spending the given output (locked with OP_TRUE) to a new OP_TRUE output.
+func testSpend(txid *btc.Uint256, vout uint32, value uint64) []byte {
+	var b [8]byte
+	tx := new(bytes.Buffer)
+	tx.Write([]byte{1, 0, 0, 0, 1})
+	tx.Write(txid.Hash[:])
+	binary.LittleEndian.PutUint32(b[:4], vout)
+	tx.Write(b[:4])
+	tx.Write([]byte{0, 0xff, 0xff, 0xff, 0xff, 1})
+	binary.LittleEndian.PutUint64(b[:], value)
+	tx.Write(b[:])
+	tx.Write([]byte{1, 0x51, 0, 0, 0, 0})
+	return tx.Bytes()
+}
+
+func TestHistIndex(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "gocoin_hist_test")
+	defer os.RemoveAll(dir)
+	hi, e := NewHistIndex(dir+"/history", testGenesis, 10)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	defer hi.Close()
+
+	// all the coinbases pay to the same script, so its events span a few pages
+	var blocks []*btc.Block
+	prv := testGenesis
+	for h := uint32(1); h <= 3*HistPageRecs; h++ {
+		bl := testBlock(prv, h, 'h')
+		hi.NotifyBlock(&utxo.BlockChanges{Height: h, Block: bl}, false)
+		blocks = append(blocks, bl)
+		prv = bl.Hash
+	}
+	tx1 := testSpend(&blocks[0].Txs[0].Hash, 0, 49e8)
+	tx2 := testSpend(btc.NewSha2Hash(tx1), 0, 48e8)
+	tip := testBlock(prv, 3*HistPageRecs+1, 'h', tx1, tx2)
+	changes := &utxo.BlockChanges{Height: tip.Height, Block: tip}
+
+	sh := HistScriptHash([]byte{0x51})
+	check := func(spent bool) {
+		recs := hi.Records(sh[:])
+		exp, exp_unsp := 3*HistPageRecs, 3*HistPageRecs
+		if spent {
+			exp += 5      // coinbase, tx1 and tx2 (spending and funding each)
+			exp_unsp += 1 // the first coinbase and tx1's output spent, new coinbase and tx2's output
+		}
+		if len(recs) != exp {
+			t.Fatal("Records", len(recs), "expected", exp)
+		}
+		if spent && recs[0].SpentHeight != tip.Height || !spent && recs[0].SpentHeight != 0 {
+			t.Error("First coinbase spent at", recs[0].SpentHeight)
+		}
+		for i, r := range recs[:3*HistPageRecs] {
+			if r.Height != uint32(i+1) || r.Spending || !r.TxID.Equal(&blocks[i].Txs[0].Hash) {
+				t.Fatal("Record", i, "mismatch")
+			}
+		}
+		if unsp, _ := hi.Unspent(sh[:]); len(unsp) != exp_unsp {
+			t.Error("Unspent", len(unsp), "expected", exp_unsp)
+		}
+		for _, p := range [][2]int{{0, 10}, {0, 0}, {60, 10}, {HistPageRecs, HistPageRecs}, {100, 500}, {exp - 1, 5}, {exp, 5}} {
+			page, total := hi.History(sh[:], p[0], p[1])
+			want := recs[p[0]:]
+			if p[1] > 0 && len(want) > p[1] {
+				want = want[:p[1]]
+			}
+			if total != exp || len(page) != len(want) {
+				t.Fatal("History", p, len(page), total, "expected", len(want), exp)
+			}
+			for i := range page {
+				a, b := page[i], want[i]
+				if a.Spending != b.Spending || !a.TxID.Equal(b.TxID) || a.Height != b.Height || a.Index != b.Index ||
+					a.Value != b.Value || a.SpentHeight != b.SpentHeight {
+					t.Fatal("History", p, "record", i, "mismatch")
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		hi.NotifyBlock(changes, false)
+		check(true)
+		hi.NotifyBlock(changes, true)
+		check(false)
+	}
+	if hi.Height != 3*HistPageRecs || hi.Hash != prv.Hash {
+		t.Error("Wrong state after undo", hi.Height)
+	}
+}
@@ -0,0 +1,214 @@
+package chain
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+/*
+	Block connection pipeline, mostly for the initial chain sync:
+	 1. BlockReader reads and decodes the stored blocks ahead, in several goroutines.
+	 2. prefetchInputs looks up the inputs of a block in the UTXO database in parallel.
+	 3. Scripts are verified by a fixed pool of workers, fed through a bounded queue,
+	    so a big block waits for free slots instead of spawning a goroutine per input.
+	 4. Away from the chain's tip, the UTXO database collects the changes of several blocks
+	    before moving them into its map, and updates its rolling hash for several blocks
+	    at once (see utxo.UTXO_COMMIT_BATCH and utxo.UTXO_MUHASH_BATCH).
+*/
+
+var (
+	SCRIPT_WORKERS      = runtime.NumCPU() // number of goroutines verifying scripts
+	SCRIPT_QUEUE_LEN    = 0x1000           // script checks waiting for a free worker
+	PREFETCH_MIN_INPUTS = 256              // use prefetchInputs for blocks with at least this many inputs
+	READ_AHEAD_BLOCKS   = 32               // how many blocks BlockReader may keep decoded ahead
+	READ_AHEAD_WORKERS  = runtime.NumCPU() // number of goroutines decoding the blocks for BlockReader
+
+	// ReplayVerifyAll makes BlockReader ignore the "trusted" flag of the stored blocks,
+	// so all their scripts get verified again (i.e. for benchmarking).
+	ReplayVerifyAll bool
+)
+
+type scriptCheck struct {
+	pkscr  []byte
+	amount uint64
+	idx    int
+	tx     *btc.Tx
+	flags  uint32
+	batch  *scriptBatch
+}
+
+// scriptBatch collects the results of all the script checks of one block.
+type scriptBatch struct {
+	wg     sync.WaitGroup
+	failed uint32
+}
+
+var (
+	script_queue chan *scriptCheck
+	script_once  sync.Once
+)
+
+func scriptWorker() {
+	for c := range script_queue {
+		// once any input of the block has failed, do not bother with the rest
+		if atomic.LoadUint32(&c.batch.failed) == 0 &&
+			!script.VerifyTxScript(c.pkscr, c.amount, c.idx, c.tx, c.flags) {
+			atomic.AddUint32(&c.batch.failed, 1)
+		}
+		c.batch.wg.Done()
+	}
+}
+
+// add queues verification of the given input. It blocks while the queue is full.
+func (b *scriptBatch) add(pkscr []byte, amount uint64, idx int, tx *btc.Tx, flags uint32) {
+	script_once.Do(func() {
+		script_queue = make(chan *scriptCheck, SCRIPT_QUEUE_LEN)
+		for i := 0; i < SCRIPT_WORKERS; i++ {
+			go scriptWorker()
+		}
+	})
+	b.wg.Add(1)
+	script_queue <- &scriptCheck{pkscr: pkscr, amount: amount, idx: idx, tx: tx, flags: flags, batch: b}
+}
+
+// wait returns the number of failed checks, after all of them are finished.
+func (b *scriptBatch) wait() uint32 {
+	b.wg.Wait()
+	return atomic.LoadUint32(&b.failed)
+}
+
+// prefetchInputs looks up all the inputs of the block in the UTXO database, using several goroutines.
+// The result is indexed by the transaction and the input. Inputs not found in the database are nil.
+// Returns nil if the block is too small for it to make sense.
+func (ch *Chain) prefetchInputs(bl *btc.Block) (res [][]*btc.TxOut) {
+	if bl.TotalInputs < PREFETCH_MIN_INPUTS || len(bl.Txs) < 2 {
+		return
+	}
+	var wg sync.WaitGroup
+	res = make([][]*btc.TxOut, len(bl.Txs))
+	workers := SCRIPT_WORKERS
+	if workers > len(bl.Txs)-1 {
+		workers = len(bl.Txs) - 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			for i := 1 + w; i < len(bl.Txs); i += workers {
+				tx := bl.Txs[i]
+				res[i] = make([]*btc.TxOut, len(tx.TxIn))
+				for j := range tx.TxIn {
+					res[i][j] = ch.Unspent.UnspentGet(&tx.TxIn[j].Input)
+				}
+			}
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+	return
+}
+
+// ReadBlock is a block delivered by BlockReader.
+type ReadBlock struct {
+	Node    *BlockTreeNode
+	Block   *btc.Block // nil on error
+	Size    int        // length of the block's data
+	Error   error
+	Corrupt bool // the data was read, but the block could not be decoded
+
+	done chan bool
+}
+
+// BlockReader reads the stored blocks on the path to the given node, decoding them ahead
+// in several goroutines, and delivers them in the order they are to be connected.
+type BlockReader struct {
+	queue chan *ReadBlock
+	quit  chan bool
+	once  sync.Once
+}
+
+// NewBlockReader starts reading the blocks following "from", up to and including "end".
+// The reader stops after the first block that cannot be read.
+func (ch *Chain) NewBlockReader(from, end *BlockTreeNode) (r *BlockReader) {
+	var path []*BlockTreeNode
+	for n := end; n != nil && n != from; n = n.Parent {
+		path = append(path, n)
+	}
+	r = &BlockReader{queue: make(chan *ReadBlock, READ_AHEAD_BLOCKS), quit: make(chan bool)}
+	go r.feed(ch, path)
+	return
+}
+
+func (r *BlockReader) feed(ch *Chain, path []*BlockTreeNode) {
+	defer close(r.queue)
+	sem := make(chan bool, READ_AHEAD_WORKERS)
+	for i := len(path) - 1; i >= 0; i-- {
+		rb := &ReadBlock{Node: path[i], done: make(chan bool)}
+		select {
+		case r.queue <- rb:
+		case <-r.quit:
+			return
+		}
+		if rb.Node.BlockSize == 0 {
+			rb.Error = errors.New("not yet commited")
+			close(rb.done)
+			return
+		}
+		select {
+		case sem <- true:
+		case <-r.quit:
+			rb.Error = errors.New("reader closed")
+			close(rb.done)
+			return
+		}
+		go func(rb *ReadBlock) {
+			ch.readBlock(rb)
+			close(rb.done)
+			<-sem
+		}(rb)
+	}
+}
+
+func (ch *Chain) readBlock(rb *ReadBlock) {
+	crec, trusted, er := ch.Blocks.BlockGetInternal(rb.Node.BlockHash, true)
+	if er != nil {
+		rb.Error = er
+		return
+	}
+	rb.Size = len(crec.Data)
+
+	bl, er := btc.NewBlock(crec.Data)
+	if er != nil {
+		rb.Error, rb.Corrupt = er, true
+		return
+	}
+	bl.Height = rb.Node.Height
+
+	// Recover the flags to be used when verifying scripts for non-trusted blocks (stored orphaned blocks)
+	ch.ApplyBlockFlags(bl)
+
+	if er = bl.BuildTxList(); er != nil {
+		rb.Error, rb.Corrupt = er, true
+		return
+	}
+	bl.Trusted = trusted && !ReplayVerifyAll
+	rb.Block = bl
+}
+
+// Next returns the next block, or nil if there are no more.
+// Check the returned record's Error field before using its Block.
+func (r *BlockReader) Next() (rb *ReadBlock) {
+	if rb = <-r.queue; rb != nil {
+		<-rb.done
+	}
+	return
+}
+
+// Close stops the reader. It is safe to call it more than once.
+func (r *BlockReader) Close() {
+	r.once.Do(func() { close(r.quit) })
+}
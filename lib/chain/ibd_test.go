@@ -0,0 +1,57 @@
+package chain
+
+import (
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestParseTillBlock(t *testing.T) {
+	const blocks = 40
+	dir, _ := os.MkdirTemp("", "gocoin_chain_test")
+	defer os.RemoveAll(dir)
+	ch := testChain(t, dir+"/", true)
+
+	prv := testGenesis
+	for h := uint32(1); h <= blocks; h++ {
+		bl := testBlock(prv, h, 'a')
+		testAccept(t, ch, bl)
+		prv = bl.Hash
+	}
+	ch.Close()
+
+	// rebuild UTXO from the stored blocks, reading them through BlockReader
+	prv_blocks, prv_workers := READ_AHEAD_BLOCKS, READ_AHEAD_WORKERS
+	READ_AHEAD_BLOCKS, READ_AHEAD_WORKERS = 4, 3
+	ReplayVerifyAll = true
+	defer func() {
+		READ_AHEAD_BLOCKS, READ_AHEAD_WORKERS = prv_blocks, prv_workers
+		ReplayVerifyAll = false
+	}()
+	ch = testChain(t, dir+"/", true)
+	defer ch.Close()
+	if ch.LastBlock().Height != blocks || !ch.LastBlock().BlockHash.Equal(prv) {
+		t.Fatal("Rescan finished at", ch.LastBlock().Height)
+	}
+	if len(ch.Unspent.HashMap) != blocks {
+		t.Error("Unexpected number of UTXO records", len(ch.Unspent.HashMap))
+	}
+
+	// the reader delivers the blocks in order and can be abandoned
+	rd := ch.NewBlockReader(ch.BlockTreeRoot, ch.LastBlock())
+	for h := uint32(1); h <= 10; h++ {
+		rb := rd.Next()
+		if rb == nil || rb.Error != nil || rb.Node.Height != h || rb.Block.Height != h || rb.Block.Trusted {
+			t.Fatal("Bad block from BlockReader at", h)
+		}
+	}
+	rd.Close()
+	rd.Close()
+	for rd.Next() != nil {
+	}
+
+	if ch.prefetchInputs(&btc.Block{Txs: []*btc.Tx{{}}}) != nil {
+		t.Error("prefetchInputs should skip small blocks")
+	}
+}
@@ -0,0 +1,109 @@
+package chain
+
+/*
+	Pruning mode: when the total size of the data files (blockchain-XXXXXXXX.dat) exceeds the target,
+	the oldest files are removed, as long as all the blocks in them are deep enough below the tip.
+	Blocks from the removed files have their length and position set to zero in blockchain.new,
+	the same way as "tools/bdb -purgeto" does it, so BlockGetInternal() returns "purged" for them.
+*/
+
+const (
+	MIN_BLOCKS_TO_KEEP = 288 // never prune the blocks that are this close to the tip (BIP159)
+	PRUNE_MIN_MB       = 550 // the lowest pruning target
+)
+
+type datFileInfo struct {
+	size       uint64
+	max_height uint32
+}
+
+// addToDatFile updates the file's stats. Call it with the mutex locked.
+func (db *BlockDB) addToDatFile(idx uint32, blen uint32, height uint32) {
+	fi := db.datfiles[idx]
+	if fi == nil {
+		fi = new(datFileInfo)
+		db.datfiles[idx] = fi
+	}
+	fi.size += uint64(blen)
+	if height > fi.max_height {
+		fi.max_height = height
+	}
+}
+
+// Pruning returns true if the blocks database works in the pruning mode.
+func (db *BlockDB) Pruning() bool {
+	return db.prune_target != 0
+}
+
+// PruneHeight returns the height up to which the blocks may have been removed from disk.
+func (db *BlockDB) PruneHeight() (res uint32) {
+	db.mutex.Lock()
+	res = db.prune_height
+	db.mutex.Unlock()
+	return
+}
+
+// Prune removes the oldest data files, for as long as the total size is above the target
+// and the highest block in the file is at least keep blocks below the tip.
+func (db *BlockDB) Prune(tip, keep uint32) (cnt int) {
+	if db.prune_target == 0 {
+		return
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var total uint64
+	for _, fi := range db.datfiles {
+		total += fi.size
+	}
+	for total > db.prune_target {
+		idx := db.maxdatfileidx
+		for i := range db.datfiles {
+			if i < idx {
+				idx = i
+			}
+		}
+		fi := db.datfiles[idx]
+		if idx == db.maxdatfileidx || fi.max_height+keep > tip {
+			break
+		}
+		db.pruneDatFile(idx)
+		total -= fi.size
+		cnt++
+	}
+	return
+}
+
+// pruneDatFile marks all the blocks from the file as purged and removes the file.
+// Call it with the mutex locked.
+func (db *BlockDB) pruneDatFile(idx uint32) {
+	var zero [12]byte
+	db.disk_access.Lock()
+	for _, rec := range db.blockIndex {
+		if rec.datfileidx == idx && rec.ipos != -1 && rec.blen != 0 {
+			rec.blen, rec.fpos = 0, 0
+			db.blockindx.WriteAt(zero[:], rec.ipos+40) // [40:48] - position, [48:52] - length
+		}
+	}
+	db.blockindx.Sync()
+	db.disk_access.Unlock()
+
+	if fi := db.datfiles[idx]; fi.max_height > db.prune_height {
+		db.prune_height = fi.max_height
+	}
+	delete(db.datfiles, idx)
+	db.data_files_done.Add(1)
+	go db.removeDatFile(idx)
+}
+
+// pruneBlocks is called after each new block, in the pruning mode.
+// It keeps enough blocks for the UTXO database to undo them during a reorg.
+func (ch *Chain) pruneBlocks(height uint32) {
+	keep := uint32(MIN_BLOCKS_TO_KEEP)
+	if ch.Unspent.UnwindBufLen > keep {
+		keep = ch.Unspent.UnwindBufLen
+	}
+	if cnt := ch.Blocks.Prune(height, keep); cnt > 0 {
+		println("Pruned", cnt, "data file(s) - blocks up to", ch.Blocks.PruneHeight(), "removed from disk")
+	}
+}
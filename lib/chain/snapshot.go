@@ -0,0 +1,421 @@
+package chain
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+/*
+	AssumeUTXO: the UTXO set can be loaded from a snapshot (in Core's dumptxoutset format) taken at a known block.
+	The node then continues from that block, while the history below it is validated in the background,
+	in a separate UTXO set (the "snapshot" folder), built from genesis.
+	When the background chainstate reaches the snapshot's block, its hash must match the snapshot's one.
+
+	The blocks below the snapshot are only stored as headers (with zero length, like purged blocks),
+	so they are not served to peers and the chain cannot be reorganized below the snapshot.
+	The state of the background validation is kept in "snapshot.dat" (the base block hash and the UTXO hash)
+	and the file is removed once the validation succeeds.
+*/
+
+const (
+	SNAPSHOT_STATE_FILE  = "snapshot.dat"
+	SNAPSHOT_MAX_PENDING = 250 // how far ahead of the background chainstate the blocks can be fetched
+)
+
+type AssumeUTXOParams struct {
+	Height    uint32
+	BlockHash string
+	UTXOHash  string // hash_serialized_3, as reported by Core's gettxoutsetinfo
+}
+
+// AssumeUTXOMainnet are the snapshots that can be loaded without specifying their hash.
+var AssumeUTXOMainnet = []AssumeUTXOParams{
+	{Height: 840000, BlockHash: "0000000000000000000320283a032748cef8227873ff4872689bf23f1cda83a5",
+		UTXOHash: "a2a5521b1b5ab65f67818e5e8eccabb7171a517f9e2382208f77687310768f96"},
+}
+
+type SnapshotCheck struct {
+	Base     *BlockTreeNode
+	UTXOHash *btc.Uint256
+
+	sync.Mutex
+	unspent  *utxo.UnspentDB // the background chainstate (nil when finished)
+	chain    *Chain          // used to validate the blocks against unspent
+	nodes    []*BlockTreeNode
+	pending  map[uint32]*btc.Block
+	height   uint32 // the background chainstate is at this block
+	done     bool
+	err      error
+	closed   bool
+	wake     chan bool
+	finished sync.WaitGroup
+
+	dir, state_file string
+}
+
+// pinnedUTXOHash returns the known UTXO hash for the given block, or nil.
+func (ch *Chain) pinnedUTXOHash(n *BlockTreeNode) *btc.Uint256 {
+	if ch.testnet() {
+		return nil
+	}
+	for _, p := range AssumeUTXOMainnet {
+		if p.Height == n.Height && p.BlockHash == n.BlockHash.String() {
+			return btc.NewUint256FromString(p.UTXOHash)
+		}
+	}
+	return nil
+}
+
+// DumpSnapshot writes the current UTXO set to the file, in Core's dumptxoutset format.
+func (ch *Chain) DumpSnapshot(fname string, netmagic [4]byte) (hash *btc.Uint256, cnt uint64, e error) {
+	f, e := os.Create(fname + ".tmp")
+	if e != nil {
+		return
+	}
+	res, cnt, e := ch.Unspent.WriteSnapshot(f, netmagic)
+	f.Close()
+	if e != nil {
+		os.Remove(fname + ".tmp")
+		return
+	}
+	if e = os.Rename(fname+".tmp", fname); e == nil {
+		hash = btc.NewUint256(res[:])
+	}
+	return
+}
+
+// LoadSnapshot replaces the UTXO set with the one from the snapshot file and moves the chain's head to its block.
+// If utxohash is nil, the snapshot must be one of the known ones (see AssumeUTXOMainnet).
+func (ch *Chain) LoadSnapshot(fname string, netmagic [4]byte, utxohash *btc.Uint256) (base *BlockTreeNode, cnt uint64, e error) {
+	if ch.SnapshotCheck != nil {
+		e = errors.New("a snapshot has already been loaded")
+		return
+	}
+	if ch.TxIndex != nil || ch.HistIndex != nil {
+		e = errors.New("snapshots cannot be used with TxIndex or HistIndex")
+		return
+	}
+
+	f, e := os.Open(fname)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	rd := bufio.NewReaderSize(f, 0x100000)
+	var hdr *utxo.SnapshotHeader
+	hdr, e = utxo.ReadSnapshotHeader(rd)
+	if e != nil {
+		return
+	}
+	if hdr.NetMagic != netmagic {
+		e = errors.New("the snapshot is for a different network")
+		return
+	}
+
+	ch.BlockIndexAccess.Lock()
+	base = ch.BlockIndex[btc.NewUint256(hdr.BlockHash[:]).BIdx()]
+	ch.BlockIndexAccess.Unlock()
+	if base == nil {
+		e = errors.New("the snapshot's block " + btc.NewUint256(hdr.BlockHash[:]).String() + " is not known - wait for the headers")
+		return
+	}
+	if base.Height <= ch.LastBlock().Height {
+		e = fmt.Errorf("the chain is already at block %d - past the snapshot's %d", ch.LastBlock().Height, base.Height)
+		return
+	}
+	if utxohash == nil {
+		if utxohash = ch.pinnedUTXOHash(base); utxohash == nil {
+			e = fmt.Errorf("unknown snapshot at block %d - specify its UTXO hash to load it", base.Height)
+			return
+		}
+	}
+
+	hm, res, e := utxo.ReadSnapshot(rd, hdr, base.Height, &AbortNow)
+	if e != nil {
+		return
+	}
+	if res != utxohash.Hash {
+		e = errors.New("UTXO hash mismatch - the snapshot has " + btc.NewUint256(res[:]).String())
+		return
+	}
+
+	// the snapshot is fine - switch over to it
+	ch.Blocks.addHeaders(base)
+	ch.Unspent.ReplaceWith(hm, base.Height, base.BlockHash.Hash[:])
+	ch.SetLast(base)
+
+	state := append(append([]byte{}, base.BlockHash.Hash[:]...), utxohash.Hash[:]...)
+	if e = ioutil.WriteFile(ch.Blocks.dirname+SNAPSHOT_STATE_FILE, state, 0600); e != nil {
+		return
+	}
+	ch.SnapshotCheck = ch.newSnapshotCheck(base, utxohash)
+	cnt = hdr.Coins
+	return
+}
+
+// loadSnapshotCheck resumes the background validation of a snapshot loaded previously (if any).
+func (ch *Chain) loadSnapshotCheck() {
+	d, er := ioutil.ReadFile(ch.Blocks.dirname + SNAPSHOT_STATE_FILE)
+	if er != nil || len(d) != 64 {
+		return
+	}
+	ch.BlockIndexAccess.Lock()
+	base := ch.BlockIndex[btc.NewUint256(d[:32]).BIdx()]
+	ch.BlockIndexAccess.Unlock()
+	if base == nil {
+		println("The snapshot's block", btc.NewUint256(d[:32]).String(), "not found - its validation cannot continue")
+		return
+	}
+	ch.SnapshotCheck = ch.newSnapshotCheck(base, btc.NewUint256(d[32:64]))
+}
+
+func (ch *Chain) newSnapshotCheck(base *BlockTreeNode, utxohash *btc.Uint256) (sc *SnapshotCheck) {
+	sc = &SnapshotCheck{Base: base, UTXOHash: utxohash, pending: make(map[uint32]*btc.Block),
+		wake: make(chan bool, 1), dir: ch.Blocks.dirname + "snapshot" + string(os.PathSeparator),
+		state_file: ch.Blocks.dirname + SNAPSHOT_STATE_FILE}
+
+	sc.nodes = make([]*BlockTreeNode, base.Height+1)
+	for n := base; n != nil; n = n.Parent {
+		sc.nodes[n.Height] = n
+	}
+
+	os.MkdirAll(sc.dir, 0770)
+	_, er := os.Stat(sc.dir + "UTXO.db")
+	sc.unspent = utxo.NewUnspentDb(&utxo.NewUnspentOpts{Dir: sc.dir, Rescan: er != nil, AbortNow: &AbortNow,
+		Prealloc: ch.CB.UTXOPrealloc})
+	sc.unspent.ComprssedUTXO = ch.Unspent.ComprssedUTXO
+	if sc.unspent.LastBlockHash != nil {
+		sc.height = sc.unspent.LastBlockHeight
+		if sc.height > base.Height || !sc.nodes[sc.height].BlockHash.Equal(btc.NewUint256(sc.unspent.LastBlockHash)) {
+			println("Background chainstate does not match the snapshot - starting it from genesis")
+			sc.unspent.ReplaceWith(make(map[utxo.UtxoKeyType][]byte), 0, ch.Genesis.Hash[:])
+			sc.height = 0
+		}
+	}
+
+	sc.chain = &Chain{Blocks: ch.Blocks, Unspent: sc.unspent, BlockTreeRoot: ch.BlockTreeRoot, Genesis: ch.Genesis}
+	sc.chain.Consensus = ch.Consensus
+
+	sc.finished.Add(1)
+	go sc.run()
+	sc.wakeUp()
+	return
+}
+
+func (sc *SnapshotCheck) wakeUp() {
+	select {
+	case sc.wake <- true:
+	default:
+	}
+}
+
+// Needed returns up to max blocks that the background validation needs, and which are not on disk.
+func (sc *SnapshotCheck) Needed(max int) (res []*BlockTreeNode) {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	if sc.done || sc.err != nil || sc.closed {
+		return
+	}
+	for h := sc.height + 1; h <= sc.Base.Height && h <= sc.height+SNAPSHOT_MAX_PENDING && len(res) < max; h++ {
+		if n := sc.nodes[h]; sc.pending[h] == nil && !sc.chain.Blocks.HasBlockData(n.BlockHash) {
+			res = append(res, n)
+		}
+	}
+	return
+}
+
+// AddBlock passes a block (with its transactions) fetched for the background validation.
+// It returns false if the block is not needed.
+func (sc *SnapshotCheck) AddBlock(bl *btc.Block, n *BlockTreeNode) (ok bool) {
+	sc.Mutex.Lock()
+	if ok = !sc.done && sc.err == nil && n.Height > sc.height && n.Height <= sc.Base.Height && sc.nodes[n.Height] == n; ok {
+		sc.pending[n.Height] = bl
+	}
+	sc.Mutex.Unlock()
+	if ok {
+		sc.wakeUp()
+	}
+	return
+}
+
+// Status returns a one line description of the background validation.
+func (sc *SnapshotCheck) Status() string {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	if sc.err != nil {
+		return fmt.Sprint("UTXO snapshot at block ", sc.Base.Height, " is INVALID: ", sc.err.Error())
+	}
+	if sc.done {
+		return fmt.Sprint("UTXO snapshot at block ", sc.Base.Height, " has been validated")
+	}
+	return fmt.Sprint("UTXO snapshot at block ", sc.Base.Height, " - validated ", sc.height, " / ",
+		sc.Base.Height, " blocks (", len(sc.pending), " pending)")
+}
+
+// Done returns true if the snapshot has been validated.
+func (sc *SnapshotCheck) Done() (res bool) {
+	sc.Mutex.Lock()
+	res = sc.done
+	sc.Mutex.Unlock()
+	return
+}
+
+// Error returns the reason why the snapshot is invalid (nil if it isn't, or not known yet).
+func (sc *SnapshotCheck) Error() (e error) {
+	sc.Mutex.Lock()
+	e = sc.err
+	sc.Mutex.Unlock()
+	return
+}
+
+// nextBlock returns the block to be validated next, from the fetched ones or from the disk.
+func (sc *SnapshotCheck) nextBlock() (bl *btc.Block, n *BlockTreeNode) {
+	sc.Mutex.Lock()
+	if sc.closed || sc.done || sc.err != nil || AbortNow {
+		sc.Mutex.Unlock()
+		return
+	}
+	h := sc.height + 1
+	n = sc.nodes[h]
+	bl = sc.pending[h]
+	delete(sc.pending, h)
+	sc.Mutex.Unlock()
+	if bl != nil {
+		return
+	}
+
+	crec, trusted, er := sc.chain.Blocks.BlockGetInternal(n.BlockHash, true)
+	if er != nil {
+		return
+	}
+	if bl, er = btc.NewBlock(crec.Data); er == nil {
+		er = bl.BuildTxList()
+	}
+	if er != nil {
+		bl = nil
+		return
+	}
+	bl.Trusted = trusted
+	return
+}
+
+func (sc *SnapshotCheck) run() {
+	defer sc.finished.Done()
+	for range sc.wake {
+		for {
+			bl, n := sc.nextBlock()
+			if bl == nil {
+				break
+			}
+			bl.Height = n.Height
+			bl.MedianPastTime = n.Parent.GetMedianTimePast()
+			sc.chain.ApplyBlockFlags(bl)
+			changes, _, e := sc.chain.ProcessBlockTransactions(bl, n.Height, sc.Base.Height)
+			if e == nil {
+				sc.unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+			} else {
+				e = fmt.Errorf("block %d %s - %s", n.Height, n.BlockHash.String(), e.Error())
+			}
+			sc.Mutex.Lock()
+			sc.err = e
+			if e == nil {
+				sc.height = n.Height
+			}
+			sc.Mutex.Unlock()
+			if e == nil && n == sc.Base {
+				sc.finish()
+			} else if e != nil {
+				println("Background validation:", sc.Status())
+			}
+		}
+		sc.Mutex.Lock()
+		closed := sc.closed || sc.done || sc.err != nil
+		sc.Mutex.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+// finish compares the UTXO hash of the background chainstate with the snapshot's one.
+func (sc *SnapshotCheck) finish() {
+	res, cnt := sc.unspent.UTXOHash()
+	sc.Mutex.Lock()
+	if res == sc.UTXOHash.Hash {
+		sc.done = true
+		sc.unspent.AbortWriting()
+		sc.unspent, sc.chain = nil, nil
+		os.RemoveAll(sc.dir)
+		os.Remove(sc.state_file)
+	} else {
+		sc.err = errors.New("UTXO hash mismatch: " + btc.NewUint256(res[:]).String() + " - rebuild the UTXO set (-r)")
+	}
+	sc.Mutex.Unlock()
+	if sc.done {
+		fmt.Println("Background validation finished:", cnt, "outputs at block", sc.Base.Height, "match the snapshot")
+	} else {
+		println("Background validation:", sc.Status())
+	}
+}
+
+// close stops the background validation and saves its state.
+func (sc *SnapshotCheck) close() {
+	sc.Mutex.Lock()
+	sc.closed = true
+	sc.Mutex.Unlock()
+	sc.wakeUp()
+	sc.finished.Wait()
+	if sc.unspent != nil {
+		sc.unspent.Close()
+	}
+}
+
+// HasBlockData returns true if the block's data is in the database.
+func (db *BlockDB) HasBlockData(hash *btc.Uint256) (res bool) {
+	db.mutex.Lock()
+	rec := db.blockIndex[hash.BIdx()]
+	res = rec != nil && (rec.ipos == -1 || rec.blen != 0)
+	db.mutex.Unlock()
+	return
+}
+
+// addHeaders stores the headers (without the blocks' data) of the given block and of all its parents,
+// which are not in the database yet.
+func (db *BlockDB) addHeaders(n *BlockTreeNode) {
+	var nodes []*BlockTreeNode
+	var fl [136]byte
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	for ; n != nil && n.Height > 0; n = n.Parent {
+		if _, ok := db.blockIndex[n.BlockHash.BIdx()]; ok {
+			break
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) > 0 && nodes[0].Height > db.prune_height {
+		db.prune_height = nodes[0].Height
+	}
+
+	db.disk_access.Lock()
+	defer db.disk_access.Unlock()
+	wr := bufio.NewWriterSize(db.blockindx, 0x100000)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n = nodes[i]
+		binary.LittleEndian.PutUint32(fl[36:40], n.Height)
+		copy(fl[56:136], n.BlockHeader[:])
+		wr.Write(fl[:])
+		db.blockIndex[n.BlockHash.BIdx()] = &oneBl{ipos: db.maxidxfilepos}
+		db.maxidxfilepos += 136
+	}
+	wr.Flush()
+	db.blockindx.Sync()
+}
@@ -0,0 +1,294 @@
+package chain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+/*
+	Optional transaction index, kept in "txindex" folder (qdb database).
+	Key:   the first 8 bytes of the txid (LSB)
+	Value: one or more 8 bytes long records (more than one on a key collision or a duplicate txid):
+		[0:4] - block height (in the main chain)
+		[4:8] - offset of the transaction within the raw block
+
+	Records are only added and removed along with the blocks, so after a reorg that took place
+	while backfilling there might be some stale ones. This is why GetTx() always verifies the txid.
+	The key of zero is reserved for the index state: height up to which all the blocks are indexed.
+*/
+
+const (
+	txIdxRecLen = 8
+	txIdxState  = qdb.KeyType(0)
+)
+
+type TxIndex struct {
+	db *qdb.DB
+	sync.Mutex
+	Height uint32 // all blocks up to this height have been indexed (genesis is never indexed)
+
+	hooked_first, hooked_last uint32 // range of blocks indexed as they were being committed
+}
+
+func txIdxKey(h []byte) qdb.KeyType {
+	return qdb.KeyType(binary.LittleEndian.Uint64(h[:8]))
+}
+
+// NewTxIndex opens the transaction index database.
+func NewTxIndex(dir string) (ti *TxIndex, e error) {
+	ti = new(TxIndex)
+	if e = qdb.NewDBExt(&ti.db, &qdb.NewDBOpts{Dir: dir, LoadData: false}); e != nil {
+		return
+	}
+	if v := ti.db.Get(txIdxState); len(v) == 4 {
+		ti.Height = binary.LittleEndian.Uint32(v)
+	}
+	return
+}
+
+func (ti *TxIndex) saveState() {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], ti.Height)
+	ti.db.Put(txIdxState, v[:])
+}
+
+// addBlock adds the block's transactions to the index. Call it with the mutex locked.
+func (ti *TxIndex) addBlock(bl *btc.Block, height uint32) {
+	var rec [txIdxRecLen]byte
+	binary.LittleEndian.PutUint32(rec[0:4], height)
+	offs := bl.TxOffset
+	for _, tx := range bl.Txs {
+		k := txIdxKey(tx.Hash.Hash[:])
+		binary.LittleEndian.PutUint32(rec[4:8], uint32(offs))
+		offs += int(tx.Size)
+		if k == txIdxState {
+			continue
+		}
+		v := ti.db.Get(k)
+		var dup bool
+		for i := 0; i+txIdxRecLen <= len(v); i += txIdxRecLen {
+			if binary.LittleEndian.Uint32(v[i:i+4]) == height {
+				dup = true // already there (e.g. backfill and commit of the same block)
+				break
+			}
+		}
+		if !dup {
+			ti.db.PutExt(k, append(append([]byte{}, v...), rec[:]...), qdb.NO_CACHE)
+		}
+	}
+}
+
+// delBlock removes the block's transactions from the index. Call it with the mutex locked.
+func (ti *TxIndex) delBlock(bl *btc.Block, height uint32) {
+	for _, tx := range bl.Txs {
+		k := txIdxKey(tx.Hash.Hash[:])
+		if k == txIdxState {
+			continue
+		}
+		v := ti.db.Get(k)
+		nv := make([]byte, 0, len(v))
+		for i := 0; i+txIdxRecLen <= len(v); i += txIdxRecLen {
+			if binary.LittleEndian.Uint32(v[i:i+4]) != height {
+				nv = append(nv, v[i:i+txIdxRecLen]...)
+			}
+		}
+		if len(nv) == 0 {
+			ti.db.Del(k)
+		} else if len(nv) != len(v) {
+			ti.db.PutExt(k, nv, qdb.NO_CACHE)
+		}
+	}
+}
+
+// BlockCommitted is called each time a new block gets connected to the main chain.
+func (ti *TxIndex) BlockCommitted(bl *btc.Block, height uint32) {
+	ti.Lock()
+	ti.addBlock(bl, height)
+	if height == ti.Height+1 {
+		ti.Height = height
+		ti.saveState()
+	} else {
+		if ti.hooked_first == 0 || height < ti.hooked_first {
+			ti.hooked_first = height
+		}
+		ti.hooked_last = height
+	}
+	ti.Unlock()
+}
+
+// BlockUndone is called each time the block is removed from the main chain.
+func (ti *TxIndex) BlockUndone(bl *btc.Block, height uint32) {
+	ti.Lock()
+	ti.delBlock(bl, height)
+	if height <= ti.Height {
+		ti.Height = height - 1
+		ti.saveState()
+	}
+	if ti.hooked_last >= height {
+		ti.hooked_last = height - 1
+	}
+	ti.Unlock()
+}
+
+// Synced returns true if the index is up to date with the given height.
+func (ti *TxIndex) Synced(height uint32) bool {
+	ti.Lock()
+	defer ti.Unlock()
+	return ti.Height >= height
+}
+
+// Stats returns a short status of the index.
+func (ti *TxIndex) Stats() string {
+	ti.Lock()
+	defer ti.Unlock()
+	return fmt.Sprint("TxIndex: height ", ti.Height, ", ", ti.db.Count(), " records")
+}
+
+func (ti *TxIndex) Close() {
+	ti.db.Close()
+}
+
+// MainChainNode returns the main chain's block at the given height (nil if above the tip).
+func (ch *Chain) MainChainNode(height uint32) (n *BlockTreeNode) {
+	ch.blockTreeAccess.Lock()
+	if int(height) < len(ch.mainChain) {
+		n = ch.mainChain[height]
+	}
+	ch.blockTreeAccess.Unlock()
+	return
+}
+
+// MainChainNodes returns up to cnt of the main chain's blocks, starting from the given height.
+func (ch *Chain) MainChainNodes(height uint32, cnt int) (res []*BlockTreeNode) {
+	ch.blockTreeAccess.Lock()
+	if int(height) < len(ch.mainChain) {
+		if end := int(height) + cnt; end < len(ch.mainChain) {
+			res = append(res, ch.mainChain[height:end]...)
+		} else {
+			res = append(res, ch.mainChain[height:]...)
+		}
+	}
+	ch.blockTreeAccess.Unlock()
+	return
+}
+
+// GetTx looks up the transaction in the index.
+// Returns the raw tx and the block containing it.
+func (ch *Chain) GetTx(txid *btc.Uint256) (data []byte, n *BlockTreeNode, er error) {
+	ti := ch.TxIndex
+	if ti == nil {
+		er = errors.New("GetTx: txindex not enabled")
+		return
+	}
+	v := ti.db.Get(txIdxKey(txid.Hash[:]))
+	for i := len(v) - txIdxRecLen; i >= 0; i -= txIdxRecLen {
+		if n = ch.MainChainNode(binary.LittleEndian.Uint32(v[i : i+4])); n == nil {
+			continue
+		}
+		crec, _, e := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+		if e != nil {
+			er = errors.New("GetTx: block not in the database")
+			return
+		}
+		bd := crec.Data
+		offs := int(binary.LittleEndian.Uint32(v[i+4 : i+8]))
+		if offs >= len(bd) {
+			continue
+		}
+		tx, le := btc.NewTx(bd[offs:])
+		if tx == nil {
+			continue
+		}
+		tx.SetHash(bd[offs : offs+le])
+		if tx.Hash.Equal(txid) {
+			data = bd[offs : offs+le]
+			return
+		}
+	}
+	n = nil
+	er = errors.New("GetTx: transaction not found in txindex")
+	return
+}
+
+// BackfillTxIndex indexes the blocks that have been committed before the index was enabled.
+// It can run in its own goroutine, along with the blocks being committed.
+func (ch *Chain) BackfillTxIndex() {
+	ti := ch.TxIndex
+	if ti == nil {
+		return
+	}
+
+	ti.Lock()
+	start := ti.Height + 1
+	ti.Unlock()
+	end := ch.LastBlock()
+	if end.Height < start {
+		return
+	}
+
+	// take the main chain's blocks to index
+	nodes := make([]*BlockTreeNode, end.Height-start+1)
+	ch.BlockIndexAccess.Lock()
+	for n := end; n != nil && n.Height >= start; n = n.Parent {
+		nodes[n.Height-start] = n
+	}
+	ch.BlockIndexAccess.Unlock()
+
+	fmt.Println("Building txindex for", len(nodes), "blocks, starting from", start)
+	ti.db.NoSync()
+	sta := time.Now()
+	prv := sta
+	var done int
+	for _, n := range nodes {
+		if AbortNow {
+			break
+		}
+		if cur := time.Now(); cur.Sub(prv) >= 10*time.Second {
+			fmt.Printf("BackfillTxIndex %d / %d ... %d blocks/s\n", n.Height, end.Height,
+				int64(done)*int64(time.Second)/int64(cur.Sub(sta)))
+			prv = cur
+		}
+
+		crec, _, er := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+		if er != nil {
+			fmt.Println("BackfillTxIndex: block", n.Height, "not in the database - stopped")
+			break
+		}
+		bl, er := btc.NewBlock(crec.Data)
+		if er == nil {
+			er = bl.BuildTxList()
+		}
+		if er != nil {
+			fmt.Println("BackfillTxIndex: block", n.Height, er.Error())
+			break
+		}
+
+		ti.Lock()
+		if n.Height <= ti.Height {
+			ti.Unlock()
+			continue // already done by BlockCommitted
+		}
+		ti.addBlock(bl, n.Height)
+		ti.Height = n.Height
+		if ti.hooked_first != 0 && ti.hooked_first <= ti.Height+1 && ti.hooked_last > ti.Height {
+			// all the blocks from here are already indexed by BlockCommitted
+			ti.Height = ti.hooked_last
+			ti.hooked_first, ti.hooked_last = 0, 0
+		}
+		if done++; done%1000 == 0 {
+			ti.saveState()
+		}
+		ti.Unlock()
+	}
+	ti.Lock()
+	ti.saveState()
+	ti.Unlock()
+	ti.db.Sync()
+	fmt.Println("BackfillTxIndex done at", ti.Height, "in", time.Now().Sub(sta).String())
+}
@@ -0,0 +1,301 @@
+package chain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+/*
+	VerifyChain checks the last blocks of the chain against the databases, like Core's verifychain:
+	 level 0 - the blocks can be read from the blocks database
+	 level 1 - the blocks link to their parents and their data match the headers (hash, merkle root, tx count)
+	 level 2 - the undo data of the blocks is there and it matches the inputs of the blocks
+	 level 3 - the blocks' outputs are in UTXO, the blocks are disconnected and connected back,
+	           after which all the UTXO records touched by the blocks must be the same as before
+	 level 4 - as level 3, but with scripts verified when connecting the blocks back
+	The levels 2 and up only check the blocks from the tip down to the first one with no undo data.
+	Only the levels 3 and up modify the chain, so the checks of the lower levels can run while
+	new blocks are being connected.
+*/
+
+const VERIFY_CHAIN_MAX_LEVEL = 4
+
+var ErrVerifyAborted = errors.New("verification aborted")
+
+// VerifyChainOpts holds the optional parameters of VerifyChain.
+type VerifyChainOpts struct {
+	Progress func(string) // gets called with a short status message from time to time
+	Abort    func() bool  // polled after each block; if it returns true, VerifyChain returns ErrVerifyAborted
+
+	// If set, Lock is called before the levels 3 and up start disconnecting the blocks and Unlock
+	// after they are connected back. Nothing else may modify the chain in between.
+	Lock, Unlock func()
+}
+
+func (o *VerifyChainOpts) progress(msg string, cnt, of uint32) {
+	if o.Progress != nil && (cnt%100 == 0 || cnt == of) {
+		o.Progress(fmt.Sprint(msg, " ", cnt, " / ", of))
+	}
+}
+
+func (o *VerifyChainOpts) aborted() bool {
+	return AbortNow || o.Abort != nil && o.Abort()
+}
+
+// VerifyChain checks depth blocks (all if zero) from the chain's tip at the given level (see above).
+// It can run in its own goroutine. For the levels 3 and up, make sure nothing else modifies
+// the chain while it is disconnecting and connecting back the blocks (see VerifyChainOpts).
+func (ch *Chain) VerifyChain(level, depth uint32, opts *VerifyChainOpts) (e error) {
+	if opts == nil {
+		opts = &VerifyChainOpts{}
+	}
+	last := ch.LastBlock()
+	if depth == 0 || depth > last.Height {
+		depth = last.Height
+	}
+	if ph := ch.Blocks.PruneHeight(); ph > 0 && last.Height-depth < ph {
+		depth = last.Height - ph
+	}
+	if level > VERIFY_CHAIN_MAX_LEVEL {
+		level = VERIFY_CHAIN_MAX_LEVEL
+	}
+
+	blocks, e := ch.verifyBlocks(last, level, depth, opts)
+	if e != nil || level < 3 || len(blocks) == 0 {
+		return
+	}
+
+	if opts.Lock != nil {
+		opts.Lock()
+		defer opts.Unlock()
+	}
+	if ch.LastBlock() != last {
+		// the chain has moved meanwhile, so take the blocks from its new tip
+		if blocks, e = ch.verifyBlocks(ch.LastBlock(), level, uint32(len(blocks)), opts); e != nil || len(blocks) == 0 {
+			return
+		}
+	}
+	e = ch.verifyUndoRedo(blocks, level >= 4, opts)
+	return
+}
+
+// verifyBlocks checks depth blocks from the given one down, returning the ones with undo data (for level 2 and up).
+func (ch *Chain) verifyBlocks(n *BlockTreeNode, level, depth uint32, opts *VerifyChainOpts) (blocks []*btc.Block, e error) {
+	with_undo := level >= 2
+	for cnt := uint32(1); cnt <= depth; cnt++ {
+		if opts.aborted() {
+			return nil, ErrVerifyAborted
+		}
+		var bl *btc.Block
+		if bl, e = ch.verifyBlockData(n, level); e != nil {
+			return
+		}
+		if with_undo {
+			if e = ch.verifyUndoData(bl, n); e == nil {
+				blocks = append(blocks, bl)
+			} else if os.IsNotExist(e) || ch.MainChainNode(n.Height) != n {
+				// no undo data from here down (or the block has just been disconnected)
+				e, with_undo = nil, false
+			} else {
+				return
+			}
+		}
+		opts.progress("Checking block", cnt, depth)
+		n = n.Parent
+	}
+	return
+}
+
+// verifyBlockData reads the block from the database and checks it against its node.
+func (ch *Chain) verifyBlockData(n *BlockTreeNode, level uint32) (bl *btc.Block, e error) {
+	crec, _, er := ch.Blocks.BlockGetInternal(n.BlockHash, true)
+	if er != nil {
+		return nil, fmt.Errorf("block %d %s cannot be read: %s", n.Height, n.BlockHash.String(), er.Error())
+	}
+	if bl, er = btc.NewBlock(crec.Data); er != nil {
+		return nil, fmt.Errorf("block %d %s cannot be decoded: %s", n.Height, n.BlockHash.String(), er.Error())
+	}
+	bl.Height = n.Height
+	if level < 1 {
+		return
+	}
+
+	if !bl.Hash.Equal(n.BlockHash) || !bytes.Equal(bl.Raw[:80], n.BlockHeader[:]) {
+		return nil, fmt.Errorf("block %d %s: data does not match the header", n.Height, n.BlockHash.String())
+	}
+	if n.Parent == nil || n.Parent.Height+1 != n.Height || !bytes.Equal(n.BlockHeader[4:36], n.Parent.BlockHash.Hash[:]) {
+		return nil, fmt.Errorf("block %d %s: not linked to its parent", n.Height, n.BlockHash.String())
+	}
+	if er = bl.BuildTxList(); er != nil {
+		return nil, fmt.Errorf("block %d %s: %s", n.Height, n.BlockHash.String(), er.Error())
+	}
+	if !bl.MerkleRootMatch() {
+		return nil, fmt.Errorf("block %d %s: merkle root mismatch", n.Height, n.BlockHash.String())
+	}
+	if n.TxCount != 0 && n.TxCount != uint32(bl.TxCount) {
+		return nil, fmt.Errorf("block %d %s: has %d txs, while the index says %d", n.Height, n.BlockHash.String(),
+			bl.TxCount, n.TxCount)
+	}
+	ch.ApplyBlockFlags(bl)
+	return
+}
+
+// spentByBlock returns all the outputs spent by the block.
+func spentByBlock(bl *btc.Block) (res map[btc.TxPrevOut]bool) {
+	res = make(map[btc.TxPrevOut]bool, bl.TotalInputs)
+	for _, tx := range bl.Txs[1:] {
+		for i := range tx.TxIn {
+			res[tx.TxIn[i].Input] = true
+		}
+	}
+	return
+}
+
+// spentOutside returns the outputs spent by the block, that were not created inside it.
+func spentOutside(bl *btc.Block) (res map[btc.TxPrevOut]bool) {
+	res = spentByBlock(bl)
+	for _, tx := range bl.Txs {
+		for vout := range tx.TxOut {
+			delete(res, btc.TxPrevOut{Hash: tx.Hash.Hash, Vout: uint32(vout)})
+		}
+	}
+	return
+}
+
+// verifyUndoData checks if the block's undo data holds exactly the outputs spent by the block.
+// If there is no undo data for the block, the returned error satisfies os.IsNotExist().
+func (ch *Chain) verifyUndoData(bl *btc.Block, n *BlockTreeNode) (e error) {
+	blhash, recs, e := ch.Unspent.ReadUndo(n.Height)
+	if e != nil {
+		if !os.IsNotExist(e) {
+			e = fmt.Errorf("block %d %s: undo data: %s", n.Height, n.BlockHash.String(), e.Error())
+		}
+		return
+	}
+	if !bytes.Equal(blhash, n.BlockHash.Hash[:]) {
+		e = fmt.Errorf("block %d %s: undo data is for a different block", n.Height, n.BlockHash.String())
+		return
+	}
+	spent := spentOutside(bl)
+	for _, rec := range recs {
+		for vout, out := range rec.Outs {
+			if out == nil {
+				continue
+			}
+			po := btc.TxPrevOut{Hash: rec.TxID, Vout: uint32(vout)}
+			if !spent[po] {
+				e = fmt.Errorf("block %d %s: undo data has %s, which the block does not spend", n.Height,
+					n.BlockHash.String(), po.String())
+				return
+			}
+			delete(spent, po)
+		}
+	}
+	for po := range spent {
+		e = fmt.Errorf("block %d %s: undo data misses %s", n.Height, n.BlockHash.String(), po.String())
+		return
+	}
+	return
+}
+
+// verifyUndoRedo disconnects the given blocks (from the tip down) and connects them back,
+// comparing the UTXO records that they touch.
+func (ch *Chain) verifyUndoRedo(blocks []*btc.Block, scripts bool, opts *VerifyChainOpts) (e error) {
+	tip := ch.LastBlock()
+	before := make(map[[32]byte]*utxo.UtxoRec)
+	note := func(txid []byte) {
+		var k [32]byte
+		copy(k[:], txid)
+		if _, ok := before[k]; !ok {
+			before[k] = ch.Unspent.UnspentGetRec(txid)
+		}
+	}
+	for _, bl := range blocks {
+		for _, tx := range bl.Txs {
+			note(tx.Hash.Hash[:])
+			for i := range tx.TxIn {
+				if tx != bl.Txs[0] {
+					note(tx.TxIn[i].Input.Hash[:])
+				}
+			}
+		}
+	}
+
+	// disconnect the blocks, checking that all their outputs are in UTXO
+	var undone int
+	n := tip
+	for _, bl := range blocks {
+		spent := spentByBlock(bl)
+		for _, tx := range bl.Txs {
+			for vout, out := range tx.TxOut {
+				po := &btc.TxPrevOut{Hash: tx.Hash.Hash, Vout: uint32(vout)}
+				if script.IsUnspendable(out.Pk_script) {
+					continue
+				}
+				if uo := ch.Unspent.UnspentGet(po); uo == nil && !spent[*po] || uo != nil && uo.Value != out.Value {
+					e = fmt.Errorf("block %d %s: output %s is not in UTXO", n.Height, n.BlockHash.String(), po.String())
+					break
+				}
+			}
+			if e != nil {
+				break
+			}
+		}
+		if e == nil && opts.aborted() {
+			e = ErrVerifyAborted
+		}
+		if e != nil {
+			break // only connect back what has been disconnected
+		}
+		ch.Unspent.UndoBlockTxs(bl, n.Parent.BlockHash.Hash[:])
+		ch.SetLast(n.Parent)
+		if ch.TxIndex != nil {
+			ch.TxIndex.BlockUndone(bl, n.Height)
+		}
+		n = n.Parent
+		undone++
+		if opts.Progress != nil {
+			opts.Progress(fmt.Sprint("Disconnected block ", undone, " / ", len(blocks)))
+		}
+	}
+
+	// and connect them back
+	for i := undone - 1; i >= 0; i-- {
+		bl := blocks[i]
+		n = tip
+		for j := 0; j < i; j++ {
+			n = n.Parent
+		}
+		bl.Trusted = !scripts
+		changes, _, er := ch.ProcessBlockTransactions(bl, n.Height, tip.Height)
+		if er != nil {
+			return fmt.Errorf("block %d %s cannot be connected back: %s - UTXO database needs rebuilding (-r)",
+				n.Height, n.BlockHash.String(), er.Error())
+		}
+		ch.Unspent.CommitBlockTxs(changes, bl.Hash.Hash[:])
+		ch.SetLast(n)
+		if ch.TxIndex != nil {
+			ch.TxIndex.BlockCommitted(bl, n.Height)
+		}
+		if opts.Progress != nil {
+			opts.Progress(fmt.Sprint("Connected block ", undone-i, " / ", undone))
+		}
+	}
+	if e != nil {
+		return
+	}
+
+	for k, rec := range before {
+		now := ch.Unspent.UnspentGetRec(k[:])
+		if (rec == nil) != (now == nil) || rec != nil && !rec.Equal(now) {
+			return fmt.Errorf("UTXO record of %s differs after reconnecting the blocks", btc.NewUint256(k[:]).String())
+		}
+	}
+	return
+}
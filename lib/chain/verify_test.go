@@ -0,0 +1,97 @@
+package chain
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+func TestVerifyChain(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "gocoin_chain_test")
+	defer os.RemoveAll(dir)
+	ch := testChain(t, dir+"/", true)
+	defer ch.Close()
+
+	var first *btc.Block
+	prv := testGenesis
+	for h := uint32(1); h <= COINBASE_MATURITY+1; h++ {
+		bl := testBlock(prv, h, 'a')
+		testAccept(t, ch, bl)
+		if first == nil {
+			first = bl
+		}
+		prv = bl.Hash
+	}
+	// a block spending the first coinbase and then its output again, inside the same block
+	tx1 := testSpend(&first.Txs[0].Hash, 0, 49e8)
+	tx2 := testSpend(btc.NewSha2Hash(tx1), 0, 48e8)
+	bl := testBlock(prv, COINBASE_MATURITY+2, 'a', tx1, tx2)
+	testAccept(t, ch, bl)
+	if ch.LastBlock().Height != COINBASE_MATURITY+2 {
+		t.Fatal("Spending block not accepted")
+	}
+	tip := ch.LastBlock()
+
+	var msgs, locks, unlocks int
+	opts := &VerifyChainOpts{Progress: func(string) { msgs++ }, Lock: func() { locks++ }, Unlock: func() { unlocks++ }}
+	for level := uint32(0); level <= VERIFY_CHAIN_MAX_LEVEL; level++ {
+		if e := ch.VerifyChain(level, 10, opts); e != nil {
+			t.Fatal("VerifyChain level", level, e.Error())
+		}
+		if ch.LastBlock() != tip {
+			t.Fatal("VerifyChain level", level, "moved the tip")
+		}
+	}
+	if msgs == 0 {
+		t.Error("No progress reported")
+	}
+	if locks != 2 || unlocks != 2 {
+		t.Error("Chain locked", locks, "times and unlocked", unlocks, "times")
+	}
+
+	// aborted while disconnecting the blocks, they must be connected back
+	var polls int
+	opts = &VerifyChainOpts{Abort: func() bool { polls++; return polls > 12 }}
+	if e := ch.VerifyChain(4, 10, opts); e != ErrVerifyAborted {
+		t.Error("VerifyChain not aborted", e)
+	}
+	if ch.LastBlock() != tip {
+		t.Fatal("Aborted VerifyChain moved the tip")
+	}
+	if ch.Unspent.UnspentGet(&btc.TxPrevOut{Hash: first.Txs[0].Hash.Hash}) != nil {
+		t.Error("Spent coinbase back in UTXO")
+	}
+
+	// undo data that does not match the block
+	undo_fn := fmt.Sprint(dir, "/undo/", tip.Height)
+	good, _ := os.ReadFile(undo_fn)
+	prev_undo, _ := os.ReadFile(fmt.Sprint(dir, "/undo/", tip.Height-1))
+	os.WriteFile(undo_fn, prev_undo, 0600)
+	if e := ch.VerifyChain(2, 10, nil); e == nil {
+		t.Error("Wrong undo data not detected")
+	}
+	if e := ch.VerifyChain(1, 10, nil); e != nil {
+		t.Error("Level 1 should not look at undo data", e)
+	}
+	os.WriteFile(undo_fn, good, 0600)
+
+	// an output missing in UTXO
+	var k utxo.UtxoKeyType
+	copy(k[:], bl.Txs[2].Hash.Hash[:])
+	ch.Unspent.Flush()
+	rec := ch.Unspent.HashMap[k]
+	delete(ch.Unspent.HashMap, k)
+	if e := ch.VerifyChain(3, 10, nil); e == nil {
+		t.Error("Missing UTXO record not detected")
+	}
+	if ch.LastBlock() != tip {
+		t.Fatal("Failed VerifyChain moved the tip")
+	}
+	ch.Unspent.HashMap[k] = rec
+	if e := ch.VerifyChain(4, 10, nil); e != nil {
+		t.Error("VerifyChain after the fix", e.Error())
+	}
+}
@@ -0,0 +1,450 @@
+package mempool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+// AcceptOpts tells Accept how to treat the transaction.
+type AcceptOpts struct {
+	Trusted   bool   // do not verify scripts and do not limit RBF
+	Local     bool   // own tx: do not check its fee
+	PkgMember bool   // part of a package: the fee gets checked for the entire package
+	Retry     bool   // the tx may be on the rejected list (i.e. waiting for inputs), so remove it from there first
+	From      uint32 // ID of the peer that sent the tx (0 if unknown) - for the per peer limits of the orphans
+
+	dry *dryRun // set by TestAccept
+}
+
+// Accept tries to add the transaction to the pool.
+// It returns the new mempool record, or nil and the reason why the tx has not been accepted.
+// All the rejected txs, except for TX_REJECTED_SCRIPT_FAIL, get added to the rejected list.
+// A tx with a missing input gets rejected with TX_REJECTED_NO_TXOU and waits for the input,
+// while the txs that have been waiting for the accepted one get retried before it returns.
+// Call it with the mempool unlocked.
+func (mp *Mempool) Accept(tx *btc.Tx, opts AcceptOpts) (rec *OneTxToSend, reason byte) {
+	var retry []*btc.Tx
+	mp.Lock()
+	rec, reason = mp.accept(tx, &opts)
+	if rec != nil {
+		retry = mp.waitingFor(&tx.Hash)
+	}
+	mp.Unlock()
+
+	mp.retryWaiting(retry)
+	return
+}
+
+func (mp *Mempool) accept(tx *btc.Tx, opts *AcceptOpts) (rec *OneTxToSend, reason byte) {
+	start_time := time.Now()
+	var final bool // set to true if any of the inpits has a final sequence
+
+	var totinp, totout uint64
+	var frommem []bool
+	var frommemcnt int
+
+	if opts.Retry && opts.dry == nil {
+		// In case case of retry, it is on the rejected list,
+		// so remove it now to free any tied WaitingForInputs
+		mp.DeleteRejected(tx.Hash.BIdx())
+	}
+
+	reject := func(why byte, cnt string) (*OneTxToSend, byte) {
+		if opts.dry == nil {
+			mp.RejectTx(tx, why)
+			mp.count(cnt)
+		}
+		return nil, why
+	}
+
+	if mp.Policy.CheckTx != nil {
+		if why := mp.Policy.CheckTx(tx); why != 0 {
+			return reject(why, "TxRejectedPolicy")
+		}
+	}
+
+	pos := make([]*btc.TxOut, len(tx.TxIn))
+	spent := make([]uint64, len(tx.TxIn))
+
+	var rbf_tx_list map[*OneTxToSend]bool
+
+	// Check if all the inputs exist in the chain
+	for i := range tx.TxIn {
+		if !final && tx.TxIn[i].Sequence >= 0xfffffffe {
+			final = true
+		}
+
+		spent[i] = tx.TxIn[i].Input.UIdx()
+
+		if opts.dry != nil && opts.dry.spent[spent[i]] {
+			return nil, TX_REJECTED_CONFLICT
+		}
+
+		if so, ok := mp.SpentOutputs[spent[i]]; ok {
+			// Can only be accepted as RBF...
+
+			if rbf_tx_list == nil {
+				rbf_tx_list = make(map[*OneTxToSend]bool)
+			}
+
+			ctx := mp.TransactionsToSend[so]
+
+			if !opts.Trusted && !mp.replaceable(ctx) {
+				return reject(TX_REJECTED_RBF_FINAL, "TxRejectedRBFFinal")
+			}
+
+			rbf_tx_list[ctx] = true
+			if !opts.Trusted && len(rbf_tx_list) > 100 {
+				return reject(TX_REJECTED_RBF_100, "TxRejectedRBF100+")
+			}
+
+			chlds := mp.GetAllChildren(ctx)
+			for _, ctx = range chlds {
+				if !opts.Trusted && !mp.replaceable(ctx) {
+					return reject(TX_REJECTED_RBF_FINAL, "TxRejectedRBF_Final")
+				}
+
+				rbf_tx_list[ctx] = true
+
+				if !opts.Trusted && len(rbf_tx_list) > 100 {
+					return reject(TX_REJECTED_RBF_100, "TxRejectedRBF100+")
+				}
+			}
+		}
+
+		if txinmem := mp.memTx(btc.BIdx(tx.TxIn[i].Input.Hash[:]), opts.dry); txinmem != nil {
+			if int(tx.TxIn[i].Input.Vout) >= len(txinmem.TxOut) {
+				return reject(TX_REJECTED_BAD_INPUT, "TxRejectedBadInput")
+			}
+
+			if !opts.Trusted && !mp.allowMemInputs() {
+				return reject(TX_REJECTED_NOT_MINED, "TxRejectedMemInput1")
+			}
+
+			pos[i] = txinmem.TxOut[tx.TxIn[i].Input.Vout]
+			mp.count("TxInputInMemory")
+			if frommem == nil {
+				frommem = make([]bool, len(tx.TxIn))
+			}
+			frommem[i] = true
+			frommemcnt++
+		} else {
+			pos[i] = mp.View.UnspentGet(&tx.TxIn[i].Input)
+			if pos[i] == nil {
+				var newone bool
+
+				if !mp.allowMemInputs() {
+					return reject(TX_REJECTED_NOT_MINED, "TxRejectedMemInput2")
+				}
+
+				if opts.dry != nil {
+					return nil, TX_REJECTED_NO_TXOU
+				}
+
+				if rej, ok := mp.TransactionsRejected[btc.BIdx(tx.TxIn[i].Input.Hash[:])]; ok {
+					if rej.Reason != TX_REJECTED_NO_TXOU || rej.Waiting4 == nil {
+						return reject(TX_REJECTED_NO_TXOU, "TxRejectedParentRej")
+					}
+					mp.count("TxWait4ParentsParent")
+				}
+
+				if opts.From != 0 && mp.peerOrphansFull(opts.From, len(tx.Raw)) {
+					mp.count("TxRejectedOrphanMax")
+					return nil, TX_REJECTED_ORPHAN_MAX
+				}
+
+				// In this case, let's "save" it for later...
+				missingid := btc.NewUint256(tx.TxIn[i].Input.Hash[:])
+				nrtx := mp.RejectTx(tx, TX_REJECTED_NO_TXOU)
+
+				if nrtx != nil && nrtx.Tx != nil {
+					nrtx.Waiting4 = missingid
+					nrtx.From = opts.From
+					mp.orphanAdded(nrtx)
+
+					// Add to waiting list:
+					var rec *OneWaitingList
+					if rec, _ = mp.WaitingForInputs[missingid.BIdx()]; rec == nil {
+						rec = new(OneWaitingList)
+						rec.TxID = missingid
+						rec.TxLen = uint32(len(tx.Raw))
+						rec.Ids = make(map[BIDX]time.Time)
+						newone = true
+						mp.WaitingForInputsSize += uint64(rec.TxLen)
+					}
+					rec.Ids[tx.Hash.BIdx()] = time.Now()
+					mp.WaitingForInputs[missingid.BIdx()] = rec
+				}
+
+				if newone {
+					mp.count("TxRejectedNoInpNew")
+				} else {
+					mp.count("TxRejectedNoInpOld")
+				}
+				mp.limitOrphansCnt()
+				return nil, TX_REJECTED_NO_TXOU
+			} else {
+				if pos[i].WasCoinbase {
+					if height := mp.View.Height(); height+1-pos[i].BlockHeight < chain.COINBASE_MATURITY {
+						fmt.Println(tx.Hash.String(), "trying to spend inmature coinbase block", pos[i].BlockHeight, "at", height)
+						return reject(TX_REJECTED_CB_INMATURE, "TxRejectedCBInmature")
+					}
+				}
+			}
+		}
+		totinp += pos[i].Value
+	}
+
+	// Check if total output value does not exceed total input
+	for i := range tx.TxOut {
+		totout += tx.TxOut[i].Value
+	}
+
+	if totout > totinp {
+		return reject(TX_REJECTED_OVERSPEND, "TxRejectedOverspend")
+	}
+
+	// Check for a proper fee
+	fee := totinp - totout
+	if opts.dry != nil {
+		opts.dry.fee = fee
+	}
+	modfee := fee
+	if fd := mp.FeeDeltas[tx.Hash.BIdx()]; fd != nil {
+		modfee = addDelta(fee, fd.Delta)
+	}
+	// do not check minimum fee for locally loaded txs, nor for package members (checked by the package)
+	if !opts.Local && !opts.PkgMember && modfee < (uint64(tx.VSize())*mp.minFeePerKB()/1000) {
+		return reject(TX_REJECTED_LOW_FEE, "TxRejectedLowFee")
+	}
+
+	var sibling *OneTxToSend
+	if mp.truc() {
+		var why byte
+		if sibling, why = mp.checkTRUC(tx, frommem, rbf_tx_list, opts.dry); why != 0 {
+			return reject(why, "TxRejectedTRUC")
+		}
+		if sibling != nil {
+			// sibling eviction - the new tx has to replace the parent's other child
+			if rbf_tx_list == nil {
+				rbf_tx_list = make(map[*OneTxToSend]bool)
+			}
+			rbf_tx_list[sibling] = true
+			for _, ctx := range mp.GetAllChildren(sibling) {
+				rbf_tx_list[ctx] = true
+			}
+		}
+	}
+
+	if rbf_tx_list != nil {
+		var totweight int
+		var totfees uint64
+
+		for ctx := range rbf_tx_list {
+			totweight += ctx.Weight()
+			totfees += ctx.Fee
+		}
+
+		if !opts.Local && totfees*uint64(tx.Weight()) >= fee*uint64(totweight) {
+			return reject(TX_REJECTED_RBF_LOWFEE, "TxRejectedRBFLowFee")
+		}
+	}
+
+	if frommem != nil && !mp.checkPackageLimits(tx, frommem, rbf_tx_list, opts.dry) {
+		return reject(TX_REJECTED_CHAIN_LIMIT, "TxRejectedChainLimit")
+	}
+
+	sigops := btc.WITNESS_SCALE_FACTOR * tx.GetLegacySigOpCount()
+
+	if !opts.Trusted { // Verify scripts
+		var wg sync.WaitGroup
+		var ver_err_cnt uint32
+		flags := mp.verifyFlags()
+
+		prev_dbg_err := script.DBG_ERR
+		script.DBG_ERR = false // keep quiet for incorrect txs
+		for i := range tx.TxIn {
+			wg.Add(1)
+			go func(prv []byte, amount uint64, i int, tx *btc.Tx) {
+				if !script.VerifyTxScript(prv, amount, i, tx, flags) {
+					atomic.AddUint32(&ver_err_cnt, 1)
+				} else {
+					chain.ScriptCache.Add(tx.WTxID(), i, flags)
+				}
+				wg.Done()
+			}(pos[i].Pk_script, pos[i].Value, i, tx)
+		}
+
+		wg.Wait()
+		script.DBG_ERR = prev_dbg_err
+
+		if ver_err_cnt > 0 {
+			// not moving it to rejected, as it would not get any better
+			if opts.dry != nil {
+				return nil, TX_REJECTED_SCRIPT_FAIL
+			}
+			mp.count("TxRejectedScript")
+			if len(rbf_tx_list) > 0 {
+				fmt.Println("RBF try", ver_err_cnt, "script(s) failed!")
+				fmt.Print("> ")
+			}
+			return nil, TX_REJECTED_SCRIPT_FAIL
+		}
+	}
+
+	for i := range tx.TxIn {
+		if btc.IsP2SH(pos[i].Pk_script) {
+			sigops += btc.WITNESS_SCALE_FACTOR * btc.GetP2SHSigOpCount(tx.TxIn[i].ScriptSig)
+		}
+		sigops += uint(tx.CountWitnessSigOps(i, pos[i].Pk_script))
+	}
+
+	rec = &OneTxToSend{Spent: spent, Volume: totinp, Local: opts.Local,
+		Fee: fee, Firstseen: time.Now(), Tx: tx, MemInputs: frommem, MemInputCnt: frommemcnt,
+		SigopsCost: uint64(sigops), Final: final, VerifyTime: time.Now().Sub(start_time)}
+
+	if opts.dry != nil {
+		opts.dry.add(rec)
+		return
+	}
+
+	for ctx := range rbf_tx_list {
+		// we dont remove with children because we have all of them on the list
+		mp.deleteTx(ctx, false, TX_REJECTED_REPLACED, func(old *OneTxToSend) {
+			if mp.OnReplaced != nil {
+				mp.OnReplaced(old, rec)
+			}
+		})
+		mp.count("TxRemovedByRBF")
+	}
+	if sibling != nil {
+		mp.count("TxTRUCSiblingEvicted")
+	}
+
+	mp.add(rec)
+	mp.count("TxAccepted")
+	if mp.OnAdded != nil {
+		mp.OnAdded(rec)
+	}
+	return
+}
+
+// checkPackageLimits returns false if accepting the tx would exceed
+// the ancestor or descendant limits of the policy.
+// The txs from the skip list (about to be replaced) are not counted as descendants.
+// The package members accepted by TestAccept are only counted as ancestors.
+func (mp *Mempool) checkPackageLimits(tx *btc.Tx, frommem []bool, skip map[*OneTxToSend]bool, dry *dryRun) bool {
+	if mp.Policy.PackageLimits == nil {
+		return true
+	}
+	anc_cnt, anc_size, desc_cnt, desc_size := mp.Policy.PackageLimits()
+	vsize := uint64(tx.VSize())
+
+	ancestors := make(map[*OneTxToSend]bool)
+	var add_ancestor func(par *OneTxToSend)
+	add_ancestor = func(par *OneTxToSend) {
+		if ancestors[par] {
+			return
+		}
+		ancestors[par] = true
+		if par.MemInputCnt > 0 {
+			for i := range par.TxIn {
+				if par.MemInputs[i] {
+					add_ancestor(mp.memTx(btc.BIdx(par.TxIn[i].Input.Hash[:]), dry))
+				}
+			}
+		}
+	}
+	for i := range frommem {
+		if frommem[i] {
+			add_ancestor(mp.memTx(btc.BIdx(tx.TxIn[i].Input.Hash[:]), dry))
+		}
+	}
+
+	if anc_cnt > 0 && len(ancestors)+1 > anc_cnt {
+		return false
+	}
+	if anc_size > 0 {
+		size := vsize
+		for a := range ancestors {
+			size += uint64(a.VSize())
+		}
+		if size > anc_size {
+			return false
+		}
+	}
+
+	if desc_cnt > 0 || desc_size > 0 {
+		// each of the ancestors is getting one more descendant
+		for a := range ancestors {
+			if dry != nil && dry.txs[a.Hash.BIdx()] == a {
+				continue
+			}
+			cnt, size := 2, uint64(a.VSize())+vsize
+			for _, ch := range mp.GetAllChildren(a) {
+				if !skip[ch] {
+					cnt++
+					size += uint64(ch.VSize())
+				}
+			}
+			if desc_cnt > 0 && cnt > desc_cnt || desc_size > 0 && size > desc_size {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// add puts the record into the pool.
+func (mp *Mempool) add(rec *OneTxToSend) {
+	if fd := mp.FeeDeltas[rec.Hash.BIdx()]; fd != nil {
+		rec.FeeDelta = fd.Delta
+	}
+	mp.TransactionsToSend[rec.Hash.BIdx()] = rec
+	if rec.SegWit != nil {
+		mp.WTxIDsToSend[rec.WTxID().BIdx()] = rec.Hash.BIdx()
+	}
+	mp.TransactionsToSendSize += uint64(len(rec.Raw))
+	mp.TransactionsToSendWeight += uint64(rec.Weight())
+
+	for i := range rec.Spent {
+		mp.SpentOutputs[rec.Spent[i]] = rec.Hash.BIdx()
+	}
+}
+
+// waitingFor returns the txs waiting for an output of the given tx.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) waitingFor(txid *btc.Uint256) (res []*btc.Tx) {
+	if wtg := mp.WaitingForInputs[txid.BIdx()]; wtg != nil {
+		for k := range wtg.Ids {
+			if rej := mp.TransactionsRejected[k]; rej != nil && rej.Tx != nil {
+				res = append(res, rej.Tx)
+			}
+		}
+	}
+	return
+}
+
+// retryWaiting resubmits the given txs. Call it with the mempool unlocked.
+func (mp *Mempool) retryWaiting(txs []*btc.Tx) {
+	for _, tx := range txs {
+		var ok bool
+		if mp.RetryTx != nil {
+			ok = mp.RetryTx(tx)
+		} else {
+			rec, _ := mp.Accept(tx, AcceptOpts{Retry: true})
+			ok = rec != nil
+		}
+		if ok {
+			mp.count("TxRetryAccepted")
+		} else {
+			mp.count("TxRetryRejected")
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package mempool
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	CLUSTER_EXACT_MAX = 12 // clusters up to this many txs get an optimal linearization
+)
+
+// Cluster is a group of mempool txs connected by spending each other's outputs.
+// The fees used for the linearization are modified by the fee deltas (see Prioritise).
+type Cluster struct {
+	Txs    []*OneTxToSend   // linearized: parents always before children, best fee rates first
+	Chunks []*OneTxsPackage // Txs split into chunks of decreasing fee rates (Fee is the modified fee)
+}
+
+// bitset keeps indexes of the txs within a cluster.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) has(i int) bool {
+	return b[i/64]&(1<<uint(i%64)) != 0
+}
+
+func (b bitset) count() (cnt int) {
+	for _, w := range b {
+		cnt += bits.OnesCount64(w)
+	}
+	return
+}
+
+// GetClusters returns all the mempool txs grouped in linearized clusters.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) GetClusters() (result []*Cluster) {
+	done := make(map[*OneTxToSend]bool, len(mp.TransactionsToSend))
+	for _, t2s := range mp.TransactionsToSend {
+		if !done[t2s] {
+			result = append(result, mp.linearize(mp.clusterOf(t2s, done)))
+		}
+	}
+	return
+}
+
+// memParents returns the in-mempool parents of the tx.
+func (mp *Mempool) memParents(tx *OneTxToSend) (result []*OneTxToSend) {
+	if tx.MemInputCnt == 0 {
+		return
+	}
+	for i := range tx.TxIn {
+		if tx.MemInputs[i] {
+			if par := mp.TransactionsToSend[btc.BIdx(tx.TxIn[i].Input.Hash[:])]; par != nil {
+				result = append(result, par)
+			}
+		}
+	}
+	return
+}
+
+// clusterOf returns all the txs connected with the given one, marking them as done.
+func (mp *Mempool) clusterOf(tx *OneTxToSend, done map[*OneTxToSend]bool) (result []*OneTxToSend) {
+	result = []*OneTxToSend{tx}
+	done[tx] = true
+	for idx := 0; idx < len(result); idx++ {
+		for _, t := range append(mp.memParents(result[idx]), mp.GetChildren(result[idx])...) {
+			if !done[t] {
+				done[t] = true
+				result = append(result, t)
+			}
+		}
+	}
+	return
+}
+
+// linearize orders the cluster's txs and splits them into chunks.
+// Small clusters get the optimal order (the best fee rate ancestor-closed subset first),
+// bigger ones take the best fee rate ancestor set first.
+func (mp *Mempool) linearize(txs []*OneTxToSend) (cl *Cluster) {
+	cl = new(Cluster)
+	if len(txs) == 1 {
+		cl.Txs = txs
+		cl.Chunks = []*OneTxsPackage{{Txs: txs, Weight: txs[0].Weight(), Fee: txs[0].ModFee()}}
+		return
+	}
+
+	// find ancestors of each tx within the cluster
+	index := make(map[*OneTxToSend]int, len(txs))
+	for i, t := range txs {
+		index[t] = i
+	}
+	anc := make([]bitset, len(txs))
+	var find_anc func(i int) bitset
+	find_anc = func(i int) bitset {
+		if anc[i] == nil {
+			anc[i] = newBitset(len(txs))
+			for _, par := range mp.memParents(txs[i]) {
+				pi := index[par]
+				anc[i].set(pi)
+				for w, v := range find_anc(pi) {
+					anc[i][w] |= v
+				}
+			}
+		}
+		return anc[i]
+	}
+	// ... and sort them topologically (each tx has more ancestors than any of its ancestors)
+	cnt := make([]int, len(txs))
+	for i := range txs {
+		cnt[i] = find_anc(i).count()
+	}
+	order := make([]int, len(txs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return cnt[order[a]] < cnt[order[b]] })
+
+	var picks []bitset
+	if len(txs) <= CLUSTER_EXACT_MAX {
+		picks = linearizeExact(txs, anc)
+	} else {
+		picks = linearizeAncestors(txs, anc)
+	}
+
+	cl.Txs = make([]*OneTxToSend, 0, len(txs))
+	for _, pick := range picks {
+		for _, i := range order {
+			if pick.has(i) {
+				cl.Txs = append(cl.Txs, txs[i])
+			}
+		}
+	}
+	cl.Chunks = chunkLinearization(cl.Txs)
+	return
+}
+
+// linearizeExact returns subsequent best fee rate ancestor-closed subsets of the cluster.
+// It checks all the subsets, so only use it for small clusters.
+func linearizeExact(txs []*OneTxToSend, anc []bitset) (picks []bitset) {
+	remaining := uint64(1)<<uint(len(txs)) - 1
+	for remaining != 0 {
+		var best, best_fee, best_weight uint64
+		for sub := remaining; sub != 0; sub = (sub - 1) & remaining {
+			var fee, weight uint64
+			closed := true
+			for s := sub; s != 0; s &= s - 1 {
+				i := bits.TrailingZeros64(s)
+				if anc[i][0]&remaining&^sub != 0 {
+					closed = false
+					break
+				}
+				fee += txs[i].ModFee()
+				weight += uint64(txs[i].Weight())
+			}
+			if !closed {
+				continue
+			}
+			if best == 0 || fee*best_weight > best_fee*weight || fee*best_weight == best_fee*weight && weight < best_weight {
+				best, best_fee, best_weight = sub, fee, weight
+			}
+		}
+		picks = append(picks, bitset{best})
+		remaining &^= best
+	}
+	return
+}
+
+// linearizeAncestors returns subsequent best fee rate ancestor sets of the cluster.
+func linearizeAncestors(txs []*OneTxToSend, anc []bitset) (picks []bitset) {
+	anc_fee := make([]uint64, len(txs))
+	anc_weight := make([]uint64, len(txs))
+	for i := range txs {
+		anc_fee[i], anc_weight[i] = txs[i].ModFee(), uint64(txs[i].Weight())
+		for j := range txs {
+			if anc[i].has(j) {
+				anc_fee[i] += txs[j].ModFee()
+				anc_weight[i] += uint64(txs[j].Weight())
+			}
+		}
+	}
+
+	done := newBitset(len(txs))
+	for left := len(txs); left > 0; {
+		best := -1
+		for i := range txs {
+			if !done.has(i) && (best < 0 || anc_fee[i]*anc_weight[best] > anc_fee[best]*anc_weight[i]) {
+				best = i
+			}
+		}
+
+		pick := newBitset(len(txs))
+		picked := []int{best}
+		for j := range txs {
+			if anc[best].has(j) && !done.has(j) {
+				picked = append(picked, j)
+			}
+		}
+		for _, j := range picked {
+			pick.set(j)
+			done.set(j)
+		}
+		left -= len(picked)
+
+		// the picked txs are no longer ancestors of the remaining ones
+		for i := range txs {
+			if done.has(i) {
+				continue
+			}
+			for _, j := range picked {
+				if anc[i].has(j) {
+					anc_fee[i] -= txs[j].ModFee()
+					anc_weight[i] -= uint64(txs[j].Weight())
+				}
+			}
+		}
+		picks = append(picks, pick)
+	}
+	return
+}
+
+// chunkLinearization splits the linearized txs into chunks, merging each tx
+// with the preceding chunks for as long as it improves their fee rate.
+func chunkLinearization(lin []*OneTxToSend) (chunks []*OneTxsPackage) {
+	for _, t := range lin {
+		ch := &OneTxsPackage{Txs: []*OneTxToSend{t}, Weight: t.Weight(), Fee: t.ModFee()}
+		for len(chunks) > 0 {
+			last := chunks[len(chunks)-1]
+			if ch.Fee*uint64(last.Weight) <= last.Fee*uint64(ch.Weight) {
+				break
+			}
+			last.Txs = append(last.Txs, ch.Txs...)
+			last.Weight += ch.Weight
+			last.Fee += ch.Fee
+			ch = last
+			chunks = chunks[:len(chunks)-1]
+		}
+		chunks = append(chunks, ch)
+	}
+	return
+}
+
+// GetChunks returns the chunks of all the clusters, sorted by fee rate (the best first).
+// Chunks of the same cluster stay in their order, so parents always come before their children.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) GetChunks() (result []*OneTxsPackage) {
+	for _, cl := range mp.GetClusters() {
+		result = append(result, cl.Chunks...)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Fee*uint64(result[j].Weight) > result[j].Fee*uint64(result[i].Weight)
+	})
+	return
+}
+
+// GetSortedMempoolClusters is like GetSortedMempoolNew(), but uses the clusters linearization.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) GetSortedMempoolClusters() (result []*OneTxToSend) {
+	result = make([]*OneTxToSend, 0, len(mp.TransactionsToSend))
+	for _, ch := range mp.GetChunks() {
+		result = append(result, ch.Txs...)
+	}
+	return
+}
+
+// GetBlockTxs selects the txs for a new block, taking entire chunks, the best fee rates first.
+// The chunks that do not fit within maxweight and maxsigops are skipped, as well as the ones
+// containing txs for which usable returns false, or that depend on the skipped ones.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) GetBlockTxs(maxweight, maxsigops uint64, usable func(*OneTxToSend) bool) (result []*OneTxToSend) {
+	var weight, sigops uint64
+	included := make(map[*OneTxToSend]bool)
+	for _, ch := range mp.GetChunks() {
+		if weight+uint64(ch.Weight) > maxweight {
+			continue
+		}
+		var ch_sigops uint64
+		ok := true
+		in_chunk := make(map[*OneTxToSend]bool, len(ch.Txs))
+		for _, t := range ch.Txs {
+			in_chunk[t] = true
+			ch_sigops += t.SigopsCost
+			if usable != nil && !usable(t) {
+				ok = false
+				break
+			}
+			for _, par := range mp.memParents(t) {
+				if !included[par] && !in_chunk[par] {
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				break
+			}
+		}
+		if !ok || sigops+ch_sigops > maxsigops {
+			continue
+		}
+		for _, t := range ch.Txs {
+			included[t] = true
+		}
+		result = append(result, ch.Txs...)
+		weight += uint64(ch.Weight)
+		sigops += ch_sigops
+	}
+	return
+}
@@ -0,0 +1,258 @@
+package mempool
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// checkClusters verifies that each pool tx is in exactly one cluster, after its parents,
+// and that the chunks of each cluster are made of its txs, with decreasing fee rates.
+func checkClusters(t *testing.T, mp *Mempool, clusters []*Cluster) {
+	seen := make(map[*OneTxToSend]bool)
+	for _, cl := range clusters {
+		var idx int
+		for ci, ch := range cl.Chunks {
+			var fee uint64
+			var weight int
+			for _, t2s := range ch.Txs {
+				if idx >= len(cl.Txs) || cl.Txs[idx] != t2s {
+					t.Fatal("Chunks do not follow the linearization")
+				}
+				idx++
+				fee += t2s.ModFee()
+				weight += t2s.Weight()
+			}
+			if fee != ch.Fee || weight != ch.Weight {
+				t.Error("Bad chunk totals", fee, ch.Fee, weight, ch.Weight)
+			}
+			if ci > 0 && ch.Fee*uint64(cl.Chunks[ci-1].Weight) > cl.Chunks[ci-1].Fee*uint64(ch.Weight) {
+				t.Error("Chunk fee rates not decreasing")
+			}
+		}
+		if idx != len(cl.Txs) {
+			t.Error("Not all the cluster's txs in chunks")
+		}
+		for _, t2s := range cl.Txs {
+			if seen[t2s] {
+				t.Error("Tx in more than one place", t2s.Hash.String())
+			}
+			for _, par := range mp.memParents(t2s) {
+				if !seen[par] {
+					t.Error("Child before its parent", t2s.Hash.String())
+				}
+			}
+			seen[t2s] = true
+		}
+	}
+	if len(seen) != len(mp.TransactionsToSend) {
+		t.Error("Clusters do not cover the pool", len(seen), len(mp.TransactionsToSend))
+	}
+}
+
+func TestClusters(t *testing.T) {
+	mp, view := testPool(t)
+
+	// a diamond: a -> b, c -> d
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 4e5, 5e5)
+	b := testTx(out(a, 0), 4e5-1000)
+	c := testTx(out(a, 1), 5e5-30000)
+	d := testTx(append(out(b, 0), out(c, 0)...), 9e5-31000-20000)
+
+	// a low fee parent with two high fee children, which should all make one chunk
+	p := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 5e5, 5e5-100)
+	c1 := testTx(out(p, 0), 5e5-6000)
+	c2 := testTx(out(p, 1), 5e5-100-6000)
+
+	for _, tx := range []*btc.Tx{a, b, c, d, p, c1, c2} {
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+
+	mp.Lock()
+	clusters := mp.GetClusters()
+	mp.Unlock()
+	if len(clusters) != 2 {
+		t.Fatal("Bad number of clusters", len(clusters))
+	}
+	checkClusters(t, mp, clusters)
+	for _, cl := range clusters {
+		if cl.Txs[0].Hash.Equal(&p.Hash) {
+			if len(cl.Chunks) != 1 || cl.Chunks[0].Fee != 12100 {
+				t.Error("Parent not merged with its children", len(cl.Chunks), cl.Chunks[0].Fee)
+			}
+		} else if !cl.Txs[0].Hash.Equal(&a.Hash) || len(cl.Txs) != 4 {
+			t.Error("Bad diamond cluster")
+		}
+	}
+
+	// a cluster too big for the exact linearization
+	outs := make([]uint64, CLUSTER_EXACT_MAX+2)
+	for i := range outs {
+		outs[i] = 5e4
+	}
+	fan := testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, outs...)
+	if rec, reason := mp.Accept(fan, AcceptOpts{}); rec == nil {
+		t.Fatal("Tx not accepted:", ReasonToString(reason))
+	}
+	for i := range outs {
+		if rec, reason := mp.Accept(testTx(out(fan, uint32(i)), 5e4-uint64(500*(i+1))), AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+	mp.Lock()
+	clusters = mp.GetClusters()
+	mp.Unlock()
+	if len(clusters) != 3 {
+		t.Fatal("Bad number of clusters", len(clusters))
+	}
+	checkClusters(t, mp, clusters)
+}
+
+func TestGetBlockTxs(t *testing.T) {
+	mp, view := testPool(t)
+	p := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-100)
+	c := testTx(out(p, 0), 1e6-100-20000)
+	x := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6-5000)
+	q := testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 5e5, 5e5-3000)
+	r := testTx(out(q, 0), 5e5-200)
+	for _, tx := range []*btc.Tx{p, c, x, q, r} {
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+
+	same := func(res []*OneTxToSend, exp ...*btc.Tx) bool {
+		if len(res) != len(exp) {
+			return false
+		}
+		for i := range res {
+			if !res[i].Hash.Equal(&exp[i].Hash) {
+				return false
+			}
+		}
+		return true
+	}
+
+	mp.Lock()
+	defer mp.Unlock()
+	if res := mp.GetBlockTxs(btc.MAX_BLOCK_WEIGHT, btc.MAX_BLOCK_SIGOPS_COST, nil); !same(res, p, c, x, q, r) {
+		t.Error("Bad block txs", len(res))
+	}
+
+	// the child of an unusable tx can not go either
+	usable := func(t2s *OneTxToSend) bool { return !t2s.Hash.Equal(&q.Hash) }
+	if res := mp.GetBlockTxs(btc.MAX_BLOCK_WEIGHT, btc.MAX_BLOCK_SIGOPS_COST, usable); !same(res, p, c, x) {
+		t.Error("Bad block txs without q", len(res))
+	}
+
+	// r would fit, but not its parent
+	maxweight := uint64(p.Weight() + c.Weight() + x.Weight() + q.Weight() - 1)
+	if r.Weight() >= q.Weight() {
+		t.Fatal("Child not smaller than parent")
+	}
+	if res := mp.GetBlockTxs(maxweight, btc.MAX_BLOCK_SIGOPS_COST, nil); !same(res, p, c, x) {
+		t.Error("Bad block txs with weight limit", len(res))
+	}
+}
+
+func TestDump(t *testing.T) {
+	mp, view := testPool(t)
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 4e5, 5e5)
+	b := testTx(out(a, 0), 3e5)
+	for _, tx := range []*btc.Tx{a, b} {
+		mp.Accept(tx, AcceptOpts{})
+	}
+
+	var top btc.Uint256
+	top.Hash[0] = 0x77
+	buf := new(bytes.Buffer)
+	mp.Lock()
+	mp.WriteDump(buf, &top)
+	mp.Unlock()
+
+	fn := t.TempDir() + string(os.PathSeparator) + "mempool.dmp"
+	if er := os.WriteFile(fn, buf.Bytes(), 0600); er != nil {
+		t.Fatal(er)
+	}
+	rtop, recs, _, er := ReadDump(fn)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if !rtop.Equal(&top) || len(recs) != 2 {
+		t.Fatal("Bad dump content", len(recs))
+	}
+
+	mp2 := New(view, mp.Policy)
+	mp2.Lock()
+	if txs, inps := mp2.Load(recs); txs != 1 || inps != 1 {
+		t.Error("Bad memory inputs", txs, inps)
+	}
+	if mp2.Check() {
+		t.Error("Loaded mempool inconsistent")
+	}
+	mp2.Unlock()
+	if mp2.TransactionsToSendSize != mp.TransactionsToSendSize || len(mp2.SpentOutputs) != len(mp.SpentOutputs) {
+		t.Error("Loaded pool differs")
+	}
+	if rec := mp2.TransactionsToSend[b.Hash.BIdx()]; rec == nil || rec.Fee != 1e5 {
+		t.Error("Bad loaded record")
+	}
+
+	os.WriteFile(fn, buf.Bytes()[:buf.Len()-3], 0600)
+	if _, _, _, er := ReadDump(fn); er == nil {
+		t.Error("Truncated dump loaded")
+	}
+}
+
+// loadDump returns the pool from a mempool.dmp file (made with "txmpsave"),
+// pointed by GOCOIN_MEMPOOL_DUMP environment variable.
+func loadDump(b *testing.B) (mp *Mempool) {
+	fn := os.Getenv("GOCOIN_MEMPOOL_DUMP")
+	if fn == "" {
+		b.Skip("GOCOIN_MEMPOOL_DUMP not set")
+	}
+	_, recs, _, er := ReadDump(fn)
+	if er != nil {
+		b.Fatal(er)
+	}
+	mp = New(nil, Policy{})
+	mp.Load(recs)
+	return
+}
+
+// BenchmarkTemplateCPFP builds block templates with GetSortedMempoolNew
+// and reports the fees they collect.
+func BenchmarkTemplateCPFP(b *testing.B) {
+	mp := loadDump(b)
+	var fees uint64
+	for i := 0; i < b.N; i++ {
+		var weight uint64
+		fees = 0
+		for _, t2s := range mp.GetSortedMempoolNew() {
+			if weight+uint64(t2s.Weight()) > btc.MAX_BLOCK_WEIGHT-4000 {
+				break
+			}
+			weight += uint64(t2s.Weight())
+			fees += t2s.Fee
+		}
+	}
+	b.ReportMetric(float64(fees), "sat/block")
+}
+
+// BenchmarkTemplateClusters builds block templates with GetBlockTxs
+// and reports the fees they collect.
+func BenchmarkTemplateClusters(b *testing.B) {
+	mp := loadDump(b)
+	var fees uint64
+	for i := 0; i < b.N; i++ {
+		fees = 0
+		for _, t2s := range mp.GetBlockTxs(btc.MAX_BLOCK_WEIGHT-4000, btc.MAX_BLOCK_SIGOPS_COST, nil) {
+			fees += t2s.Fee
+		}
+	}
+	b.ReportMetric(float64(fees), "sat/block")
+}
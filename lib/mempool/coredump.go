@@ -0,0 +1,164 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// Bitcoin Core's mempool.dat is made of the version (int64 LE), the number of txs (uint64 LE)
+// and for each tx: the tx itself (with witness), the time it entered the pool and its fee delta
+// (both int64 LE). Then come the fee deltas of txs that are not in the pool and the txids of not yet
+// broadcasted txs (both preceded by a var_int count). In version 2 all that follows the version is XOR-ed with a key stored
+// right after it (as an 8 bytes long vector).
+
+const (
+	CORE_DUMP_VERSION1 = 1
+	CORE_DUMP_VERSION2 = 2
+
+	coreDumpMinRec = 60 + 16 // the smallest possible tx, followed by the time and the fee delta
+)
+
+// CoreDumpRec is a tx read from Bitcoin Core's mempool.dat file.
+type CoreDumpRec struct {
+	*btc.Tx
+	Time     time.Time
+	FeeDelta int64
+}
+
+type coreDumpReader struct {
+	b   []byte
+	pos int
+}
+
+func (rd *coreDumpReader) Read(p []byte) (n int, er error) {
+	if rd.pos >= len(rd.b) {
+		return 0, io.EOF
+	}
+	n = copy(p, rd.b[rd.pos:])
+	rd.pos += n
+	return
+}
+
+func (rd *coreDumpReader) int64() (res int64, er error) {
+	er = binary.Read(rd, binary.LittleEndian, &res)
+	return
+}
+
+// ReadCoreDump reads Bitcoin Core's mempool.dat file (version 1 or 2).
+// It returns the txs in the order they are stored, and the fee deltas of other txs.
+func ReadCoreDump(fn string) (recs []*CoreDumpRec, deltas []*OneFeeDelta, er error) {
+	var ver, tim, delta int64
+	var cnt uint64
+	var le int
+
+	rd := new(coreDumpReader)
+	if rd.b, er = os.ReadFile(fn); er != nil {
+		return
+	}
+	if ver, er = rd.int64(); er != nil {
+		return
+	}
+	switch ver {
+	case CORE_DUMP_VERSION1:
+	case CORE_DUMP_VERSION2:
+		if cnt, er = btc.ReadVLen(rd); er != nil {
+			return
+		}
+		if cnt != 8 || rd.pos+8 > len(rd.b) {
+			er = errors.New("bad obfuscation key")
+			return
+		}
+		key := rd.b[rd.pos : rd.pos+8]
+		rd.pos += 8
+		for i := rd.pos; i < len(rd.b); i++ {
+			rd.b[i] ^= key[i%8]
+		}
+	default:
+		er = errors.New(fmt.Sprint("unsupported version ", ver))
+		return
+	}
+
+	if er = binary.Read(rd, binary.LittleEndian, &cnt); er != nil {
+		return
+	}
+	// do not trust the count for the preallocation, as it is only limited by the file's size
+	if max := uint64(len(rd.b)-rd.pos) / coreDumpMinRec; cnt > max {
+		recs = make([]*CoreDumpRec, 0, int(max))
+	} else {
+		recs = make([]*CoreDumpRec, 0, int(cnt))
+	}
+	for ; cnt > 0; cnt-- {
+		rec := new(CoreDumpRec)
+		if rec.Tx, le = btc.NewTx(rd.b[rd.pos:]); rec.Tx == nil {
+			er = errors.New(fmt.Sprint("tx ", len(recs), ": parse error"))
+			return
+		}
+		raw := make([]byte, le) // so the txs do not hold the entire file
+		copy(raw, rd.b[rd.pos:])
+		rec.Tx.SetHash(raw)
+		rd.pos += le
+		if tim, er = rd.int64(); er != nil {
+			return
+		}
+		if rec.FeeDelta, er = rd.int64(); er != nil {
+			return
+		}
+		rec.Time = time.Unix(tim, 0)
+		recs = append(recs, rec)
+	}
+
+	if cnt, er = btc.ReadVLen(rd); er != nil {
+		return
+	}
+	for ; cnt > 0; cnt-- {
+		if rd.pos+32 > len(rd.b) {
+			er = io.ErrUnexpectedEOF
+			return
+		}
+		id := btc.NewUint256(rd.b[rd.pos : rd.pos+32])
+		rd.pos += 32
+		if delta, er = rd.int64(); er != nil {
+			return
+		}
+		deltas = append(deltas, &OneFeeDelta{Id: id, Delta: delta})
+	}
+	// the unbroadcast txids that follow (if any) are of no use for us
+	return
+}
+
+// WriteCoreDump stores the pool and the fee deltas in Bitcoin Core's mempool.dat format (version 1).
+// The txs are written parents first, so they can be loaded one by one.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) WriteCoreDump(wr io.Writer) {
+	binary.Write(wr, binary.LittleEndian, int64(CORE_DUMP_VERSION1))
+
+	binary.Write(wr, binary.LittleEndian, uint64(len(mp.TransactionsToSend)))
+	for _, cl := range mp.GetClusters() {
+		for _, t2s := range cl.Txs {
+			wr.Write(t2s.Raw)
+			binary.Write(wr, binary.LittleEndian, t2s.Firstseen.Unix())
+			binary.Write(wr, binary.LittleEndian, t2s.FeeDelta)
+		}
+	}
+
+	var other bytes.Buffer
+	var cnt uint64
+	for k, fd := range mp.FeeDeltas {
+		if _, ok := mp.TransactionsToSend[k]; !ok {
+			other.Write(fd.Id.Hash[:])
+			binary.Write(&other, binary.LittleEndian, fd.Delta)
+			cnt++
+		}
+	}
+	btc.WriteVlen(wr, cnt)
+	wr.Write(other.Bytes())
+
+	btc.WriteVlen(wr, 0) // no unbroadcast txids
+}
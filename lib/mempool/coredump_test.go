@@ -0,0 +1,134 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestCoreDump(t *testing.T) {
+	mp, view := testPool(t)
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 4e5, 5e5)
+	b := testTx(out(a, 0), 3e5)
+	c := testTx(out(b, 0), 2e5)
+	for _, tx := range []*btc.Tx{a, b, c} {
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+	var other btc.Uint256
+	other.Hash[0] = 0x55
+	mp.Lock()
+	mp.Prioritise(&b.Hash, 1000)
+	mp.Prioritise(&other, -2000)
+	buf := new(bytes.Buffer)
+	mp.WriteCoreDump(buf)
+	mp.Unlock()
+
+	check := func(fn string) {
+		recs, deltas, er := ReadCoreDump(fn)
+		if er != nil {
+			t.Fatal(er)
+		}
+		if len(recs) != 3 || !recs[0].Hash.Equal(&a.Hash) || !recs[1].Hash.Equal(&b.Hash) || !recs[2].Hash.Equal(&c.Hash) {
+			t.Fatal("Bad txs read")
+		}
+		if recs[1].FeeDelta != 1000 || recs[0].FeeDelta != 0 || !bytes.Equal(recs[2].Raw, c.Raw) {
+			t.Error("Bad records read")
+		}
+		if len(deltas) != 1 || !deltas[0].Id.Equal(&other) || deltas[0].Delta != -2000 {
+			t.Error("Bad fee deltas read")
+		}
+	}
+
+	dir := t.TempDir() + string(os.PathSeparator)
+	os.WriteFile(dir+"v1.dat", buf.Bytes(), 0600)
+	check(dir + "v1.dat")
+
+	// the same content obfuscated, as made by newer versions of Bitcoin Core
+	key := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	v2 := binary.LittleEndian.AppendUint64(nil, CORE_DUMP_VERSION2)
+	v2 = append(append(v2, 8), key...)
+	for _, c := range buf.Bytes()[8:] {
+		v2 = append(v2, c^key[len(v2)%8])
+	}
+	os.WriteFile(dir+"v2.dat", v2, 0600)
+	check(dir + "v2.dat")
+
+	os.WriteFile(dir+"bad.dat", buf.Bytes()[:buf.Len()-20], 0600)
+	if _, _, er := ReadCoreDump(dir + "bad.dat"); er == nil {
+		t.Error("Truncated file read")
+	}
+
+	// a huge count of txs must not make it allocate the memory for them
+	huge := binary.LittleEndian.AppendUint64(nil, CORE_DUMP_VERSION1)
+	huge = binary.LittleEndian.AppendUint64(huge, 1<<60)
+	huge = append(huge, buf.Bytes()[16:]...)
+	os.WriteFile(dir+"huge.dat", huge, 0600)
+	if _, _, er := ReadCoreDump(dir + "huge.dat"); er == nil {
+		t.Error("File with a huge count read")
+	}
+}
+
+// TestCoreDumpLayout checks the files byte by byte, as laid out by Bitcoin Core
+// (DumpMempool / LoadMempool).
+func TestCoreDumpLayout(t *testing.T) {
+	mp, view := testPool(t)
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 9e5)
+	rec, reason := mp.Accept(a, AcceptOpts{})
+	if rec == nil {
+		t.Fatal("Tx not accepted:", ReasonToString(reason))
+	}
+	var other btc.Uint256
+	other.Hash[0] = 0x55
+
+	var v1 []byte
+	v1 = append(v1, 1, 0, 0, 0, 0, 0, 0, 0) // version (int64)
+	v1 = append(v1, 1, 0, 0, 0, 0, 0, 0, 0) // number of txs (uint64)
+	v1 = append(v1, a.Raw...)
+	v1 = append(v1, 0x00, 0xe1, 0xf5, 0x05, 0, 0, 0, 0) // time: 100000000 (int64)
+	v1 = append(v1, 0xe8, 0x03, 0, 0, 0, 0, 0, 0)       // fee delta: 1000 (int64)
+	v1 = append(v1, 1)                                  // fee deltas of other txs (var_int)
+	v1 = append(v1, other.Hash[:]...)
+	v1 = append(v1, 0x30, 0xf8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // -2000 (int64)
+	v1 = append(v1, 0)                                              // unbroadcast txids (var_int)
+
+	mp.Lock()
+	rec.Firstseen = time.Unix(100000000, 0)
+	mp.Prioritise(&a.Hash, 1000)
+	mp.Prioritise(&other, -2000)
+	buf := new(bytes.Buffer)
+	mp.WriteCoreDump(buf)
+	mp.Unlock()
+	if !bytes.Equal(buf.Bytes(), v1) {
+		t.Errorf("Bad file written\n%x\n%x", buf.Bytes(), v1)
+	}
+
+	// version 2: the XOR key (a vector of 8 bytes) and the rest obfuscated by the file position
+	v2 := []byte{2, 0, 0, 0, 0, 0, 0, 0, 8, 0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6, 0x07, 0x18}
+	key := v2[9:17]
+	for _, c := range v1[8:] {
+		v2 = append(v2, c^key[len(v2)%8])
+	}
+
+	dir := t.TempDir() + string(os.PathSeparator)
+	for i, data := range [][]byte{v1, v2} {
+		fn := dir + fmt.Sprint("v", i+1, ".dat")
+		os.WriteFile(fn, data, 0600)
+		recs, deltas, er := ReadCoreDump(fn)
+		if er != nil {
+			t.Fatal(fn, er)
+		}
+		if len(recs) != 1 || !recs[0].Hash.Equal(&a.Hash) || recs[0].Time.Unix() != 100000000 || recs[0].FeeDelta != 1000 {
+			t.Error(fn, "Bad txs read")
+		}
+		if len(deltas) != 1 || !deltas[0].Id.Equal(&other) || deltas[0].Delta != -2000 {
+			t.Error(fn, "Bad fee deltas read")
+		}
+	}
+}
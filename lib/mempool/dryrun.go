@@ -0,0 +1,85 @@
+package mempool
+
+import (
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// TestResult tells what Accept would do with a tx.
+type TestResult struct {
+	Reason byte    // zero if the tx would be accepted
+	Fee    uint64  // zero if the inputs have not been found
+	VSize  int     // virtual size of the tx
+	SPB    float64 // effective fee rate (of the entire package, for its members) - only set if accepted
+}
+
+// dryRun keeps the package members that TestAccept has found acceptable,
+// so the following members can spend their outputs.
+type dryRun struct {
+	txs   map[BIDX]*OneTxToSend
+	spent map[uint64]bool
+	fee   uint64 // of the last tx checked
+}
+
+func (d *dryRun) add(rec *OneTxToSend) {
+	d.txs[rec.Hash.BIdx()] = rec
+	for _, k := range rec.Spent {
+		d.spent[k] = true
+	}
+}
+
+// memTx returns the mempool tx with the given id, or a package member from the dry run.
+func (mp *Mempool) memTx(bidx BIDX, dry *dryRun) *OneTxToSend {
+	if t2s := mp.TransactionsToSend[bidx]; t2s != nil {
+		return t2s
+	}
+	if dry != nil {
+		return dry.txs[bidx]
+	}
+	return nil
+}
+
+// TestAccept checks if the txs would get accepted, without changing the pool.
+// More than one tx is treated as a package: parents must come before their children
+// and the minimum fee is checked for all of them together.
+// Call it with the mempool unlocked.
+func (mp *Mempool) TestAccept(txs []*btc.Tx) (res []TestResult) {
+	var totfee, totsize uint64
+	dry := &dryRun{txs: make(map[BIDX]*OneTxToSend), spent: make(map[uint64]bool)}
+	opts := AcceptOpts{PkgMember: len(txs) > 1, dry: dry}
+	res = make([]TestResult, len(txs))
+
+	mp.Lock()
+	defer mp.Unlock()
+	for i, tx := range txs {
+		res[i].VSize = tx.VSize()
+		if _, ok := mp.TransactionsToSend[tx.Hash.BIdx()]; ok {
+			res[i].Reason = TX_REJECTED_IN_MEMPOOL
+			continue
+		}
+		dry.fee = 0
+		_, res[i].Reason = mp.accept(tx, &opts)
+		res[i].Fee = dry.fee
+		if res[i].Reason == 0 {
+			totfee += dry.fee
+			totsize += uint64(res[i].VSize)
+		}
+	}
+	if totsize == 0 {
+		return
+	}
+
+	low_fee := opts.PkgMember && totfee < totsize*mp.minFeePerKB()/1000
+	for i := range res {
+		if res[i].Reason != 0 {
+			continue
+		}
+		if low_fee {
+			res[i].Reason = TX_REJECTED_LOW_FEE
+		} else if opts.PkgMember {
+			res[i].SPB = float64(totfee) / float64(totsize)
+		} else {
+			res[i].SPB = float64(res[i].Fee) / float64(res[i].VSize)
+		}
+	}
+	return
+}
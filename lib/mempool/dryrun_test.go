@@ -0,0 +1,128 @@
+package mempool
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestTestAccept(t *testing.T) {
+	mp, view := testPool(t)
+	in_pool := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-1000)
+	mp.Accept(in_pool, AcceptOpts{})
+
+	ok := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6-5000)
+	low := testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 1e6-10)
+	orphan := testTx(out(ok, 0), 1e6-6000)
+	for _, c := range []struct {
+		tx     *btc.Tx
+		reason byte
+	}{
+		{ok, 0},
+		{low, TX_REJECTED_LOW_FEE},
+		{orphan, TX_REJECTED_NO_TXOU},
+		{in_pool, TX_REJECTED_IN_MEMPOOL},
+		{testTx(out(in_pool, 0), 1e6), TX_REJECTED_OVERSPEND},
+	} {
+		res := mp.TestAccept([]*btc.Tx{c.tx})
+		if len(res) != 1 || res[0].Reason != c.reason {
+			t.Error("Expected", ReasonToString(c.reason), "got", ReasonToString(res[0].Reason))
+		}
+	}
+	if res := mp.TestAccept([]*btc.Tx{ok}); res[0].Fee != 5000 || res[0].VSize != ok.VSize() ||
+		res[0].SPB != 5000/float64(ok.VSize()) {
+		t.Error("Bad result", res[0])
+	}
+
+	// a low fee parent with a high fee child
+	parent := testTx([]btc.TxPrevOut{view.coin(4, 1e6)}, 1e6-10)
+	child := testTx(out(parent, 0), 1e6-10-5000)
+	res := mp.TestAccept([]*btc.Tx{parent, child})
+	if res[0].Reason != 0 || res[1].Reason != 0 || res[0].SPB != res[1].SPB ||
+		res[0].SPB != 5010/float64(parent.VSize()+child.VSize()) {
+		t.Error("Package not accepted", ReasonToString(res[0].Reason), ReasonToString(res[1].Reason), res[0].SPB)
+	}
+
+	// ... with a child not paying enough
+	res = mp.TestAccept([]*btc.Tx{parent, testTx(out(parent, 0), 1e6-20)})
+	if res[0].Reason != TX_REJECTED_LOW_FEE || res[1].Reason != TX_REJECTED_LOW_FEE {
+		t.Error("Low fee package accepted")
+	}
+
+	// two package members spending the same coin
+	res = mp.TestAccept([]*btc.Tx{ok, testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6-9000)})
+	if res[0].Reason != 0 || res[1].Reason != TX_REJECTED_CONFLICT {
+		t.Error("Conflict not detected", ReasonToString(res[1].Reason))
+	}
+
+	if len(mp.TransactionsToSend) != 1 || len(mp.TransactionsRejected) != 0 || len(mp.WaitingForInputs) != 0 ||
+		len(mp.SpentOutputs) != 1 {
+		t.Error("TestAccept changed the pool")
+	}
+}
+
+func TestPrioritise(t *testing.T) {
+	mp, view := testPool(t)
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-2000)
+	b := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6-3000)
+
+	// a delta set before the tx arrives
+	mp.Lock()
+	mp.Prioritise(&a.Hash, 5000)
+	mp.Unlock()
+	for _, tx := range []*btc.Tx{a, b} {
+		mp.Accept(tx, AcceptOpts{})
+	}
+
+	mp.Lock()
+	res := mp.GetBlockTxs(btc.MAX_BLOCK_WEIGHT, btc.MAX_BLOCK_SIGOPS_COST, nil)
+	if len(res) != 2 || !res[0].Hash.Equal(&a.Hash) || res[0].Fee != 2000 || res[0].ModFee() != 7000 {
+		t.Error("Prioritised tx not first")
+	}
+
+	// the prioritised tx survives eviction
+	mp.LimitPoolSize(mp.TransactionsToSendSize - 1)
+	mp.Unlock()
+	if _, ok := mp.TransactionsToSend[a.Hash.BIdx()]; !ok || len(mp.TransactionsToSend) != 1 {
+		t.Error("Bad tx evicted")
+	}
+
+	// the deltas get saved along with the pool
+	buf := new(bytes.Buffer)
+	mp.Lock()
+	mp.Prioritise(&b.Hash, -100)
+	mp.WriteDump(buf, &a.Hash)
+	mp.Unlock()
+	fn := t.TempDir() + string(os.PathSeparator) + "mempool.dmp"
+	os.WriteFile(fn, buf.Bytes(), 0600)
+	_, _, deltas, er := ReadDump(fn)
+	if er != nil {
+		t.Fatal(er)
+	}
+	if len(deltas) != 2 {
+		t.Fatal("Bad number of deltas", len(deltas))
+	}
+	for _, fd := range deltas {
+		if fd.Id.Equal(&a.Hash) && fd.Delta != 5000 || fd.Id.Equal(&b.Hash) && fd.Delta != -100 {
+			t.Error("Bad delta", fd.Id.String(), fd.Delta)
+		}
+	}
+
+	// a negative delta makes it pay too little
+	mp.Lock()
+	mp.Prioritise(&b.Hash, -2900)
+	mp.Unlock()
+	if rec, reason := mp.Accept(b, AcceptOpts{}); rec != nil || reason != TX_REJECTED_LOW_FEE {
+		t.Error("Tx with negative delta accepted", ReasonToString(reason))
+	}
+
+	// the delta is gone once it gets back to zero
+	mp.Lock()
+	mp.Prioritise(&a.Hash, -5000)
+	mp.Unlock()
+	if _, ok := mp.FeeDeltas[a.Hash.BIdx()]; ok || mp.TransactionsToSend[a.Hash.BIdx()].FeeDelta != 0 {
+		t.Error("Zero delta not removed")
+	}
+}
@@ -0,0 +1,244 @@
+package mempool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// The mempool.dmp file is made of the top block hash, the records (written by WriteBytes),
+// the spent outputs and DUMP_END_MARKER, followed by the fee deltas (see Prioritise),
+// which older versions do not read.
+
+var (
+	DUMP_END_MARKER = []byte("END_OF_FILE")
+)
+
+func bool2byte(v bool) byte {
+	if v {
+		return 1
+	} else {
+		return 0
+	}
+}
+
+// WriteBytes stores the record in the mempool.dmp format.
+func (t2s *OneTxToSend) WriteBytes(wr io.Writer) {
+	btc.WriteVlen(wr, uint64(len(t2s.Raw)))
+	wr.Write(t2s.Raw)
+
+	btc.WriteVlen(wr, uint64(len(t2s.Spent)))
+	binary.Write(wr, binary.LittleEndian, t2s.Spent[:])
+
+	binary.Write(wr, binary.LittleEndian, t2s.Invsentcnt)
+	binary.Write(wr, binary.LittleEndian, t2s.SentCnt)
+	binary.Write(wr, binary.LittleEndian, uint32(t2s.Firstseen.Unix()))
+	binary.Write(wr, binary.LittleEndian, uint32(t2s.Lastsent.Unix()))
+	binary.Write(wr, binary.LittleEndian, t2s.Volume)
+	binary.Write(wr, binary.LittleEndian, t2s.Fee)
+	binary.Write(wr, binary.LittleEndian, t2s.SigopsCost)
+	binary.Write(wr, binary.LittleEndian, t2s.VerifyTime)
+	wr.Write([]byte{bool2byte(t2s.Local), t2s.Blocked, bool2byte(t2s.MemInputs != nil), bool2byte(t2s.Final)})
+}
+
+// ReadTxRecord reads a record written by WriteBytes.
+// MemInputs only gets allocated (if the tx had any inputs in the mempool) - the caller must fill it.
+func ReadTxRecord(rd io.Reader) (t2s *OneTxToSend, er error) {
+	var le uint64
+	var tina uint32
+	var tmp [4]byte
+	var i int
+
+	if le, er = btc.ReadVLen(rd); er != nil {
+		return
+	}
+	raw := make([]byte, int(le))
+	if _, er = io.ReadFull(rd, raw); er != nil {
+		return
+	}
+
+	t2s = new(OneTxToSend)
+	if t2s.Tx, i = btc.NewTx(raw); t2s.Tx == nil || i != len(raw) {
+		return nil, errors.New("tx parse error")
+	}
+	t2s.Tx.SetHash(raw)
+
+	if le, er = btc.ReadVLen(rd); er != nil {
+		return
+	}
+	t2s.Spent = make([]uint64, int(le))
+	if er = binary.Read(rd, binary.LittleEndian, t2s.Spent[:]); er != nil {
+		return
+	}
+
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.Invsentcnt); er != nil {
+		return
+	}
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.SentCnt); er != nil {
+		return
+	}
+	if er = binary.Read(rd, binary.LittleEndian, &tina); er != nil {
+		return
+	}
+	t2s.Firstseen = time.Unix(int64(tina), 0)
+	if er = binary.Read(rd, binary.LittleEndian, &tina); er != nil {
+		return
+	}
+	t2s.Lastsent = time.Unix(int64(tina), 0)
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.Volume); er != nil {
+		return
+	}
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.Fee); er != nil {
+		return
+	}
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.SigopsCost); er != nil {
+		return
+	}
+	if er = binary.Read(rd, binary.LittleEndian, &t2s.VerifyTime); er != nil {
+		return
+	}
+
+	if _, er = io.ReadFull(rd, tmp[:]); er != nil {
+		return
+	}
+	t2s.Local = tmp[0] != 0
+	t2s.Blocked = tmp[1]
+	if tmp[2] != 0 {
+		t2s.MemInputs = make([]bool, len(t2s.TxIn))
+	}
+	t2s.Final = tmp[3] != 0
+
+	t2s.Tx.Fee = t2s.Fee
+	return
+}
+
+// ReadDump reads a mempool.dmp file.
+// It returns hash of the top block at which the file was made, all the records and the fee deltas.
+func ReadDump(fn string) (top *btc.Uint256, recs []*OneTxToSend, deltas []*OneFeeDelta, er error) {
+	var f *os.File
+	var totcnt uint64
+	var tmp [32]byte
+	var t2s *OneTxToSend
+	var delta int64
+
+	if f, er = os.Open(fn); er != nil {
+		return
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	if _, er = io.ReadFull(rd, tmp[:32]); er != nil {
+		return
+	}
+	top = btc.NewUint256(tmp[:32])
+
+	if totcnt, er = btc.ReadVLen(rd); er != nil {
+		return
+	}
+	recs = make([]*OneTxToSend, 0, int(totcnt))
+	for ; totcnt > 0; totcnt-- {
+		if t2s, er = ReadTxRecord(rd); er != nil {
+			er = errors.New(fmt.Sprint("record ", len(recs), ": ", er.Error()))
+			return
+		}
+		recs = append(recs, t2s)
+	}
+
+	// the spent outputs can be recovered from the records
+	if totcnt, er = btc.ReadVLen(rd); er != nil {
+		return
+	}
+	if _, er = rd.Discard(int(totcnt) * (8 + btc.Uint256IdxLen)); er != nil {
+		return
+	}
+
+	if _, er = io.ReadFull(rd, tmp[:len(DUMP_END_MARKER)]); er != nil {
+		return
+	}
+	if !bytes.Equal(tmp[:len(DUMP_END_MARKER)], DUMP_END_MARKER) {
+		er = errors.New("marker missing")
+		return
+	}
+
+	if totcnt, er = btc.ReadVLen(rd); er != nil {
+		if er == io.EOF {
+			er = nil // made by an older version
+		}
+		return
+	}
+	for ; totcnt > 0; totcnt-- {
+		if _, er = io.ReadFull(rd, tmp[:32]); er != nil {
+			return
+		}
+		if er = binary.Read(rd, binary.LittleEndian, &delta); er != nil {
+			return
+		}
+		deltas = append(deltas, &OneFeeDelta{Id: btc.NewUint256(tmp[:32]), Delta: delta})
+	}
+	return
+}
+
+// WriteDump stores the content of the pool (not the rejected txs) and the fee deltas in mempool.dmp format.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) WriteDump(wr io.Writer, top *btc.Uint256) {
+	wr.Write(top.Hash[:])
+
+	btc.WriteVlen(wr, uint64(len(mp.TransactionsToSend)))
+	for _, t2s := range mp.TransactionsToSend {
+		t2s.WriteBytes(wr)
+	}
+
+	btc.WriteVlen(wr, uint64(len(mp.SpentOutputs)))
+	for k, v := range mp.SpentOutputs {
+		binary.Write(wr, binary.LittleEndian, k)
+		binary.Write(wr, binary.LittleEndian, v)
+	}
+
+	wr.Write(DUMP_END_MARKER[:])
+
+	btc.WriteVlen(wr, uint64(len(mp.FeeDeltas)))
+	for _, fd := range mp.FeeDeltas {
+		wr.Write(fd.Id.Hash[:])
+		binary.Write(wr, binary.LittleEndian, fd.Delta)
+	}
+}
+
+// Load replaces the content of the pool (not the rejected txs) with the given records,
+// setting up their MemInputs. It returns how many txs use how many inputs from the pool.
+// The records are not verified - make sure to call it with the mempool locked.
+func (mp *Mempool) Load(recs []*OneTxToSend) (txs_cnt, inps_cnt int) {
+	mp.TransactionsToSend = make(map[BIDX]*OneTxToSend, len(recs))
+	mp.TransactionsToSendSize = 0
+	mp.TransactionsToSendWeight = 0
+	mp.WTxIDsToSend = make(map[BIDX]BIDX)
+	mp.SpentOutputs = make(map[uint64]BIDX)
+	for _, t2s := range recs {
+		mp.add(t2s)
+	}
+
+	for _, t2s := range mp.TransactionsToSend {
+		t2s.MemInputCnt = 0
+		if t2s.MemInputs != nil {
+			txs_cnt++
+			for i := range t2s.TxIn {
+				if _, inmem := mp.TransactionsToSend[btc.BIdx(t2s.TxIn[i].Input.Hash[:])]; inmem {
+					t2s.MemInputs[i] = true
+					t2s.MemInputCnt++
+					inps_cnt++
+				}
+			}
+			if t2s.MemInputCnt == 0 {
+				println("ERROR: MemInputs not nil but nothing found")
+				t2s.MemInputs = nil
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,284 @@
+package mempool
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	FEE_EST_MIN_SPB     = 0.1     // lowest bucket (satoshis per virtual byte)
+	FEE_EST_MAX_SPB     = 10000.0 // highest bucket
+	FEE_EST_SPACING     = 1.05    // each bucket is this much higher than the previous one
+	FEE_EST_MAX_TARGET  = 144     // highest confirmation target we track (in blocks)
+	FEE_EST_DECAY       = 0.998   // applied to all the stats with each new block
+	FEE_EST_SUFFICIENT  = 0.1     // minimum number of txs per block (in a range of buckets) to consider the data
+	FEE_EST_SUCCESS     = 0.85    // required ratio of txs confirmed within the target
+	FEE_EST_SUCCESS_CON = 0.95    // same as above, for the conservative mode
+)
+
+// FeeEstimator tracks how long the mempool txs take to get confirmed,
+// for a range of fee rate buckets, in order to estimate a fee needed to confirm within N blocks.
+// All the stats decay exponentially, so the recent blocks matter the most.
+type FeeEstimator struct {
+	sync.Mutex
+	FeeEstimatorStats
+	tracked map[BIDX]feeEstTx
+}
+
+// FeeEstimatorStats is the part of the estimator that gets saved on disk.
+type FeeEstimatorStats struct {
+	Buckets []float64   // lower bound of each bucket (SPB)
+	TxCnt   []float64   // txs confirmed, per bucket
+	FeeSum  []float64   // sum of their fee rates, per bucket
+	Conf    [][]float64 // [target-1][bucket] - txs confirmed within the target
+	Fail    [][]float64 // [target-1][bucket] - txs that left the mempool unconfirmed after the target
+	Height  uint32      // last processed block
+}
+
+type feeEstTx struct {
+	height uint32
+	bucket int
+}
+
+// NewFeeEstimator returns an estimator with no data.
+func NewFeeEstimator() (e *FeeEstimator) {
+	e = new(FeeEstimator)
+	for spb := FEE_EST_MIN_SPB; spb <= FEE_EST_MAX_SPB; spb *= FEE_EST_SPACING {
+		e.Buckets = append(e.Buckets, spb)
+	}
+	e.TxCnt = make([]float64, len(e.Buckets))
+	e.FeeSum = make([]float64, len(e.Buckets))
+	e.Conf = make([][]float64, FEE_EST_MAX_TARGET)
+	e.Fail = make([][]float64, FEE_EST_MAX_TARGET)
+	for i := range e.Conf {
+		e.Conf[i] = make([]float64, len(e.Buckets))
+		e.Fail[i] = make([]float64, len(e.Buckets))
+	}
+	e.tracked = make(map[BIDX]feeEstTx)
+	return
+}
+
+// bucket returns index of the bucket for the given fee rate.
+func (e *FeeEstimator) bucket(spb float64) int {
+	if spb <= e.Buckets[0] {
+		return 0
+	}
+	i := int(math.Log(spb/FEE_EST_MIN_SPB) / math.Log(FEE_EST_SPACING))
+	if i >= len(e.Buckets) {
+		return len(e.Buckets) - 1
+	}
+	return i
+}
+
+// TxAdded starts tracking a new mempool tx.
+// Own txs and txs spending unconfirmed outputs are ignored, as their fee does not reflect the market.
+func (e *FeeEstimator) TxAdded(t2s *OneTxToSend) {
+	if t2s.Local || t2s.MemInputs != nil {
+		return
+	}
+	e.Lock()
+	if e.Height == 0 { // ProcessBlock not called yet
+		e.Unlock()
+		return
+	}
+	e.tracked[t2s.Hash.BIdx()] = feeEstTx{height: e.Height, bucket: e.bucket(t2s.SPB())}
+	e.Unlock()
+}
+
+// TxMined records a confirmation of the tracked tx in a block at the given height.
+func (e *FeeEstimator) TxMined(t2s *OneTxToSend, height uint32) {
+	e.Lock()
+	defer e.Unlock()
+	bidx := t2s.Hash.BIdx()
+	rec, ok := e.tracked[bidx]
+	if !ok {
+		return
+	}
+	delete(e.tracked, bidx)
+	if height <= rec.height {
+		return
+	}
+	for t := int(height-rec.height) - 1; t < FEE_EST_MAX_TARGET; t++ {
+		e.Conf[t][rec.bucket]++
+	}
+	e.TxCnt[rec.bucket]++
+	e.FeeSum[rec.bucket] += t2s.SPB()
+}
+
+// TxRemoved records the tracked tx leaving the mempool without being confirmed.
+func (e *FeeEstimator) TxRemoved(t2s *OneTxToSend) {
+	e.Lock()
+	defer e.Unlock()
+	bidx := t2s.Hash.BIdx()
+	rec, ok := e.tracked[bidx]
+	if !ok {
+		return
+	}
+	delete(e.tracked, bidx)
+	for t := 0; t < int(e.Height-rec.height) && t < FEE_EST_MAX_TARGET; t++ {
+		e.Fail[t][rec.bucket]++
+	}
+}
+
+// ProcessBlock decays the stats for a new block.
+// Call it before TxMined for the block's txs. It does nothing if the height has already been processed.
+func (e *FeeEstimator) ProcessBlock(height uint32) {
+	e.Lock()
+	defer e.Unlock()
+	if height <= e.Height {
+		return
+	}
+	if e.Height == 0 {
+		e.Height = height
+		return
+	}
+	decay := math.Pow(FEE_EST_DECAY, float64(height-e.Height))
+	for b := range e.Buckets {
+		e.TxCnt[b] *= decay
+		e.FeeSum[b] *= decay
+		for t := range e.Conf {
+			e.Conf[t][b] *= decay
+			e.Fail[t][b] *= decay
+		}
+	}
+	e.Height = height
+}
+
+// Tracked returns number of the mempool txs currently being tracked.
+func (e *FeeEstimator) Tracked() (cnt int) {
+	e.Lock()
+	cnt = len(e.tracked)
+	e.Unlock()
+	return
+}
+
+// EstimateFee returns the lowest fee rate (SPB) at which txs have been getting
+// confirmed within the target number of blocks, or zero if there is not enough data.
+func (e *FeeEstimator) EstimateFee(target int, conservative bool) float64 {
+	e.Lock()
+	defer e.Unlock()
+	if target < 1 || target > FEE_EST_MAX_TARGET {
+		return 0
+	}
+	return e.estimateFee(target, conservative, e.unconfirmed())
+}
+
+// unconfirmed returns [target-1][bucket] number of the tracked txs that have been waiting for at least target blocks.
+func (e *FeeEstimator) unconfirmed() (res [][]float64) {
+	res = make([][]float64, FEE_EST_MAX_TARGET)
+	for t := range res {
+		res[t] = make([]float64, len(e.Buckets))
+	}
+	for _, rec := range e.tracked {
+		age := int(e.Height - rec.height)
+		if age > FEE_EST_MAX_TARGET {
+			age = FEE_EST_MAX_TARGET
+		}
+		if age > 0 {
+			res[age-1][rec.bucket]++
+		}
+	}
+	for t := FEE_EST_MAX_TARGET - 2; t >= 0; t-- {
+		for b := range res[t] {
+			res[t][b] += res[t+1][b]
+		}
+	}
+	return
+}
+
+func (e *FeeEstimator) estimateFee(target int, conservative bool, unconfirmed [][]float64) (spb float64) {
+	success := FEE_EST_SUCCESS
+	if conservative {
+		success = FEE_EST_SUCCESS_CON
+	}
+	sufficient := FEE_EST_SUFFICIENT / (1 - FEE_EST_DECAY)
+	conf, fail, unconf := e.Conf[target-1], e.Fail[target-1], unconfirmed[target-1]
+
+	// Go from the highest fee rate down, grouping buckets until there is enough data to tell
+	var n, nconf, nfail, nunconf, fees float64
+	for b := len(e.Buckets) - 1; b >= 0; b-- {
+		n += e.TxCnt[b]
+		fees += e.FeeSum[b]
+		nconf += conf[b]
+		nfail += fail[b]
+		nunconf += unconf[b]
+		if n < sufficient {
+			continue
+		}
+		if nconf/(n+nfail+nunconf) < success {
+			break
+		}
+		spb = fees / n
+		n, nconf, nfail, nunconf, fees = 0, 0, 0, 0, 0
+	}
+	return
+}
+
+// EstimateSmartFee returns the fee rate (SPB) needed to confirm within the target,
+// or within the lowest higher target for which there is enough data.
+// It returns zero blocks if no estimate can be made.
+func (e *FeeEstimator) EstimateSmartFee(target int, conservative bool) (spb float64, blocks int) {
+	if target < 1 {
+		target = 1
+	} else if target > FEE_EST_MAX_TARGET {
+		target = FEE_EST_MAX_TARGET
+	}
+	e.Lock()
+	defer e.Unlock()
+	unconf := e.unconfirmed()
+	for blocks = target; blocks <= FEE_EST_MAX_TARGET; blocks++ {
+		if spb = e.estimateFee(blocks, conservative, unconf); spb > 0 {
+			return
+		}
+	}
+	blocks = 0
+	return
+}
+
+// Save stores the stats in the given file.
+func (e *FeeEstimator) Save(fn string) (er error) {
+	var f *os.File
+	if f, er = os.Create(fn); er != nil {
+		return
+	}
+	buf := bufio.NewWriter(f)
+	e.Lock()
+	er = gob.NewEncoder(buf).Encode(&e.FeeEstimatorStats)
+	e.Unlock()
+	if er == nil {
+		er = buf.Flush()
+	}
+	f.Close()
+	return
+}
+
+// Load restores the stats from the given file.
+// The file is ignored if it has been made for different buckets or targets.
+func (e *FeeEstimator) Load(fn string) (er error) {
+	var f *os.File
+	if f, er = os.Open(fn); er != nil {
+		return
+	}
+	defer f.Close()
+	var st FeeEstimatorStats
+	if er = gob.NewDecoder(bufio.NewReader(f)).Decode(&st); er != nil {
+		return
+	}
+	if len(st.Buckets) != len(e.Buckets) || len(st.TxCnt) != len(e.Buckets) || len(st.FeeSum) != len(e.Buckets) ||
+		len(st.Conf) != FEE_EST_MAX_TARGET || len(st.Fail) != FEE_EST_MAX_TARGET {
+		return errors.New("fee estimates file does not match the current buckets")
+	}
+	for t := range st.Conf {
+		if len(st.Conf[t]) != len(e.Buckets) || len(st.Fail[t]) != len(e.Buckets) {
+			return errors.New("fee estimates file is corrupt")
+		}
+	}
+	e.Lock()
+	e.FeeEstimatorStats = st
+	e.Unlock()
+	return
+}
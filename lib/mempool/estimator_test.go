@@ -0,0 +1,114 @@
+package mempool
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// estTx makes a mempool record paying the given fee rate (SPB).
+func estTx(id uint32, spb float64) *OneTxToSend {
+	var po btc.TxPrevOut
+	po.Vout = id
+	tx := testTx([]btc.TxPrevOut{po}, 1e6)
+	return &OneTxToSend{Tx: tx, Fee: uint64(spb * float64(tx.VSize()))}
+}
+
+// feedEstimator simulates blocks where fast txs confirm in the next block and slow ones after 10 blocks.
+// If expire_every is not zero, every n-th slow tx gets removed instead of being mined.
+func feedEstimator(e *FeeEstimator, blocks int, fast_spb, slow_spb float64, expire_every int) {
+	var id uint32
+	var slow [][]*OneTxToSend
+	for h := uint32(1000); h < 1000+uint32(blocks); h++ {
+		e.ProcessBlock(h)
+		if len(slow) >= 10 {
+			for i, t2s := range slow[0] {
+				if expire_every != 0 && i%expire_every == 0 {
+					e.TxRemoved(t2s)
+				} else {
+					e.TxMined(t2s, h)
+				}
+			}
+			slow = slow[1:]
+		}
+		var fast, ss []*OneTxToSend
+		for i := 0; i < 5; i++ {
+			id++
+			t2s := estTx(id, fast_spb)
+			e.TxAdded(t2s)
+			fast = append(fast, t2s)
+			id++
+			t2s = estTx(id, slow_spb)
+			e.TxAdded(t2s)
+			ss = append(ss, t2s)
+		}
+		slow = append(slow, ss)
+		e.ProcessBlock(h + 1)
+		for _, t2s := range fast {
+			e.TxMined(t2s, h+1)
+		}
+	}
+}
+
+func TestFeeEstimator(t *testing.T) {
+	e := NewFeeEstimator()
+	if spb, blocks := e.EstimateSmartFee(2, false); spb != 0 || blocks != 0 {
+		t.Error("Estimate without data", spb, blocks)
+	}
+
+	feedEstimator(e, 500, 50, 5, 0)
+
+	if spb := e.EstimateFee(1, false); math.Abs(spb-50) > 1 {
+		t.Error("Bad estimate for 1 block:", spb)
+	}
+	if spb := e.EstimateFee(12, false); math.Abs(spb-5) > 0.1 {
+		t.Error("Bad estimate for 12 blocks:", spb)
+	}
+	if spb, blocks := e.EstimateSmartFee(6, false); math.Abs(spb-50) > 1 || blocks != 6 {
+		t.Error("Bad smart estimate for 6 blocks:", spb, blocks)
+	}
+	if e.Tracked() != 50 {
+		t.Error("Bad number of tracked txs:", e.Tracked())
+	}
+
+	if spb := e.EstimateFee(10, false); math.Abs(spb-5) > 0.1 {
+		t.Error("Bad estimate for 10 blocks:", spb)
+	}
+
+	// now every fifth slow tx leaves the mempool unconfirmed, which makes the slow bucket fail
+	e = NewFeeEstimator()
+	feedEstimator(e, 500, 50, 5, 5)
+	if spb := e.EstimateFee(10, false); math.Abs(spb-50) > 1 {
+		t.Error("Bad estimate with failures:", spb)
+	}
+}
+
+func TestFeeEstimatorSaveLoad(t *testing.T) {
+	e := NewFeeEstimator()
+	feedEstimator(e, 300, 20, 2, 0)
+	fn := filepath.Join(t.TempDir(), "fee_estimates.dat")
+	if er := e.Save(fn); er != nil {
+		t.Fatal(er)
+	}
+
+	e2 := NewFeeEstimator()
+	if er := e2.Load(fn); er != nil {
+		t.Fatal(er)
+	}
+	if e2.Height != e.Height {
+		t.Error("Bad height after load", e2.Height, e.Height)
+	}
+	for _, target := range []int{1, 5, 20, 100} {
+		if a, b := e.EstimateFee(target, true), e2.EstimateFee(target, true); math.Abs(a-b) > 1e-9 {
+			t.Error("Different estimate after load", target, a, b)
+		}
+	}
+
+	os.WriteFile(fn, []byte("garbage"), 0600)
+	if er := NewFeeEstimator().Load(fn); er == nil {
+		t.Error("Garbage file loaded")
+	}
+}
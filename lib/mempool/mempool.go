@@ -0,0 +1,490 @@
+// Package mempool keeps the transactions that have not been mined yet,
+// along with the ones that have been rejected and the ones waiting for their inputs.
+// It does not know anything about the network - the UTXO set comes via UtxoView,
+// the acceptance rules can be tuned with Policy and the user gets notified via callbacks.
+package mempool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+const (
+	TX_REJECTED_DISABLED = 1
+
+	TX_REJECTED_TOO_BIG      = 101
+	TX_REJECTED_FORMAT       = 102
+	TX_REJECTED_LEN_MISMATCH = 103
+	TX_REJECTED_EMPTY_INPUT  = 104
+
+	TX_REJECTED_OVERSPEND   = 154
+	TX_REJECTED_SCRIPT_FAIL = 155 // only returned by Accept - such txs are not put on the rejected list
+	TX_REJECTED_BAD_INPUT   = 157
+	TX_REJECTED_CONFLICT    = 158 // only returned by TestAccept - the tx spends the same input as another package member
+	TX_REJECTED_ORPHAN_MAX  = 159 // only returned by Accept - missing inputs, but the peer has too many such txs already
+
+	// Anything from the list below might eventually get mined
+	TX_REJECTED_NO_TXOU     = 202
+	TX_REJECTED_LOW_FEE     = 205
+	TX_REJECTED_NOT_MINED   = 208
+	TX_REJECTED_CB_INMATURE = 209
+	TX_REJECTED_RBF_LOWFEE  = 210
+	TX_REJECTED_RBF_FINAL   = 211
+	TX_REJECTED_RBF_100     = 212
+	TX_REJECTED_REPLACED    = 213
+	TX_REJECTED_CHAIN_LIMIT = 214
+	TX_REJECTED_IN_MEMPOOL  = 215 // only returned by TestAccept
+	TX_REJECTED_TRUC_VER    = 216 // TRUC (v3) tx spending an unconfirmed non-TRUC one, or the other way around
+	TX_REJECTED_TRUC_LIMIT  = 217 // TRUC tx with more than one unconfirmed ancestor or descendant
+	TX_REJECTED_TRUC_SIZE   = 218 // TRUC tx (or TRUC child) too big
+)
+
+const (
+	TRUC_VERSION         = 3
+	TRUC_MAX_VSIZE       = 10000 // of any TRUC tx
+	TRUC_CHILD_MAX_VSIZE = 1000  // of a TRUC tx with an unconfirmed parent
+)
+
+type BIDX [btc.Uint256IdxLen]byte
+
+// UtxoView gives the mempool access to the confirmed coins.
+type UtxoView interface {
+	UnspentGet(po *btc.TxPrevOut) *btc.TxOut
+	Height() uint32 // height of the current top block
+}
+
+// Policy decides which transactions get into the pool. All the hooks are optional.
+type Policy struct {
+	MinFeePerKB    func() uint64                 // minimum fee per 1000 vbytes (default 0)
+	SetMinFeePerKB func(uint64) bool             // called by LimitPoolSize, shall return true if the value has changed
+	AllowMemInputs func() bool                   // accept txs spending unconfirmed outputs (default true)
+	MaxPoolSize    func() uint64                 // in bytes of raw txs (default 0 - no limit)
+	RejectedLimits func() (size uint64, cnt int) // for the rejected list (default 0, 0 - no limits)
+
+	// PackageLimits returns the maximum number and total vsize of in-mempool ancestors
+	// and descendants (each including the tx itself) of any tx (default all 0 - no limits).
+	PackageLimits func() (anc_cnt int, anc_size uint64, desc_cnt int, desc_size uint64)
+
+	// OrphanLimits returns the limits for the txs waiting for inputs: the maximum number and
+	// total size of the ones from a single peer, the maximum number of all of them and
+	// how long they can wait (default all 0 - no limits).
+	OrphanLimits func() (peer_cnt int, peer_size uint64, max_cnt int, expire time.Duration)
+
+	// FullRBF allows replacing txs that do not signal BIP125 replaceability (default false).
+	FullRBF func() bool
+
+	// TRUC applies the topology rules of BIP431 to version 3 txs, which makes them
+	// always replaceable, also by a sibling (default false - v3 txs are treated like any other).
+	TRUC func() bool
+
+	// CheckTx, if set, gets called for each tx before its inputs are looked at.
+	// A non-zero value rejects the tx with this reason.
+	CheckTx func(tx *btc.Tx) byte
+
+	VerifyFlags uint32 // for the scripts of non-trusted txs (default script.STANDARD_VERIFY_FLAGS)
+}
+
+type OneTxToSend struct {
+	Invsentcnt, SentCnt uint32
+	Firstseen, Lastsent time.Time
+	Local               bool
+	Spent               []uint64 // Which records in SpentOutputs this TX added
+	Volume, Fee         uint64
+	*btc.Tx
+	Blocked     byte   // if non-zero, it gives you the reason why this tx nas not been routed
+	MemInputs   []bool // transaction is spending inputs from other unconfirmed tx(s)
+	MemInputCnt int
+	SigopsCost  uint64
+	Final       bool // if true RFB will not work on it
+	VerifyTime  time.Duration
+	FeeDelta    int64 // set by Prioritise - affects the block templates and eviction (see ModFee)
+}
+
+// OneFeeDelta is a fee delta set by Prioritise.
+type OneFeeDelta struct {
+	Id    *btc.Uint256
+	Delta int64
+}
+
+type OneTxRejected struct {
+	Id    *btc.Uint256
+	Wtxid *btc.Uint256 // only set for SegWit txs
+	time.Time
+	Size     uint32
+	Reason   byte
+	Waiting4 *btc.Uint256
+	From     uint32 // for the txs waiting for inputs: the peer they came from (see AcceptOpts.From)
+	*btc.Tx
+}
+
+type OneWaitingList struct {
+	TxID  *btc.Uint256
+	TxLen uint32
+	Ids   map[BIDX]time.Time // List of pending tx ids
+}
+
+// Mempool must be locked when accessing any of its fields,
+// or calling any of its methods that do not lock it by themselves.
+type Mempool struct {
+	sync.Mutex
+
+	// The actual memory pool:
+	TransactionsToSend       map[BIDX]*OneTxToSend
+	TransactionsToSendSize   uint64
+	TransactionsToSendWeight uint64
+
+	// Maps wtxid to txid, for the SegWit txs in TransactionsToSend (BIP339):
+	WTxIDsToSend map[BIDX]BIDX
+
+	// All the outputs that are currently spent in TransactionsToSend:
+	SpentOutputs map[uint64]BIDX
+
+	// Transactions that we downloaded, but rejected:
+	TransactionsRejected     map[BIDX]*OneTxRejected
+	TransactionsRejectedSize uint64 // only include those that have *Tx pointer set
+
+	// Maps wtxid to txid, for the SegWit txs in TransactionsRejected:
+	WTxIDsRejected map[BIDX]BIDX
+
+	// Transactions that are waiting for inputs:
+	WaitingForInputs     map[BIDX]*OneWaitingList
+	WaitingForInputsSize uint64
+
+	// Number and size of the txs waiting for inputs (orphans), in total and per peer they came from:
+	OrphansCnt     int
+	OrphansSize    uint64
+	OrphansPerPeer map[uint32]*OnePeerOrphans
+
+	View   UtxoView
+	Policy Policy
+
+	// Fee deltas set by Prioritise. They are not removed by Clear - only when the tx gets mined.
+	FeeDeltas map[BIDX]*OneFeeDelta
+
+	minFeeBumped   time.Time // when LimitPoolSize last raised the minimum fee (zero if it is back at the floor)
+	blockSinceBump bool      // a block has been mined since then, so the minimum fee can start decaying
+
+	// The callbacks below are called with the mempool locked, so they must not lock it again.
+	OnAdded    func(t2s *OneTxToSend)
+	OnRemoved  func(t2s *OneTxToSend, reason byte) // expired, conflicting or removed on request
+	OnReplaced func(old, t2s *OneTxToSend)         // old has been replaced by t2s (RBF)
+	OnMined    func(t2s *OneTxToSend, bl *btc.Block)
+
+	// RetryTx, if set, is used to resubmit txs whose missing inputs have just appeared.
+	// By default they go through Accept(tx, AcceptOpts{Retry: true}).
+	// It is called with the mempool unlocked.
+	RetryTx func(tx *btc.Tx) bool
+
+	// Counter, if set, gets called to count various events (i.e. "TxAccepted", "TxRejectedLowFee")
+	Counter func(name string, val uint64)
+}
+
+// New returns an empty mempool that will look for confirmed inputs in the given view.
+func New(view UtxoView, policy Policy) (mp *Mempool) {
+	mp = &Mempool{View: view, Policy: policy}
+	mp.FeeDeltas = make(map[BIDX]*OneFeeDelta)
+	mp.Clear()
+	return
+}
+
+// Clear removes all the transactions (also the rejected and the waiting ones).
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) Clear() {
+	mp.TransactionsToSend = make(map[BIDX]*OneTxToSend)
+	mp.TransactionsToSendSize = 0
+	mp.TransactionsToSendWeight = 0
+	mp.WTxIDsToSend = make(map[BIDX]BIDX)
+	mp.SpentOutputs = make(map[uint64]BIDX)
+	mp.TransactionsRejected = make(map[BIDX]*OneTxRejected)
+	mp.TransactionsRejectedSize = 0
+	mp.WTxIDsRejected = make(map[BIDX]BIDX)
+	mp.WaitingForInputs = make(map[BIDX]*OneWaitingList)
+	mp.WaitingForInputsSize = 0
+	mp.OrphansCnt = 0
+	mp.OrphansSize = 0
+	mp.OrphansPerPeer = make(map[uint32]*OnePeerOrphans)
+}
+
+func (mp *Mempool) count(name string) {
+	if mp.Counter != nil {
+		mp.Counter(name, 1)
+	}
+}
+
+func (mp *Mempool) countAdd(name string, val uint64) {
+	if mp.Counter != nil {
+		mp.Counter(name, val)
+	}
+}
+
+func (mp *Mempool) minFeePerKB() uint64 {
+	if mp.Policy.MinFeePerKB != nil {
+		return mp.Policy.MinFeePerKB()
+	}
+	return 0
+}
+
+func (mp *Mempool) setMinFeePerKB(val uint64) bool {
+	if mp.Policy.SetMinFeePerKB != nil {
+		return mp.Policy.SetMinFeePerKB(val)
+	}
+	return false
+}
+
+func (mp *Mempool) allowMemInputs() bool {
+	return mp.Policy.AllowMemInputs == nil || mp.Policy.AllowMemInputs()
+}
+
+func (mp *Mempool) maxPoolSize() uint64 {
+	if mp.Policy.MaxPoolSize != nil {
+		return mp.Policy.MaxPoolSize()
+	}
+	return 0
+}
+
+func (mp *Mempool) fullRBF() bool {
+	return mp.Policy.FullRBF != nil && mp.Policy.FullRBF()
+}
+
+func (mp *Mempool) truc() bool {
+	return mp.Policy.TRUC != nil && mp.Policy.TRUC()
+}
+
+// isTRUC returns true if the tx is subject to the TRUC rules.
+func (mp *Mempool) isTRUC(tx *btc.Tx) bool {
+	return tx.Version == TRUC_VERSION && mp.truc()
+}
+
+// replaceable returns true if the tx can be replaced by a conflicting one.
+func (mp *Mempool) replaceable(t2s *OneTxToSend) bool {
+	return !t2s.Final || mp.fullRBF() || mp.isTRUC(t2s.Tx)
+}
+
+func (mp *Mempool) verifyFlags() uint32 {
+	if mp.Policy.VerifyFlags != 0 {
+		return mp.Policy.VerifyFlags
+	}
+	return script.STANDARD_VERIFY_FLAGS
+}
+
+func ReasonToString(reason byte) string {
+	switch reason {
+	case 0:
+		return ""
+	case TX_REJECTED_DISABLED:
+		return "RELAY_OFF"
+	case TX_REJECTED_TOO_BIG:
+		return "TOO_BIG"
+	case TX_REJECTED_FORMAT:
+		return "FORMAT"
+	case TX_REJECTED_LEN_MISMATCH:
+		return "LEN_MISMATCH"
+	case TX_REJECTED_EMPTY_INPUT:
+		return "EMPTY_INPUT"
+	case TX_REJECTED_OVERSPEND:
+		return "OVERSPEND"
+	case TX_REJECTED_SCRIPT_FAIL:
+		return "SCRIPT_FAIL"
+	case TX_REJECTED_BAD_INPUT:
+		return "BAD_INPUT"
+	case TX_REJECTED_CONFLICT:
+		return "CONFLICT"
+	case TX_REJECTED_ORPHAN_MAX:
+		return "ORPHAN_MAX"
+	case TX_REJECTED_NO_TXOU:
+		return "NO_TXOU"
+	case TX_REJECTED_LOW_FEE:
+		return "LOW_FEE"
+	case TX_REJECTED_NOT_MINED:
+		return "NOT_MINED"
+	case TX_REJECTED_CB_INMATURE:
+		return "CB_INMATURE"
+	case TX_REJECTED_RBF_LOWFEE:
+		return "RBF_LOWFEE"
+	case TX_REJECTED_RBF_FINAL:
+		return "RBF_FINAL"
+	case TX_REJECTED_RBF_100:
+		return "RBF_100"
+	case TX_REJECTED_REPLACED:
+		return "REPLACED"
+	case TX_REJECTED_CHAIN_LIMIT:
+		return "CHAIN_LIMIT"
+	case TX_REJECTED_IN_MEMPOOL:
+		return "IN_MEMPOOL"
+	case TX_REJECTED_TRUC_VER:
+		return "TRUC_VERSION"
+	case TX_REJECTED_TRUC_LIMIT:
+		return "TRUC_LIMIT"
+	case TX_REJECTED_TRUC_SIZE:
+		return "TRUC_SIZE"
+	}
+	return fmt.Sprint("UNKNOWN_", reason)
+}
+
+// WitnessDependentReason returns true if the given reject reason might have been
+// caused by the witness data only, so a tx with the same txid but a different
+// witness may still get accepted.
+func WitnessDependentReason(reason byte) bool {
+	switch reason {
+	case TX_REJECTED_TOO_BIG, TX_REJECTED_LOW_FEE, TX_REJECTED_RBF_LOWFEE:
+		return true
+	}
+	return false
+}
+
+// TxByWTxID returns the mempool record of a tx with the given wtxid, or nil if not found.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) TxByWTxID(wtxid BIDX) *OneTxToSend {
+	if txid, ok := mp.WTxIDsToSend[wtxid]; ok {
+		return mp.TransactionsToSend[txid]
+	}
+	if t2s := mp.TransactionsToSend[wtxid]; t2s != nil && t2s.SegWit == nil {
+		return t2s
+	}
+	return nil
+}
+
+// RejectedByWTxID returns the rejected record, only if it still has the tx data.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) RejectedByWTxID(wtxid BIDX) *OneTxRejected {
+	txid, ok := mp.WTxIDsRejected[wtxid]
+	if !ok {
+		txid = wtxid
+	}
+	if rej := mp.TransactionsRejected[txid]; rej != nil && rej.Tx != nil && rej.Tx.WTxID().BIdx() == wtxid {
+		return rej
+	}
+	return nil
+}
+
+// RejectTx adds a transaction to the rejected list.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) RejectTx(tx *btc.Tx, why byte) *OneTxRejected {
+	rec := new(OneTxRejected)
+	rec.Time = time.Now()
+	rec.Size = uint32(len(tx.Raw))
+	rec.Reason = why
+
+	// TODO: only store tx for selected reasons
+	if why >= 200 {
+		rec.Tx = tx
+		rec.Id = &tx.Hash
+		mp.TransactionsRejectedSize += uint64(rec.Size)
+	} else {
+		rec.Id = new(btc.Uint256)
+		rec.Id.Hash = tx.Hash.Hash
+	}
+
+	bidx := tx.Hash.BIdx()
+	if _, ok := mp.TransactionsRejected[bidx]; ok {
+		mp.DeleteRejected(bidx) // so it does not get counted twice
+	}
+	if tx.SegWit != nil {
+		rec.Wtxid = new(btc.Uint256)
+		rec.Wtxid.Hash = tx.WTxID().Hash
+		mp.WTxIDsRejected[rec.Wtxid.BIdx()] = bidx
+	}
+	mp.TransactionsRejected[bidx] = rec
+
+	return rec
+}
+
+// DeleteRejected removes the tx from the rejected list (and from the waiting list).
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) DeleteRejected(bidx BIDX) {
+	if tr, ok := mp.TransactionsRejected[bidx]; ok {
+		if tr.Waiting4 != nil {
+			w4i, _ := mp.WaitingForInputs[tr.Waiting4.BIdx()]
+			delete(w4i.Ids, bidx)
+			if len(w4i.Ids) == 0 {
+				mp.WaitingForInputsSize -= uint64(w4i.TxLen)
+				delete(mp.WaitingForInputs, tr.Waiting4.BIdx())
+			}
+			mp.orphanGone(tr)
+		}
+		if tr.Tx != nil {
+			mp.TransactionsRejectedSize -= uint64(tr.Size)
+		}
+		if tr.Wtxid != nil {
+			delete(mp.WTxIDsRejected, tr.Wtxid.BIdx())
+		}
+		delete(mp.TransactionsRejected, bidx)
+	}
+}
+
+// CheckTrusted can be used as chain.TrustedTxChecker.
+// It returns true if the same tx (including its witness) has been verified by the mempool.
+func (mp *Mempool) CheckTrusted(tx *btc.Tx) bool {
+	mp.Lock()
+	rec, ok := mp.TransactionsToSend[tx.Hash.BIdx()]
+	mp.Unlock()
+	if ok && rec.Local {
+		mp.count("TxScrOwn")
+		return false // Assume own txs as non-trusted
+	}
+	if ok {
+		ok = tx.WTxID().Equal(rec.WTxID())
+		if !ok {
+			mp.count("TxScrSWErr")
+		}
+	}
+	if ok {
+		mp.count("TxScrBoosted")
+	} else {
+		mp.count("TxScrMissed")
+	}
+	return ok
+}
+
+// Prioritise adds the delta to the fee of the given tx, as seen by the block templates and eviction.
+// The tx does not need to be in the pool (yet). Make sure to call it with the mempool locked.
+func (mp *Mempool) Prioritise(txid *btc.Uint256, delta int64) {
+	bidx := txid.BIdx()
+	fd := mp.FeeDeltas[bidx]
+	if fd == nil {
+		fd = &OneFeeDelta{Id: new(btc.Uint256)}
+		fd.Id.Hash = txid.Hash
+		mp.FeeDeltas[bidx] = fd
+	}
+	fd.Delta += delta
+	if fd.Delta == 0 {
+		delete(mp.FeeDeltas, bidx)
+	}
+	if t2s := mp.TransactionsToSend[bidx]; t2s != nil {
+		t2s.FeeDelta = fd.Delta
+	}
+}
+
+// addDelta returns the fee modified by the delta (never below zero).
+func addDelta(fee uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > fee {
+		return 0
+	}
+	return uint64(int64(fee) + delta)
+}
+
+// ModFee returns the fee modified by FeeDelta.
+func (tx *OneTxToSend) ModFee() uint64 {
+	return addDelta(tx.Fee, tx.FeeDelta)
+}
+
+func (rec *OneTxToSend) IIdx(key uint64) int {
+	for i, o := range rec.TxIn {
+		if o.Input.UIdx() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (tx *OneTxToSend) SPW() float64 {
+	return float64(tx.Fee) / float64(tx.Weight())
+}
+
+func (tx *OneTxToSend) SPB() float64 {
+	return tx.SPW() * 4.0
+}
@@ -0,0 +1,417 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// testView is a UTXO set kept in a map.
+type testView struct {
+	outs   map[btc.TxPrevOut]*btc.TxOut
+	height uint32
+}
+
+func (v *testView) UnspentGet(po *btc.TxPrevOut) *btc.TxOut {
+	return v.outs[*po]
+}
+
+func (v *testView) Height() uint32 {
+	return v.height
+}
+
+// coin adds a confirmed OP_TRUE output to the view.
+func (v *testView) coin(id byte, value uint64) btc.TxPrevOut {
+	var po btc.TxPrevOut
+	po.Hash[0], po.Hash[31] = id, 0xcc
+	v.outs[po] = &btc.TxOut{Value: value, Pk_script: []byte{0x51}, BlockHeight: 1}
+	return po
+}
+
+// testTx makes a replaceable tx spending the given inputs to OP_TRUE outputs of the given values.
+func testTx(ins []btc.TxPrevOut, outs ...uint64) *btc.Tx {
+	return testTxExt(1, 0xfffffffd, ins, outs...)
+}
+
+// testTxExt is like testTx, but with the given version and the inputs' sequence.
+func testTxExt(version, sequence uint32, ins []btc.TxPrevOut, outs ...uint64) *btc.Tx {
+	var b [8]byte
+	raw := new(bytes.Buffer)
+	binary.LittleEndian.PutUint32(b[:4], version)
+	raw.Write(b[:4])
+	btc.WriteVlen(raw, uint64(len(ins)))
+	for _, in := range ins {
+		raw.Write(in.Hash[:])
+		binary.LittleEndian.PutUint32(b[:4], in.Vout)
+		raw.Write(b[:4])
+		raw.WriteByte(0)
+		binary.LittleEndian.PutUint32(b[:4], sequence)
+		raw.Write(b[:4])
+	}
+	btc.WriteVlen(raw, uint64(len(outs)))
+	for _, val := range outs {
+		binary.LittleEndian.PutUint64(b[:], val)
+		raw.Write(b[:])
+		raw.Write([]byte{1, 0x51})
+	}
+	raw.Write([]byte{0, 0, 0, 0})
+	tx, _ := btc.NewTx(raw.Bytes())
+	tx.SetHash(raw.Bytes())
+	return tx
+}
+
+func out(tx *btc.Tx, vout uint32) []btc.TxPrevOut {
+	return []btc.TxPrevOut{{Hash: tx.Hash.Hash, Vout: vout}}
+}
+
+func testPool(t *testing.T) (mp *Mempool, view *testView) {
+	view = &testView{outs: make(map[btc.TxPrevOut]*btc.TxOut), height: 1000}
+	mp = New(view, Policy{MinFeePerKB: func() uint64 { return 1000 }})
+	t.Cleanup(func() {
+		mp.Lock()
+		if mp.Check() {
+			t.Error("Mempool inconsistent")
+		}
+		mp.Unlock()
+	})
+	return
+}
+
+func TestAccept(t *testing.T) {
+	mp, view := testPool(t)
+	var added []*OneTxToSend
+	mp.OnAdded = func(t2s *OneTxToSend) { added = append(added, t2s) }
+
+	tx := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-1000)
+	rec, reason := mp.Accept(tx, AcceptOpts{})
+	if rec == nil {
+		t.Fatal("Tx not accepted:", ReasonToString(reason))
+	}
+	if rec.Fee != 1000 || rec.Volume != 1e6 || rec.MemInputs != nil {
+		t.Error("Bad record", rec.Fee, rec.Volume)
+	}
+	if len(added) != 1 || added[0] != rec {
+		t.Error("OnAdded not called")
+	}
+	if mp.TransactionsToSendSize != uint64(len(tx.Raw)) || len(mp.SpentOutputs) != 1 {
+		t.Error("Bad pool stats", mp.TransactionsToSendSize, len(mp.SpentOutputs))
+	}
+
+	// a child spending from the mempool
+	child, reason := mp.Accept(testTx(out(tx, 0), 1e6-2000), AcceptOpts{})
+	if child == nil {
+		t.Fatal("Child not accepted:", ReasonToString(reason))
+	}
+	if child.MemInputCnt != 1 || !child.MemInputs[0] {
+		t.Error("Child's MemInputs not set")
+	}
+	if len(mp.GetChildren(rec)) != 1 || len(mp.GetAllParents(child)) != 1 {
+		t.Error("Bad parent/child relations")
+	}
+
+	for _, c := range []struct {
+		tx     *btc.Tx
+		reason byte
+	}{
+		{testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6+1), TX_REJECTED_OVERSPEND},
+		{testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 1e6-10), TX_REJECTED_LOW_FEE},
+		{testTx(out(tx, 5), 1000), TX_REJECTED_BAD_INPUT},
+	} {
+		if rec, reason := mp.Accept(c.tx, AcceptOpts{}); rec != nil || reason != c.reason {
+			t.Error("Expected", ReasonToString(c.reason), "got", ReasonToString(reason))
+		}
+		if _, ok := mp.TransactionsRejected[c.tx.Hash.BIdx()]; !ok {
+			t.Error("Tx not on the rejected list", ReasonToString(c.reason))
+		}
+	}
+
+	// own txs do not need to pay the fee
+	if rec, _ := mp.Accept(testTx([]btc.TxPrevOut{view.coin(4, 1e6)}, 1e6), AcceptOpts{Local: true}); rec == nil {
+		t.Error("Local tx not accepted")
+	}
+
+	// immature coinbase
+	po := view.coin(5, 1e6)
+	view.outs[po].WasCoinbase = true
+	view.outs[po].BlockHeight = view.height - 10
+	if _, reason := mp.Accept(testTx([]btc.TxPrevOut{po}, 1e5), AcceptOpts{}); reason != TX_REJECTED_CB_INMATURE {
+		t.Error("Inmature coinbase spent", ReasonToString(reason))
+	}
+
+	// extra policy
+	mp.Policy.CheckTx = func(tx *btc.Tx) byte { return TX_REJECTED_FORMAT }
+	if _, reason := mp.Accept(testTx([]btc.TxPrevOut{view.coin(6, 1e6)}, 1e5), AcceptOpts{}); reason != TX_REJECTED_FORMAT {
+		t.Error("Policy.CheckTx ignored")
+	}
+	mp.Policy.CheckTx = nil
+	mp.Policy.AllowMemInputs = func() bool { return false }
+	if _, reason := mp.Accept(testTx(out(child.Tx, 0), 1e5), AcceptOpts{}); reason != TX_REJECTED_NOT_MINED {
+		t.Error("Mem input accepted", ReasonToString(reason))
+	}
+}
+
+func TestWaitingForInputs(t *testing.T) {
+	mp, view := testPool(t)
+	parent := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 5e5, 4e5)
+	child := testTx(out(parent, 1), 3e5)
+
+	if rec, reason := mp.Accept(child, AcceptOpts{}); rec != nil || reason != TX_REJECTED_NO_TXOU {
+		t.Fatal("Orphan not rejected", ReasonToString(reason))
+	}
+	if wtg := mp.WaitingForInputs[parent.Hash.BIdx()]; wtg == nil || len(wtg.Ids) != 1 {
+		t.Fatal("Orphan not waiting for its parent")
+	}
+
+	var retried int
+	mp.OnAdded = func(t2s *OneTxToSend) {
+		if t2s.Tx == child {
+			retried++
+		}
+	}
+	if rec, _ := mp.Accept(parent, AcceptOpts{}); rec == nil {
+		t.Fatal("Parent not accepted")
+	}
+	if retried != 1 || mp.TransactionsToSend[child.Hash.BIdx()] == nil {
+		t.Error("Orphan not accepted after its parent")
+	}
+	if len(mp.WaitingForInputs) != 0 || len(mp.TransactionsRejected) != 0 || mp.WaitingForInputsSize != 0 {
+		t.Error("Waiting list not cleaned up")
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	mp, view := testPool(t)
+	coin := view.coin(1, 1e6)
+	tx := testTx([]btc.TxPrevOut{coin}, 1e6-1000)
+	child := testTx(out(tx, 0), 1e6-2000)
+	mp.Accept(tx, AcceptOpts{})
+	mp.Accept(child, AcceptOpts{})
+
+	if _, reason := mp.Accept(testTx([]btc.TxPrevOut{coin}, 1e6-900), AcceptOpts{}); reason != TX_REJECTED_RBF_LOWFEE {
+		t.Error("Replacement not paying more accepted", ReasonToString(reason))
+	}
+
+	var replaced []*OneTxToSend
+	var by *OneTxToSend
+	mp.OnReplaced = func(old, t2s *OneTxToSend) {
+		replaced = append(replaced, old)
+		by = t2s
+	}
+	rbf, reason := mp.Accept(testTx([]btc.TxPrevOut{coin}, 1e6-5000), AcceptOpts{})
+	if rbf == nil {
+		t.Fatal("Replacement not accepted", ReasonToString(reason))
+	}
+	if len(replaced) != 2 || by != rbf {
+		t.Error("OnReplaced not called properly", len(replaced))
+	}
+	if len(mp.TransactionsToSend) != 1 || mp.TransactionsRejected[child.Hash.BIdx()].Reason != TX_REJECTED_REPLACED {
+		t.Error("Replaced txs not removed")
+	}
+}
+
+func TestBlockMined(t *testing.T) {
+	mp, view := testPool(t)
+	tx := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 5e5, 4e5)
+	child := testTx(out(tx, 0), 4e5)
+	conflict := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 9e5)
+	waiting := testTx(out(conflict, 0), 8e5) // waits for a tx that gets mined
+
+	for _, tx := range []*btc.Tx{tx, child, conflict} {
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted", ReasonToString(reason))
+		}
+	}
+	mp.Lock()
+	mp.DeleteTx(mp.TransactionsToSend[conflict.Hash.BIdx()], true, 0)
+	mp.Unlock()
+	mp.Accept(waiting, AcceptOpts{})
+
+	var mined, removed int
+	mp.OnMined = func(t2s *OneTxToSend, bl *btc.Block) { mined++ }
+	mp.OnRemoved = func(t2s *OneTxToSend, reason byte) { removed++ }
+
+	// the block has tx, another spend of child's input and the tx the waiting one needs
+	other := testTx(out(tx, 0), 3e5)
+	view.outs[out(conflict, 0)[0]] = &btc.TxOut{Value: 9e5, Pk_script: []byte{0x51}}
+	mp.BlockMined(&btc.Block{Txs: []*btc.Tx{nil, tx, other, conflict}})
+
+	if mined != 1 || removed != 1 {
+		t.Error("Bad callbacks", mined, removed)
+	}
+	if len(mp.TransactionsToSend) != 1 || mp.TransactionsToSend[waiting.Hash.BIdx()] == nil {
+		t.Error("Bad pool content after the block", len(mp.TransactionsToSend))
+	}
+	if len(mp.WaitingForInputs) != 0 {
+		t.Error("Waiting list of a mined tx left")
+	}
+}
+
+func TestLimitPoolSize(t *testing.T) {
+	mp, view := testPool(t)
+	var min_fee uint64
+	mp.Policy.SetMinFeePerKB = func(v uint64) bool {
+		min_fee = v
+		return true
+	}
+	var removed int
+	mp.OnRemoved = func(t2s *OneTxToSend, reason byte) {
+		if reason == TX_REJECTED_LOW_FEE {
+			removed++
+		}
+	}
+	for i := 1; i <= 32; i++ {
+		tx := testTx([]btc.TxPrevOut{view.coin(byte(i), 1e6)}, 1e6-uint64(1000*i))
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted", ReasonToString(reason))
+		}
+	}
+
+	size := mp.TransactionsToSendSize
+	mp.Lock()
+	mp.LimitPoolSize(size / 2)
+	mp.Unlock()
+	if removed < 16 || mp.TransactionsToSendSize > size/2 {
+		t.Error("Pool not trimmed", removed, mp.TransactionsToSendSize)
+	}
+	for _, t2s := range mp.TransactionsToSend {
+		if t2s.Fee < uint64(1000*removed) {
+			t.Error("Wrong tx evicted", t2s.Fee)
+		}
+	}
+	if min_fee == 0 {
+		t.Error("Minimum fee not raised")
+	}
+
+	sorted := mp.GetSortedMempoolNew()
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Fee > sorted[i-1].Fee {
+			t.Error("Mempool not sorted by fee")
+		}
+	}
+}
+
+func TestCheckTrusted(t *testing.T) {
+	mp, view := testPool(t)
+	tx := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 9e5)
+	if mp.CheckTrusted(tx) {
+		t.Error("Unknown tx trusted")
+	}
+	mp.Accept(tx, AcceptOpts{})
+	if !mp.CheckTrusted(tx) {
+		t.Error("Verified tx not trusted")
+	}
+	own := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 9e5)
+	mp.Accept(own, AcceptOpts{Local: true, Trusted: true})
+	if mp.CheckTrusted(own) {
+		t.Error("Own tx trusted")
+	}
+}
+
+func TestPackageLimits(t *testing.T) {
+	mp, view := testPool(t)
+	mp.Policy.PackageLimits = func() (int, uint64, int, uint64) { return 3, 0, 3, 0 }
+
+	a := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 4e5, 4e5)
+	b := testTx(out(a, 0), 3e5)
+	c := testTx(out(b, 0), 2e5)
+	for _, tx := range []*btc.Tx{a, b, c} {
+		if rec, reason := mp.Accept(tx, AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+
+	// too many ancestors
+	if rec, reason := mp.Accept(testTx(out(c, 0), 1e5), AcceptOpts{}); rec != nil || reason != TX_REJECTED_CHAIN_LIMIT {
+		t.Error("Too long chain accepted", ReasonToString(reason))
+	}
+	// too many descendants of a
+	if rec, reason := mp.Accept(testTx(out(a, 1), 3e5), AcceptOpts{}); rec != nil || reason != TX_REJECTED_CHAIN_LIMIT {
+		t.Error("Too many descendants accepted", ReasonToString(reason))
+	}
+
+	mp.Policy.PackageLimits = func() (int, uint64, int, uint64) { return 25, 0, 25, uint64(a.VSize() + b.VSize() + c.VSize()) }
+	if rec, reason := mp.Accept(testTx(out(a, 1), 3e5), AcceptOpts{}); rec != nil || reason != TX_REJECTED_CHAIN_LIMIT {
+		t.Error("Too big descendants package accepted", ReasonToString(reason))
+	}
+}
+
+func TestLimitPoolSizePackages(t *testing.T) {
+	mp, view := testPool(t)
+	min_fee := uint64(1000)
+	mp.Policy.MinFeePerKB = func() uint64 { return min_fee }
+	mp.Policy.SetMinFeePerKB = func(v uint64) bool {
+		if v < 1000 {
+			v = 1000
+		}
+		if v == min_fee {
+			return false
+		}
+		min_fee = v
+		return true
+	}
+
+	// a low fee parent with a high fee child
+	parent := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-100)
+	child := testTx(out(parent, 0), 1e6-100-50000)
+	mp.Accept(parent, AcceptOpts{Local: true})
+	mp.Accept(child, AcceptOpts{})
+	for i := 0; i < 4; i++ {
+		if rec, reason := mp.Accept(testTx([]btc.TxPrevOut{view.coin(byte(10+i), 1e6)}, 1e6-uint64(10000+1000*i)), AcceptOpts{}); rec == nil {
+			t.Fatal("Tx not accepted:", ReasonToString(reason))
+		}
+	}
+
+	mp.Lock()
+	mp.LimitPoolSize(mp.TransactionsToSendSize * 3 / 5) // enough room for three txs
+	mp.Unlock()
+	if len(mp.TransactionsToSend) != 3 {
+		t.Error("Bad number of txs left", len(mp.TransactionsToSend))
+	}
+	if _, ok := mp.TransactionsToSend[parent.Hash.BIdx()]; !ok {
+		t.Error("Low fee parent of a high fee child evicted")
+	}
+	if _, ok := mp.TransactionsToSend[child.Hash.BIdx()]; !ok {
+		t.Error("High fee child evicted")
+	}
+	bumped := min_fee
+	if bumped <= 1000+MIN_FEE_INCREMENT {
+		t.Fatal("Minimum fee not raised", bumped)
+	}
+
+	// no decay until a block is mined
+	mp.Lock()
+	mp.minFeeBumped = mp.minFeeBumped.Add(-MIN_FEE_HALFLIFE)
+	mp.LimitPoolSize(1e6)
+	mp.Unlock()
+	if min_fee != bumped {
+		t.Error("Minimum fee decayed before a block", min_fee)
+	}
+
+	// pool way below the limit, so a quarter of the half-life halves the fee
+	mp.BlockMined(&btc.Block{Txs: []*btc.Tx{nil}})
+	mp.Lock()
+	mp.minFeeBumped = time.Now().Add(-MIN_FEE_HALFLIFE / 4)
+	mp.LimitPoolSize(1e6)
+	mp.Unlock()
+	if min_fee > bumped/2+1 || min_fee < bumped/2-1 {
+		t.Error("Minimum fee not halved", bumped, min_fee)
+	}
+
+	// back at the floor, txs rejected for low fee are forgotten
+	mp.Lock()
+	mp.minFeeBumped = time.Now().Add(-10 * MIN_FEE_HALFLIFE)
+	mp.LimitPoolSize(1e6)
+	cnt := 0
+	for _, r := range mp.TransactionsRejected {
+		if r.Reason == TX_REJECTED_LOW_FEE {
+			cnt++
+		}
+	}
+	mp.Unlock()
+	if min_fee != 1000 || cnt != 0 {
+		t.Error("Minimum fee not back at the floor", min_fee, cnt)
+	}
+}
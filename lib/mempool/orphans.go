@@ -0,0 +1,137 @@
+package mempool
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// OnePeerOrphans keeps the number and the total size of the txs
+// waiting for inputs (orphans) that came from one peer.
+type OnePeerOrphans struct {
+	Cnt  int
+	Size uint64
+}
+
+func (mp *Mempool) orphanLimits() (peer_cnt int, peer_size uint64, max_cnt int, expire time.Duration) {
+	if mp.Policy.OrphanLimits != nil {
+		peer_cnt, peer_size, max_cnt, expire = mp.Policy.OrphanLimits()
+	}
+	return
+}
+
+// peerOrphansFull returns true if another orphan of the given size
+// would not fit into the limits of the peer.
+func (mp *Mempool) peerOrphansFull(from uint32, size int) bool {
+	po := mp.OrphansPerPeer[from]
+	if po == nil {
+		return false
+	}
+	peer_cnt, peer_size, _, _ := mp.orphanLimits()
+	return peer_cnt > 0 && po.Cnt >= peer_cnt || peer_size > 0 && po.Size+uint64(size) > peer_size
+}
+
+// orphanAdded accounts the new record waiting for inputs.
+func (mp *Mempool) orphanAdded(rec *OneTxRejected) {
+	mp.OrphansCnt++
+	mp.OrphansSize += uint64(rec.Size)
+	if rec.From != 0 {
+		po := mp.OrphansPerPeer[rec.From]
+		if po == nil {
+			po = new(OnePeerOrphans)
+			mp.OrphansPerPeer[rec.From] = po
+		}
+		po.Cnt++
+		po.Size += uint64(rec.Size)
+	}
+}
+
+// orphanGone reverts orphanAdded.
+func (mp *Mempool) orphanGone(rec *OneTxRejected) {
+	mp.OrphansCnt--
+	mp.OrphansSize -= uint64(rec.Size)
+	if po := mp.OrphansPerPeer[rec.From]; po != nil {
+		po.Cnt--
+		po.Size -= uint64(rec.Size)
+		if po.Cnt == 0 {
+			delete(mp.OrphansPerPeer, rec.From)
+		}
+	}
+}
+
+// MissingParents returns the txids of the tx's parents that are neither in the pool, nor confirmed.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) MissingParents(tx *btc.Tx) (res []*btc.Uint256) {
+	seen := make(map[BIDX]bool, len(tx.TxIn))
+	for i := range tx.TxIn {
+		inp := &tx.TxIn[i].Input
+		bidx := btc.BIdx(inp.Hash[:])
+		if seen[bidx] {
+			continue
+		}
+		seen[bidx] = true
+		if _, ok := mp.TransactionsToSend[bidx]; ok || mp.View.UnspentGet(inp) != nil {
+			continue
+		}
+		res = append(res, btc.NewUint256(inp.Hash[:]))
+	}
+	return
+}
+
+// orphans returns the keys of all the records waiting for inputs.
+func (mp *Mempool) orphans() (res []BIDX) {
+	res = make([]BIDX, 0, mp.OrphansCnt)
+	for k, rec := range mp.TransactionsRejected {
+		if rec.Waiting4 != nil {
+			res = append(res, k)
+		}
+	}
+	return
+}
+
+// limitOrphansCnt removes random orphans, if there are more of them than allowed.
+func (mp *Mempool) limitOrphansCnt() {
+	_, _, max_cnt, _ := mp.orphanLimits()
+	if max_cnt <= 0 || mp.OrphansCnt <= max_cnt {
+		return
+	}
+	ids := mp.orphans()
+	for _, i := range rand.Perm(len(ids)) {
+		mp.DeleteRejected(ids[i])
+		mp.count("TxOrphanEvicted")
+		if mp.OrphansCnt <= max_cnt {
+			break
+		}
+	}
+}
+
+// LimitOrphans removes the orphans that have been waiting for inputs for too long,
+// and then random ones, if there are still too many of them.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) LimitOrphans() {
+	if _, _, _, expire := mp.orphanLimits(); expire > 0 && mp.OrphansCnt > 0 {
+		old := time.Now().Add(-expire)
+		for _, k := range mp.orphans() {
+			if mp.TransactionsRejected[k].Time.Before(old) {
+				mp.DeleteRejected(k)
+				mp.count("TxOrphanExpired")
+			}
+		}
+	}
+	mp.limitOrphansCnt()
+}
+
+// DeletePeerOrphans removes all the orphans that came from the given peer.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) DeletePeerOrphans(from uint32) {
+	if _, ok := mp.OrphansPerPeer[from]; !ok {
+		return
+	}
+	for _, k := range mp.orphans() {
+		if mp.TransactionsRejected[k].From == from {
+			mp.DeleteRejected(k)
+			mp.count("TxOrphanPeerGone")
+		}
+	}
+}
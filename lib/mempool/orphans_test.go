@@ -0,0 +1,93 @@
+package mempool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestOrphans(t *testing.T) {
+	mp, view := testPool(t)
+	var max_cnt int
+	var expire time.Duration
+	mp.Policy.OrphanLimits = func() (int, uint64, int, time.Duration) { return 3, 1e6, max_cnt, expire }
+
+	// orphans from peer 1 until it hits its limit
+	var orphans []*btc.Tx
+	for i := 0; i < 4; i++ {
+		parent := testTx([]btc.TxPrevOut{view.coin(byte(i+1), 1e6)}, 1e6-1000)
+		orphans = append(orphans, testTx(out(parent, 0), 1e6-2000))
+	}
+	for i, tx := range orphans {
+		exp := byte(TX_REJECTED_NO_TXOU)
+		if i == 3 {
+			exp = TX_REJECTED_ORPHAN_MAX
+		}
+		if _, reason := mp.Accept(tx, AcceptOpts{From: 1}); reason != exp {
+			t.Error("Orphan", i, "expected", ReasonToString(exp), "got", ReasonToString(reason))
+		}
+	}
+	if po := mp.OrphansPerPeer[1]; po == nil || po.Cnt != 3 || mp.OrphansCnt != 3 {
+		t.Fatal("Bad orphans count")
+	}
+	if _, ok := mp.TransactionsRejected[orphans[3].Hash.BIdx()]; ok {
+		t.Error("Orphan above the limit stored")
+	}
+
+	// other peers are not affected
+	if _, reason := mp.Accept(orphans[3], AcceptOpts{From: 2}); reason != TX_REJECTED_NO_TXOU {
+		t.Error("Orphan from another peer not stored", ReasonToString(reason))
+	}
+
+	// random eviction above the total limit
+	max_cnt = 2
+	mp.Lock()
+	mp.LimitOrphans()
+	mp.Unlock()
+	if mp.OrphansCnt != 2 || len(mp.WaitingForInputs) != 2 {
+		t.Error("Orphans not evicted", mp.OrphansCnt)
+	}
+
+	// expiry
+	mp.Lock()
+	for _, rec := range mp.TransactionsRejected {
+		rec.Time = rec.Time.Add(-time.Hour)
+	}
+	expire = time.Minute
+	mp.LimitOrphans()
+	mp.Unlock()
+	if mp.OrphansCnt != 0 || mp.OrphansSize != 0 || len(mp.OrphansPerPeer) != 0 || len(mp.WaitingForInputs) != 0 {
+		t.Error("Orphans not expired", mp.OrphansCnt)
+	}
+
+	// all of the peer's orphans removed at once
+	expire = 0
+	mp.Accept(orphans[0], AcceptOpts{From: 1})
+	mp.Accept(orphans[1], AcceptOpts{From: 2})
+	mp.Lock()
+	mp.DeletePeerOrphans(1)
+	mp.Unlock()
+	if _, ok := mp.TransactionsRejected[orphans[1].Hash.BIdx()]; !ok || mp.OrphansCnt != 1 || mp.OrphansPerPeer[1] != nil {
+		t.Error("Bad orphans left after DeletePeerOrphans")
+	}
+}
+
+func TestMissingParents(t *testing.T) {
+	mp, view := testPool(t)
+	inmem := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-1000)
+	if _, reason := mp.Accept(inmem, AcceptOpts{}); reason != 0 {
+		t.Fatal("Parent not accepted", ReasonToString(reason))
+	}
+	unknown1 := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 5e5, 5e5-1000)
+	unknown2 := testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 1e6-1000)
+	ins := []btc.TxPrevOut{view.coin(4, 1e6), out(inmem, 0)[0], out(unknown1, 0)[0], out(unknown1, 1)[0], out(unknown2, 0)[0]}
+	tx := testTx(ins, 3e6)
+
+	mp.Lock()
+	res := mp.MissingParents(tx)
+	mp.Unlock()
+	if len(res) != 2 || !res[0].Equal(&unknown1.Hash) || !res[1].Equal(&unknown2.Hash) {
+		t.Error("Bad missing parents", res)
+	}
+}
@@ -0,0 +1,74 @@
+package mempool
+
+import (
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// PackageResult tells what AcceptPackage has done with an ancestor package.
+type PackageResult struct {
+	Added  []*OneTxToSend // the package's txs added to the pool (not the ones that were already there)
+	Fee    uint64         // total fee of the added txs
+	VSize  uint64         // total virtual size of the added txs
+	Reason byte           // zero if the package has been accepted
+	Failed *btc.Tx        // the tx rejected for Reason (nil if it was the package's fee rate)
+}
+
+// AcceptPackage tries to add an ancestor package (BIP331) - the parents first and the child last.
+// The fees of the txs are not checked one by one, but the fee rate of all the txs the package adds
+// must not be below the minimum. If any of the txs gets rejected or the fee rate is too low,
+// the txs added so far get removed (with their children) for the same reason, so nothing
+// of the package stays in the pool.
+// Call it with the mempool unlocked.
+func (mp *Mempool) AcceptPackage(pkg []*btc.Tx, opts AcceptOpts) (res *PackageResult) {
+	res = new(PackageResult)
+	opts.PkgMember = true
+
+	already_in := make(map[BIDX]bool, len(pkg))
+	mp.Lock()
+	for _, tx := range pkg {
+		if _, ok := mp.TransactionsToSend[tx.Hash.BIdx()]; ok {
+			already_in[tx.Hash.BIdx()] = true
+		}
+	}
+	mp.Unlock()
+
+	for _, tx := range pkg {
+		mp.Lock()
+		_, ok := mp.TransactionsToSend[tx.Hash.BIdx()]
+		mp.Unlock()
+		if ok {
+			continue // it may have been accepted as a waiting one
+		}
+		if rec, reason := mp.Accept(tx, opts); rec == nil {
+			res.Reason, res.Failed = reason, tx
+			break
+		}
+	}
+
+	mp.Lock()
+	defer mp.Unlock()
+	for _, tx := range pkg {
+		if already_in[tx.Hash.BIdx()] {
+			continue
+		}
+		if t2s := mp.TransactionsToSend[tx.Hash.BIdx()]; t2s != nil {
+			res.Added = append(res.Added, t2s)
+			res.Fee += t2s.Fee
+			res.VSize += uint64(t2s.VSize())
+		}
+	}
+
+	if res.Reason == 0 && res.Fee < res.VSize*mp.minFeePerKB()/1000 {
+		res.Reason = TX_REJECTED_LOW_FEE
+	}
+	if res.Reason != 0 {
+		// the parents accepted so far get rejected for the reason of the entire package
+		for i := len(res.Added) - 1; i >= 0; i-- {
+			if _, ok := mp.TransactionsToSend[res.Added[i].Hash.BIdx()]; ok {
+				mp.DeleteTx(res.Added[i], true, res.Reason)
+			}
+		}
+		res.Added = nil
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package mempool
+
+import (
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestAcceptPackage(t *testing.T) {
+	mp, view := testPool(t)
+	var removed []byte
+	mp.OnRemoved = func(t2s *OneTxToSend, reason byte) { removed = append(removed, reason) }
+	inPool := func(tx *btc.Tx) bool {
+		_, ok := mp.TransactionsToSend[tx.Hash.BIdx()]
+		return ok
+	}
+
+	// a zero fee parent paid for by its child
+	parent := testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6)
+	child := testTx(out(parent, 0), 1e6-1000)
+	if rec, reason := mp.Accept(parent, AcceptOpts{}); rec != nil || reason != TX_REJECTED_LOW_FEE {
+		t.Fatal("Zero fee parent accepted alone", ReasonToString(reason))
+	}
+	res := mp.AcceptPackage([]*btc.Tx{parent, child}, AcceptOpts{Retry: true})
+	if res.Reason != 0 {
+		t.Fatal("Package not accepted:", ReasonToString(res.Reason))
+	}
+	if len(res.Added) != 2 || res.Fee != 1000 || res.VSize != uint64(parent.VSize()+child.VSize()) {
+		t.Error("Bad result", len(res.Added), res.Fee, res.VSize)
+	}
+	if !inPool(parent) || !inPool(child) {
+		t.Error("Package not in the pool")
+	}
+
+	// the package's fee rate too low - the accepted parent gets removed
+	parent = testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6)
+	child = testTx(out(parent, 0), 1e6-10)
+	removed = nil
+	res = mp.AcceptPackage([]*btc.Tx{parent, child}, AcceptOpts{Retry: true})
+	if res.Reason != TX_REJECTED_LOW_FEE || res.Failed != nil || res.Added != nil {
+		t.Error("Low fee package accepted", ReasonToString(res.Reason))
+	}
+	if inPool(parent) || inPool(child) || len(removed) != 2 || removed[0] != TX_REJECTED_LOW_FEE {
+		t.Error("Low fee package not removed", removed)
+	}
+
+	// a member rejected - the parent gets removed as well
+	parent = testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 1e6)
+	child = testTx(out(parent, 0), 1e6+1)
+	removed = nil
+	res = mp.AcceptPackage([]*btc.Tx{parent, child}, AcceptOpts{Retry: true})
+	if res.Reason != TX_REJECTED_OVERSPEND || res.Failed != child || res.Added != nil {
+		t.Error("Bad package accepted", ReasonToString(res.Reason))
+	}
+	if inPool(parent) || len(removed) != 1 || removed[0] != TX_REJECTED_OVERSPEND {
+		t.Error("Parent of a bad child not removed", removed)
+	}
+
+	// a parent already in the pool is neither counted nor removed
+	parent = testTx([]btc.TxPrevOut{view.coin(4, 1e6)}, 1e6)
+	if rec, _ := mp.Accept(parent, AcceptOpts{Local: true}); rec == nil {
+		t.Fatal("Parent not accepted")
+	}
+	child = testTx(out(parent, 0), 1e6-10)
+	res = mp.AcceptPackage([]*btc.Tx{parent, child}, AcceptOpts{Retry: true})
+	if res.Reason != TX_REJECTED_LOW_FEE || !inPool(parent) || inPool(child) {
+		t.Error("Parent in the pool paid for its child", ReasonToString(res.Reason))
+	}
+	child = testTx(out(parent, 0), 1e6-1000)
+	res = mp.AcceptPackage([]*btc.Tx{parent, child}, AcceptOpts{Retry: true})
+	if res.Reason != 0 || len(res.Added) != 1 || res.Added[0].Tx != child || res.Fee != 1000 {
+		t.Error("Bad result with the parent in the pool", ReasonToString(res.Reason), len(res.Added))
+	}
+}
@@ -0,0 +1,158 @@
+package mempool
+
+import (
+	"fmt"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// DeleteTx deletes the tx from the mempool.
+// Deletes all the children as well if with_children is true.
+// If reason is not zero, add the deleted txs to the rejected list.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) DeleteTx(tx *OneTxToSend, with_children bool, reason byte) {
+	mp.deleteTx(tx, with_children, reason, func(t2s *OneTxToSend) {
+		if mp.OnRemoved != nil {
+			mp.OnRemoved(t2s, reason)
+		}
+	})
+}
+
+// deleteTx does the job for DeleteTx, calling notify for each deleted record.
+func (mp *Mempool) deleteTx(tx *OneTxToSend, with_children bool, reason byte, notify func(*OneTxToSend)) {
+	if with_children {
+		// remove all the children that are spending from tx
+		var po btc.TxPrevOut
+		po.Hash = tx.Hash.Hash
+		for po.Vout = 0; po.Vout < uint32(len(tx.TxOut)); po.Vout++ {
+			if so, ok := mp.SpentOutputs[po.UIdx()]; ok {
+				if child, ok := mp.TransactionsToSend[so]; ok {
+					mp.deleteTx(child, true, reason, notify)
+				}
+			}
+		}
+	}
+
+	for i := range tx.Spent {
+		delete(mp.SpentOutputs, tx.Spent[i])
+	}
+
+	mp.TransactionsToSendSize -= uint64(len(tx.Raw))
+	mp.TransactionsToSendWeight -= uint64(tx.Weight())
+	delete(mp.TransactionsToSend, tx.Hash.BIdx())
+	if tx.SegWit != nil {
+		delete(mp.WTxIDsToSend, tx.WTxID().BIdx())
+	}
+	if reason != 0 {
+		mp.RejectTx(tx.Tx, reason)
+	}
+	if notify != nil {
+		notify(tx)
+	}
+}
+
+// UnMarkChildrenForMem clears the MemInput flag of all the children (used when a tx is mined).
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) UnMarkChildrenForMem(tx *OneTxToSend) {
+	// Go through all the tx's outputs and unmark MemInputs in txs that have been spending it
+	var po btc.TxPrevOut
+	po.Hash = tx.Hash.Hash
+	for po.Vout = 0; po.Vout < uint32(len(tx.TxOut)); po.Vout++ {
+		uidx := po.UIdx()
+		if val, ok := mp.SpentOutputs[uidx]; ok {
+			if rec, _ := mp.TransactionsToSend[val]; rec != nil {
+				if rec.MemInputs == nil {
+					mp.count("TxMinedMeminER1")
+					fmt.Println("WTF?", po.String(), "just mined in", rec.Hash.String(), "- not marked as mem")
+					continue
+				}
+				idx := rec.IIdx(uidx)
+				if idx < 0 {
+					mp.count("TxMinedMeminER2")
+					fmt.Println("WTF?", po.String(), " just mined. Was in SpentOutputs & mempool, but DUPA")
+					continue
+				}
+				rec.MemInputs[idx] = false
+				rec.MemInputCnt--
+				mp.count("TxMinedMeminOut")
+				if rec.MemInputCnt == 0 {
+					mp.count("TxMinedMeminTx")
+					rec.MemInputs = nil
+				}
+			} else {
+				mp.count("TxMinedMeminERR")
+				fmt.Println("WTF?", po.String(), " in SpentOutputs, but not in mempool")
+			}
+		}
+	}
+}
+
+// txMined is called for each tx mined in a new block.
+// It returns the txs that have been waiting for this one.
+func (mp *Mempool) txMined(tx *btc.Tx, bl *btc.Block) []*btc.Tx {
+	h := tx.Hash
+	delete(mp.FeeDeltas, h.BIdx())
+	if rec, ok := mp.TransactionsToSend[h.BIdx()]; ok {
+		mp.count("TxMinedToSend")
+		mp.UnMarkChildrenForMem(rec)
+		mp.deleteTx(rec, false, 0, func(t2s *OneTxToSend) {
+			if mp.OnMined != nil {
+				mp.OnMined(t2s, bl)
+			}
+		})
+	}
+	if mr, ok := mp.TransactionsRejected[h.BIdx()]; ok {
+		if mr.Tx != nil {
+			mp.count(fmt.Sprint("TxMinedROK-", mr.Reason))
+		} else {
+			mp.count(fmt.Sprint("TxMinedRNO-", mr.Reason))
+		}
+		mp.DeleteRejected(h.BIdx())
+	}
+
+	// Go through all the inputs and make sure we are not leaving them in SpentOutputs
+	for i := range tx.TxIn {
+		idx := tx.TxIn[i].Input.UIdx()
+		if val, ok := mp.SpentOutputs[idx]; ok {
+			if rec, _ := mp.TransactionsToSend[val]; rec != nil {
+				// if we got here, the txs has been Malleabled
+				if rec.Local {
+					mp.count("TxMinedMalleabled")
+					fmt.Println("Input from own ", rec.Tx.Hash.String(), " mined in ", tx.Hash.String())
+				} else {
+					mp.count("TxMinedOtherSpend")
+				}
+				mp.DeleteTx(rec, true, 0)
+			} else {
+				mp.count("TxMinedSpentERROR")
+				fmt.Println("WTF? Input", tx.TxIn[i].Input.String(), "in mem-spent, but tx not in the mem-pool")
+			}
+			delete(mp.SpentOutputs, idx)
+		}
+	}
+
+	return mp.waitingFor(&h)
+}
+
+// BlockMined removes all the block's txs (and the txs conflicting with them) from the mempool.
+// Then it retries the txs that have been waiting for the mined ones.
+// Call it with the mempool unlocked.
+func (mp *Mempool) BlockMined(bl *btc.Block) {
+	var retry []*btc.Tx
+	var wtg_cnt uint64
+	mp.Lock()
+	mp.blockSinceBump = true
+	for i := 1; i < len(bl.Txs); i++ {
+		if wtg := mp.txMined(bl.Txs[i], bl); wtg != nil {
+			retry = append(retry, wtg...)
+			wtg_cnt++
+		}
+	}
+	mp.Unlock()
+
+	// Try to redo waiting txs
+	if wtg_cnt > 0 {
+		mp.countAdd("TxMinedGotInput", wtg_cnt)
+		mp.retryWaiting(retry)
+	}
+}
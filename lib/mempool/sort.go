@@ -0,0 +1,596 @@
+package mempool
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+const (
+	MIN_FEE_INCREMENT = 1000           // added to the fee per kB of the last package evicted by LimitPoolSize
+	MIN_FEE_HALFLIFE  = 12 * time.Hour // of the minimum fee raised by LimitPoolSize
+)
+
+// GetSortedMempool returns txs sorted by SPB, but with parents first.
+func (mp *Mempool) GetSortedMempool() (result []*OneTxToSend) {
+	all_txs := make([]BIDX, len(mp.TransactionsToSend))
+	var idx int
+	const MIN_PKB = 200
+	for k, _ := range mp.TransactionsToSend {
+		all_txs[idx] = k
+		idx++
+	}
+	sort.Slice(all_txs, func(i, j int) bool {
+		rec_i := mp.TransactionsToSend[all_txs[i]]
+		rec_j := mp.TransactionsToSend[all_txs[j]]
+		rate_i := rec_i.Fee * uint64(rec_j.Weight())
+		rate_j := rec_j.Fee * uint64(rec_i.Weight())
+		if rate_i != rate_j {
+			return rate_i > rate_j
+		}
+		if rec_i.MemInputCnt != rec_j.MemInputCnt {
+			return rec_i.MemInputCnt < rec_j.MemInputCnt
+		}
+		for x := 0; x < 32; x++ {
+			if rec_i.Hash.Hash[x] != rec_i.Hash.Hash[x] {
+				return rec_i.Hash.Hash[x] < rec_i.Hash.Hash[x]
+			}
+		}
+		return false
+	})
+
+	// now put the childrer after the parents
+	result = make([]*OneTxToSend, len(all_txs))
+	already_in := make(map[BIDX]bool, len(all_txs))
+	parent_of := make(map[BIDX][]BIDX)
+
+	idx = 0
+
+	var missing_parents = func(txkey BIDX, is_any bool) (res []BIDX, yes bool) {
+		tx := mp.TransactionsToSend[txkey]
+		if tx.MemInputs == nil {
+			return
+		}
+		var cnt_ok int
+		for idx, inp := range tx.TxIn {
+			if tx.MemInputs[idx] {
+				txk := btc.BIdx(inp.Input.Hash[:])
+				if _, ok := already_in[txk]; ok {
+				} else {
+					yes = true
+					if is_any {
+						return
+					}
+					res = append(res, txk)
+				}
+
+				cnt_ok++
+				if cnt_ok == tx.MemInputCnt {
+					return
+				}
+			}
+		}
+		return
+	}
+
+	var append_txs func(txkey BIDX)
+	append_txs = func(txkey BIDX) {
+		result[idx] = mp.TransactionsToSend[txkey]
+		idx++
+		already_in[txkey] = true
+
+		if toretry, ok := parent_of[txkey]; ok {
+			for _, kv := range toretry {
+				if _, in := already_in[kv]; in {
+					continue
+				}
+				if _, yes := missing_parents(kv, true); !yes {
+					append_txs(kv)
+				}
+			}
+			delete(parent_of, txkey)
+		}
+	}
+
+	for _, txkey := range all_txs {
+		if missing, yes := missing_parents(txkey, false); yes {
+			for _, kv := range missing {
+				parent_of[kv] = append(parent_of[kv], txkey)
+			}
+			continue
+		}
+		append_txs(txkey)
+	}
+
+	if idx != len(result) || idx != len(already_in) || len(parent_of) != 0 {
+		fmt.Println("Get sorted mempool idx:", idx, " result:", len(result), " alreadyin:", len(already_in), " parents:", len(parent_of))
+		fmt.Println("DUPA!!!!!!!!!!")
+		result = result[:idx]
+	}
+
+	return
+}
+
+// LimitPoolSize evicts the lowest fee rate chunks if the pool is over maxlen,
+// raising the minimum fee, or lets the minimum fee decay otherwise.
+// It must be called with the mempool locked.
+func (mp *Mempool) LimitPoolSize(maxlen uint64) {
+	ticklen := maxlen >> 5 // 1/32th of the max size = X
+
+	if mp.TransactionsToSendSize < maxlen {
+		mp.decayMinFee(maxlen)
+		return
+	}
+
+	//sta := time.Now()
+
+	// Evict the chunks with the lowest fee rate first, so a low fee parent does not get
+	// dropped while it has a high fee child. The last chunk of a cluster has no descendants.
+	sorted := mp.GetChunks()
+	idx := len(sorted)
+	var last *OneTxsPackage
+
+	old_size := mp.TransactionsToSendSize
+
+	maxlen -= ticklen
+
+	for idx > 0 && mp.TransactionsToSendSize > maxlen {
+		idx--
+		last = sorted[idx]
+		for _, tx := range last.Txs {
+			if _, ok := mp.TransactionsToSend[tx.Hash.BIdx()]; ok {
+				mp.DeleteTx(tx, true, TX_REJECTED_LOW_FEE)
+			}
+		}
+	}
+
+	if cnt := len(sorted) - idx; cnt > 0 {
+		newspkb := 4000*last.Fee/uint64(last.Weight) + MIN_FEE_INCREMENT
+		if cur := mp.minFeePerKB(); newspkb < cur {
+			newspkb = cur
+		}
+		mp.setMinFeePerKB(newspkb)
+		mp.minFeeBumped = time.Now()
+		mp.blockSinceBump = false
+
+		/*fmt.Println("Mempool purged in", time.Now().Sub(sta).String(), "-",
+		old_size-mp.TransactionsToSendSize, "/", old_size, "bytes and", cnt, "/", len(sorted), "chunks removed. SPKB:", newspkb)*/
+		mp.count("TxPoolSizeHigh")
+		mp.countAdd("TxPurgedSizCnt", uint64(cnt))
+		mp.countAdd("TxPurgedSizBts", old_size-mp.TransactionsToSendSize)
+	}
+}
+
+// decayMinFee lowers the minimum fee raised by LimitPoolSize, halving it every MIN_FEE_HALFLIFE
+// (faster if the pool is much below its max size), once a block has been mined since the last rise.
+// Back at the floor, the txs rejected for low fee are removed from the rejected list.
+func (mp *Mempool) decayMinFee(maxlen uint64) {
+	if mp.minFeeBumped.IsZero() || !mp.blockSinceBump {
+		mp.count("TxPoolSizeOK")
+		return
+	}
+
+	halflife := MIN_FEE_HALFLIFE
+	if mp.TransactionsToSendSize < maxlen/4 {
+		halflife /= 4
+	} else if mp.TransactionsToSendSize < maxlen/2 {
+		halflife /= 2
+	}
+
+	now := time.Now()
+	newspkb := float64(mp.minFeePerKB()) / math.Pow(2, float64(now.Sub(mp.minFeeBumped))/float64(halflife))
+	mp.minFeeBumped = now
+
+	if newspkb >= MIN_FEE_INCREMENT/2 {
+		mp.setMinFeePerKB(uint64(newspkb))
+		if mp.minFeePerKB() > uint64(newspkb) {
+			newspkb = 0 // we are at the floor
+		}
+	} else {
+		newspkb = 0
+	}
+
+	if newspkb == 0 {
+		mp.setMinFeePerKB(0)
+		mp.minFeeBumped = time.Time{}
+		var cnt uint64
+		for k, v := range mp.TransactionsRejected {
+			if v.Reason == TX_REJECTED_LOW_FEE {
+				mp.DeleteRejected(k)
+				cnt++
+			}
+		}
+		mp.count("TxPoolSizeLow")
+		mp.countAdd("TxRejectedFeeUndone", cnt)
+	}
+}
+
+func (mp *Mempool) GetSortedRejected() (sorted []*OneTxRejected) {
+	var idx int
+	sorted = make([]*OneTxRejected, len(mp.TransactionsRejected))
+	for _, t := range mp.TransactionsRejected {
+		sorted[idx] = t
+		idx++
+	}
+	var now = time.Now()
+	sort.Slice(sorted, func(i, j int) bool {
+		return int64(sorted[i].Size)*int64(now.Sub(sorted[i].Time)) < int64(sorted[j].Size)*int64(now.Sub(sorted[j].Time))
+	})
+	return
+}
+
+// LimitRejectedSize must be called with the mempool locked.
+func (mp *Mempool) LimitRejectedSize() {
+	//ticklen := maxlen >> 5 // 1/32th of the max size = X
+	var idx int
+	var sorted []*OneTxRejected
+
+	old_cnt := len(mp.TransactionsRejected)
+	old_size := mp.TransactionsRejectedSize
+
+	var maxlen uint64
+	var maxcnt int
+	if mp.Policy.RejectedLimits != nil {
+		maxlen, maxcnt = mp.Policy.RejectedLimits()
+	}
+
+	if maxcnt > 0 && len(mp.TransactionsRejected) > maxcnt {
+		mp.count("TxRejectedCntHigh")
+		sorted = mp.GetSortedRejected()
+		maxcnt -= maxcnt >> 5
+		for idx = maxcnt; idx < len(sorted); idx++ {
+			mp.DeleteRejected(sorted[idx].Id.BIdx())
+		}
+		sorted = sorted[:maxcnt]
+	}
+
+	if maxlen > 0 && mp.TransactionsRejectedSize > maxlen {
+		mp.count("TxRejectedBtsHigh")
+		if sorted == nil {
+			sorted = mp.GetSortedRejected()
+		}
+		maxlen -= maxlen >> 5
+		for idx = len(sorted) - 1; idx >= 0; idx-- {
+			mp.DeleteRejected(sorted[idx].Hash.BIdx())
+			if mp.TransactionsRejectedSize <= maxlen {
+				break
+			}
+		}
+	}
+
+	if old_cnt > len(mp.TransactionsRejected) {
+		mp.countAdd("TxRejectedSizCnt", uint64(old_cnt-len(mp.TransactionsRejected)))
+		mp.countAdd("TxRejectedSizBts", old_size-mp.TransactionsRejectedSize)
+	}
+}
+
+// Check verifies the mempool for consistency, printing all the problems found.
+// Make sure to call it with the mempool locked.
+func (mp *Mempool) Check() (dupa bool) {
+	var spent_cnt int
+	var totsize uint64
+
+	// First check if t2s.MemInputs fields are properly set
+	for _, t2s := range mp.TransactionsToSend {
+		var micnt int
+
+		totsize += uint64(len(t2s.Raw))
+
+		for i, inp := range t2s.TxIn {
+			spent_cnt++
+
+			outk, ok := mp.SpentOutputs[inp.Input.UIdx()]
+			if ok {
+				if outk != t2s.Hash.BIdx() {
+					fmt.Println("Tx", t2s.Hash.String(), "input", i, "has a mismatch in mp.SpentOutputs record", outk)
+					dupa = true
+				}
+			} else {
+				fmt.Println("Tx", t2s.Hash.String(), "input", i, "is not in mp.SpentOutputs")
+				dupa = true
+			}
+
+			_, ok = mp.TransactionsToSend[btc.BIdx(inp.Input.Hash[:])]
+
+			if t2s.MemInputs == nil {
+				if ok {
+					fmt.Println("Tx", t2s.Hash.String(), "MemInputs==nil but input", i, "is in mempool", inp.Input.String())
+					dupa = true
+				}
+			} else {
+				if t2s.MemInputs[i] {
+					micnt++
+					if !ok {
+						fmt.Println("Tx", t2s.Hash.String(), "MemInput set but input", i, "NOT in mempool", inp.Input.String())
+						dupa = true
+					}
+				} else {
+					if ok {
+						fmt.Println("Tx", t2s.Hash.String(), "MemInput NOT set but input", i, "IS in mempool", inp.Input.String())
+						dupa = true
+					}
+				}
+			}
+
+			if _, ok := mp.TransactionsToSend[btc.BIdx(inp.Input.Hash[:])]; !ok {
+				if unsp := mp.View.UnspentGet(&inp.Input); unsp == nil {
+					fmt.Println("Mempool tx", t2s.Hash.String(), "has no input", i)
+					dupa = true
+				}
+			}
+		}
+		if t2s.MemInputs != nil && micnt == 0 {
+			fmt.Println("Tx", t2s.Hash.String(), "has MemInputs array with all false values")
+			dupa = true
+		}
+		if t2s.MemInputCnt != micnt {
+			fmt.Println("Tx", t2s.Hash.String(), "has incorrect MemInputCnt", t2s.MemInputCnt, micnt)
+			dupa = true
+		}
+	}
+
+	if spent_cnt != len(mp.SpentOutputs) {
+		fmt.Println("mp.SpentOutputs length mismatch", spent_cnt, len(mp.SpentOutputs))
+		dupa = true
+	}
+
+	if totsize != mp.TransactionsToSendSize {
+		fmt.Println("mp.TransactionsToSendSize mismatch", totsize, mp.TransactionsToSendSize)
+		dupa = true
+	}
+
+	totsize = 0
+	var orphans int
+	var orphans_size uint64
+	for _, tr := range mp.TransactionsRejected {
+		if tr.Tx != nil {
+			totsize += uint64(tr.Size)
+		}
+		if tr.Waiting4 != nil {
+			orphans++
+			orphans_size += uint64(tr.Size)
+		}
+	}
+	if totsize != mp.TransactionsRejectedSize {
+		fmt.Println("mp.TransactionsRejectedSize mismatch", totsize, mp.TransactionsRejectedSize)
+		dupa = true
+	}
+	if orphans != mp.OrphansCnt || orphans_size != mp.OrphansSize {
+		fmt.Println("mp.OrphansCnt/Size mismatch", orphans, mp.OrphansCnt, orphans_size, mp.OrphansSize)
+		dupa = true
+	}
+
+	return
+}
+
+// GetChildren gets all first level children of the tx.
+func (mp *Mempool) GetChildren(tx *OneTxToSend) (result []*OneTxToSend) {
+	var po btc.TxPrevOut
+	po.Hash = tx.Hash.Hash
+
+	res := make(map[*OneTxToSend]bool)
+
+	for po.Vout = 0; po.Vout < uint32(len(tx.TxOut)); po.Vout++ {
+		uidx := po.UIdx()
+		if val, ok := mp.SpentOutputs[uidx]; ok {
+			res[mp.TransactionsToSend[val]] = true
+		}
+	}
+
+	result = make([]*OneTxToSend, len(res))
+	var idx int
+	for ttx, _ := range res {
+		result[idx] = ttx
+		idx++
+	}
+	return
+}
+
+// GetItWithAllChildren gets all the children (and all of their children...) of the tx.
+// If any of the children has other unconfirmed parents, they are also included in the result.
+// The result is sorted with the input parent first and always with parents before their children.
+func (mp *Mempool) GetItWithAllChildren(tx *OneTxToSend) (result []*OneTxToSend) {
+	already_included := make(map[*OneTxToSend]bool)
+
+	result = []*OneTxToSend{tx} // out starting (parent) tx shall be the first element of the result
+	already_included[tx] = true
+
+	for idx := 0; idx < len(result); idx++ {
+		par := result[idx]
+		for _, ch := range mp.GetChildren(par) {
+			// do it for each returned child,
+
+			// but only if it has not been included yet ...
+			if _, ok := already_included[ch]; !ok {
+
+				// first make sure we have all of its parents...
+				for _, prnt := range mp.GetAllParentsExcept(ch, par) {
+					if _, ok := already_included[prnt]; !ok {
+						// if we dont have a parent, just insert it here into the result
+						result = append(result, prnt)
+						// ... and mark it as included, for later
+						already_included[prnt] = true
+					}
+				}
+
+				// now we can safely insert the child, as all its parent shall be already included
+				result = append(result, ch)
+				// ... and mark it as included, for later
+				already_included[ch] = true
+			}
+		}
+	}
+	return
+}
+
+// GetAllChildren gets all the children (and all of their children...) of the tx.
+// The result is sorted by the oldest parent.
+func (mp *Mempool) GetAllChildren(tx *OneTxToSend) (result []*OneTxToSend) {
+	already_included := make(map[*OneTxToSend]bool)
+	var idx int
+	par := tx
+	for {
+		chlds := mp.GetChildren(par)
+		for _, ch := range chlds {
+			if _, ok := already_included[ch]; !ok {
+				already_included[ch] = true
+				result = append(result, ch)
+			}
+		}
+		if idx == len(result) {
+			break
+		}
+
+		par = result[idx]
+		already_included[par] = true
+		idx++
+	}
+	return
+}
+
+// GetAllParents gets all the unconfirmed parents of the given tx.
+// The result is sorted by the oldest parent.
+func (mp *Mempool) GetAllParents(tx *OneTxToSend) (result []*OneTxToSend) {
+	already_in := make(map[*OneTxToSend]bool)
+	already_in[tx] = true
+	var do_one func(*OneTxToSend)
+	do_one = func(tx *OneTxToSend) {
+		if tx.MemInputCnt > 0 {
+			for idx := range tx.TxIn {
+				if tx.MemInputs[idx] {
+					par_tx := mp.TransactionsToSend[btc.BIdx(tx.TxIn[idx].Input.Hash[:])]
+					if _, ok := already_in[par_tx]; !ok {
+						do_one(par_tx)
+					}
+				}
+			}
+		}
+		if _, ok := already_in[tx]; !ok {
+			result = append(result, tx)
+			already_in[tx] = true
+		}
+	}
+	do_one(tx)
+	return
+}
+
+// GetAllParents gets all the unconfirmed parents of the given tx, except for the input tx (and its parents).
+// The result is sorted by the oldest parent.
+func (mp *Mempool) GetAllParentsExcept(tx, except *OneTxToSend) (result []*OneTxToSend) {
+	already_in := make(map[*OneTxToSend]bool)
+	already_in[tx] = true
+	var do_one func(*OneTxToSend)
+	do_one = func(tx *OneTxToSend) {
+		if tx.MemInputCnt > 0 {
+			for idx := range tx.TxIn {
+				if tx.MemInputs[idx] {
+					if par_tx := mp.TransactionsToSend[btc.BIdx(tx.TxIn[idx].Input.Hash[:])]; par_tx != except {
+						if _, ok := already_in[par_tx]; !ok {
+							do_one(par_tx)
+						}
+					}
+				}
+			}
+		}
+		if _, ok := already_in[tx]; !ok {
+			result = append(result, tx)
+			already_in[tx] = true
+		}
+	}
+	do_one(tx)
+	return
+}
+
+type OneTxsPackage struct {
+	Txs    []*OneTxToSend
+	Weight int
+	Fee    uint64
+}
+
+func (pk *OneTxsPackage) AnyIn(list map[*OneTxToSend]bool) (ok bool) {
+	for _, par := range pk.Txs {
+		if _, ok = list[par]; ok {
+			return
+		}
+	}
+	return
+}
+
+func (mp *Mempool) LookForPackages(txs []*OneTxToSend) (result []*OneTxsPackage) {
+	for _, tx := range txs {
+		if tx.MemInputCnt > 0 {
+			continue
+		}
+		var pkg OneTxsPackage
+		pandch := mp.GetItWithAllChildren(tx)
+		if len(pandch) > 1 {
+			pkg.Txs = pandch
+			for _, t := range pkg.Txs {
+				pkg.Weight += t.Weight()
+				pkg.Fee += t.Fee
+			}
+			result = append(result, &pkg)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Fee*uint64(result[j].Weight) > result[j].Fee*uint64(result[i].Weight)
+	})
+	return
+}
+
+// GetSortedMempoolNew is like GetSortedMempool(), but one uses Child-Pays-For-Parent algo.
+func (mp *Mempool) GetSortedMempoolNew() (result []*OneTxToSend) {
+	txs := mp.GetSortedMempool()
+	pkgs := mp.LookForPackages(txs)
+	//println(len(pkgs), "pkgs from", len(txs), "txs")
+
+	result = make([]*OneTxToSend, len(txs))
+	var txs_idx, pks_idx, res_idx int
+	already_in := make(map[*OneTxToSend]bool, len(txs))
+	for txs_idx < len(txs) {
+		tx := txs[txs_idx]
+
+		if pks_idx < len(pkgs) {
+			pk := pkgs[pks_idx]
+			if pk.Fee*uint64(tx.Weight()) > tx.Fee*uint64(pk.Weight) {
+				pks_idx++
+				if pk.AnyIn(already_in) {
+					continue
+				}
+				// all package's txs new: incude them all
+				copy(result[res_idx:], pk.Txs)
+				res_idx += len(pk.Txs)
+				for _, _t := range pk.Txs {
+					already_in[_t] = true
+				}
+				continue
+			}
+		}
+
+		txs_idx++
+		if _, ok := already_in[tx]; ok {
+			continue
+		}
+		result[res_idx] = tx
+		already_in[tx] = true
+		res_idx++
+	}
+	//println("All sorted.  res_idx:", res_idx, "  txs:", len(txs))
+	return
+}
+
+// GetMempoolFees only takes chunk weight and the fee.
+func (mp *Mempool) GetMempoolFees(maxweight uint64) (result [][2]uint64) {
+	var weightsofar uint64
+	for _, ch := range mp.GetChunks() {
+		if weightsofar >= maxweight {
+			break
+		}
+		result = append(result, [2]uint64{uint64(ch.Weight), ch.Fee})
+		weightsofar += uint64(ch.Weight)
+	}
+	return
+}
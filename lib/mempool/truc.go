@@ -0,0 +1,48 @@
+package mempool
+
+import (
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// checkTRUC applies the TRUC (BIP431) topology rules to a tx spending the given mempool inputs.
+// TRUC txs may only spend TRUC txs and the other way around. A TRUC tx can have one unconfirmed
+// parent, which cannot have any other unconfirmed ancestors or descendants.
+// If the parent already has a child (not on the skip list), it is returned as the sibling,
+// which the new tx has to replace to get in (following the RBF fee rules).
+func (mp *Mempool) checkTRUC(tx *btc.Tx, frommem []bool, skip map[*OneTxToSend]bool, dry *dryRun) (sibling *OneTxToSend, reason byte) {
+	var parents []*OneTxToSend
+	for i := range frommem {
+		if !frommem[i] {
+			continue
+		}
+		par := mp.memTx(btc.BIdx(tx.TxIn[i].Input.Hash[:]), dry)
+		if (par.Version == TRUC_VERSION) != (tx.Version == TRUC_VERSION) {
+			return nil, TX_REJECTED_TRUC_VER
+		}
+		if len(parents) == 0 || parents[len(parents)-1] != par {
+			parents = append(parents, par)
+		}
+	}
+
+	if tx.Version != TRUC_VERSION {
+		return
+	}
+	if tx.VSize() > TRUC_MAX_VSIZE {
+		return nil, TX_REJECTED_TRUC_SIZE
+	}
+	if len(parents) == 0 {
+		return
+	}
+	if len(parents) > 1 || parents[0].MemInputCnt > 0 {
+		return nil, TX_REJECTED_TRUC_LIMIT
+	}
+	if tx.VSize() > TRUC_CHILD_MAX_VSIZE {
+		return nil, TX_REJECTED_TRUC_SIZE
+	}
+	for _, ch := range mp.GetChildren(parents[0]) {
+		if !skip[ch] {
+			sibling = ch
+		}
+	}
+	return
+}
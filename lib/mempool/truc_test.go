@@ -0,0 +1,106 @@
+package mempool
+
+import (
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestFullRBF(t *testing.T) {
+	mp, view := testPool(t)
+	var full_rbf bool
+	mp.Policy.FullRBF = func() bool { return full_rbf }
+
+	// a chain of replacements of a tx that does not signal RBF
+	coin := view.coin(1, 1e6)
+	tx := testTxExt(1, 0xffffffff, []btc.TxPrevOut{coin}, 1e6-1000)
+	child := testTx(out(tx, 0), 1e6-2000)
+	mp.Accept(tx, AcceptOpts{})
+	mp.Accept(child, AcceptOpts{})
+
+	if rec, reason := mp.Accept(testTx([]btc.TxPrevOut{coin}, 1e6-5000), AcceptOpts{}); rec != nil || reason != TX_REJECTED_RBF_FINAL {
+		t.Error("Non-signalling tx replaced", ReasonToString(reason))
+	}
+
+	full_rbf = true
+	if rec, reason := mp.Accept(testTx([]btc.TxPrevOut{coin}, 1e6-900), AcceptOpts{}); rec != nil || reason != TX_REJECTED_RBF_LOWFEE {
+		t.Error("Replacement with a lower fee rate accepted", ReasonToString(reason))
+	}
+	rbf1 := testTxExt(1, 0xffffffff, []btc.TxPrevOut{coin}, 1e6-5000)
+	if rec, reason := mp.Accept(rbf1, AcceptOpts{}); rec == nil {
+		t.Fatal("Full RBF replacement not accepted", ReasonToString(reason))
+	}
+	if len(mp.TransactionsToSend) != 1 || mp.TransactionsRejected[child.Hash.BIdx()].Reason != TX_REJECTED_REPLACED {
+		t.Error("Replaced txs not removed")
+	}
+
+	// ... and the replacement gets replaced again
+	rbf2 := testTxExt(1, 0xffffffff, []btc.TxPrevOut{coin}, 1e6-9000)
+	if rec, reason := mp.Accept(rbf2, AcceptOpts{}); rec == nil {
+		t.Fatal("Second replacement not accepted", ReasonToString(reason))
+	}
+	if _, ok := mp.TransactionsToSend[rbf1.Hash.BIdx()]; ok || len(mp.TransactionsToSend) != 1 {
+		t.Error("First replacement not removed")
+	}
+
+	full_rbf = false
+	if rec, reason := mp.Accept(testTx([]btc.TxPrevOut{coin}, 1e6-20000), AcceptOpts{}); rec != nil || reason != TX_REJECTED_RBF_FINAL {
+		t.Error("Non-signalling replacement replaced", ReasonToString(reason))
+	}
+}
+
+func TestTRUC(t *testing.T) {
+	mp, view := testPool(t)
+	truc := true
+	mp.Policy.TRUC = func() bool { return truc }
+
+	accept := func(tx *btc.Tx, exp byte, what string) {
+		rec, reason := mp.Accept(tx, AcceptOpts{})
+		if reason != exp || (rec != nil) != (exp == 0) {
+			t.Error(what+": expected", ReasonToString(exp), "got", ReasonToString(reason))
+		}
+	}
+
+	parent := testTxExt(3, 0xffffffff, []btc.TxPrevOut{view.coin(1, 1e6)}, 4e5, 5e5)
+	legacy := testTx([]btc.TxPrevOut{view.coin(2, 1e6)}, 1e6-1000)
+	accept(parent, 0, "TRUC parent")
+	accept(legacy, 0, "Legacy tx")
+
+	accept(testTxExt(3, 0, out(legacy, 0), 1e6-2000), TX_REJECTED_TRUC_VER, "TRUC child of legacy")
+	accept(testTx(out(parent, 0), 4e5-1000), TX_REJECTED_TRUC_VER, "Legacy child of TRUC")
+
+	big := make([]uint64, 120)
+	for i := range big {
+		big[i] = 1000
+	}
+	accept(testTxExt(3, 0, out(parent, 0), big...), TX_REJECTED_TRUC_SIZE, "Big TRUC child")
+
+	child1 := testTxExt(3, 0xffffffff, out(parent, 0), 4e5-1000)
+	accept(child1, 0, "TRUC child")
+	accept(testTxExt(3, 0, out(child1, 0), 4e5-2000), TX_REJECTED_TRUC_LIMIT, "TRUC grandchild")
+
+	// sibling eviction: the other output of the parent can only be spent by a child paying more
+	accept(testTxExt(3, 0, out(parent, 1), 5e5-500), TX_REJECTED_RBF_LOWFEE, "Cheap sibling")
+	var replaced []*OneTxToSend
+	mp.OnReplaced = func(old, t2s *OneTxToSend) { replaced = append(replaced, old) }
+	child2 := testTxExt(3, 0, out(parent, 1), 5e5-3000)
+	accept(child2, 0, "Sibling")
+	if len(replaced) != 1 || replaced[0].Tx != child1 {
+		t.Error("Sibling not evicted")
+	}
+
+	// the TRUC parent does not signal BIP125, but can still be replaced - along with its child
+	accept(testTx([]btc.TxPrevOut{view.coin(1, 1e6)}, 1e6-60000), 0, "TRUC parent replacement")
+	if len(mp.TransactionsToSend) != 2 {
+		t.Error("Bad number of txs left", len(mp.TransactionsToSend))
+	}
+
+	// v3 txs are nothing special when TRUC is off
+	truc = false
+	p2 := testTxExt(3, 0xffffffff, []btc.TxPrevOut{view.coin(3, 1e6)}, 1e6-1000)
+	c2 := testTx(out(p2, 0), 1e6-2000)
+	accept(p2, 0, "Non-TRUC v3")
+	accept(c2, 0, "Legacy child of non-TRUC v3")
+	accept(testTxExt(3, 0, out(c2, 0), 1e6-3000), 0, "Non-TRUC v3 grandchild")
+	accept(testTx([]btc.TxPrevOut{view.coin(3, 1e6)}, 1e6-20000), TX_REJECTED_RBF_FINAL, "Non-TRUC v3 replacement")
+}
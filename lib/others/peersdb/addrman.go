@@ -0,0 +1,506 @@
+package peersdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	mrand "math/rand"
+	"sort"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/others/utils"
+)
+
+/*
+Address manager, modeled after the one from Bitcoin Core.
+
+All the known addresses are kept in PeerDB, but only the ones placed in the new
+or the tried table are used for outgoing connections.
+The position of an address in the new table depends on its own group (/16) and on
+the group of the node that told us about it, so a single source group can only
+fill NewBucketsPerSourceGroup buckets.
+The position in the tried table depends on the address's group, so a single group
+can only fill TriedBucketsPerGroup buckets.
+Addresses for outgoing connections are picked from random (non-empty) buckets,
+so the few buckets filled by a flooding group do not get more picks than the others.
+*/
+
+const (
+	NewBucketCount           = 256
+	TriedBucketCount         = 64
+	BucketSize               = 64
+	NewBucketsPerSourceGroup = 8
+	TriedBucketsPerGroup     = 8
+
+	MaxAnchors = 2 // outgoing connections to restore after restart
+
+	selectCandidates = 8  // SelectOutbound takes the best scored one of this many
+	selectTries      = 64 // how many random picks from a table, before giving up
+)
+
+type addrPos struct {
+	tried        bool
+	bucket, slot uint16
+}
+
+type addrMan struct {
+	key      [32]byte
+	newTab   [NewBucketCount][BucketSize]uint64
+	triedTab [TriedBucketCount][BucketSize]uint64
+	pos      map[uint64]addrPos
+	newCnt   int
+	triedCnt int
+
+	newBucketCnt   [NewBucketCount]int
+	triedBucketCnt [TriedBucketCount]int
+
+	anchors    []*PeerAddr // loaded from disk - to be connected first
+	anchorsOut []*PeerAddr // to be saved on disk
+	anchorsSet bool
+}
+
+var (
+	addrman      addrMan // protected by peerdb_mutex
+	addrman_file string
+
+	rnd = mrand.New(mrand.NewSource(time.Now().UnixNano()))
+)
+
+// Group returns the network group (/16) of the given IP4 address.
+func Group(ip4 [4]byte) uint16 {
+	return uint16(ip4[0])<<8 | uint16(ip4[1])
+}
+
+func (am *addrMan) hash(data ...[]byte) uint64 {
+	h := sha256.New()
+	h.Write(am.key[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil)[:8])
+}
+
+func u64b(v uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+func (am *addrMan) newBucket(p *PeerAddr) int {
+	h1 := am.hash(p.Ip4[:2], p.Source[:2]) % NewBucketsPerSourceGroup
+	return int(am.hash(p.Source[:2], u64b(h1)) % NewBucketCount)
+}
+
+func (am *addrMan) triedBucket(p *PeerAddr) int {
+	h1 := am.hash(u64b(p.UniqID())) % TriedBucketsPerGroup
+	return int(am.hash(p.Ip4[:2], u64b(h1)) % TriedBucketCount)
+}
+
+func (am *addrMan) slot(tried bool, bucket int, id uint64) int {
+	tab := []byte{'N'}
+	if tried {
+		tab[0] = 'K'
+	}
+	return int(am.hash(tab, u64b(uint64(bucket)), u64b(id)) % BucketSize)
+}
+
+func (am *addrMan) reset() {
+	am.newTab = [NewBucketCount][BucketSize]uint64{}
+	am.triedTab = [TriedBucketCount][BucketSize]uint64{}
+	am.pos = make(map[uint64]addrPos)
+	am.newCnt, am.triedCnt = 0, 0
+	am.newBucketCnt = [NewBucketCount]int{}
+	am.triedBucketCnt = [TriedBucketCount]int{}
+}
+
+func (am *addrMan) has(id uint64) (yes bool) {
+	_, yes = am.pos[id]
+	return
+}
+
+func (am *addrMan) set(tried bool, b, s int, id uint64) {
+	if tried {
+		am.triedTab[b][s] = id
+		am.triedCnt++
+		am.triedBucketCnt[b]++
+	} else {
+		am.newTab[b][s] = id
+		am.newCnt++
+		am.newBucketCnt[b]++
+	}
+	am.pos[id] = addrPos{tried: tried, bucket: uint16(b), slot: uint16(s)}
+}
+
+func (am *addrMan) remove(id uint64) {
+	if ps, ok := am.pos[id]; ok {
+		if ps.tried {
+			am.triedTab[ps.bucket][ps.slot] = 0
+			am.triedCnt--
+			am.triedBucketCnt[ps.bucket]--
+		} else {
+			am.newTab[ps.bucket][ps.slot] = 0
+			am.newCnt--
+			am.newBucketCnt[ps.bucket]--
+		}
+		delete(am.pos, id)
+	}
+}
+
+// placeNew puts the address into the new table.
+// If its slot is taken, it only replaces the occupant if that one is terrible.
+func (am *addrMan) placeNew(p *PeerAddr) bool {
+	id := p.UniqID()
+	b := am.newBucket(p)
+	s := am.slot(false, b, id)
+	if cur := am.newTab[b][s]; cur != 0 && cur != id {
+		if v := PeerDB.Get(qdb.KeyType(cur)); v != nil {
+			if old := NewPeer(v); old != nil && !old.IsTerrible() {
+				return false
+			}
+			PeerDB.Del(qdb.KeyType(cur))
+		}
+		am.remove(cur)
+	}
+	am.remove(id)
+	am.set(false, b, s, id)
+	return true
+}
+
+// markGood moves the address to the tried table.
+// A current occupant of its tried slot gets moved back to the new table.
+func (am *addrMan) markGood(p *PeerAddr) {
+	id := p.UniqID()
+	b := am.triedBucket(p)
+	s := am.slot(true, b, id)
+	if cur := am.triedTab[b][s]; cur != 0 && cur != id {
+		am.remove(cur)
+		if v := PeerDB.Get(qdb.KeyType(cur)); v != nil {
+			if old := NewPeer(v); old != nil {
+				old.Tried = false
+				am.placeNew(old)
+				PeerDB.Put(qdb.KeyType(cur), old.Bytes())
+			}
+		}
+	}
+	am.remove(id)
+	am.set(true, b, s, id)
+}
+
+// IsTerrible tells whether the address is not worth keeping in the tables.
+func (p *PeerAddr) IsTerrible() bool {
+	now := time.Now().Unix()
+	if int64(p.Time) > now+600 {
+		return true
+	}
+	if now-int64(p.Time) > int64(ExpirePeerAfter/time.Second) {
+		return true
+	}
+	if p.LastSuccess == 0 && p.Attempts >= 3 {
+		return true
+	}
+	if p.LastSuccess != 0 && now-int64(p.LastSuccess) > 7*24*3600 && p.Attempts >= 10 {
+		return true
+	}
+	return false
+}
+
+// Score returns the quality of the peer - the higher, the better.
+// It is built from: how recently we've seen it, our successful connections to it,
+// useful blocks and transactions it delivered, its ping time and misbehaviour.
+func (p *PeerAddr) Score() (sc int) {
+	now := time.Now().Unix()
+	if age := (now - int64(p.Time)) / 900; age < 100 {
+		sc += 100 - int(age)
+	}
+	if p.LastSuccess != 0 {
+		sc += 50
+	} else {
+		sc -= 20 * imin(int(p.Attempts), 10)
+	}
+	sc += imin(int(p.Blocks), 1000) / 10
+	sc += imin(int(p.Txs), 10000) / 100
+	sc -= imin(int(p.PingMs)/20, 100)
+	sc -= imin(int(p.Misbehave)/10, 500)
+	return
+}
+
+func imin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// NotePing updates the average ping time of the peer.
+func (p *PeerAddr) NotePing(ms int) {
+	if ms > 0xffff {
+		ms = 0xffff
+	}
+	if p.PingMs == 0 {
+		p.PingMs = uint16(ms)
+	} else {
+		p.PingMs = uint16((3*int(p.PingMs) + ms) / 4)
+	}
+}
+
+// NoteBlock should be called when the peer delivered us a new block.
+func (p *PeerAddr) NoteBlock() {
+	p.Blocks++
+}
+
+// NoteTx should be called when the peer delivered us a new mempool tx.
+func (p *PeerAddr) NoteTx() {
+	p.Txs++
+}
+
+// NoteMisbehave adds the misbehave points to the peer's record.
+func (p *PeerAddr) NoteMisbehave(how_much int) {
+	p.Misbehave += uint32(how_much)
+}
+
+// Attempt should be called before trying to connect to the peer.
+func (p *PeerAddr) Attempt() {
+	if p.Attempts < 0xffff {
+		p.Attempts++
+	}
+}
+
+// Good should be called after a successful handshake on an outgoing connection.
+// It moves the address to the tried table.
+func (p *PeerAddr) Good() {
+	p.LastSuccess = uint32(time.Now().Unix())
+	p.Attempts = 0
+	if !IsIp4Banned(p.Ip4) {
+		p.Tried = true
+		peerdb_mutex.Lock()
+		addrman.markGood(p)
+		peerdb_mutex.Unlock()
+	}
+	p.Save()
+}
+
+// AddNew adds an address that has been advertised to us by src.
+// It returns false if there was no room for it in the new table.
+func AddNew(a *PeerAddr, src [4]byte) bool {
+	k := qdb.KeyType(a.UniqID())
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+	if v := PeerDB.Get(k); v != nil {
+		if ex := NewPeer(v); ex != nil {
+			if a.Time > ex.Time {
+				ex.Time = a.Time
+			}
+			ex.Services = a.Services
+			if !IsIp4Banned(ex.Ip4) && !addrman.has(uint64(k)) {
+				addrman.placeNew(ex)
+			}
+			PeerDB.Put(k, ex.Bytes())
+			return true
+		}
+	}
+	a.Source = src
+	if IsIp4Banned(a.Ip4) || !addrman.placeNew(a) {
+		return false
+	}
+	PeerDB.Put(k, a.Bytes())
+	return true
+}
+
+// AddrManStats returns the number of addresses in the new and the tried table.
+func AddrManStats() (new_cnt, tried_cnt int) {
+	peerdb_mutex.Lock()
+	new_cnt, tried_cnt = addrman.newCnt, addrman.triedCnt
+	peerdb_mutex.Unlock()
+	return
+}
+
+// pick returns a random address from the given table: first a random non-empty bucket
+// is chosen and then a random address in it.
+func (am *addrMan) pick(tried bool) uint64 {
+	var buckets []int
+	if tried {
+		buckets = am.triedBucketCnt[:]
+	} else {
+		buckets = am.newBucketCnt[:]
+	}
+	var non_empty []int
+	for b, cnt := range buckets {
+		if cnt > 0 {
+			non_empty = append(non_empty, b)
+		}
+	}
+	if len(non_empty) == 0 {
+		return 0
+	}
+	b := non_empty[rnd.Intn(len(non_empty))]
+	n := rnd.Intn(buckets[b])
+	for s := 0; s < BucketSize; s++ {
+		var id uint64
+		if tried {
+			id = am.triedTab[b][s]
+		} else {
+			id = am.newTab[b][s]
+		}
+		if id != 0 {
+			if n == 0 {
+				return id
+			}
+			n--
+		}
+	}
+	return 0
+}
+
+// SelectOutbound picks an address for a new outgoing connection.
+// It chooses the tried or the new table with equal chances, never returns an address
+// from a group listed in usedGroups and, of a few random candidates, takes the best scored.
+// The candidates are taken from random buckets (see addrMan.pick).
+func SelectOutbound(isConnected func(*PeerAddr) bool, usedGroups map[uint16]bool) *PeerAddr {
+	if proxyPeer != nil {
+		if isConnected == nil || !isConnected(proxyPeer) {
+			return proxyPeer
+		}
+		return nil
+	}
+
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+
+	tabs := []bool{true, false}
+	if rnd.Intn(2) == 1 {
+		tabs[0], tabs[1] = false, true
+	}
+
+	for _, tried := range tabs {
+		var best *PeerAddr
+		var best_score, found int
+		for i := 0; i < selectTries && found < selectCandidates; i++ {
+			id := addrman.pick(tried)
+			if id == 0 {
+				break
+			}
+			v := PeerDB.Get(qdb.KeyType(id))
+			if v == nil {
+				continue
+			}
+			ad := NewPeer(v)
+			if ad == nil || ad.IsTerrible() || usedGroups[Group(ad.Ip4)] ||
+				!sys.ValidIp4(ad.Ip4[:]) || sys.IsIPBlocked(ad.Ip4[:]) || IsIp4Banned(ad.Ip4) {
+				continue
+			}
+			if isConnected != nil && isConnected(ad) {
+				continue
+			}
+			found++
+			if sc := ad.Score(); best == nil || sc > best_score {
+				best, best_score = ad, sc
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+// SetAnchors sets the addresses to be stored as anchors when closing the DB.
+func SetAnchors(ads []*PeerAddr) {
+	peerdb_mutex.Lock()
+	if len(ads) > MaxAnchors {
+		ads = ads[:MaxAnchors]
+	}
+	addrman.anchorsOut = ads
+	addrman.anchorsSet = true
+	peerdb_mutex.Unlock()
+}
+
+// NextAnchor returns the next anchor address to connect to, or nil.
+func NextAnchor() (ad *PeerAddr) {
+	peerdb_mutex.Lock()
+	if len(addrman.anchors) > 0 {
+		ad = addrman.anchors[0]
+		addrman.anchors = addrman.anchors[1:]
+	}
+	peerdb_mutex.Unlock()
+	return
+}
+
+/*
+addrman.dat file:
+ [0:32] - the secret key used for bucketing
+ [32] - number of anchors
+ [33:...] - anchors (30 bytes each, as in utils.OnePeer)
+*/
+
+// loadAddrMan reads addrman.dat and places all the known addresses in the tables.
+func loadAddrMan() {
+	peerdb_mutex.Lock()
+	defer peerdb_mutex.Unlock()
+
+	addrman.reset()
+	addrman.anchors = nil
+	d, _ := ioutil.ReadFile(addrman_file)
+	if len(d) >= 33 {
+		copy(addrman.key[:], d[:32])
+		for i, of := 0, 33; i < int(d[32]) && of+30 <= len(d); i, of = i+1, of+30 {
+			if ad := NewPeer(d[of : of+30]); ad != nil {
+				addrman.anchors = append(addrman.anchors, ad)
+			}
+		}
+	} else {
+		rand.Read(addrman.key[:])
+	}
+
+	var recs manyPeers
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if ad := NewPeer(v); ad != nil && !IsIp4Banned(ad.Ip4) {
+			recs = append(recs, ad)
+		}
+		return 0
+	})
+	sort.Sort(recs) // the best ones take the slots first
+
+	for _, p := range recs {
+		id := p.UniqID()
+		if p.Source == [4]byte{} {
+			p.Source = p.Ip4
+		}
+		if p.Tried {
+			b := addrman.triedBucket(p)
+			s := addrman.slot(true, b, id)
+			if addrman.triedTab[b][s] == 0 {
+				addrman.set(true, b, s, id)
+				continue
+			}
+			p.Tried = false
+		}
+		b := addrman.newBucket(p)
+		s := addrman.slot(false, b, id)
+		if addrman.newTab[b][s] == 0 {
+			addrman.set(false, b, s, id)
+		}
+	}
+}
+
+func saveAddrMan() {
+	if addrman_file == "" {
+		return
+	}
+	peerdb_mutex.Lock()
+	ads := addrman.anchorsOut
+	if !addrman.anchorsSet {
+		ads = addrman.anchors // not used yet - keep them
+	}
+	d := make([]byte, 33, 33+30*len(ads))
+	copy(d[:32], addrman.key[:])
+	d[32] = byte(len(ads))
+	for _, ad := range ads {
+		op := utils.OnePeer{NetAddr: ad.NetAddr, Time: ad.Time}
+		d = append(d, op.Bytes()...)
+	}
+	peerdb_mutex.Unlock()
+	ioutil.WriteFile(addrman_file, d, 0600)
+}
@@ -0,0 +1,148 @@
+package peersdb
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+func init_test_addrman(t *testing.T) {
+	var e error
+	PeerDB, e = qdb.NewDB(t.TempDir()+"/peers", true)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	addrman_file = ""
+	loadAddrMan()
+	rnd = rand.New(rand.NewSource(1))
+}
+
+func test_peer(a, b, c, d byte) (p *PeerAddr) {
+	p = NewEmptyPeer()
+	p.Ip4 = [4]byte{a, b, c, d}
+	p.Port = 8333
+	p.Services = 1
+	p.Time = uint32(time.Now().Add(-5 * time.Minute).Unix())
+	return
+}
+
+// add_honest adds cnt addresses, each from a different /16 and advertised by a different /16.
+func add_honest(cnt int) (res []*PeerAddr) {
+	for i := 0; i < cnt; i++ {
+		p := test_peer(byte(20+i/100), byte(i%100), 1, 1)
+		AddNew(p, [4]byte{byte(120 + i/100), byte(i % 100), 2, 2})
+		res = append(res, p)
+	}
+	return
+}
+
+func is_attacker(p *PeerAddr) bool {
+	return p.Ip4[0] == 66 || p.Source[0] == 66
+}
+
+func count_attackers() (cnt int) {
+	for id := range addrman.pos {
+		if v := PeerDB.Get(qdb.KeyType(id)); v != nil && is_attacker(NewPeer(v)) {
+			cnt++
+		}
+	}
+	return
+}
+
+// select_outbound simulates filling 8 outbound slots and returns how many went to the attacker.
+func select_outbound() (attacker int) {
+	used := make(map[uint16]bool)
+	conns := make(map[uint64]bool)
+	for i := 0; i < 8; i++ {
+		ad := SelectOutbound(func(ad *PeerAddr) bool { return conns[ad.UniqID()] }, used)
+		if ad == nil {
+			break
+		}
+		conns[ad.UniqID()] = true
+		used[Group(ad.Ip4)] = true
+		if is_attacker(ad) {
+			attacker++
+		}
+	}
+	return
+}
+
+func TestAddrManSingleGroupFlood(t *testing.T) {
+	init_test_addrman(t)
+	defer PeerDB.Close()
+
+	honest := add_honest(300)
+	for _, p := range honest[:50] {
+		p.Good()
+	}
+
+	// the attacker controls 66.66.0.0/16 and floods us with its own addresses
+	for i := 0; i < 20000; i++ {
+		AddNew(test_peer(66, 66, byte(i>>8), byte(i)), [4]byte{66, 66, byte(i % 7), 1})
+	}
+
+	if cnt := count_attackers(); cnt > NewBucketsPerSourceGroup*BucketSize {
+		t.Error("Attacker has", cnt, "addresses in the tables")
+	}
+
+	for i := 0; i < 100; i++ {
+		if cnt := select_outbound(); cnt > 1 {
+			t.Fatal("Attacker got", cnt, "outbound slots")
+		}
+	}
+}
+
+func TestAddrManSourceGroupFlood(t *testing.T) {
+	init_test_addrman(t)
+	defer PeerDB.Close()
+
+	honest := add_honest(300)
+	for _, p := range honest[:50] {
+		p.Good()
+	}
+
+	// the attacker's nodes in 66.66.0.0/16 advertise addresses from many different groups
+	for i := 0; i < 20000; i++ {
+		AddNew(test_peer(byte(130+i%50), byte(i/50), byte(i>>8), byte(i)), [4]byte{66, 66, byte(i % 7), 1})
+	}
+
+	cnt := count_attackers()
+	t.Log("Attacker has", cnt, "addresses in the tables")
+	if cnt > NewBucketsPerSourceGroup*BucketSize {
+		t.Error("Attacker has", cnt, "addresses in the tables")
+	}
+
+	var tot int
+	for i := 0; i < 100; i++ {
+		cnt := select_outbound()
+		if cnt > 8/2 {
+			t.Fatal("Attacker got", cnt, "outbound slots")
+		}
+		tot += cnt
+	}
+	t.Log("Attacker got", tot, "of", 100*8, "outbound slots")
+	if tot > 100*8/10 {
+		t.Error("Attacker got", tot, "of", 100*8, "outbound slots")
+	}
+}
+
+func TestAddrManRecord(t *testing.T) {
+	p := test_peer(1, 2, 3, 4)
+	p.Tried = true
+	p.Source = [4]byte{5, 6, 7, 8}
+	p.Attempts = 3
+	p.PingMs = 120
+	p.Blocks = 10
+	p.Txs = 1000
+	p.Misbehave = 50
+	r := NewPeer(p.Bytes())
+	if !r.Tried || r.Source != p.Source || r.Attempts != 3 || r.PingMs != 120 ||
+		r.Blocks != 10 || r.Txs != 1000 || r.Misbehave != 50 || r.Ip4 != p.Ip4 {
+		t.Error("Extended record mismatch")
+	}
+	if len(test_peer(1, 2, 3, 4).Bytes()) != 30 {
+		t.Error("Plain record should be 30 bytes long")
+	}
+}
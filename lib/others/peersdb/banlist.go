@@ -0,0 +1,279 @@
+package peersdb
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/others/qdb"
+)
+
+// The ban list is kept separately from PeerDB, in banlist.json.
+// Each entry is a subnet (a single IP is stored as /32) with its expiry time and a reason.
+// The bans of single IPs are found by the key, only the wider subnets need to be checked
+// one by one. Changes are written to disk in the background.
+
+const (
+	DefaultBanTime = 24 * time.Hour
+)
+
+type OneBan struct {
+	Subnet  *net.IPNet `json:"-"`
+	Address string     `json:"address"`
+	Created int64      `json:"ban_created"`
+	Until   int64      `json:"banned_until"`
+	Reason  string     `json:"ban_reason"`
+}
+
+var (
+	banlist        map[string]*OneBan = make(map[string]*OneBan) // by the subnet
+	banned_subnets []*OneBan                                     // the bans of more than a single IP
+	banlist_mutex  sync.Mutex
+	banlist_file   string
+
+	banlist_save      = make(chan bool, 1)
+	banlist_saver     sync.Once
+	banlist_save_lock sync.Mutex
+)
+
+// ParseSubnet accepts "IP", "IP:port" or "IP/bits" (CIDR) and returns the subnet.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, er := net.ParseCIDR(s)
+		if er != nil {
+			return nil, er
+		}
+		if ip4 := n.IP.To4(); ip4 != nil && len(n.Mask) == net.IPv6len {
+			n.IP, n.Mask = ip4, n.Mask[12:]
+		}
+		return n, nil
+	}
+	if h, _, er := net.SplitHostPort(s); er == nil {
+		s = h
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid IP address " + s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ipKey returns the banlist key of a ban for the single IP.
+func ipKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+func isSingleIP(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	return ones == bits
+}
+
+// indexSubnets rebuilds banned_subnets. Call it with the banlist_mutex locked.
+func indexSubnets() {
+	banned_subnets = nil
+	for _, b := range banlist {
+		if !isSingleIP(b.Subnet) {
+			banned_subnets = append(banned_subnets, b)
+		}
+	}
+}
+
+// expireBans removes the expired bans. Call it with the banlist_mutex locked.
+func expireBans() (changed bool) {
+	now := time.Now().Unix()
+	for k, b := range banlist {
+		if b.Until != 0 && b.Until <= now {
+			delete(banlist, k)
+			changed = true
+		}
+	}
+	if changed {
+		indexSubnets()
+	}
+	return
+}
+
+// BanSubnet adds (or updates) a ban. Zero duration means DefaultBanTime.
+func BanSubnet(n *net.IPNet, dur time.Duration, reason string) {
+	if dur <= 0 {
+		dur = DefaultBanTime
+	}
+	now := time.Now()
+	BanSubnetUntil(n, now.Add(dur), reason)
+}
+
+// BanSubnetUntil adds (or updates) a ban, expiring at the given time.
+func BanSubnetUntil(n *net.IPNet, until time.Time, reason string) {
+	b := &OneBan{Subnet: n, Address: n.String(), Created: time.Now().Unix(), Until: until.Unix(), Reason: reason}
+	banlist_mutex.Lock()
+	banlist[b.Address] = b
+	if !isSingleIP(n) {
+		indexSubnets()
+	}
+	banlist_mutex.Unlock()
+	saveBanList()
+}
+
+// Unban removes the ban of the exact subnet. Returns false if there was no such ban.
+func Unban(n *net.IPNet) (ok bool) {
+	banlist_mutex.Lock()
+	if _, ok = banlist[n.String()]; ok {
+		delete(banlist, n.String())
+		if !isSingleIP(n) {
+			indexSubnets()
+		}
+	}
+	banlist_mutex.Unlock()
+	if ok {
+		saveBanList()
+	}
+	return
+}
+
+// ClearBans removes all the bans.
+func ClearBans() {
+	banlist_mutex.Lock()
+	banlist = make(map[string]*OneBan)
+	banned_subnets = nil
+	banlist_mutex.Unlock()
+	saveBanList()
+}
+
+// ListBans returns all the active bans, sorted by creation time.
+func ListBans() (res []*OneBan) {
+	banlist_mutex.Lock()
+	expireBans()
+	for _, b := range banlist {
+		res = append(res, b)
+	}
+	banlist_mutex.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Created != res[j].Created {
+			return res[i].Created < res[j].Created
+		}
+		return res[i].Address < res[j].Address
+	})
+	return
+}
+
+// IsBanned returns the ban matching the given IP, or nil if it is not banned.
+func IsBanned(ip net.IP) *OneBan {
+	now := time.Now().Unix()
+	banlist_mutex.Lock()
+	defer banlist_mutex.Unlock()
+	if b := banlist[ipKey(ip)]; b != nil && (b.Until == 0 || b.Until > now) {
+		return b
+	}
+	for _, b := range banned_subnets {
+		if (b.Until == 0 || b.Until > now) && b.Subnet.Contains(ip) {
+			return b
+		}
+	}
+	return nil
+}
+
+// IsSubnetBanned returns the active ban of exactly the given subnet, or nil if there is none.
+// Wider bans covering the subnet do not count.
+func IsSubnetBanned(n *net.IPNet) *OneBan {
+	now := time.Now().Unix()
+	banlist_mutex.Lock()
+	defer banlist_mutex.Unlock()
+	if b := banlist[n.String()]; b != nil && (b.Until == 0 || b.Until > now) {
+		return b
+	}
+	return nil
+}
+
+// IsIp4Banned is IsBanned for the IP4 format used by the peers DB.
+func IsIp4Banned(ip4 [4]byte) bool {
+	return IsBanned(net.IP(ip4[:])) != nil
+}
+
+func loadBanList() (found bool) {
+	d, er := ioutil.ReadFile(banlist_file)
+	if er != nil {
+		return !os.IsNotExist(er)
+	}
+	var bans []*OneBan
+	if er = json.Unmarshal(d, &bans); er != nil {
+		println("loadBanList:", er.Error())
+		return true
+	}
+	banlist_mutex.Lock()
+	banlist = make(map[string]*OneBan, len(bans))
+	for _, b := range bans {
+		if n, er := ParseSubnet(b.Address); er == nil {
+			b.Subnet = n
+			banlist[n.String()] = b
+		}
+	}
+	expireBans()
+	indexSubnets()
+	banlist_mutex.Unlock()
+	return true
+}
+
+// saveBanList makes the ban list written to disk by a background goroutine.
+func saveBanList() {
+	if banlist_file == "" {
+		return
+	}
+	banlist_saver.Do(func() {
+		go func() {
+			for range banlist_save {
+				writeBanList()
+			}
+		}()
+	})
+	select {
+	case banlist_save <- true:
+	default: // already pending
+	}
+}
+
+// writeBanList stores the current ban list in banlist_file.
+func writeBanList() {
+	banlist_save_lock.Lock()
+	defer banlist_save_lock.Unlock()
+	if banlist_file == "" {
+		return
+	}
+	bans := ListBans()
+	if bans == nil {
+		bans = []*OneBan{}
+	}
+	d, _ := json.MarshalIndent(bans, "", "\t")
+	ioutil.WriteFile(banlist_file, d, 0600)
+}
+
+// importBannedPeers creates the ban list from the peers banned in the DB (the old way).
+func importBannedPeers() {
+	var cnt int
+	banlist_mutex.Lock()
+	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
+		if p := NewPeer(v); p != nil && p.Banned != 0 {
+			n := &net.IPNet{IP: net.IP(append([]byte{}, p.Ip4[:]...)), Mask: net.CIDRMask(32, 32)}
+			banlist[n.String()] = &OneBan{Subnet: n, Address: n.String(), Created: int64(p.Banned),
+				Until: time.Unix(int64(p.Banned), 0).Add(DefaultBanTime).Unix(), Reason: "imported"}
+			cnt++
+		}
+		return 0
+	})
+	expireBans()
+	banlist_mutex.Unlock()
+	if cnt > 0 {
+		saveBanList()
+	}
+}
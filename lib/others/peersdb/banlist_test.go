@@ -0,0 +1,58 @@
+package peersdb
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func set_banlist_file(fn string) {
+	banlist_save_lock.Lock()
+	banlist_file = fn
+	banlist_save_lock.Unlock()
+}
+
+func TestBanList(t *testing.T) {
+	set_banlist_file(t.TempDir() + "/banlist.json")
+	ClearBans()
+
+	n, er := ParseSubnet("1.2.3.4/16")
+	if er != nil || n.String() != "1.2.0.0/16" {
+		t.Fatal("ParseSubnet", n, er)
+	}
+	BanSubnet(n, time.Hour, "test")
+
+	if n, _ = ParseSubnet("5.6.7.8:8333"); n.String() != "5.6.7.8/32" {
+		t.Fatal("ParseSubnet", n)
+	}
+	BanSubnetUntil(n, time.Now().Add(-time.Second), "expired")
+
+	if !IsIp4Banned([4]byte{1, 2, 200, 1}) || IsIp4Banned([4]byte{1, 3, 0, 1}) {
+		t.Error("Subnet ban not working")
+	}
+	if IsBanned(net.ParseIP("5.6.7.8")) != nil || IsSubnetBanned(n) != nil {
+		t.Error("Expired ban still active")
+	}
+	if n, _ = ParseSubnet("1.2.3.0/24"); IsSubnetBanned(n) != nil || IsBanned(n.IP) == nil {
+		t.Error("Narrower subnet taken as banned")
+	}
+	if n, _ = ParseSubnet("1.2.0.0/16"); IsSubnetBanned(n) == nil {
+		t.Error("Subnet not banned")
+	}
+
+	writeBanList() // do not wait for the background save
+	banlist_mutex.Lock()
+	banlist = nil
+	banlist_mutex.Unlock()
+	if !loadBanList() {
+		t.Fatal("banlist file not found")
+	}
+	if bans := ListBans(); len(bans) != 1 || bans[0].Address != "1.2.0.0/16" || bans[0].Reason != "test" {
+		t.Error("Ban list not restored", bans)
+	}
+
+	if n, _ = ParseSubnet("1.2.0.0/16"); !Unban(n) || IsIp4Banned([4]byte{1, 2, 3, 4}) {
+		t.Error("Unban failed")
+	}
+	set_banlist_file("")
+}
@@ -34,6 +34,16 @@ var (
 type PeerAddr struct {
 	*utils.OnePeer
 
+	// The fields below are saved in the extended part of the record (see Bytes)
+	Tried bool // we have successfully connected to it (it is in the tried table)
+	Source [4]byte // IP4 of the node that advertised this address to us
+	LastSuccess uint32 // time of the last successful outgoing connection
+	Attempts uint16 // failed connection attempts since LastSuccess
+	PingMs uint16 // average ping time (EMA)
+	Blocks uint32 // number of useful blocks we got from it
+	Txs uint32 // number of useful transactions we got from it
+	Misbehave uint32 // the total of misbehave points it has collected
+
 	// The fields below don't get saved, but are used internaly
 	Manual bool  // Manually connected (from UI)
 	Friend bool  // Connected from friends.txt
@@ -54,9 +64,57 @@ func NewEmptyPeer() (p *PeerAddr) {
 	return
 }
 
+/*
+Extended peer record, following the utils.OnePeer one (all values LSB):
+ [30:34] - Banned (always present in the extended record)
+ [34] - Flags (bit 0: Tried)
+ [35:39] - Source IPv4
+ [39:43] - LastSuccess
+ [43:45] - Attempts
+ [45:47] - PingMs
+ [47:51] - Blocks
+ [51:55] - Txs
+ [55:59] - Misbehave
+*/
+const extRecLen = 59
+
 func NewPeer(v []byte) (p *PeerAddr) {
 	p = new(PeerAddr)
 	p.OnePeer = utils.NewPeer(v)
+	if p.OnePeer != nil && len(v) >= extRecLen {
+		p.Tried = (v[34] & 1) != 0
+		copy(p.Source[:], v[35:39])
+		p.LastSuccess = binary.LittleEndian.Uint32(v[39:43])
+		p.Attempts = binary.LittleEndian.Uint16(v[43:45])
+		p.PingMs = binary.LittleEndian.Uint16(v[45:47])
+		p.Blocks = binary.LittleEndian.Uint32(v[47:51])
+		p.Txs = binary.LittleEndian.Uint32(v[51:55])
+		p.Misbehave = binary.LittleEndian.Uint32(v[55:59])
+	}
+	return
+}
+
+// Bytes returns the serialized record, as stored in PeerDB.
+func (p *PeerAddr) Bytes() (res []byte) {
+	res = p.OnePeer.Bytes()
+	if !p.Tried && p.Source == [4]byte{} && p.LastSuccess == 0 && p.Attempts == 0 &&
+		p.PingMs == 0 && p.Blocks == 0 && p.Txs == 0 && p.Misbehave == 0 {
+		return // no need for the extended record
+	}
+	if len(res) < 34 {
+		res = append(res, 0, 0, 0, 0)
+	}
+	res = append(res, make([]byte, extRecLen-34)...)
+	if p.Tried {
+		res[34] = 1
+	}
+	copy(res[35:39], p.Source[:])
+	binary.LittleEndian.PutUint32(res[39:43], p.LastSuccess)
+	binary.LittleEndian.PutUint16(res[43:45], p.Attempts)
+	binary.LittleEndian.PutUint16(res[45:47], p.PingMs)
+	binary.LittleEndian.PutUint32(res[47:51], p.Blocks)
+	binary.LittleEndian.PutUint32(res[51:55], p.Txs)
+	binary.LittleEndian.PutUint32(res[55:59], p.Misbehave)
 	return
 }
 
@@ -112,13 +170,20 @@ func NewPeerFromString(ipstr string, force_default_port bool) (p *PeerAddr, e er
 		return
 	}
 
-	if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp!=nil && NewPeer(dbp).Banned!=0 {
+	if IsIp4Banned(p.Ip4) {
 		e = errors.New(p.Ip() + " is banned")
 		p = nil
-	} else {
-		p.Time = uint32(time.Now().Unix())
-		p.Save()
+		return
 	}
+
+	if dbp := PeerDB.Get(qdb.KeyType(p.UniqID())); dbp != nil {
+		if old := NewPeer(dbp); old != nil {
+			p = old // the ban (if any) has expired
+			p.Banned = 0
+		}
+	}
+	p.Time = uint32(time.Now().Unix())
+	p.Save()
 	return
 }
 
@@ -139,6 +204,7 @@ func ExpirePeers() {
 	if delcnt > 0 {
 		for delcnt > 0 && PeerDB.Count() > MinPeersInDB {
 			delcnt--
+			addrman.remove(uint64(todel[delcnt]))
 			PeerDB.Del(todel[delcnt])
 		}
 		PeerDB.Defrag(false)
@@ -147,17 +213,31 @@ func ExpirePeers() {
 }
 
 
+// Save stores the record in PeerDB and makes sure it is in the address manager.
 func (p *PeerAddr) Save() {
 	if p.Time > 0x80000000 {
 		println("saving dupa", int32(p.Time), p.Ip())
 	}
+	peerdb_mutex.Lock()
+	if !IsIp4Banned(p.Ip4) && !addrman.has(p.UniqID()) {
+		if p.Source == [4]byte{} {
+			p.Source = p.Ip4
+		}
+		addrman.placeNew(p)
+	}
+	peerdb_mutex.Unlock()
 	PeerDB.Put(qdb.KeyType(p.UniqID()), p.Bytes())
 	PeerDB.Sync()
 }
 
 
-func (p *PeerAddr) Ban() {
+// Ban bans the peer's IP for DefaultBanTime.
+func (p *PeerAddr) Ban(reason string) {
+	BanSubnet(&net.IPNet{IP: net.IP(append([]byte{}, p.Ip4[:]...)), Mask: net.CIDRMask(32, 32)}, 0, reason)
 	p.Banned = uint32(time.Now().Unix())
+	peerdb_mutex.Lock()
+	addrman.remove(p.UniqID())
+	peerdb_mutex.Unlock()
 	p.Save()
 }
 
@@ -192,6 +272,10 @@ func (p *PeerAddr) String() (s string) {
 	} else {
 		s += fmt.Sprintf("  Seen %5d sec ago", int(now)-int(p.Time))
 	}
+	if p.Tried {
+		s += "  TRIED"
+	}
+	s += fmt.Sprintf("  score:%d", p.Score())
 	return
 }
 
@@ -203,6 +287,10 @@ func (mp manyPeers) Len() int {
 }
 
 func (mp manyPeers) Less(i, j int) bool {
+	si, sj := mp[i].Score(), mp[j].Score()
+	if si != sj {
+		return si > sj
+	}
 	return mp[i].Time > mp[j].Time
 }
 
@@ -211,7 +299,7 @@ func (mp manyPeers) Swap(i, j int) {
 }
 
 
-// GetBestPeers fetches a given number of best (most recenty seen) peers.
+// GetBestPeers fetches a given number of best (highest score) peers.
 func GetBestPeers(limit uint, isConnected func(*PeerAddr)bool) (res manyPeers) {
 	if proxyPeer!=nil {
 		if isConnected==nil || !isConnected(proxyPeer) {
@@ -223,7 +311,7 @@ func GetBestPeers(limit uint, isConnected func(*PeerAddr)bool) (res manyPeers) {
 	tmp := make(manyPeers, 0)
 	PeerDB.Browse(func(k qdb.KeyType, v []byte) uint32 {
 		ad := NewPeer(v)
-		if ad.Banned==0 && sys.ValidIp4(ad.Ip4[:]) && !sys.IsIPBlocked(ad.Ip4[:]) {
+		if sys.ValidIp4(ad.Ip4[:]) && !sys.IsIPBlocked(ad.Ip4[:]) && !IsIp4Banned(ad.Ip4) {
 			if isConnected==nil || !isConnected(ad) {
 				tmp = append(tmp, ad)
 			}
@@ -269,6 +357,12 @@ func initSeeds(seeds []string, port uint16) {
 // InitPeers should be called from the main thread.
 func InitPeers(dir string) {
 	PeerDB, _ = qdb.NewDB(dir+"peers3", true)
+	banlist_file = dir + "banlist.json"
+	if !loadBanList() {
+		importBannedPeers()
+	}
+	addrman_file = dir + "addrman.dat"
+	loadAddrMan()
 
 	if ConnectOnly != "" {
 		x := strings.Index(ConnectOnly, ":")
@@ -315,6 +409,8 @@ func InitPeers(dir string) {
 func ClosePeerDB() {
 	if PeerDB!=nil {
 		fmt.Println("Closing peer DB")
+		saveAddrMan()
+		writeBanList()
 		PeerDB.Sync()
 		PeerDB.Defrag(true)
 		PeerDB.Close()
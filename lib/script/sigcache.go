@@ -0,0 +1,128 @@
+package script
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+// VerifyCache remembers inputs whose scripts have already been verified successfully,
+// so transactions seen in the memory pool do not need to be verified again inside a block.
+// Entries are keyed by a salted hash of (wtxid, input index), so a peer cannot predict them.
+// Only positive results are stored and the number of entries is bounded (oldest go first).
+type VerifyCache struct {
+	sync.Mutex
+	salt [32]byte
+	max  int
+	m    map[[16]byte]verifyCacheRec
+	ring [][16]byte
+	pos  int
+	free []int // slots of the ring freed by erased entries (used before evicting any)
+
+	// Counter, if set, gets called with the name of each event (hit, miss, add, evict)
+	Counter func(string)
+}
+
+type verifyCacheRec struct {
+	flags uint32 // verify flags the input was checked with
+	slot  int    // in the ring
+}
+
+// NewVerifyCache returns a cache that can hold up to max entries.
+func NewVerifyCache(max int) (c *VerifyCache) {
+	c = new(VerifyCache)
+	rand.Read(c.salt[:])
+	c.max = max
+	c.m = make(map[[16]byte]verifyCacheRec, max)
+	c.ring = make([][16]byte, 0, max)
+	return
+}
+
+func (c *VerifyCache) key(wtxid *btc.Uint256, i int) (k [16]byte) {
+	var b [4]byte
+	sha := sha256.New()
+	sha.Write(c.salt[:])
+	sha.Write(wtxid.Hash[:])
+	binary.LittleEndian.PutUint32(b[:], uint32(i))
+	sha.Write(b[:])
+	copy(k[:], sha.Sum(nil))
+	return
+}
+
+func (c *VerifyCache) count(what string) {
+	if c.Counter != nil {
+		c.Counter(what)
+	}
+}
+
+// Add records that input i of the given transaction passed verification with the given flags.
+func (c *VerifyCache) Add(wtxid *btc.Uint256, i int, flags uint32) {
+	if c == nil || c.max == 0 {
+		return
+	}
+	k := c.key(wtxid, i)
+	c.Lock()
+	if rec, ok := c.m[k]; ok {
+		rec.flags |= flags
+		c.m[k] = rec
+		c.Unlock()
+		return
+	}
+	var slot int
+	if n := len(c.free); n > 0 {
+		slot = c.free[n-1]
+		c.free = c.free[:n-1]
+	} else if len(c.ring) < c.max {
+		slot = len(c.ring)
+		c.ring = append(c.ring, k)
+	} else {
+		slot = c.pos
+		old := c.ring[slot]
+		if rec, ok := c.m[old]; ok && rec.slot == slot {
+			delete(c.m, old)
+			c.count("SigCacheEvict")
+		}
+		c.pos = (c.pos + 1) % c.max
+	}
+	c.ring[slot] = k
+	c.m[k] = verifyCacheRec{flags: flags, slot: slot}
+	c.Unlock()
+	c.count("SigCacheAdd")
+}
+
+// Check returns true if input i of the given transaction has already been verified
+// with (at least) all the given flags. When erase is true, a matching entry gets removed
+// from the cache, as it is not going to be needed again (i.e. the tx has been mined).
+func (c *VerifyCache) Check(wtxid *btc.Uint256, i int, flags uint32, erase bool) bool {
+	if c == nil || c.max == 0 {
+		return false
+	}
+	k := c.key(wtxid, i)
+	c.Lock()
+	rec, ok := c.m[k]
+	ok = ok && (rec.flags&flags) == flags
+	if ok && erase {
+		delete(c.m, k)
+		c.free = append(c.free, rec.slot)
+	}
+	c.Unlock()
+	if ok {
+		c.count("SigCacheHit")
+	} else {
+		c.count("SigCacheMiss")
+	}
+	return ok
+}
+
+// Len returns the number of entries in the cache.
+func (c *VerifyCache) Len() (res int) {
+	if c != nil {
+		c.Lock()
+		res = len(c.m)
+		c.Unlock()
+	}
+	return
+}
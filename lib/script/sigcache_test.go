@@ -0,0 +1,65 @@
+package script
+
+import (
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func TestVerifyCache(t *testing.T) {
+	var h1, h2, h3 btc.Uint256
+	h1.Hash[0] = 1
+	h2.Hash[0] = 2
+	h3.Hash[0] = 3
+
+	c := NewVerifyCache(2)
+	if c.Check(&h1, 0, VER_P2SH, false) {
+		t.Error("Hit on empty cache")
+	}
+
+	c.Add(&h1, 0, STANDARD_VERIFY_FLAGS)
+	if !c.Check(&h1, 0, VER_P2SH|VER_WITNESS, false) {
+		t.Error("No hit for a subset of flags")
+	}
+	if c.Check(&h1, 0, VER_SIGPUSHONLY, false) {
+		t.Error("Hit for a flag that was not verified")
+	}
+	if c.Check(&h1, 1, VER_P2SH, false) {
+		t.Error("Hit for a different input")
+	}
+
+	c.Add(&h2, 0, VER_P2SH)
+	c.Add(&h3, 0, VER_P2SH) // evicts h1
+	if c.Len() != 2 {
+		t.Error("Bad length", c.Len())
+	}
+	if c.Check(&h1, 0, VER_P2SH, false) {
+		t.Error("Oldest entry not evicted")
+	}
+
+	if !c.Check(&h2, 0, VER_P2SH, true) {
+		t.Error("h2 not found")
+	}
+	if c.Check(&h2, 0, VER_P2SH, false) {
+		t.Error("h2 not erased")
+	}
+
+	// the erased entry's slot gets reused, so nothing is evicted now
+	c.Add(&h2, 0, VER_P2SH)
+	if c.Len() != 2 || !c.Check(&h3, 0, VER_P2SH, false) {
+		t.Error("Entry evicted while there was a free slot")
+	}
+	// and the re-added entry is not evicted through its old slot
+	c.Check(&h3, 0, VER_P2SH, true)
+	c.Add(&h1, 0, VER_P2SH)
+	c.Add(&h3, 0, VER_P2SH) // evicts h2, as the oldest
+	if c.Len() != 2 || c.Check(&h2, 0, VER_P2SH, false) || !c.Check(&h1, 0, VER_P2SH, false) {
+		t.Error("Bad eviction after re-adding", c.Len())
+	}
+
+	var nc *VerifyCache
+	nc.Add(&h1, 0, VER_P2SH)
+	if nc.Check(&h1, 0, VER_P2SH, false) {
+		t.Error("Hit on nil cache")
+	}
+}
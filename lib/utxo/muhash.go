@@ -0,0 +1,194 @@
+package utxo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+/*
+	MuHash3072 - the rolling UTXO set hash, as used by Bitcoin Core (see its crypto/muhash.cpp).
+	Each coin is mapped to a number modulo 2^3072 - 1103717, by hashing its serialization
+	(the same as for hash_serialized_3) with SHA256 and expanding it with ChaCha20.
+	The set's hash is the product of the numbers of all its coins, so the coins can be
+	added and removed in any order. The final 32 bytes are SHA256 of the product.
+*/
+
+const (
+	MUHASH_BYTES = 384
+	muhash_c     = 1103717
+)
+
+var (
+	muhash_mask  = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1))
+	muhash_prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(muhash_c))
+	muhash_cbig  = big.NewInt(muhash_c)
+)
+
+type MuHash struct {
+	num, den *big.Int
+}
+
+// NewMuHash returns the hash of an empty set.
+func NewMuHash() *MuHash {
+	return &MuHash{num: big.NewInt(1), den: big.NewInt(1)}
+}
+
+// muhashReduce brings x (up to 6144 bits) back below the prime.
+func muhashReduce(x *big.Int) *big.Int {
+	var hi big.Int
+	for x.BitLen() > 3072 {
+		hi.Rsh(x, 3072)
+		x.And(x, muhash_mask)
+		hi.Mul(&hi, muhash_cbig)
+		x.Add(x, &hi)
+	}
+	if x.Cmp(muhash_prime) >= 0 {
+		x.Sub(x, muhash_prime)
+	}
+	return x
+}
+
+func muhashMul(a, b *big.Int) {
+	a.Mul(a, b)
+	muhashReduce(a)
+}
+
+func chacha20Block(out []byte, key *[8]uint32, counter uint32) {
+	var s, x [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	copy(s[4:12], key[:])
+	s[12] = counter
+	x = s
+	qr := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+		x[a] += x[b]
+		x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+		x[c] += x[d]
+		x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+	}
+	for i := 0; i < 10; i++ {
+		qr(0, 4, 8, 12)
+		qr(1, 5, 9, 13)
+		qr(2, 6, 10, 14)
+		qr(3, 7, 11, 15)
+		qr(0, 5, 10, 15)
+		qr(1, 6, 11, 12)
+		qr(2, 7, 8, 13)
+		qr(3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+s[i])
+	}
+}
+
+// leToInt converts a little endian number to big.Int
+func leToInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// muhashNum maps the data to a 3072-bit number.
+func muhashNum(data []byte) *big.Int {
+	var key [8]uint32
+	var tmp [MUHASH_BYTES]byte
+	h := sha256.Sum256(data)
+	for i := range key {
+		key[i] = binary.LittleEndian.Uint32(h[4*i:])
+	}
+	for i := 0; i < MUHASH_BYTES/64; i++ {
+		chacha20Block(tmp[64*i:], &key, uint32(i))
+	}
+	return muhashReduce(leToInt(tmp[:]))
+}
+
+// muhashProduct multiplies the numbers of all the given elements, using all the CPUs if there are many.
+func muhashProduct(data [][]byte) *big.Int {
+	threads := runtime.NumCPU()
+	if len(data) < 4*threads {
+		threads = 1
+	}
+	res := make([]*big.Int, threads)
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t int) {
+			x := big.NewInt(1)
+			for i := t; i < len(data); i += threads {
+				muhashMul(x, muhashNum(data[i]))
+			}
+			res[t] = x
+			wg.Done()
+		}(t)
+	}
+	wg.Wait()
+	for t := 1; t < threads; t++ {
+		muhashMul(res[0], res[t])
+	}
+	return res[0]
+}
+
+// Insert adds the element to the set.
+func (m *MuHash) Insert(data []byte) {
+	muhashMul(m.num, muhashNum(data))
+}
+
+// Remove removes the element from the set.
+func (m *MuHash) Remove(data []byte) {
+	muhashMul(m.den, muhashNum(data))
+}
+
+// Update adds and removes many elements at once.
+func (m *MuHash) Update(add, del [][]byte) {
+	if len(add) > 0 {
+		muhashMul(m.num, muhashProduct(add))
+	}
+	if len(del) > 0 {
+		muhashMul(m.den, muhashProduct(del))
+	}
+}
+
+// Combine adds all the elements of the other set.
+func (m *MuHash) Combine(o *MuHash) {
+	muhashMul(m.num, o.num)
+	muhashMul(m.den, o.den)
+}
+
+// normalize moves the denominator into the numerator.
+func (m *MuHash) normalize() {
+	if m.den.Cmp(big.NewInt(1)) != 0 {
+		muhashMul(m.num, new(big.Int).ModInverse(m.den, muhash_prime))
+		m.den.SetInt64(1)
+	}
+}
+
+// Bytes returns the current state, in the format of Core's Num3072 (little endian).
+func (m *MuHash) Bytes() (res []byte) {
+	m.normalize()
+	res = make([]byte, MUHASH_BYTES)
+	be := m.num.Bytes()
+	for i := range be {
+		res[len(be)-1-i] = be[i]
+	}
+	return
+}
+
+// SetBytes restores the state returned by Bytes.
+func (m *MuHash) SetBytes(b []byte) {
+	m.num = muhashReduce(leToInt(b))
+	m.den = big.NewInt(1)
+}
+
+// Finalize returns the hash of the set (the muhash of Core's gettxoutsetinfo).
+func (m *MuHash) Finalize() [32]byte {
+	return sha256.Sum256(m.Bytes())
+}
@@ -0,0 +1,65 @@
+package utxo
+
+import (
+	"testing"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+)
+
+func muhashElem(i byte) []byte {
+	var tmp [32]byte
+	tmp[0] = i
+	return tmp[:]
+}
+
+func TestMuHash(t *testing.T) {
+	// from Bitcoin Core's crypto_tests.cpp
+	m := NewMuHash()
+	m.Insert(muhashElem(0))
+	m.Insert(muhashElem(1))
+	m.Remove(muhashElem(2))
+	res := m.Finalize()
+	if s := btc.NewUint256(res[:]).String(); s != "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863" {
+		t.Error("bad muhash", s)
+	}
+
+	// the order does not matter
+	m1, m2 := NewMuHash(), NewMuHash()
+	var els [][]byte
+	for i := 0; i < 100; i++ {
+		els = append(els, muhashElem(byte(i)))
+		m1.Insert(els[i])
+	}
+	m2.Update(els[50:], nil)
+	m2.Update(els[:50], [][]byte{muhashElem(200)})
+	m2.Insert(muhashElem(200))
+	if m1.Finalize() != m2.Finalize() {
+		t.Error("Update mismatch")
+	}
+
+	m3 := NewMuHash()
+	m3.SetBytes(m2.Bytes())
+	if m3.Finalize() != m1.Finalize() {
+		t.Error("SetBytes mismatch")
+	}
+}
+
+func TestMuHashUnspentDB(t *testing.T) {
+	db := &UnspentDB{HashMap: make(map[UtxoKeyType][]byte), muhash: NewMuHash()}
+	db.commit(&BlockChanges{Height: 1, AddList: []*UtxoRec{
+		{TxID: [32]byte{1}, Coinbase: true, InBlock: 1, Outs: []*UtxoTxOut{{Value: 50e8, PKScr: []byte{0x51}}}},
+		{TxID: [32]byte{2}, InBlock: 1, Outs: []*UtxoTxOut{{Value: 1, PKScr: []byte{0x52}},
+			{Value: 2, PKScr: []byte{0x53}}, {Value: 0, PKScr: []byte{0x6a}}}},
+	}})
+	db.muhashApply()
+	db.commit(&BlockChanges{Height: 2, DeledTxs: map[[32]byte][]bool{{2}: {false, true, false}}})
+	db.muhashApply()
+
+	if db.muhash.Finalize() != db.calcMuHash().Finalize() {
+		t.Error("rolling muhash mismatch")
+	}
+	info := db.GetTxOutSetInfo(true, true)
+	if info.TxOuts != 2 || info.Transactions != 2 || info.TotalAmount != 50e8+1 || *info.MuHash != db.muhash.Finalize() {
+		t.Error("bad txoutset info", info)
+	}
+}
@@ -0,0 +1,397 @@
+package utxo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/script"
+)
+
+/*
+	UTXO set snapshots in the format of Bitcoin Core's dumptxoutset (version 2):
+	  [0:5]   - magic bytes "utxo\xff"
+	  [5:7]   - version (uint16)
+	  [7:11]  - network magic
+	  [11:43] - hash of the block at which the snapshot was taken
+	  [43:51] - number of coins (uint64)
+	Followed by the coins, grouped by TXID (in the order of the TXIDs):
+	  32 bytes TXID, compact size: number of coins, and for each coin:
+	    compact size: vout
+	    VARINT: 2*height + is_coinbase
+	    VARINT: compressed amount
+	    compressed script (see script.CompressScript) or VARINT(6+length) followed by the script
+
+	VARINT is Core's MSB base-128 encoding - not the same as btc.VLen.
+*/
+
+const SNAPSHOT_VERSION = 2
+
+var SnapshotMagic = []byte{'u', 't', 'x', 'o', 0xff}
+
+type SnapshotHeader struct {
+	NetMagic  [4]byte
+	BlockHash [32]byte
+	Coins     uint64
+}
+
+func writeVarInt(w io.Writer, n uint64) {
+	var tmp [10]byte
+	var l int
+	for {
+		tmp[l] = byte(n & 0x7f)
+		if l > 0 {
+			tmp[l] |= 0x80
+		}
+		if n <= 0x7f {
+			break
+		}
+		n = (n >> 7) - 1
+		l++
+	}
+	for i := l; i >= 0; i-- {
+		w.Write(tmp[i : i+1])
+	}
+}
+
+func readVarInt(r io.ByteReader) (n uint64, e error) {
+	var b byte
+	for i := 0; i < 10; i++ {
+		if b, e = r.ReadByte(); e != nil {
+			return
+		}
+		n = (n << 7) | uint64(b&0x7f)
+		if (b & 0x80) == 0 {
+			return
+		}
+		n++
+	}
+	e = errors.New("VARINT too long")
+	return
+}
+
+// coreUnspendable returns true for the outputs that Bitcoin Core never puts into its UTXO set.
+func coreUnspendable(scr []byte) bool {
+	return len(scr) > 0 && scr[0] == 0x6a || len(scr) > script.MAX_SCRIPT_SIZE
+}
+
+// CoinsHasher calculates hash_serialized_3 of the UTXO set, as reported by Core's gettxoutsetinfo.
+// The coins must be added in the order of their outpoints.
+type CoinsHasher struct {
+	h   hash.Hash
+	buf bytes.Buffer
+}
+
+func NewCoinsHasher() *CoinsHasher {
+	return &CoinsHasher{h: sha256.New()}
+}
+
+// writeCoin writes the coin's serialization used by Core's UTXO set hashes (TxOutSer).
+func writeCoin(buf *bytes.Buffer, txid []byte, vout uint32, height uint32, coinbase bool, value uint64, pkscr []byte) {
+	var b [8]byte
+	code := height << 1
+	if coinbase {
+		code |= 1
+	}
+	buf.Write(txid[:32])
+	binary.LittleEndian.PutUint32(b[:4], vout)
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint32(b[:4], code)
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint64(b[:], value)
+	buf.Write(b[:])
+	btc.WriteVlen(buf, uint64(len(pkscr)))
+	buf.Write(pkscr)
+}
+
+func (hs *CoinsHasher) Add(txid []byte, vout uint32, height uint32, coinbase bool, value uint64, pkscr []byte) {
+	hs.buf.Reset()
+	writeCoin(&hs.buf, txid, vout, height, coinbase, value, pkscr)
+	hs.h.Write(hs.buf.Bytes())
+}
+
+// Sum returns the double SHA256 of all the coins added.
+func (hs *CoinsHasher) Sum() (res [32]byte) {
+	return sha256.Sum256(hs.h.Sum(nil))
+}
+
+// sortedKeys returns the keys of the HashMap in the ascending order (which is also the order of the TXIDs).
+// Call it with the RWMutex locked.
+func (db *UnspentDB) sortedKeys() (keys []UtxoKeyType) {
+	keys = make([]UtxoKeyType, 0, len(db.HashMap))
+	for k := range db.HashMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	return
+}
+
+// walkCoins calls the callback for each spendable output, in the order of the outpoints.
+// Call it with the Mutex and the RWMutex locked.
+func (db *UnspentDB) walkCoins(keys []UtxoKeyType, cb func(rec *UtxoRec, vout uint32, out *UtxoTxOut) error) (e error) {
+	for _, k := range keys {
+		rec := NewUtxoRec(k, db.HashMap[k])
+		for vout, out := range rec.Outs {
+			if out != nil && !coreUnspendable(out.PKScr) {
+				if e = cb(rec, uint32(vout), out); e != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// UTXOHash returns hash_serialized_3 of the UTXO set and the number of the outputs.
+func (db *UnspentDB) UTXOHash() (res [32]byte, cnt uint64) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	db.flush()
+	db.RWMutex.RLock()
+	defer db.RWMutex.RUnlock()
+
+	hs := NewCoinsHasher()
+	db.walkCoins(db.sortedKeys(), func(rec *UtxoRec, vout uint32, out *UtxoTxOut) error {
+		hs.Add(rec.TxID[:], vout, rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+		cnt++
+		return nil
+	})
+	res = hs.Sum()
+	return
+}
+
+// WriteSnapshot writes the UTXO set in Core's dumptxoutset format.
+// It returns hash_serialized_3 of the set and the number of coins written.
+func (db *UnspentDB) WriteSnapshot(w io.Writer, netmagic [4]byte) (res [32]byte, cnt uint64, e error) {
+	var ver [2]byte
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	db.abortWriting()
+	db.flush()
+	db.RWMutex.RLock()
+	defer db.RWMutex.RUnlock()
+
+	if db.LastBlockHash == nil {
+		e = errors.New("UTXO set is empty")
+		return
+	}
+	keys := db.sortedKeys()
+	db.walkCoins(keys, func(*UtxoRec, uint32, *UtxoTxOut) error {
+		cnt++
+		return nil
+	})
+
+	wr := bufio.NewWriterSize(w, 0x100000)
+	wr.Write(SnapshotMagic)
+	binary.LittleEndian.PutUint16(ver[:], SNAPSHOT_VERSION)
+	wr.Write(ver[:])
+	wr.Write(netmagic[:])
+	wr.Write(db.LastBlockHash)
+	binary.Write(wr, binary.LittleEndian, cnt)
+
+	hs := NewCoinsHasher()
+	var outs []uint32
+	var last *UtxoRec
+	flush := func() {
+		if len(outs) > 0 {
+			wr.Write(last.TxID[:])
+			btc.WriteVlen(wr, uint64(len(outs)))
+			for _, vout := range outs {
+				out := last.Outs[vout]
+				btc.WriteVlen(wr, uint64(vout))
+				code := uint64(last.InBlock) << 1
+				if last.Coinbase {
+					code |= 1
+				}
+				writeVarInt(wr, code)
+				writeVarInt(wr, btc.CompressAmount(out.Value))
+				if cs := script.CompressScript(out.PKScr); cs != nil {
+					wr.Write(cs)
+				} else {
+					writeVarInt(wr, uint64(6+len(out.PKScr)))
+					wr.Write(out.PKScr)
+				}
+			}
+			outs = outs[:0]
+		}
+	}
+	for _, k := range keys {
+		last = NewUtxoRec(k, db.HashMap[k])
+		for vout, out := range last.Outs {
+			if out != nil && !coreUnspendable(out.PKScr) {
+				hs.Add(last.TxID[:], uint32(vout), last.InBlock, last.Coinbase, out.Value, out.PKScr)
+				outs = append(outs, uint32(vout))
+			}
+		}
+		flush()
+	}
+	res = hs.Sum()
+	e = wr.Flush()
+	return
+}
+
+// ReadSnapshotHeader reads and checks the header of a snapshot file.
+func ReadSnapshotHeader(rd io.Reader) (hdr *SnapshotHeader, e error) {
+	var b [51]byte
+	if _, e = io.ReadFull(rd, b[:]); e != nil {
+		return
+	}
+	if !bytes.Equal(b[:5], SnapshotMagic) {
+		e = errors.New("not a UTXO snapshot file")
+		return
+	}
+	if v := binary.LittleEndian.Uint16(b[5:7]); v != SNAPSHOT_VERSION {
+		e = fmt.Errorf("unsupported snapshot version %d", v)
+		return
+	}
+	hdr = new(SnapshotHeader)
+	copy(hdr.NetMagic[:], b[7:11])
+	copy(hdr.BlockHash[:], b[11:43])
+	hdr.Coins = binary.LittleEndian.Uint64(b[43:51])
+	return
+}
+
+// ReadSnapshot reads the coins that follow the header and returns them as a new HashMap,
+// together with their hash_serialized_3. None of the coins may be above max_height.
+func ReadSnapshot(rd *bufio.Reader, hdr *SnapshotHeader, max_height uint32, abort *bool) (hm map[UtxoKeyType][]byte, res [32]byte, e error) {
+	var txid, prev_txid [32]byte
+	var cnt, n, u64 uint64
+	var scr []byte
+	var k UtxoKeyType
+
+	prealloc := hdr.Coins / 2
+	if prealloc > UTXO_RECORDS_PREALLOC {
+		prealloc = UTXO_RECORDS_PREALLOC
+	}
+	hm = make(map[UtxoKeyType][]byte, prealloc)
+	hs := NewCoinsHasher()
+	perc := uint64(101)
+	for cnt < hdr.Coins {
+		if abort != nil && *abort {
+			e = errors.New("aborted")
+			return
+		}
+		if p := 100 * cnt / hdr.Coins; p != perc {
+			perc = p
+			fmt.Print("\rLoading UTXO snapshot - ", perc, "% complete ... ")
+		}
+		if _, e = io.ReadFull(rd, txid[:]); e != nil {
+			return
+		}
+		if cnt > 0 && bytes.Compare(txid[:], prev_txid[:]) <= 0 {
+			e = errors.New("snapshot coins are not sorted")
+			return
+		}
+		prev_txid = txid
+		if n, e = btc.ReadVLen(rd); e != nil {
+			return
+		}
+		if n == 0 || cnt+n > hdr.Coins {
+			e = errors.New("bad number of coins in snapshot")
+			return
+		}
+		rec := &UtxoRec{TxID: txid}
+		var prev_vout uint64
+		for i := uint64(0); i < n; i++ {
+			var vout uint64
+			if vout, e = btc.ReadVLen(rd); e != nil {
+				return
+			}
+			if i > 0 && vout <= prev_vout || vout >= 0x100000 {
+				e = errors.New("bad output index in snapshot")
+				return
+			}
+			prev_vout = vout
+			if u64, e = readVarInt(rd); e != nil {
+				return
+			}
+			if i == 0 {
+				rec.InBlock, rec.Coinbase = uint32(u64>>1), (u64&1) != 0
+			} else if rec.InBlock != uint32(u64>>1) || rec.Coinbase != ((u64&1) != 0) {
+				e = errors.New("inconsistent coins of one transaction in snapshot")
+				return
+			}
+			if rec.InBlock > max_height {
+				e = errors.New("snapshot coin above the base height")
+				return
+			}
+			if u64, e = readVarInt(rd); e != nil {
+				return
+			}
+			out := &UtxoTxOut{Value: btc.DecompressAmount(u64)}
+			if u64, e = readVarInt(rd); e != nil {
+				return
+			}
+			if u64 < 6 {
+				scr = make([]byte, ComprScrLen[u64])
+				scr[0] = byte(u64)
+				if _, e = io.ReadFull(rd, scr[1:]); e != nil {
+					return
+				}
+				if out.PKScr = script.DecompressScript(scr); out.PKScr == nil {
+					e = errors.New("bad compressed script in snapshot")
+					return
+				}
+			} else {
+				if u64-6 > script.MAX_SCRIPT_SIZE {
+					e = errors.New("script too long in snapshot")
+					return
+				}
+				out.PKScr = make([]byte, u64-6)
+				if _, e = io.ReadFull(rd, out.PKScr); e != nil {
+					return
+				}
+			}
+			for uint64(len(rec.Outs)) <= vout {
+				rec.Outs = append(rec.Outs, nil)
+			}
+			rec.Outs[vout] = out
+			hs.Add(txid[:], uint32(vout), rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+		}
+		cnt += n
+		copy(k[:], txid[:])
+		hm[k] = Serialize(rec, false, nil)
+	}
+	fmt.Print("\r                                                                 \r")
+	if _, er := rd.ReadByte(); er != io.EOF {
+		e = errors.New("extra data at the end of snapshot")
+		return
+	}
+	res = hs.Sum()
+	return
+}
+
+// ReplaceWith replaces the content of the UTXO set, i.e. with one loaded from a snapshot.
+// The undo data is removed, so the new state cannot be rolled back.
+func (db *UnspentDB) ReplaceWith(hm map[UtxoKeyType][]byte, height uint32, blhash []byte) {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	db.abortWriting()
+	db.flush()
+
+	db.RWMutex.Lock()
+	for _, v := range db.HashMap {
+		Memory_Free(v)
+	}
+	db.HashMap = hm
+	db.LastBlockHash = make([]byte, 32)
+	copy(db.LastBlockHash, blhash)
+	db.LastBlockHeight = height
+	db.RWMutex.Unlock()
+	db.muhash = nil // will be calculated when needed
+
+	os.RemoveAll(db.dir_undo)
+	db.undo_dir_created = false
+	db.DirtyDB.Set()
+	db.Save()
+}
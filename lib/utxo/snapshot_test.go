@@ -0,0 +1,89 @@
+package utxo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVarInt(t *testing.T) {
+	for _, v := range []struct {
+		n   uint64
+		hex string
+	}{
+		{0, "00"}, {127, "7f"}, {128, "8000"}, {255, "807f"}, {256, "8100"}, {16383, "fe7f"},
+		{16384, "ff00"}, {16511, "ff7f"}, {65535, "82fe7f"}, {1 << 32, "8efefeff00"},
+	} {
+		var buf bytes.Buffer
+		writeVarInt(&buf, v.n)
+		if hex.EncodeToString(buf.Bytes()) != v.hex {
+			t.Error("writeVarInt", v.n, hex.EncodeToString(buf.Bytes()), v.hex)
+		}
+		if n, e := readVarInt(&buf); e != nil || n != v.n {
+			t.Error("readVarInt", v.hex, n, e)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	p2kh, _ := hex.DecodeString("76a914a25dec4d0011064ef106a983c39c7a540699f22088ac")
+	db := &UnspentDB{HashMap: make(map[UtxoKeyType][]byte)}
+	db.LastBlockHash = make([]byte, 32)
+	db.LastBlockHash[0] = 0xaa
+	db.LastBlockHeight = 100
+	for _, rec := range []*UtxoRec{
+		{TxID: [32]byte{1, 2, 3}, Coinbase: true, InBlock: 7,
+			Outs: []*UtxoTxOut{{Value: 50e8, PKScr: p2kh}}},
+		{TxID: [32]byte{0, 9}, InBlock: 99,
+			Outs: []*UtxoTxOut{nil, {Value: 12345, PKScr: []byte{0x51}}, {Value: 0, PKScr: []byte{0x6a, 0x01, 0x02}}}},
+		{TxID: [32]byte{0xff}, InBlock: 100,
+			Outs: []*UtxoTxOut{{Value: 1, PKScr: p2kh}, {Value: 2, PKScr: []byte{}}}},
+	} {
+		var k UtxoKeyType
+		copy(k[:], rec.TxID[:])
+		db.HashMap[k] = Serialize(rec, false, nil)
+	}
+
+	var buf bytes.Buffer
+	hash, cnt, e := db.WriteSnapshot(&buf, [4]byte{0xf9, 0xbe, 0xb4, 0xd9})
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if cnt != 4 { // the OP_RETURN output is not included
+		t.Error("coins written", cnt)
+	}
+	if h2, cnt2 := db.UTXOHash(); h2 != hash || cnt2 != cnt {
+		t.Error("UTXOHash mismatch")
+	}
+
+	rd := bufio.NewReader(&buf)
+	hdr, e := ReadSnapshotHeader(rd)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if hdr.Coins != 4 || hdr.BlockHash[0] != 0xaa || hdr.NetMagic[0] != 0xf9 {
+		t.Error("bad header", hdr)
+	}
+	if _, _, e = ReadSnapshot(bufio.NewReader(bytes.NewReader(buf.Bytes())), hdr, 99, nil); e == nil {
+		t.Error("coin above max_height not detected")
+	}
+	hm, hash2, e := ReadSnapshot(rd, hdr, 100, nil)
+	if e != nil {
+		t.Fatal(e.Error())
+	}
+	if hash2 != hash {
+		t.Error("hash mismatch")
+	}
+	if len(hm) != 3 {
+		t.Fatal("records loaded", len(hm))
+	}
+	rec := NewUtxoRec(UtxoKeyType{0, 9}, hm[UtxoKeyType{0, 9}])
+	if len(rec.Outs) != 2 || rec.Outs[0] != nil || rec.Outs[1].Value != 12345 || rec.InBlock != 99 || rec.Coinbase {
+		t.Error("bad record loaded")
+	}
+	rec = NewUtxoRec(UtxoKeyType{1, 2, 3}, hm[UtxoKeyType{1, 2, 3}])
+	if !rec.Coinbase || rec.Outs[0].Value != 50e8 || !bytes.Equal(rec.Outs[0].PKScr, p2kh) {
+		t.Error("bad coinbase record loaded")
+	}
+}
@@ -0,0 +1,145 @@
+package utxo
+
+import (
+	"bytes"
+)
+
+// muhashAdd notes the coins of the record being added to the set.
+func (db *UnspentDB) muhashAdd(rec *UtxoRec) {
+	if db.muhash == nil {
+		return
+	}
+	for vout, out := range rec.Outs {
+		if out != nil && !coreUnspendable(out.PKScr) {
+			buf := new(bytes.Buffer)
+			writeCoin(buf, rec.TxID[:], uint32(vout), rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+			db.mh_add = append(db.mh_add, buf.Bytes())
+		}
+	}
+}
+
+// muhashDel notes the coin being removed from the set.
+func (db *UnspentDB) muhashDel(rec *UtxoRec, vout int) {
+	if db.muhash == nil || vout >= len(rec.Outs) {
+		return
+	}
+	if out := rec.Outs[vout]; out != nil && !coreUnspendable(out.PKScr) {
+		buf := new(bytes.Buffer)
+		writeCoin(buf, rec.TxID[:], uint32(vout), rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+		db.mh_del = append(db.mh_del, buf.Bytes())
+	}
+}
+
+// muhashApply updates the rolling hash with the coins noted by muhashAdd and muhashDel.
+func (db *UnspentDB) muhashApply() {
+	if db.muhash != nil {
+		db.muhash.Update(db.mh_add, db.mh_del)
+	}
+	db.mh_add, db.mh_del = nil, nil
+}
+
+// muhashFlush makes sure the rolling hash is up to date, calculating it from scratch if it is not known.
+// Call it with the Mutex and the RWMutex (at least for reading) locked.
+func (db *UnspentDB) muhashFlush() {
+	if db.muhash == nil {
+		db.mh_add, db.mh_del = nil, nil // these are already in the set
+		db.muhash = db.calcMuHash()
+	} else {
+		db.muhashApply()
+	}
+}
+
+// calcMuHash calculates the rolling hash from scratch.
+// Call it with the Mutex and the RWMutex locked.
+func (db *UnspentDB) calcMuHash() (m *MuHash) {
+	var batch [][]byte
+	m = NewMuHash()
+	for k, v := range db.HashMap {
+		rec := NewUtxoRec(k, v)
+		for vout, out := range rec.Outs {
+			if out != nil && !coreUnspendable(out.PKScr) {
+				buf := new(bytes.Buffer)
+				writeCoin(buf, rec.TxID[:], uint32(vout), rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+				batch = append(batch, buf.Bytes())
+			}
+		}
+		if len(batch) >= 0x10000 {
+			m.Update(batch, nil)
+			batch = batch[:0]
+		}
+	}
+	m.Update(batch, nil)
+	return
+}
+
+// MuHash returns the muhash of the UTXO set, as reported by Core's gettxoutsetinfo.
+func (db *UnspentDB) MuHash() [32]byte {
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	db.abortWriting()
+	db.flush()
+	db.RWMutex.RLock()
+	db.muhashFlush()
+	db.RWMutex.RUnlock()
+	return db.muhash.Finalize()
+}
+
+type TxOutSetInfo struct {
+	Height         uint32
+	BlockHash      []byte
+	Transactions   uint64
+	TxOuts         uint64
+	BogoSize       uint64
+	TotalAmount    uint64
+	HashSerialized *[32]byte // nil if not requested
+	MuHash         *[32]byte // nil if not requested
+}
+
+// GetTxOutSetInfo returns the statistics of the UTXO set, like Core's gettxoutsetinfo.
+// Calculating hash_serialized_3 requires sorting of the whole set, so it is only done if requested.
+func (db *UnspentDB) GetTxOutSetInfo(hash_serialized, muhash bool) (res *TxOutSetInfo) {
+	var hs *CoinsHasher
+	db.Mutex.Lock()
+	defer db.Mutex.Unlock()
+	db.abortWriting()
+	db.flush()
+	db.RWMutex.RLock()
+	defer db.RWMutex.RUnlock()
+
+	res = &TxOutSetInfo{Height: db.LastBlockHeight, BlockHash: append([]byte{}, db.LastBlockHash...)}
+	if muhash {
+		db.muhashFlush()
+		res.MuHash = new([32]byte)
+		*res.MuHash = db.muhash.Finalize()
+	}
+
+	var keys []UtxoKeyType
+	if hash_serialized {
+		hs = NewCoinsHasher()
+		keys = db.sortedKeys()
+	} else {
+		keys = make([]UtxoKeyType, 0, len(db.HashMap))
+		for k := range db.HashMap {
+			keys = append(keys, k)
+		}
+	}
+	var last *UtxoRec
+	db.walkCoins(keys, func(rec *UtxoRec, vout uint32, out *UtxoTxOut) error {
+		if rec != last {
+			res.Transactions++
+			last = rec
+		}
+		res.TxOuts++
+		res.BogoSize += 32 + 4 + 4 + 8 + 2 + uint64(len(out.PKScr))
+		res.TotalAmount += out.Value
+		if hs != nil {
+			hs.Add(rec.TxID[:], vout, rec.InBlock, rec.Coinbase, out.Value, out.PKScr)
+		}
+		return nil
+	})
+	if hs != nil {
+		res.HashSerialized = new([32]byte)
+		*res.HashSerialized = hs.Sum()
+	}
+	return
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"github.com/piotrnar/gocoin/lib/others/sys"
@@ -21,8 +22,13 @@ var (
 	UTXO_WRITING_TIME_TARGET        = 5 * time.Minute // Take it easy with flushing UTXO.db onto disk
 	UTXO_SKIP_SAVE_BLOCKS    uint32 = 0
 	UTXO_PURGE_UNSPENDABLE   bool = false
+	UTXO_MUHASH_BATCH               = 0x10000 // away from the chain's tip, update the rolling hash once this many coins are pending
+	UTXO_COMMIT_BATCH               = 0x40000 // away from the chain's tip, move the changes into HashMap once this many records are pending
 )
 
+// If this bit is set in UTXO.db's block height, the file ends with the MuHash of the set
+const UTXO_DB_MUHASH_FLAG = 0x4000000000000000
+
 var Memory_Malloc = func(le int) []byte {
 	return make([]byte, le)
 }
@@ -37,6 +43,9 @@ type CallbackFunctions struct {
 	// output is being added or removed. When being removed, btc.TxOut is nil.
 	NotifyTxAdd func(*UtxoRec)
 	NotifyTxDel func(*UtxoRec, []bool)
+	// If NotifyBlock is set, it will be called after each block commit and before each undo,
+	// with the block in changes.Block (for undo only Height and Block are set).
+	NotifyBlock func(changes *BlockChanges, undo bool)
 }
 
 // BlockChanges is used to pass block's changes to UnspentDB.
@@ -46,6 +55,7 @@ type BlockChanges struct {
 	AddList         []*UtxoRec
 	DeledTxs        map[[32]byte][]bool
 	UndoData        map[[32]byte]*UtxoRec
+	Block           *btc.Block // only for NotifyBlock
 }
 
 type UnspentDB struct {
@@ -72,6 +82,17 @@ type UnspentDB struct {
 	CB                  CallbackFunctions
 
 	undo_dir_created    bool
+	prealloc            int
+
+	muhash         *MuHash  // rolling hash of the set (nil if not known)
+	mh_add, mh_del [][]byte // coins added/removed by the current block
+
+	// Away from the chain's tip, the changes of several blocks are collected in pending
+	// (nil value for a removed record) and moved into HashMap at once, by flush().
+	// Records created and spent within the batch never get to HashMap.
+	// Both maps are accessed with the RWMutex locked.
+	pending  map[UtxoKeyType][]byte
+	batching bool
 }
 
 type NewUnspentOpts struct {
@@ -82,6 +103,7 @@ type NewUnspentOpts struct {
 	CB              CallbackFunctions
 	AbortNow        *bool
 	UseGoHeap       bool
+	Prealloc        int // initial size of an empty UTXO map (UTXO_RECORDS_PREALLOC if zero)
 }
 
 func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB) {
@@ -92,6 +114,9 @@ func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB) {
 	db.volatimemode = opts.VolatimeMode
 	db.UnwindBufLen = 256
 	db.CB = opts.CB
+	if db.prealloc = opts.Prealloc; db.prealloc == 0 {
+		db.prealloc = UTXO_RECORDS_PREALLOC
+	}
 	db.abortwritingnow = make(chan bool, 1)
 	db.hurryup = make(chan bool, 1)
 
@@ -103,7 +128,8 @@ func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB) {
 	}
 
 	if opts.Rescan {
-		db.HashMap = make(map[UtxoKeyType][]byte, UTXO_RECORDS_PREALLOC)
+		db.HashMap = make(map[UtxoKeyType][]byte, db.prealloc)
+		db.muhash = NewMuHash()
 		return
 	}
 
@@ -113,6 +139,7 @@ func NewUnspentDb(opts *NewUnspentOpts) (db *UnspentDB) {
 	var le uint64
 	var u64, tot_recs uint64
 	var info string
+	var has_muhash bool
 	var rd *bufio.Reader
 	var of *os.File
 
@@ -134,6 +161,7 @@ redo:
 
 	// If the highest bit of the block number is set, the UTXO records are compressed
 	db.ComprssedUTXO = (u64 & 0x8000000000000000) != 0
+	has_muhash = (u64 & UTXO_DB_MUHASH_FLAG) != 0
 
 	db.LastBlockHash = make([]byte, 32)
 	_, er = rd.Read(db.LastBlockHash)
@@ -187,6 +215,14 @@ redo:
 			cnt_dwn--
 		}
 	}
+	if has_muhash {
+		mh := make([]byte, MUHASH_BYTES)
+		if _, er = io.ReadFull(rd, mh); er != nil {
+			goto fatal_error
+		}
+		db.muhash = NewMuHash()
+		db.muhash.SetBytes(mh)
+	}
 	of.Close()
 
 	fmt.Print("\r                                                                 \r")
@@ -214,7 +250,8 @@ fatal_error:
 	}
 	db.LastBlockHeight = 0
 	db.LastBlockHash = nil
-	db.HashMap = make(map[UtxoKeyType][]byte, UTXO_RECORDS_PREALLOC)
+	db.HashMap = make(map[UtxoKeyType][]byte, db.prealloc)
+	db.muhash = NewMuHash()
 
 	return
 }
@@ -242,6 +279,11 @@ func (db *UnspentDB) save() {
 	if db.ComprssedUTXO {
 		u64 |= 0x8000000000000000
 	}
+	var muhash []byte
+	if db.muhash != nil {
+		muhash = db.muhash.Bytes() // it goes at the end of the file
+		u64 |= UTXO_DB_MUHASH_FLAG
+	}
 	binary.Write(buf, binary.LittleEndian, u64)
 	buf.Write(db.LastBlockHash)
 	binary.Write(buf, binary.LittleEndian, uint64(total_records))
@@ -341,8 +383,11 @@ func (db *UnspentDB) save() {
 finito:
 	db.RWMutex.RUnlock()
 
-	if !abort && buf.Len() > 0 {
-		data_channel <- buf.Bytes()
+	if !abort {
+		buf.Write(muhash)
+		if buf.Len() > 0 {
+			data_channel <- buf.Bytes()
+		}
 	}
 	exit_channel <- abort
 
@@ -388,7 +433,17 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 		}()
 	}
 
+	if changes.UndoData != nil {
+		db.flush() // at the tip, the changes go straight into HashMap
+	}
+	db.batching = changes.UndoData == nil
 	db.commit(changes)
+	if changes.UndoData != nil || len(db.mh_add)+len(db.mh_del) >= UTXO_MUHASH_BATCH {
+		db.muhashApply()
+	}
+	if len(db.pending) >= UTXO_COMMIT_BATCH {
+		db.flush()
+	}
 
 	if db.LastBlockHash == nil {
 		db.LastBlockHash = make([]byte, 32)
@@ -402,6 +457,10 @@ func (db *UnspentDB) CommitBlockTxs(changes *BlockChanges, blhash []byte) (e err
 
 	db.DirtyDB.Set()
 	wg.Wait()
+
+	if db.CB.NotifyBlock != nil && changes.Block != nil {
+		db.CB.NotifyBlock(changes, false)
+	}
 	return
 }
 
@@ -409,6 +468,11 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 	db.Mutex.Lock()
 	defer db.Mutex.Unlock()
 	db.abortWriting()
+	db.flush()
+
+	if db.CB.NotifyBlock != nil {
+		db.CB.NotifyBlock(&BlockChanges{Height: db.LastBlockHeight, Block: bl}, true)
+	}
 
 	for _, tx := range bl.Txs {
 		lst := make([]bool, len(tx.TxOut))
@@ -418,31 +482,17 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		db.del(tx.Hash.Hash[:], lst)
 	}
 
-	fn := fmt.Sprint(db.dir_undo, db.LastBlockHeight)
-	var addback []*UtxoRec
-
-	if _, er := os.Stat(fn); er != nil {
-		fn += ".tmp"
-	}
-
-	dat, er := ioutil.ReadFile(fn)
+	fn := db.undoFile(db.LastBlockHeight)
+	_, addback, er := db.ReadUndo(db.LastBlockHeight)
 	if er != nil {
 		panic(er.Error())
 	}
 
-	off := 32 // ship the block hash
-	for off < len(dat) {
-		le, n := btc.VLen(dat[off:])
-		off += n
-		qr := FullUtxoRec(dat[off : off+le])
-		off += le
-		addback = append(addback, qr)
-	}
-
 	for _, rec := range addback {
 		if db.CB.NotifyTxAdd != nil {
 			db.CB.NotifyTxAdd(rec)
 		}
+		db.muhashAdd(rec)
 
 		var ind UtxoKeyType
 		copy(ind[:], rec.TxID[:])
@@ -462,12 +512,65 @@ func (db *UnspentDB) UndoBlockTxs(bl *btc.Block, newhash []byte) {
 		db.RWMutex.Unlock()
 	}
 
+	db.muhashApply()
+
 	os.Remove(fn)
 	db.LastBlockHeight--
 	copy(db.LastBlockHash, newhash)
 	db.DirtyDB.Set()
 }
 
+// undoFile returns the name of the undo file of the block at the given height.
+func (db *UnspentDB) undoFile(height uint32) (fn string) {
+	fn = fmt.Sprint(db.dir_undo, height)
+	if _, er := os.Stat(fn); er != nil {
+		fn += ".tmp"
+	}
+	return
+}
+
+// ReadUndo reads the undo data of the block at the given height (the block's hash and the records it has spent).
+func (db *UnspentDB) ReadUndo(height uint32) (blhash []byte, recs []*UtxoRec, e error) {
+	dat, e := ioutil.ReadFile(db.undoFile(height))
+	if e != nil {
+		return
+	}
+	if len(dat) < 32 {
+		e = errors.New("undo file too short")
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			e = fmt.Errorf("undo file corrupt: %v", r)
+		}
+	}()
+	blhash = dat[:32]
+	for off := 32; off < len(dat); {
+		le, n := btc.VLen(dat[off:])
+		off += n
+		if n == 0 || le <= 0 || off+le > len(dat) {
+			e = errors.New("undo file corrupt")
+			return
+		}
+		recs = append(recs, FullUtxoRec(dat[off:off+le]))
+		off += le
+	}
+	return
+}
+
+// UnspentGetRec returns the record of the given transaction, or nil if it is not in the set.
+func (db *UnspentDB) UnspentGetRec(txid []byte) (rec *UtxoRec) {
+	var ind UtxoKeyType
+	copy(ind[:], txid)
+	db.RWMutex.RLock()
+	if v, _ := db.get(ind); v != nil {
+		rec = NewUtxoRec(ind, v)
+	}
+	db.RWMutex.RUnlock()
+	return
+}
+
 // Idle should be called when the main thread is idle.
 func (db *UnspentDB) Idle() bool {
 	if db.volatimemode {
@@ -488,8 +591,10 @@ func (db *UnspentDB) Save() bool {
 	if db.WritingInProgress.Get() {
 		return false
 	}
+	db.flush()
 	db.WritingInProgress.Set()
 	db.writingDone.Add(1)
+	db.muhashApply() // save() needs it up to date
 	go db.save() // this one will call db.writingDone.Done()
 	return true
 }
@@ -519,7 +624,7 @@ func (db *UnspentDB) UnspentGet(po *btc.TxPrevOut) (res *btc.TxOut) {
 	copy(ind[:], po.Hash[:])
 
 	db.RWMutex.RLock()
-	v = db.HashMap[ind]
+	v, _ = db.get(ind)
 	db.RWMutex.RUnlock()
 	if v != nil {
 		res = OneUtxoRec(ind, v, po.Vout)
@@ -533,16 +638,69 @@ func (db *UnspentDB) TxPresent(id *btc.Uint256) (res bool) {
 	var ind UtxoKeyType
 	copy(ind[:], id.Hash[:])
 	db.RWMutex.RLock()
-	_, res = db.HashMap[ind]
+	v, _ := db.get(ind)
 	db.RWMutex.RUnlock()
+	return v != nil
+}
+
+// get returns the record, looking at the pending changes first (pend is true if it was found there).
+// Call it with the RWMutex locked.
+func (db *UnspentDB) get(ind UtxoKeyType) (v []byte, pend bool) {
+	if v, pend = db.pending[ind]; !pend {
+		v = db.HashMap[ind]
+	}
 	return
 }
 
+// set stores the record (removes it, if v is nil) in HashMap, or in the pending changes while batching.
+// Call it with the RWMutex locked.
+func (db *UnspentDB) set(ind UtxoKeyType, v []byte) {
+	if db.batching {
+		if db.pending == nil {
+			db.pending = make(map[UtxoKeyType][]byte, UTXO_COMMIT_BATCH)
+		}
+		db.pending[ind] = v
+	} else if v != nil {
+		db.HashMap[ind] = v
+	} else {
+		delete(db.HashMap, ind)
+	}
+}
+
+// flush moves the pending changes into HashMap. Call it with the Mutex locked.
+func (db *UnspentDB) flush() {
+	db.batching = false
+	if len(db.pending) == 0 {
+		return
+	}
+	db.RWMutex.Lock()
+	for k, v := range db.pending {
+		if old := db.HashMap[k]; old != nil {
+			Memory_Free(old) // del() does not free the records that are still in HashMap
+		}
+		if v != nil {
+			db.HashMap[k] = v
+		} else {
+			delete(db.HashMap, k)
+		}
+		delete(db.pending, k)
+	}
+	db.RWMutex.Unlock()
+}
+
+// Flush moves the changes of the recent blocks into HashMap.
+// Call it before accessing HashMap directly.
+func (db *UnspentDB) Flush() {
+	db.Mutex.Lock()
+	db.flush()
+	db.Mutex.Unlock()
+}
+
 func (db *UnspentDB) del(hash []byte, outs []bool) {
 	var ind UtxoKeyType
 	copy(ind[:], hash)
 	db.RWMutex.RLock()
-	v := db.HashMap[ind]
+	v, pend := db.get(ind)
 	db.RWMutex.RUnlock()
 	if v == nil {
 		return // no such txid in UTXO (just ignorde delete request)
@@ -554,6 +712,7 @@ func (db *UnspentDB) del(hash []byte, outs []bool) {
 	var anyout bool
 	for i, rm := range outs {
 		if rm || UTXO_PURGE_UNSPENDABLE && rec.Outs[i] != nil && script.IsUnspendable(rec.Outs[i].PKScr) {
+			db.muhashDel(rec, i)
 			rec.Outs[i] = nil
 		} else if !anyout && rec.Outs[i] != nil {
 			anyout = true
@@ -561,12 +720,14 @@ func (db *UnspentDB) del(hash []byte, outs []bool) {
 	}
 	db.RWMutex.Lock()
 	if anyout {
-		db.HashMap[ind] = Serialize(rec, false, nil)
+		db.set(ind, Serialize(rec, false, nil))
 	} else {
-		delete(db.HashMap, ind)
+		db.set(ind, nil)
 	}
 	db.RWMutex.Unlock()
-	Memory_Free(v)
+	if pend || !db.batching {
+		Memory_Free(v)
+	}
 }
 
 func (db *UnspentDB) commit(changes *BlockChanges) {
@@ -592,8 +753,9 @@ func (db *UnspentDB) commit(changes *BlockChanges) {
 			add_this_tx = true
 		}
 		if add_this_tx {
+			db.muhashAdd(rec)
 			db.RWMutex.Lock()
-			db.HashMap[ind] = Serialize(rec, false, nil)
+			db.set(ind, Serialize(rec, false, nil))
 			db.RWMutex.Unlock()
 		}
 	}
@@ -625,6 +787,7 @@ func (db *UnspentDB) UTXOStats() (s string) {
 
 	filesize = 8 + 32 + 8  // UTXO.db: block_no + block_hash + rec_cnt
 
+	db.Flush()
 	db.RWMutex.RLock()
 
 	lele := len(db.HashMap)
@@ -673,11 +836,11 @@ func (db *UnspentDB) UTXOStats() (s string) {
 // GetStats returns DB statistics.
 func (db *UnspentDB) GetStats() (s string) {
 	db.RWMutex.RLock()
-	hml := len(db.HashMap)
+	hml, pnd := len(db.HashMap), len(db.pending)
 	db.RWMutex.RUnlock()
 
-	s = fmt.Sprintf("UNSPENT: %d txs.  MaxCnt:%d  Dirt:%t  Writ:%t  Abort:%t  Compr:%t\n",
-		hml, len(rec_outs), db.DirtyDB.Get(), db.WritingInProgress.Get(),
+	s = fmt.Sprintf("UNSPENT: %d txs (+%d pending).  MaxCnt:%d  Dirt:%t  Writ:%t  Abort:%t  Compr:%t\n",
+		hml, pnd, len(rec_outs), db.DirtyDB.Get(), db.WritingInProgress.Get(),
 		len(db.abortwritingnow) > 0, db.ComprssedUTXO)
 	s += fmt.Sprintf(" Last Block : %s @ %d\n", btc.NewUint256(db.LastBlockHash).String(),
 		db.LastBlockHeight)
@@ -688,6 +851,7 @@ func (db *UnspentDB) PurgeUnspendable(all bool) {
 	var unspendable_txs, unspendable_recs uint64
 	db.Mutex.Lock()
 	db.abortWriting()
+	db.flush()
 
 	db.RWMutex.Lock()
 
@@ -718,6 +882,9 @@ func (db *UnspentDB) PurgeUnspendable(all bool) {
 		}
 	}
 	db.RWMutex.Unlock()
+	if unspendable_txs > 0 || unspendable_recs > 0 {
+		db.muhash = nil // some of the purged outputs may be in Core's UTXO set
+	}
 
 	db.Mutex.Unlock()
 
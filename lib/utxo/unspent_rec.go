@@ -1,6 +1,8 @@
 package utxo
 
 import (
+	"bytes"
+
 	"github.com/piotrnar/gocoin/lib/btc"
 )
 
@@ -45,6 +47,22 @@ var (
 )
 
 
+// Equal returns true if both records hold the same transaction's outputs.
+func (r *UtxoRec) Equal(o *UtxoRec) bool {
+	if r.TxID != o.TxID || r.Coinbase != o.Coinbase || r.InBlock != o.InBlock || len(r.Outs) != len(o.Outs) {
+		return false
+	}
+	for i := range r.Outs {
+		if (r.Outs[i] == nil) != (o.Outs[i] == nil) {
+			return false
+		}
+		if r.Outs[i] != nil && (r.Outs[i].Value != o.Outs[i].Value || !bytes.Equal(r.Outs[i].PKScr, o.Outs[i].PKScr)) {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *UtxoRec) ToUnspent(idx uint32, ad *btc.BtcAddr) (nr *OneUnspentTx) {
 	nr = new(OneUnspentTx)
 	nr.TxPrevOut.Hash = r.TxID
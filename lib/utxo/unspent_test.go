@@ -2,6 +2,7 @@ package utxo
 
 import (
 	"bytes"
+	"os"
 	"testing"
 	"github.com/piotrnar/gocoin/lib/btc"
 	"encoding/hex"
@@ -172,3 +173,40 @@ func BenchmarkSerializeCompressWithAlloc(b *testing.B) {
 		}
 	}
 }
+
+func TestCommitBatch(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "gocoin_utxo_test")
+	defer os.RemoveAll(dir)
+	db := NewUnspentDb(&NewUnspentOpts{Dir: dir + "/", Rescan: true, VolatimeMode: true, Prealloc: 100})
+	out := func(val uint64) *UtxoTxOut {
+		return &UtxoTxOut{Value: val, PKScr: []byte{0x51}}
+	}
+	get := func(id byte, vout uint32) *btc.TxOut {
+		return db.UnspentGet(&btc.TxPrevOut{Hash: [32]byte{id}, Vout: vout})
+	}
+
+	// away from the tip the changes are only pending, but the lookups must see them
+	db.CommitBlockTxs(&BlockChanges{Height: 1, AddList: []*UtxoRec{
+		{TxID: [32]byte{1}, InBlock: 1, Outs: []*UtxoTxOut{out(1), out(2)}},
+		{TxID: [32]byte{2}, InBlock: 1, Outs: []*UtxoTxOut{out(3)}},
+	}}, make([]byte, 32))
+	db.CommitBlockTxs(&BlockChanges{Height: 2, AddList: []*UtxoRec{
+		{TxID: [32]byte{3}, InBlock: 2, Outs: []*UtxoTxOut{out(4)}},
+	}, DeledTxs: map[[32]byte][]bool{{1}: {true, false}, {2}: {true}}}, make([]byte, 32))
+	if len(db.HashMap) != 0 {
+		t.Error("HashMap updated while batching", len(db.HashMap))
+	}
+	if get(1, 0) != nil || get(1, 1) == nil || get(2, 0) != nil || get(3, 0) == nil || db.TxPresent(&btc.Uint256{Hash: [32]byte{2}}) {
+		t.Error("Lookups do not see the pending changes")
+	}
+
+	// at the tip, the pending changes get flushed and the new ones go straight to HashMap
+	db.CommitBlockTxs(&BlockChanges{Height: 3, DeledTxs: map[[32]byte][]bool{{3}: {true}},
+		UndoData: map[[32]byte]*UtxoRec{}}, make([]byte, 32))
+	if len(db.pending) != 0 || len(db.HashMap) != 1 {
+		t.Error("Bad state after flush", len(db.pending), len(db.HashMap))
+	}
+	if rec := db.UnspentGetRec([]byte{1}); rec == nil || rec.Outs[0] != nil || rec.Outs[1].Value != 2 {
+		t.Error("Bad record after flush")
+	}
+}
@@ -0,0 +1,91 @@
+// This tool replays the blocks stored in gocoin's blocks database into an empty UTXO set,
+// to measure the speed of the block connection pipeline (see lib/chain/ibd.go).
+// The blocks database is opened read-only and the folder is locked, so the node cannot run meanwhile.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/piotrnar/gocoin/lib/btc"
+	"github.com/piotrnar/gocoin/lib/chain"
+	"github.com/piotrnar/gocoin/lib/others/sys"
+	"github.com/piotrnar/gocoin/lib/utxo"
+)
+
+var (
+	dir      = flag.String("dir", "", "Folder with the blocks database (blockchain.new and blockchain*.dat)")
+	testnet  = flag.Bool("t", false, "The blocks are from Testnet3")
+	nblocks  = flag.Uint("n", 0, "Replay only this many blocks (0 for all)")
+	verify   = flag.Bool("v", false, "Verify scripts of all the blocks (ignore their trusted flags)")
+	utxodir  = flag.String("utxo", filepath.Join(os.TempDir(), "gocoin_ibd_benchmark"), "Temporary folder for the UTXO database")
+	ahead    = flag.Int("ra", chain.READ_AHEAD_BLOCKS, "Number of blocks to read and decode ahead")
+	workers  = flag.Int("sw", chain.SCRIPT_WORKERS, "Number of script verification workers")
+	mh_batch = flag.Int("mb", utxo.UTXO_MUHASH_BATCH, "Number of coins to batch before updating the UTXO set's MuHash")
+	cm_batch = flag.Int("cb", utxo.UTXO_COMMIT_BATCH, "Number of UTXO records to batch before moving them into the UTXO set")
+)
+
+func main() {
+	var genesis *btc.Uint256
+
+	flag.Parse()
+	if *dir == "" {
+		fmt.Println("Specify the folder with the blocks database (i.e. -dir ~/.bitcoin/gocoin/btcnet/)")
+		fmt.Println("The node must not be running. The database is only read from.")
+		flag.PrintDefaults()
+		return
+	}
+
+	if *testnet {
+		genesis = btc.NewUint256FromString("000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943")
+	} else {
+		genesis = btc.NewUint256FromString("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
+	}
+
+	chain.ReplayVerifyAll = *verify
+	chain.READ_AHEAD_BLOCKS = *ahead
+	chain.SCRIPT_WORKERS = *workers
+	utxo.UTXO_MUHASH_BATCH = *mh_batch
+	utxo.UTXO_COMMIT_BATCH = *cm_batch
+
+	sys.LockDatabaseDir(filepath.Clean(*dir) + string(os.PathSeparator))
+	defer sys.UnlockDatabaseDir()
+
+	os.RemoveAll(*utxodir)
+	defer os.RemoveAll(*utxodir)
+
+	fmt.Println("Loading blocks database from", *dir, "...")
+	ch := chain.NewChainExt(filepath.Clean(*dir)+string(os.PathSeparator), genesis, false,
+		&chain.NewChanOpts{UTXOVolatileMode: true, DoNotRescan: true, UTXODir: filepath.Clean(*utxodir) + string(os.PathSeparator)},
+		&chain.BlockDBOpts{MaxCachedBlocks: 1, ReadOnly: true})
+	defer ch.Blocks.Close()
+
+	end, _ := ch.BlockTreeRoot.FindFarthestNode()
+	for *nblocks != 0 && end.Height > uint32(*nblocks) {
+		end = end.Parent
+	}
+	var size uint64
+	for n := end; n != nil; n = n.Parent {
+		size += uint64(n.BlockSize)
+	}
+
+	fmt.Println("Replaying", end.Height, "blocks with", *ahead, "blocks read ahead,", *workers, "script workers,",
+		"MuHash batch of", *mh_batch, "and commit batch of", *cm_batch)
+	ecdsa_cnt := btc.EcdsaVerifyCnt()
+	sta := time.Now()
+	ch.ParseTillBlock(end)
+	tim := time.Now().Sub(sta)
+
+	last := ch.LastBlock()
+	fmt.Println("Reached block", last.Height, "in", tim.String())
+	fmt.Printf("%.1f blocks/s, %.2f MB/s, %d signatures verified\n", float64(last.Height)/tim.Seconds(),
+		float64(size)/1e6/tim.Seconds(), btc.EcdsaVerifyCnt()-ecdsa_cnt)
+	ch.Unspent.Flush()
+	fmt.Println("UTXO records:", len(ch.Unspent.HashMap))
+
+	al, sy := sys.MemUsed()
+	fmt.Println("Mem Used:", al>>20, "/", sy>>20)
+}